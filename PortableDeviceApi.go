@@ -21,11 +21,9 @@ const (
 	CLSID_PortableDevicePropVariantCollection = "08a99e2f-6d6d-4b80-af5a-baf2bcbe4cb9"
 	IID_IPortableDevicePropVariantCollection  = "89b2e422-4f1b-4316-bcef-a44afea83eb3"
 
-	WPD_DEVICE_OBJECT_ID                = "DEVICE"
-	STGM_READ                           = 0x00000000
-	STGM_WRITE                          = 0x00000001
-	STGM_CREATE                         = 0x00001000
-	PORTABLE_DEVICE_DELETE_NO_RECURSION = 0
+	STGM_READ   = 0x00000000
+	STGM_WRITE  = 0x00000001
+	STGM_CREATE = 0x00001000
 
 	NUM_OBJECTS_TO_REQUEST = 10
 )
@@ -37,20 +35,6 @@ var (
 	WPD_CLIENT_REVISION                    = PROPERTYKEY{GUID{0x204D9F0C, 0x2292, 0x4080, [8]byte{0x9F, 0x42, 0x40, 0x66, 0x4E, 0x70, 0xF8, 0x59}}, 5}
 	WPD_CLIENT_SECURITY_QUALITY_OF_SERVICE = PROPERTYKEY{GUID{0x204D9F0C, 0x2292, 0x4080, [8]byte{0x9F, 0x42, 0x40, 0x66, 0x4E, 0x70, 0xF8, 0x59}}, 8}
 	WPD_CLIENT_DESIRED_ACCESS              = PROPERTYKEY{GUID{0x204D9F0C, 0x2292, 0x4080, [8]byte{0x9F, 0x42, 0x40, 0x66, 0x4E, 0x70, 0xF8, 0x59}}, 9}
-
-	WPD_OBJECT_PARENT_ID                       = PROPERTYKEY{GUID{0xEF6B490D, 0x5CD8, 0x437A, [8]byte{0xAF, 0xFC, 0xDA, 0x8B, 0x60, 0xEE, 0x4A, 0x3C}}, 3}
-	WPD_OBJECT_NAME                            = PROPERTYKEY{GUID{0xEF6B490D, 0x5CD8, 0x437A, [8]byte{0xAF, 0xFC, 0xDA, 0x8B, 0x60, 0xEE, 0x4A, 0x3C}}, 4}
-	WPD_OBJECT_CONTENT_TYPE                    = PROPERTYKEY{GUID{0xEF6B490D, 0x5CD8, 0x437A, [8]byte{0xAF, 0xFC, 0xDA, 0x8B, 0x60, 0xEE, 0x4A, 0x3C}}, 7}
-	WPD_OBJECT_SIZE                            = PROPERTYKEY{GUID{0xEF6B490D, 0x5CD8, 0x437A, [8]byte{0xAF, 0xFC, 0xDA, 0x8B, 0x60, 0xEE, 0x4A, 0x3C}}, 11}
-	WPD_OBJECT_ORIGINAL_FILE_NAME              = PROPERTYKEY{GUID{0xEF6B490D, 0x5CD8, 0x437A, [8]byte{0xAF, 0xFC, 0xDA, 0x8B, 0x60, 0xEE, 0x4A, 0x3C}}, 12}
-	WPD_OBJECT_DATE_CREATED                    = PROPERTYKEY{GUID{0xEF6B490D, 0x5CD8, 0x437A, [8]byte{0xAF, 0xFC, 0xDA, 0x8B, 0x60, 0xEE, 0x4A, 0x3C}}, 18}
-	WPD_OBJECT_DATE_MODIFIED                   = PROPERTYKEY{GUID{0xEF6B490D, 0x5CD8, 0x437A, [8]byte{0xAF, 0xFC, 0xDA, 0x8B, 0x60, 0xEE, 0x4A, 0x3C}}, 19}
-	WPD_PROPERTY_ATTRIBUTE_CAN_WRITE           = PROPERTYKEY{GUID{0xAB7943D8, 0x6332, 0x445F, [8]byte{0xA0, 0x0D, 0x8D, 0x5E, 0xF1, 0xE9, 0x6F, 0x37}}, 4}
-	WPD_RESOURCE_DEFAULT                       = PROPERTYKEY{GUID{0xE81E79BE, 0x34F0, 0x41BF, [8]byte{0xB5, 0x3F, 0xF1, 0xA0, 0x6A, 0xE8, 0x78, 0x42}}, 0}
-	WPD_COMMAND_OBJECT_MANAGEMENT_MOVE_OBJECTS = PROPERTYKEY{GUID{0xEF1E43DD, 0xA9ED, 0x4341, [8]byte{0x8B, 0xCC, 0x18, 0x61, 0x92, 0xAE, 0xA0, 0x89}}, 8}
-	WPD_COMMAND_OBJECT_MANAGEMENT_COPY_OBJECTS = PROPERTYKEY{GUID{0xEF1E43DD, 0xA9ED, 0x4341, [8]byte{0x8B, 0xCC, 0x18, 0x61, 0x92, 0xAE, 0xA0, 0x89}}, 9}
-	WPD_CONTENT_TYPE_FUNCTIONAL_OBJECT         = GUID{0x99ED0160, 0x17FF, 0x4C44, [8]byte{0x9D, 0x98, 0x1D, 0x7A, 0x6F, 0x94, 0x19, 0x21}}
-	WPD_CONTENT_TYPE_FOLDER                    = GUID{0x27E2E392, 0xA111, 0x48E0, [8]byte{0xAB, 0x0C, 0xE1, 0x77, 0x05, 0xA0, 0x5F, 0x85}}
 )
 
 var (
@@ -234,6 +218,30 @@ func (o *IPortableDeviceValues) Vtable() *IPortableDeviceValuesVtbl {
 	return (*IPortableDeviceValuesVtbl)(unsafe.Pointer(o.vtbl))
 }
 
+func (o *IPortableDeviceValues) GetCount() (uint32, int32, error) {
+	var val uint32
+	hr, err := Syscall(
+		o.Vtable().GetCount,
+		2,
+		uintptr(unsafe.Pointer(o)),
+		uintptr(unsafe.Pointer(&val)),
+		0)
+	return val, hr, err
+}
+
+func (o *IPortableDeviceValues) GetAt(ind uint32) (PROPERTYKEY, *PROPVARIANT, int32, error) {
+	var key PROPERTYKEY
+	var val PROPVARIANT
+	hr, err := Syscall6(
+		o.Vtable().GetAt,
+		4,
+		uintptr(unsafe.Pointer(o)),
+		uintptr(ind),
+		uintptr(unsafe.Pointer(&key)),
+		uintptr(unsafe.Pointer(&val)), 0, 0)
+	return key, &val, hr, err
+}
+
 func (o *IPortableDeviceValues) SetValue(key PROPERTYKEY, val *PROPVARIANT) (int32, error) {
 	return Syscall(
 		o.Vtable().SetValue,
@@ -339,6 +347,15 @@ func (o *IPortableDeviceValues) GetGuidValue(key PROPERTYKEY) (GUID, int32, erro
 	return val, hr, err
 }
 
+func (o *IPortableDeviceValues) SetKeyValue(key PROPERTYKEY, val PROPERTYKEY) (int32, error) {
+	return Syscall(
+		o.Vtable().SetKeyValue,
+		3,
+		uintptr(unsafe.Pointer(o)),
+		uintptr(unsafe.Pointer(&key)),
+		uintptr(unsafe.Pointer(&val)))
+}
+
 func (o *IPortableDeviceValues) SetBoolValue(key PROPERTYKEY, b bool) (int32, error) {
 	var val uintptr = 0
 	if b {
@@ -522,27 +539,42 @@ func (o *IPortableDeviceContent) CreateObjectWithPropertiesAndData(properties *I
 }
 
 func (o *IPortableDeviceContent) Delete(option int, list *IPortableDevicePropVariantCollection) (*IPortableDevicePropVariantCollection, int32, error) {
+	var results *IPortableDevicePropVariantCollection
 	hr, err := Syscall6(
 		o.Vtable().Delete,
 		4,
 		uintptr(unsafe.Pointer(o)),
 		uintptr(option),
 		uintptr(unsafe.Pointer(list)),
-		0,
+		uintptr(unsafe.Pointer(&results)),
 		0, 0)
-	return nil, hr, err
+	return results, hr, err
 }
 
 func (o *IPortableDeviceContent) Copy(list *IPortableDevicePropVariantCollection, id string) (*IPortableDevicePropVariantCollection, int32, error) {
+	var results *IPortableDevicePropVariantCollection
 	hr, err := Syscall6(
 		o.Vtable().Copy,
 		4,
 		uintptr(unsafe.Pointer(o)),
 		uintptr(unsafe.Pointer(list)),
 		uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr(id))),
-		0,
+		uintptr(unsafe.Pointer(&results)),
+		0, 0)
+	return results, hr, err
+}
+
+func (o *IPortableDeviceContent) Move(list *IPortableDevicePropVariantCollection, id string) (*IPortableDevicePropVariantCollection, int32, error) {
+	var results *IPortableDevicePropVariantCollection
+	hr, err := Syscall6(
+		o.Vtable().Move,
+		4,
+		uintptr(unsafe.Pointer(o)),
+		uintptr(unsafe.Pointer(list)),
+		uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr(id))),
+		uintptr(unsafe.Pointer(&results)),
 		0, 0)
-	return nil, hr, err
+	return results, hr, err
 }
 
 type IEnumPortableDeviceObjectIDsVtbl struct {
@@ -616,6 +648,18 @@ func (o *IPortableDeviceProperties) GetValues(id string, keys *IPortableDeviceKe
 	return v, hr, err
 }
 
+func (o *IPortableDeviceProperties) SetValues(id string, values *IPortableDeviceValues) (*IPortableDeviceValues, int32, error) {
+	var v *IPortableDeviceValues
+	hr, err := Syscall6(
+		o.Vtable().SetValues,
+		4,
+		uintptr(unsafe.Pointer(o)),
+		uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr(id))),
+		uintptr(unsafe.Pointer(values)),
+		uintptr(unsafe.Pointer(&v)), 0, 0)
+	return v, hr, err
+}
+
 func (o *IPortableDeviceProperties) GetPropertyAttributes(id string, key PROPERTYKEY) (*IPortableDeviceValues, int32, error) {
 	var v *IPortableDeviceValues
 	hr, err := CoCreateInstance(CLSID_PortableDeviceValues, IID_IPortableDeviceValues, &v)
@@ -758,6 +802,32 @@ func (o *IStream) Vtable() *IStreamVtbl {
 	return (*IStreamVtbl)(unsafe.Pointer(o.vtbl))
 }
 
+// SeekTo calls IStream::Seek. It is not named Seek as it does not match
+// io.Seeker.
+func (o *IStream) SeekTo(offset int64, origin int) (uint64, int32, error) {
+	var pos uint64
+	if unsafe.Sizeof(uintptr(0)) == 4 {
+		// the LARGE_INTEGER takes two words on 32-bit
+		hr, err := Syscall6(
+			o.Vtable().Seek,
+			5,
+			uintptr(unsafe.Pointer(o)),
+			uintptr(uint32(offset)),
+			uintptr(uint32(uint64(offset)>>32)),
+			uintptr(origin),
+			uintptr(unsafe.Pointer(&pos)), 0)
+		return pos, hr, err
+	}
+	hr, err := Syscall6(
+		o.Vtable().Seek,
+		4,
+		uintptr(unsafe.Pointer(o)),
+		uintptr(offset),
+		uintptr(origin),
+		uintptr(unsafe.Pointer(&pos)), 0, 0)
+	return pos, hr, err
+}
+
 func (o *IStream) Commit(flag uint32) (int32, error) {
 	return Syscall(
 		o.Vtable().Commit,
@@ -767,7 +837,39 @@ func (o *IStream) Commit(flag uint32) (int32, error) {
 		0)
 }
 
-func (o *IPortableDeviceResources) GetStream(id string) (*IStream, uint32, int32, error) {
+func (o *IStream) Revert() (int32, error) {
+	return Syscall(
+		o.Vtable().Revert,
+		1,
+		uintptr(unsafe.Pointer(o)),
+		0,
+		0)
+}
+
+func (o *IPortableDeviceResources) GetSupportedResources(id string) (*IPortableDeviceKeyCollection, int32, error) {
+	var col *IPortableDeviceKeyCollection
+	hr, err := Syscall(
+		o.Vtable().GetSupportedResources,
+		3,
+		uintptr(unsafe.Pointer(o)),
+		uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr(id))),
+		uintptr(unsafe.Pointer(&col)))
+	return col, hr, err
+}
+
+func (o *IPortableDeviceResources) GetResourceAttributes(id string, key PROPERTYKEY) (*IPortableDeviceValues, int32, error) {
+	var v *IPortableDeviceValues
+	hr, err := Syscall6(
+		o.Vtable().GetResourceAttributes,
+		4,
+		uintptr(unsafe.Pointer(o)),
+		uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr(id))),
+		uintptr(unsafe.Pointer(&key)),
+		uintptr(unsafe.Pointer(&v)), 0, 0)
+	return v, hr, err
+}
+
+func (o *IPortableDeviceResources) GetStream(id string, key PROPERTYKEY) (*IStream, uint32, int32, error) {
 	var stream *IStream
 	var transferSize uint32
 	hr, err := Syscall6(
@@ -775,13 +877,32 @@ func (o *IPortableDeviceResources) GetStream(id string) (*IStream, uint32, int32
 		6,
 		uintptr(unsafe.Pointer(o)),
 		uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr(id))),
-		uintptr(unsafe.Pointer(&WPD_RESOURCE_DEFAULT)),
+		uintptr(unsafe.Pointer(&key)),
 		STGM_READ,
 		uintptr(unsafe.Pointer(&transferSize)),
 		uintptr(unsafe.Pointer(&stream)))
 	return stream, transferSize, hr, err
 }
 
+func (o *IPortableDeviceResources) CreateResource(attrs *IPortableDeviceValues) (*IStream, uint32, int32, error) {
+	var stream *IStream
+	var transferSize uint32
+	var cookie uintptr
+	hr, err := Syscall6(
+		o.Vtable().CreateResource,
+		5,
+		uintptr(unsafe.Pointer(o)),
+		uintptr(unsafe.Pointer(attrs)),
+		uintptr(unsafe.Pointer(&stream)),
+		uintptr(unsafe.Pointer(&transferSize)),
+		uintptr(unsafe.Pointer(&cookie)),
+		0)
+	if cookie != 0 {
+		CoTaskMemFree(cookie)
+	}
+	return stream, transferSize, hr, err
+}
+
 type IPortableDeviceDataStreamVtbl struct {
 	IStreamVtbl
 	GetObjectID uintptr
@@ -813,8 +934,16 @@ func (o *IPortableDeviceDataStream) GetObjectID() (string, int32, error) {
 }
 
 const (
+	VT_EMPTY  = 0
+	VT_I4     = 3
 	VT_DATE   = 7
+	VT_ERROR  = 10
+	VT_BOOL   = 11
+	VT_UI4    = 19
+	VT_I8     = 20
+	VT_UI8    = 21
 	VT_LPWSTR = 31
+	VT_CLSID  = 72
 )
 
 type PROPVARIANT struct {
@@ -836,6 +965,46 @@ func UnixTimeToVariantTime(utime int64) float64 {
 	return float64(utime+int64(offset))/86400 + 25569
 }
 
+func PropVariantToValue(pv *PROPVARIANT) interface{} {
+	switch pv.Vt {
+	case VT_LPWSTR:
+		return utf16PtrToString(*(**uint16)(unsafe.Pointer(&pv.Val1)))
+	case VT_UI4:
+		return uint32(pv.Val1)
+	case VT_I4, VT_ERROR:
+		return int32(pv.Val1)
+	case VT_UI8:
+		// The 64-bit value spans Val1 and the start of Val2 on 32-bit.
+		return *(*uint64)(unsafe.Pointer(&pv.Val1))
+	case VT_I8:
+		return *(*int64)(unsafe.Pointer(&pv.Val1))
+	case VT_BOOL:
+		return int16(pv.Val1) != 0
+	case VT_CLSID:
+		g := *(**GUID)(unsafe.Pointer(&pv.Val1))
+		if g == nil {
+			return GUID{}
+		}
+		return *g
+	case VT_DATE:
+		vtime := *((*float64)(unsafe.Pointer(&pv.Val1)))
+		return time.Unix(VariantTimeToUnixTime(vtime), 0)
+	}
+	return nil
+}
+
+// utf16PtrToString converts the NUL terminated string p of any length.
+func utf16PtrToString(p *uint16) string {
+	if p == nil {
+		return ""
+	}
+	var s []uint16
+	for ptr := unsafe.Pointer(p); *(*uint16)(ptr) != 0; ptr = unsafe.Pointer(uintptr(ptr) + unsafe.Sizeof(*p)) {
+		s = append(s, *(*uint16)(ptr))
+	}
+	return syscall.UTF16ToString(s)
+}
+
 type IPortableDevicePropVariantCollectionVtbl struct {
 	IUnknownVtbl
 	GetCount   uintptr
@@ -864,6 +1033,28 @@ func (o *IPortableDevicePropVariantCollection) Add(pv *PROPVARIANT) (int32, erro
 		0)
 }
 
+func (o *IPortableDevicePropVariantCollection) GetCount() (uint32, int32, error) {
+	var val uint32
+	hr, err := Syscall(
+		o.Vtable().GetCount,
+		2,
+		uintptr(unsafe.Pointer(o)),
+		uintptr(unsafe.Pointer(&val)),
+		0)
+	return val, hr, err
+}
+
+func (o *IPortableDevicePropVariantCollection) GetAt(ind uint32) (*PROPVARIANT, int32, error) {
+	var val PROPVARIANT
+	hr, err := Syscall(
+		o.Vtable().GetAt,
+		3,
+		uintptr(unsafe.Pointer(o)),
+		uintptr(ind),
+		uintptr(unsafe.Pointer(&val)))
+	return &val, hr, err
+}
+
 type IPortableDeviceCapabilitiesVtbl struct {
 	IUnknownVtbl
 	GetSupportedCommands         uintptr
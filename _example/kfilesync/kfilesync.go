@@ -1,43 +1,35 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
-	"encoding/csv"
 	"fmt"
 	"github.com/tobwithu/gowpd"
-	"io"
-	"io/ioutil"
+	"github.com/tobwithu/gowpd/sync"
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
 	"sort"
-    "strings"
 	"strconv"
+	"strings"
+	"time"
 )
 
 const (
-	ST_NEW = iota
-	ST_NEWER
-	ST_SAME
-	ST_OLDER
-	ST_NOT_EXIST
-
-	LIST_FILENAME      = ".kfilesync"
-	SYSTEM_VOLUME_INFO = "System Volume Information"
+	LIST_FILENAME    = ".kfilesync"
+	BASE_FILENAME    = ".kfilesync-base"
+	JOURNAL_FILENAME = ".kfilesync-journal"
 )
 
 var (
 	MTP_ID   = regexp.MustCompile("(?i)^MTP(\\d):(\\S*)")
 	MTP_NAME = regexp.MustCompile("(^.{2,}?):(\\S*)")
 
-	deviceCount      int
-	src, dst         *FileManager
-	srcList, dstList map[string]*gowpd.Object
+	deviceCount int
+	devices     = make(map[int]*gowpd.Device)
 )
 
 func help() {
-	fmt.Println("kfilesync src dst [mode]\n")
+	fmt.Println("kfilesync src dst [mode] [hash] [empty...] [safety...] [plan:file|apply:file] [time...] [rule...]\n")
 	fmt.Println("  src\tSource folder")
 	fmt.Println("\t    ex) MTP0:\\DCIM  - DCIM folder of MTP device with id = 0")
 	fmt.Println("  dst\tDestination folder")
@@ -48,345 +40,330 @@ func help() {
 	fmt.Println("\t-  Delete files which is not in source folder.")
 	fmt.Println("\t=  Make destination folder equal to source folder.")
 	fmt.Println("\t?  Show differences only.")
+	fmt.Println("\t2  Two-way sync. Files changed on both sides are kept both,")
+	fmt.Println("\t   the older one with \" (conflict)\" in its name.")
+	fmt.Println("\t2n Two-way sync. The newest file wins a conflict.")
+	fmt.Println("\t2s Two-way sync. The source wins a conflict.")
+	fmt.Println("\t2d Two-way sync. The destination wins a conflict.")
+	fmt.Println("\t2a Two-way sync. Sync nothing if there is a conflict.")
+	fmt.Println("  hash\tCompare files of the same size by their SHA-256 digests.")
+	fmt.Println("\t   Digests are kept in the list file.")
+	fmt.Println("  empty\tSync what is left out by default.")
+	fmt.Println("\temptydirs   Empty folders.")
+	fmt.Println("\temptyfiles  Zero-byte files, like .nomedia.")
+	fmt.Println("  safety\tGuard the files which - and = modes delete.")
+	fmt.Println("\tquarantine[:days]  Move deleted files to " + sync.DEFAULT_QUARANTINE_DIR + " in dst")
+	fmt.Println("\t                   and delete them after days.")
+	fmt.Println("\tmaxdelete:n[%]     Sync nothing if more than n files, or n% of dst, would")
+	fmt.Println("\t                   be deleted.")
+	fmt.Println("  plan:file\tWrite the actions of mode +, - or = to file instead of")
+	fmt.Println("\t   syncing, as JSON for .json, CSV for .csv or else a table.")
+	fmt.Println("\t   plan:- prints the table.")
+	fmt.Println("  apply:file\tCarry out the actions of a plan file. Nothing is done if")
+	fmt.Println("\t   files changed since the plan was written, or if a JSON plan")
+	fmt.Println("\t   was written for other folders.")
+	fmt.Println("  time\tCount files of the same size as the same although their times differ.")
+	fmt.Println("\ttolerance:n  By up to n seconds, like 2 for FAT.")
+	fmt.Println("\thours:n      By up to n whole hours, like 1 for daylight saving time.")
+	fmt.Println("\tsizeonly     By any time, for devices which do not keep times.")
+	fmt.Println("  rule\tLeave files out of the sync, after the rules of the")
+	fmt.Println("\t   " + gowpd.RULES_FILENAME + " files in src and dst.")
+	fmt.Println("\texclude:pattern  Exclude files like a .gitignore line,")
+	fmt.Println("\t                 ex) exclude:*.tmp  exclude:size>1G  exclude:type:video")
+	fmt.Println("\tinclude:pattern  Include files an earlier rule excludes.")
+	fmt.Println("\trules:file       Read rules from file.")
 }
 
-type PathInfo struct {
-	deviceId string
-	path     string
-}
-
-type FileManager struct {
-	PathInfo
-	device *gowpd.Device
+// getDevice returns the device id. Folders of one device share it, so the
+// device copies between them itself.
+func getDevice(id int) (*gowpd.Device, error) {
+	if d := devices[id]; d != nil {
+		return d, nil
+	}
+	d, err := gowpd.ChooseDevice(id)
+	if err != nil {
+		return nil, err
+	}
+	devices[id] = d
+	return d, nil
 }
 
-func getMtpFileManager(id int, path string, relPath string) (*FileManager, error) {
-	var fm FileManager
-	fm.deviceId = string(id)
-	fm.path = relPath
-	if fm.path == "" {
-		fm.path = gowpd.PathSeparator
-	}
-	fm.device, _ = gowpd.ChooseDevice(id)
-	o := fm.device.FindObject(fm.path)
-	if o == nil {
-		return nil, fmt.Errorf("Folder not found : %v", path)
-	}
-	if !o.IsDir {
-		return nil, fmt.Errorf("Not a folder : %v", path)
-	}
-	return &fm, nil
+func getMtpTree(id int, relPath string) (sync.Tree, string, error) {
+	if relPath == "" {
+		relPath = gowpd.PathSeparator
+	}
+	d, err := getDevice(id)
+	if err != nil {
+		return nil, "", err
+	}
+	t, err := sync.NewDeviceTree(d, relPath)
+	if err != nil {
+		return nil, "", err
+	}
+	return t, fmt.Sprintf("MTP%d:%v", id, relPath), nil
 }
 
-func getFileManager(path string) (*FileManager, error) {
+// getTree returns the tree of path and a key telling whether two paths are
+// the same folder.
+func getTree(path string) (sync.Tree, string, error) {
 	path = gowpd.CleanPath(path)
 
 	rs := MTP_ID.FindStringSubmatch(path)
 	if len(rs) > 0 {
 		id, _ := strconv.Atoi(rs[1])
 		if id >= deviceCount {
-			return nil, fmt.Errorf("Invaild MTP device id : %v >= %v", id, deviceCount)
+			return nil, "", fmt.Errorf("Invaild MTP device id : %v >= %v", id, deviceCount)
 		}
-		return getMtpFileManager(id, path, rs[2])
+		return getMtpTree(id, rs[2])
 	} else {
 		rs = MTP_NAME.FindStringSubmatch(path)
 		if len(rs) > 0 {
 			id := gowpd.GetDeviceId(rs[1])
 			if id < 0 {
-				return nil, fmt.Errorf("Invaild MTP device name : %v", rs[1])
+				return nil, "", fmt.Errorf("Invaild MTP device name : %v", rs[1])
 			}
-			return getMtpFileManager(id, path, rs[2])
+			return getMtpTree(id, rs[2])
 		} else {
-			fileInfo, err := os.Stat(path)
-			if err != nil {
-				return nil, fmt.Errorf("Folder not found : %v", path)
-			}
-			if !fileInfo.IsDir() {
-				return nil, fmt.Errorf("Not a folder : %v", path)
-			}
-			var fm FileManager
-			fm.path = path
-			return &fm, nil
+			t, err := sync.NewDirTree(path)
+			return t, path, err
 		}
 	}
 }
 
-func listMtpFiles(d *gowpd.Device, id string, curPath string, clean bool, list map[string]*gowpd.Object) int {
-	objs, _ := d.GetChildObjects(id)
-	n := len(objs)
-	for _, o := range objs {
-		if o.Name == SYSTEM_VOLUME_INFO {
-			n--
-			continue
-		} else if strings.HasPrefix(o.Name, ".trashed-"){
-            n--
-            continue
-        }
-		rel := filepath.Join(curPath, o.Name)
-		list[rel] = o
-		if o.IsDir {
-			o.ChildCount = listMtpFiles(d, o.Id, rel, clean, list)
-			if clean && o.ChildCount == 0 {
-				delete(list, rel)
-				n--
-			}
-		} else {
-			o.ChildCount = -1
-			if clean && o.Size == 0 {
-				delete(list, rel)
-				n--
-			}
-		}
+// stateDir returns the local folder of the state files of dst, whose key is
+// key. It is dst itself for a local folder. The state of a device folder is
+// kept in the user config folder, as state files are written locally.
+func stateDir(dst sync.Tree, key string) (string, error) {
+	if t, ok := dst.(*sync.DirTree); ok {
+		return t.Root, nil
 	}
-	return n
-}
-
-func ListMtpFiles(d *gowpd.Device, path string, clean bool) (list map[string]*gowpd.Object) {
-	list = make(map[string]*gowpd.Object)
-	obj := d.FindObject(path)
-	if obj == nil || !obj.IsDir {
-		return
-	}
-	listMtpFiles(d, obj.Id, "", clean, list)
-	return
-}
-
-func listFiles(path string, curPath string, clean bool, list map[string]*gowpd.Object) int {
-	infos, err := ioutil.ReadDir(path)
+	dir, err := os.UserConfigDir()
 	if err != nil {
-		return 0
+		return "", err
 	}
-	n := len(infos)
-	for _, info := range infos {
-		if info.Name() == SYSTEM_VOLUME_INFO {
-			n--
-			continue
-		}
-		o := gowpd.ObjectFromFileInfo(filepath.Join(path, info.Name()), info)
-
-		rel := filepath.Join(curPath, info.Name())
-		list[rel] = o
-		if o.IsDir {
-			o.ChildCount = listFiles(o.Id, rel, clean, list)
-			if clean && o.ChildCount == 0 {
-				delete(list, rel)
-				n--
-			}
-		} else {
-			o.ChildCount = -1
-			if clean && o.Size == 0 {
-				delete(list, rel)
-				n--
-			}
-		}
-	}
-	return n
+	dir = filepath.Join(dir, "kfilesync", url.QueryEscape(key))
+	return dir, os.MkdirAll(dir, 0755)
 }
 
-func (fm *FileManager) ListFiles(clean bool) map[string]*gowpd.Object {
-	if fm.device != nil {
-		return ListMtpFiles(fm.device, fm.path, clean)
+// loadState reads the state file path. Lists of old versions are migrated.
+func loadState(path string) *sync.State {
+	s, err := sync.LoadState(path)
+	if err != nil {
+		fmt.Println(err)
+		return sync.NewState()
 	}
-	list := make(map[string]*gowpd.Object)
-	info, _ := os.Lstat(fm.path)
-	if info == nil || !info.IsDir() {
-		return list
+	if s.Recovered {
+		fmt.Printf("Recovered : %v\n", path)
 	}
-	listFiles(fm.path, "", clean, list)
-	return list
+	return s
 }
 
-func (fm *FileManager) Delete(obj *gowpd.Object) (err error) {
-	if fm.device != nil {
-		err = fm.device.Delete(obj.Id)
-	} else {
-		err = os.Remove(obj.Id)
-	}
-	if err != nil {
+// SaveList writes the list m to the state s and saves it as path.
+func SaveList(s *sync.State, m map[string]*gowpd.Object, path string) bool {
+	s.SetObjects("", m)
+	if err := s.Save(path); err != nil {
 		fmt.Println(err)
+		return false
 	}
-	return err
+	return true
 }
 
-func (fm *FileManager) Mkdir(path string, obj *gowpd.Object) {
-	filename := filepath.Join(fm.path, path)
-	if fm.device != nil {
-		parent := fm.device.FindObject(filepath.Dir(filename))
-		if parent != nil {
-			fm.device.CreateFolder(parent.Id, obj.Name)
+// printErrors prints the actions which failed.
+func printErrors(p *sync.Plan) {
+	for _, a := range p.Actions {
+		if a.Err != nil {
+			fmt.Printf("%v : %v\n", a.Path, a.Err)
 		}
-	} else {
-		os.MkdirAll(filename, os.ModePerm)
 	}
 }
 
-func SortKey(m map[string]*gowpd.Object) []string {
-	keys := make([]string, 0, len(m))
-	for k := range m {
-		keys = append(keys, k)
+// newPlan compares src and dst, or loads the plan file applyPath for them
+// if it is not empty.
+func newPlan(src, dst sync.Tree, opts *sync.Options, applyPath string) (*sync.Plan, error) {
+	if applyPath == "" {
+		return sync.NewPlan(src, dst, opts)
+	}
+	f, err := os.Open(applyPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	p, err := sync.ReadPlan(f, src, dst, opts)
+	if p != nil && err != nil {
+		printErrors(p)
 	}
-	sort.Strings(keys)
-	return keys
+	return p, err
 }
 
-func SaveList(m map[string]*gowpd.Object, path string) bool {
+// writePlan writes p to path in the format of its extension. A path of "-"
+// prints the table.
+func writePlan(p *sync.Plan, path string) bool {
+	if path == "-" {
+		return p.WriteTable(os.Stdout) == nil
+	}
 	f, err := os.Create(path)
 	if err != nil {
 		fmt.Println(err)
 		return false
 	}
-	defer f.Close()
-
-	keys := SortKey(m)
-
-	w := csv.NewWriter(bufio.NewWriter(f))
-	defer w.Flush()
-
-	for _, k := range keys {
-		o := m[k]
-		v := []string{
-			k,
-			strconv.FormatInt(o.ModTime, 10),
-			strconv.FormatInt(o.Size, 10),
-			strconv.Itoa(o.ChildCount)}
-		w.Write(v)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = p.WriteJSON(f)
+	case ".csv":
+		err = p.WriteCSV(f)
+	default:
+		err = p.WriteTable(f)
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		fmt.Println(err)
+		return false
 	}
 	return true
 }
 
-func LoadList(path string) (m map[string]*gowpd.Object) {
-	m = make(map[string]*gowpd.Object)
-	f, err := os.Open(path)
+// recoverJournal cleans up after a sync which was cut short and left the
+// journal path, and removes the journal once apply records what the sync
+// completed. apply may be nil.
+func recoverJournal(path string, src, dst sync.Tree, apply func(r *sync.Recovery) bool) {
+	r, err := sync.LoadJournal(path)
 	if err != nil {
+		fmt.Println(err)
 		return
 	}
-	defer f.Close()
-	r := csv.NewReader(bufio.NewReader(f))
-	for {
-		val, err := r.Read()
-		if err != nil {
-			return
-		}
-		mtime, _ := strconv.ParseInt(val[1], 10, 64)
-		size, _ := strconv.ParseInt(val[2], 10, 64)
-		cnt, _ := strconv.Atoi(val[3])
-		dir := (cnt >= 0)
-		o := gowpd.Object{ObjectInfo: gowpd.ObjectInfo{ModTime: mtime, Size: size, IsDir: dir}, ChildCount: cnt}
-		m[val[0]] = &o
-	}
-	return
+	if r == nil {
+		return
+	}
+	fmt.Printf("Recovering interrupted sync : %v\n", path)
+	if err = r.Clean(src, dst); err != nil {
+		fmt.Println(err)
+	}
+	if apply == nil || apply(r) {
+		os.Remove(path)
+	}
 }
 
-func copyFile(src, dst string) error {
-	var err error
-	var srcfd *os.File
-	var dstfd *os.File
-	var srcinfo os.FileInfo
-
-	if srcfd, err = os.Open(src); err != nil {
-		return err
+// createJournal logs the steps of plans to the journal path. The sync goes
+// on without it if it cannot be written.
+func createJournal(path string, plans ...*sync.Plan) *sync.Journal {
+	j, err := sync.CreateJournal(path, plans...)
+	if err != nil {
+		fmt.Println(err)
+		return nil
 	}
-	defer srcfd.Close()
+	return j
+}
 
-	if dstfd, err = os.Create(dst); err != nil {
-		return err
+// execute prints the changes of p and carries them out, logged to the
+// journal path, which is removed once save records the result.
+func execute(p *sync.Plan, journalPath string, save func() bool) {
+	for _, a := range p.Actions {
+		switch a.Type {
+		case sync.ACTION_COPY, sync.ACTION_OVERWRITE, sync.ACTION_MKDIR:
+			fmt.Printf("+ %v\n", a.Path)
+		case sync.ACTION_DELETE:
+			fmt.Printf("- %v\n", a.Path)
+		case sync.ACTION_MOVE:
+			fmt.Printf("= %v -> %v\n", a.OldPath, a.Path)
+		}
 	}
-	defer dstfd.Close()
-
-	if _, err = io.Copy(dstfd, srcfd); err != nil {
-		return err
+	j := createJournal(journalPath, p)
+	if err := sync.Execute(p, nil); err != nil {
+		printErrors(p)
 	}
-	if srcinfo, err = os.Stat(src); err != nil {
-		return err
+	if save() && j != nil {
+		j.Close()
 	}
-	if err = os.Chmod(dst, srcinfo.Mode()); err != nil {
+}
+
+// isListFile reports whether path is a state file of kfilesync or its
+// backup or temporary file, or the journal.
+func isListFile(path string, obj *gowpd.Object) bool {
+	if path == JOURNAL_FILENAME {
+		return true
 	}
-	tm := srcinfo.ModTime()
-	return os.Chtimes(dst, tm, tm)
+	for _, ext := range []string{"", sync.STATE_BACKUP_EXT, ".tmp"} {
+		if path == LIST_FILENAME+ext || path == BASE_FILENAME+ext {
+			return true
+		}
+	}
+	return false
 }
 
-func CopyFile(path string, obj *gowpd.Object, overwrite bool) {
-	if obj.IsDir {
-		dst.Mkdir(path, obj)
+// twoWay syncs src and dst both ways from the baseline basePath.
+func twoWay(src, dst sync.Tree, opts *sync.Options, basePath, journalPath string) {
+	state := loadState(basePath)
+	if opts.Hash {
+		opts.HashCache = state
+	}
+	base := &sync.Baseline{A: state.Objects("A"), B: state.Objects("B")}
+	recoverJournal(journalPath, src, dst, func(r *sync.Recovery) bool {
+		r.ApplyBaseline(base)
+		return saveBaseline(state, base, basePath)
+	})
+	p, err := sync.NewTwoWayPlan(src, dst, base, opts)
+	if p == nil {
+		fmt.Println(err)
 		return
 	}
-	filename := filepath.Join(dst.path, path)
-	if dst.device == nil {
-		if src.device == nil {
-			copyFile(filepath.Join(src.path, path), filename)
-		} else {
-			src.device.CopyObjectFromDevice(filename, obj)
+	for _, c := range p.Conflicts {
+		switch {
+		case c.KeptAs != "":
+			fmt.Printf("! %v (kept as %v)\n", c.Path, c.KeptAs)
+		case c.Winner == sync.SIDE_NONE:
+			fmt.Printf("! %v\n", c.Path)
 		}
-	} else {
-		if overwrite {
-			dst.Delete(dstList[path])
-		}
-		parent := dst.device.FindObject(filepath.Dir(filename))
-		if parent == nil {
-			return
+	}
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	for _, plan := range []*sync.Plan{p.AtoB, p.BtoA} {
+		arrow := ">"
+		if plan == p.BtoA {
+			arrow = "<"
 		}
-		if src.device == nil {
-			dst.device.CopyToDevice(parent.Id, filepath.Join(src.path, path))
-		} else {
-			if src.deviceId != dst.deviceId {
-				reader, _ := src.device.GetReader(obj.Id)
-				if reader != nil {
-					dst.device.CopyObjectToDevice(parent.Id, reader, obj)
-					reader.Close()
-				}
-			} else {
-				if dst.device.CanCopy {
-					dst.device.Copy(parent.Id, obj.Id)
-				} else {
-					reader, _ := src.device.GetReader(obj.Id)
-					if reader != nil {
-						var buf bytes.Buffer
-						io.Copy(&buf, reader)
-						reader.Close()
-						dst.device.CopyObjectToDevice(parent.Id, &buf, obj)
-					}
-				}
+		for _, a := range plan.Actions {
+			switch a.Type {
+			case sync.ACTION_COPY, sync.ACTION_OVERWRITE, sync.ACTION_MKDIR, sync.ACTION_KEEP_BOTH:
+				fmt.Printf("+%v %v\n", arrow, a.Path)
+			case sync.ACTION_DELETE:
+				fmt.Printf("-%v %v\n", arrow, a.Path)
+			case sync.ACTION_MOVE:
+				fmt.Printf("=%v %v -> %v\n", arrow, a.OldPath, a.Path)
 			}
 		}
 	}
-}
-
-func checkDst() {
-	dk := SortKey(dstList)
-	for i := len(dk) - 1; i >= 0; i-- {
-		k := dk[i]
-		s, _ := srcList[k]
-		if s == nil {
-			fmt.Printf("- %v\n", k)
-			dst.Delete(dstList[k])
-		}
+	j := createJournal(journalPath, p.AtoB, p.BtoA)
+	if err := sync.ExecuteTwoWay(p, nil); err != nil {
+		printErrors(p.AtoB)
+		printErrors(p.BtoA)
+	}
+	if p.Base == base {
+		// the trees were not listed after the sync, which the next run
+		// recovers from the journal
+		return
+	}
+	if saveBaseline(state, p.Base, basePath) && j != nil {
+		j.Close()
 	}
 }
 
-type Handler func(state int, path string, obj *gowpd.Object)
-
-func checkSrc(handle Handler) {
-	sk := SortKey(srcList)
-	for _, k := range sk {
-		s, _ := srcList[k]
-		d, _ := dstList[k]
-		if d == nil {
-			handle(ST_NEW, k, s)
-		} else if s.ObjectInfo != d.ObjectInfo {
-			if s.IsDir {
-				continue
-			}
-			if s.ModTime >= d.ModTime {
-				handle(ST_NEWER, k, s)
-			} else {
-				handle(ST_OLDER, k, s)
-			}
-		}
+// saveBaseline writes base to the state s and saves it as path.
+func saveBaseline(s *sync.State, base *sync.Baseline, path string) bool {
+	s.SetObjects("A", base.A)
+	s.SetObjects("B", base.B)
+	if err := s.Save(path); err != nil {
+		fmt.Println(err)
+		return false
 	}
+	return true
 }
 
 func main() {
-	if len(os.Args) < 3 || len(os.Args) > 4 {
+	if len(os.Args) < 3 {
 		gowpd.Init()
 		if cnt := gowpd.GetDeviceCount(); cnt > 0 {
 			defer gowpd.Destroy()
@@ -409,8 +386,57 @@ func main() {
 		return
 	}
 	mode := "+"
-	if len(os.Args) == 4 {
-		switch os.Args[3] {
+	hash := false
+	emptyDirs, emptyFiles := false, false
+	var planPath, applyPath string
+	rules := &gowpd.Rules{}
+	var tp sync.TimePolicy
+	var quarantine *sync.Quarantine
+	maxDelete, maxDeletePercent := 0, 0.0
+	for _, arg := range os.Args[3:] {
+		var err error
+		switch {
+		case strings.HasPrefix(arg, "tolerance:"):
+			tp.Tolerance, err = strconv.ParseInt(arg[len("tolerance:"):], 10, 64)
+		case strings.HasPrefix(arg, "hours:"):
+			tp.HourOffsets, err = strconv.ParseInt(arg[len("hours:"):], 10, 64)
+		case arg == "sizeonly":
+			tp.SizeOnly = true
+		case arg == "emptydirs":
+			emptyDirs = true
+		case arg == "emptyfiles":
+			emptyFiles = true
+		case arg == "quarantine":
+			quarantine = &sync.Quarantine{}
+		case strings.HasPrefix(arg, "quarantine:"):
+			var days int
+			days, err = strconv.Atoi(arg[len("quarantine:"):])
+			quarantine = &sync.Quarantine{Retention: time.Duration(days) * 24 * time.Hour}
+		case strings.HasPrefix(arg, "maxdelete:") && strings.HasSuffix(arg, "%"):
+			maxDeletePercent, err = strconv.ParseFloat(arg[len("maxdelete:"):len(arg)-1], 64)
+		case strings.HasPrefix(arg, "maxdelete:"):
+			maxDelete, err = strconv.Atoi(arg[len("maxdelete:"):])
+		case strings.HasPrefix(arg, "plan:"):
+			planPath = arg[len("plan:"):]
+			continue
+		case strings.HasPrefix(arg, "apply:"):
+			applyPath = arg[len("apply:"):]
+			continue
+		case strings.HasPrefix(arg, "exclude:"):
+			err = rules.Add(arg[len("exclude:"):])
+		case strings.HasPrefix(arg, "include:"):
+			err = rules.Add("!" + arg[len("include:"):])
+		case strings.HasPrefix(arg, "rules:"):
+			var r *gowpd.Rules
+			if r, err = gowpd.LoadRules(arg[len("rules:"):]); err == nil {
+				rules = gowpd.MergeRules(rules, r)
+			}
+		}
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		switch arg {
 		case "0":
 			mode = "0"
 		case "-":
@@ -419,6 +445,10 @@ func main() {
 			mode = "="
 		case "?":
 			mode = "?"
+		case "2", "2n", "2s", "2d", "2a":
+			mode = arg
+		case "hash":
+			hash = true
 		}
 	}
 	p1 := os.Args[1]
@@ -439,103 +469,147 @@ func main() {
 		defer gowpd.Destroy()
 	}
 
-	var err error
-	src, err = getFileManager(p1)
+	defer func() {
+		for _, d := range devices {
+			d.Release()
+		}
+	}()
+	src, srcKey, err := getTree(p1)
 	if err != nil {
 		fmt.Println(err)
 		return
-	} else if src.device != nil {
-		defer src.device.Release()
 	}
-
-	dst, err = getFileManager(p2)
+	dst, dstKey, err := getTree(p2)
 	if err != nil {
 		fmt.Println(err)
 		return
-	} else if dst.device != nil {
-		defer dst.device.Release()
 	}
-	if src.PathInfo == dst.PathInfo {
+	if srcKey == dstKey {
 		fmt.Println("Error : src = dst")
 		return
 	}
 
-	srcList = src.ListFiles(true)
-	dstList = dst.ListFiles(true)
-	excPath := filepath.Join(dst.path, LIST_FILENAME)
+	opts := &sync.Options{SkipEmptyDirs: !emptyDirs, SkipEmptyFiles: !emptyFiles, Hash: hash, DetectMoves: true, Rules: rules, Time: tp,
+		Quarantine: quarantine, MaxDelete: maxDelete, MaxDeletePercent: maxDeletePercent, Ignore: isListFile}
+	dir, err := stateDir(dst, dstKey)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	excPath := filepath.Join(dir, LIST_FILENAME)
+	basePath := filepath.Join(dir, BASE_FILENAME)
+	journalPath := filepath.Join(dir, JOURNAL_FILENAME)
+	if planPath != "" || applyPath != "" {
+		if mode != "+" && mode != "-" && mode != "=" {
+			fmt.Printf("Error : plan and apply are not supported by mode %v\n", mode)
+			return
+		}
+		if planPath != "" && applyPath != "" {
+			fmt.Println("Error : plan and apply at once")
+			return
+		}
+	}
+	var state *sync.State
+	if mode[0] != '2' {
+		state = loadState(excPath)
+		if hash {
+			opts.HashCache = state
+		}
+	}
 	switch mode {
+	case "2", "2n", "2s", "2d", "2a":
+		opts.Conflict = map[string]sync.ConflictPolicy{
+			"2":  sync.CONFLICT_KEEP_BOTH,
+			"2n": sync.CONFLICT_NEWEST,
+			"2s": sync.CONFLICT_PREFER_A,
+			"2d": sync.CONFLICT_PREFER_B,
+			"2a": sync.CONFLICT_ABORT,
+		}[mode]
+		twoWay(src, dst, opts, basePath, journalPath)
 	case "0":
-		checkSrc(func(state int, k string, s *gowpd.Object) {
-			switch state {
-			case ST_NEW:
-				fmt.Printf("[S  ] %v\n", k)
-			case ST_NEWER:
-				fmt.Printf("[S>D] %v\n", k)
-			}
-		})
-		SaveList(srcList, excPath)
-	case "-":
-		checkDst()
-	case "=":
-		checkSrc(func(state int, k string, s *gowpd.Object) {
-			switch state {
-			case ST_NEW:
-				fmt.Printf("+ %v\n", k)
-				CopyFile(k, s, false)
-			case ST_NEWER:
-				fmt.Printf("+ %v\n", k)
-				CopyFile(k, s, true)
+		p, err := sync.NewPlan(src, dst, opts)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		for _, a := range p.Actions {
+			switch a.Type {
+			case sync.ACTION_COPY, sync.ACTION_MKDIR:
+				fmt.Printf("[S  ] %v\n", a.Path)
+			case sync.ACTION_OVERWRITE:
+				fmt.Printf("[S>D] %v\n", a.Path)
 			}
+		}
+		SaveList(state, p.SrcList, excPath)
+	case "-", "=":
+		opts.Mode = sync.MODE_DELETE
+		if mode == "=" {
+			opts.Mode = sync.MODE_MIRROR
+		}
+		recoverJournal(journalPath, src, dst, nil)
+		p, err := newPlan(src, dst, opts, applyPath)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if planPath != "" {
+			writePlan(p, planPath)
+			return
+		}
+		execute(p, journalPath, func() bool {
+			return !hash || state.Save(excPath) == nil
 		})
-		checkDst()
 	case "?":
-		excList := LoadList(excPath)
-		checkSrc(func(state int, k string, s *gowpd.Object) {
-			if k == LIST_FILENAME {
-				return
-			}
-			switch state {
-			case ST_NEW:
+		excList := state.Objects("")
+		p, err := sync.NewPlan(src, dst, opts)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		var dstOnly []string
+		for _, a := range p.Actions {
+			switch {
+			case a.Type == sync.ACTION_COPY, a.Type == sync.ACTION_MKDIR:
 				fmt.Printf("[S  ]")
-			case ST_NEWER:
+			case a.Type == sync.ACTION_OVERWRITE:
 				fmt.Printf("[S>D]")
-			case ST_OLDER:
+			case a.Reason == sync.SKIP_OLDER:
 				fmt.Printf("[S<D]")
+			case a.Reason == sync.SKIP_NOT_IN_SRC:
+				dstOnly = append(dstOnly, a.Path)
+				continue
+			default:
+				continue
 			}
-			e, _ := excList[k]
-			if e == nil {
+			if excList[a.Path] == nil {
 				fmt.Printf(" ")
 			} else {
 				fmt.Printf("*")
 			}
-			fmt.Printf(" %v\n", k)
-		})
-
-		dk := SortKey(dstList)
-		for _, k := range dk {
-			s, _ := srcList[k]
-			if s == nil {
-				fmt.Printf("[  D]  %v\n", k)
-			}
+			fmt.Printf(" %v\n", a.Path)
+		}
+		sort.Strings(dstOnly)
+		for _, k := range dstOnly {
+			fmt.Printf("[  D]  %v\n", k)
 		}
 	default:
-		excList := LoadList(excPath)
-		checkSrc(func(state int, k string, s *gowpd.Object) {
-			if state == ST_NEW || state == ST_NEWER {
-				e, _ := excList[k]
-				if e == nil && k != LIST_FILENAME {
-					fmt.Printf("+ %v\n", k)
-					CopyFile(k, s, state == ST_NEWER)
-				} else if s.ObjectInfo != e.ObjectInfo {
-					if !s.IsDir {
-						if s.ModTime >= e.ModTime && k != LIST_FILENAME {
-							fmt.Printf("+ %v\n", k)
-							CopyFile(k, s, state == ST_NEWER)
-						}
-					}
-				}
-			}
+		recoverJournal(journalPath, src, dst, func(r *sync.Recovery) bool {
+			list := state.Objects("")
+			r.ApplyList(list)
+			return SaveList(state, list, excPath)
+		})
+		opts.Exclude = state.Objects("")
+		p, err := newPlan(src, dst, opts, applyPath)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if planPath != "" {
+			writePlan(p, planPath)
+			return
+		}
+		execute(p, journalPath, func() bool {
+			return SaveList(state, p.SyncedList(opts.Exclude), excPath)
 		})
-		SaveList(srcList, excPath)
 	}
 }
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"github.com/tobwithu/gowpd"
+	"github.com/tobwithu/gowpd/sync"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// run runs kfilesync with args.
+func run(args ...string) {
+	defer func(a []string) { os.Args = a }(os.Args)
+	os.Args = append([]string{"kfilesync"}, args...)
+	main()
+}
+
+func TestDeleteKeepsListFiles(t *testing.T) {
+	for _, mode := range []string{"-", "="} {
+		src, err := ioutil.TempDir("", "kfilesync")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(src)
+		dst, err := ioutil.TempDir("", "kfilesync")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dst)
+		if err = ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("a"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		run(src, dst)
+		backup := filepath.Join(dst, LIST_FILENAME+sync.STATE_BACKUP_EXT)
+		if err = ioutil.WriteFile(backup, []byte("{}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		run(src, dst, mode, "quarantine")
+		for _, name := range []string{"a.txt", LIST_FILENAME, LIST_FILENAME + sync.STATE_BACKUP_EXT} {
+			if _, err := os.Stat(filepath.Join(dst, name)); err != nil {
+				t.Errorf("%v: %v", mode, err)
+			}
+		}
+	}
+}
+
+func TestStateDir(t *testing.T) {
+	config, err := ioutil.TempDir("", "kfilesync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(config)
+	defer os.Setenv("AppData", os.Getenv("AppData"))
+	os.Setenv("AppData", config)
+
+	d := gowpd.NewMemoryDevice()
+	if _, err = d.CreateFolder(gowpd.WPD_DEVICE_OBJECT_ID, "Storage"); err != nil {
+		t.Fatal(err)
+	}
+	dst, err := sync.NewDeviceTree(d, "Storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := stateDir(dst, "MTP0:\\Storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(config, "kfilesync", "MTP0%3A%5CStorage"); dir != want {
+		t.Errorf("dir = %v, want %v", dir, want)
+	}
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		t.Errorf("stat: %v", err)
+	}
+}
@@ -0,0 +1,121 @@
+package gowpd
+
+import (
+	"fmt"
+	"io"
+)
+
+const (
+	ATOMIC_TEMP_PREFIX = ".gowpd-"
+	ATOMIC_TEMP_SUFFIX = ".part"
+)
+
+// WithAtomic uploads under a hidden temporary name, checks the size and
+// renames the object when it is complete, so a failed upload never leaves a
+// truncated object under the final name. An existing object of the same
+// name is deleted only after that.
+//
+// If the device does not allow renaming, the data is read back from the
+// temporary object and uploaded again under the final name once the old
+// object is deleted. The temporary object is kept until then.
+func WithAtomic() CopyOption {
+	return func(o *copyOptions) {
+		o.atomic = true
+	}
+}
+
+func atomicTempName(fileName string) string {
+	return ATOMIC_TEMP_PREFIX + fileName + ATOMIC_TEMP_SUFFIX
+}
+
+func (d *Device) uploadAtomic(parentId string, src io.Reader, obj *Object, o *copyOptions) (string, int64, error) {
+	children, err := d.GetChildObjects(parentId)
+	if err != nil {
+		return "", 0, err
+	}
+	tmpName := atomicTempName(obj.Name)
+	var old []string
+	for _, c := range children {
+		if c == nil {
+			continue
+		}
+		switch c.Name {
+		case tmpName:
+			// left over by an upload that did not finish
+			d.Delete(c.Id)
+		case obj.Name:
+			if c.IsDir {
+				return "", 0, fmt.Errorf("Is a folder : %v", obj.Name)
+			}
+			old = append(old, c.Id)
+		}
+	}
+
+	verified := *o
+	if verified.verify < VERIFY_SIZE {
+		verified.verify = VERIFY_SIZE
+	}
+	id, n, err := d.uploadAs(parentId, tmpName, src, obj, &verified)
+	if err != nil {
+		if id != "" {
+			d.Delete(id)
+		}
+		return "", n, err
+	}
+	err = d.rename(id, obj.Name, o.nameOf(obj.Name))
+	if IsNameRejected(err) {
+		if name, objName, ok := o.sanitized(obj.Name); ok {
+			err = d.rename(id, name, objName)
+		}
+	}
+	if err != nil {
+		if !isRefused(err) {
+			return "", n, err
+		}
+		id, err = d.replaceByUpload(parentId, id, obj, old, o)
+		return id, n, err
+	}
+	if len(old) > 0 {
+		_, err = d.DeleteMany(old, false)
+	}
+	return id, n, err
+}
+
+// replaceByUpload replaces the objects old by a copy of the temporary object
+// tmpId named obj.Name, for devices that do not rename objects. The copy is
+// uploaded with the options of the first upload, so its progress is reported
+// too.
+func (d *Device) replaceByUpload(parentId string, tmpId string, obj *Object, old []string, o *copyOptions) (string, error) {
+	s, err := d.spoolObject(tmpId, o)
+	if err != nil {
+		return "", err
+	}
+	defer s.Close()
+	if len(old) > 0 {
+		if _, err = d.DeleteMany(old, false); err != nil {
+			return "", err
+		}
+	}
+	sized := *obj
+	sized.Size = s.size
+	verified := *o
+	if verified.verify < VERIFY_SIZE {
+		verified.verify = VERIFY_SIZE
+	}
+	id, _, err := d.uploadAs(parentId, obj.Name, s.Reader(), &sized, &verified)
+	if err != nil {
+		return id, err
+	}
+	return id, d.Delete(tmpId)
+}
+
+// isRefused reports whether err means the device does not allow an
+// operation, such as renaming, rather than that the call failed.
+func isRefused(err error) bool {
+	code, _ := ErrorCode(err)
+	switch code {
+	case E_ACCESSDENIED, E_NOTIMPL, E_NOT_SUPPORTED, E_INVALIDARG:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,180 @@
+package gowpd
+
+import (
+	"strings"
+	"testing"
+)
+
+// childNames returns the names of the children of id and their contents.
+func childNames(t *testing.T, d *Device, id string) map[string]string {
+	t.Helper()
+	objs, err := d.GetChildObjects(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[string]string)
+	for _, o := range objs {
+		buf := make([]byte, o.Size)
+		d.ReadAt(o.Id, buf, 0)
+		names[o.Name] = string(buf)
+	}
+	return names
+}
+
+func TestAtomicUpload(t *testing.T) {
+	errWrite := errDisconnected
+	tmp := atomicTempName("a.txt")
+	creates := 0
+	tests := []struct {
+		name  string
+		size  int64
+		fault func(op string) error
+		err   bool
+		want  map[string]string
+	}{
+		{"replace", 3, nil, false, map[string]string{"a.txt": "new"}},
+		{"write fails", 3, func(op string) error {
+			if op == "Write" {
+				return errWrite
+			}
+			return nil
+		}, true, map[string]string{"a.txt": "old"}},
+		{"commit fails", 3, func(op string) error {
+			if op == "Commit" {
+				return errWrite
+			}
+			return nil
+		}, true, map[string]string{"a.txt": "old"}},
+		{"short source", 10, nil, true, map[string]string{"a.txt": "old"}},
+		{"rename refused", 3, func(op string) error {
+			if op == "SetValues" {
+				return HResult(E_ACCESSDENIED)
+			}
+			return nil
+		}, false, map[string]string{"a.txt": "new"}},
+		{"disconnected before rename", 3, func(op string) error {
+			if op == "SetValues" {
+				return errDisconnected
+			}
+			return nil
+		}, true, map[string]string{"a.txt": "old", tmp: "new"}},
+		// the old object is gone but the data is kept in the temporary object
+		{"disconnected in fallback", 3, func(op string) error {
+			switch op {
+			case "SetValues":
+				return HResult(E_NOTIMPL)
+			case "CreateObjectWithPropertiesAndData":
+				creates++
+				if creates > 1 {
+					return errDisconnected
+				}
+			}
+			return nil
+		}, true, map[string]string{tmp: "new"}},
+	}
+	for _, tt := range tests {
+		b := NewMemoryBackend()
+		d := NewDevice(b)
+		root := putFolder(t, d, WPD_DEVICE_OBJECT_ID, "Storage")
+		putFile(t, d, root, "a.txt", "old")
+		if tt.fault != nil {
+			b.Fault = func(op string, ids []string) error {
+				return tt.fault(op)
+			}
+		}
+		obj := &Object{Name: "a.txt", ObjectInfo: ObjectInfo{Size: tt.size}}
+		_, err := d.CopyObjectToDevice(root, strings.NewReader("new"), obj, WithAtomic())
+		b.Fault = nil
+		if (err != nil) != tt.err {
+			t.Errorf("%v: err = %v", tt.name, err)
+		}
+		if got := childNames(t, d, root); !equalMap(got, tt.want) {
+			t.Errorf("%v: objects = %v", tt.name, got)
+		}
+	}
+}
+
+func TestAtomicUploadOptions(t *testing.T) {
+	b := NewMemoryBackend()
+	d := NewDevice(b)
+	root := putFolder(t, d, WPD_DEVICE_OBJECT_ID, "Storage")
+	putFile(t, d, root, "a.txt", "old")
+	streams := 0
+	b.Fault = func(op string, ids []string) error {
+		switch op {
+		case "SetValues":
+			return HResult(E_ACCESSDENIED)
+		case "GetStream":
+			streams++
+		}
+		return nil
+	}
+	files := 0
+	progress := func(p Progress) {
+		if p.FilesDone == 1 {
+			files++
+		}
+	}
+	obj := &Object{Name: "a.txt", ObjectInfo: ObjectInfo{Size: 3}}
+	voice := FileType{FormatGUID(MTP_FORMAT_AAC), WPD_CONTENT_TYPE_AUDIO}
+	_, err := d.CopyObjectToDevice(root, strings.NewReader("new"), obj, WithAtomic(), WithVerify(VERIFY_HASH, HASH_SHA256), WithProgress(progress), WithFileType(voice))
+	b.Fault = nil
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the temporary object is hashed and spooled, then the copy is hashed
+	if streams != 3 {
+		t.Errorf("streams read = %v", streams)
+	}
+	if files != 2 {
+		t.Errorf("uploads reported = %v", files)
+	}
+	if o, _ := d.GetObject(childId(t, d, root, "a.txt")); o.Format != voice.Format || o.ContentType != voice.ContentType {
+		t.Errorf("object = %+v", o)
+	}
+}
+
+func TestAtomicUploadCleanup(t *testing.T) {
+	b := NewMemoryBackend()
+	d := NewDevice(b)
+	root := putFolder(t, d, WPD_DEVICE_OBJECT_ID, "Storage")
+	putFile(t, d, root, atomicTempName("a.txt"), "stale")
+	putFolder(t, d, root, "dir")
+
+	if _, err := d.CopyObjectToDevice(root, strings.NewReader("new"), &Object{Name: "a.txt", ObjectInfo: ObjectInfo{Size: 3}}, WithAtomic()); err != nil {
+		t.Fatal(err)
+	}
+	if got := childNames(t, d, root); !equalMap(got, map[string]string{"a.txt": "new", "dir": ""}) {
+		t.Errorf("objects = %v", got)
+	}
+	if _, err := d.CopyObjectToDevice(root, strings.NewReader("x"), &Object{Name: "dir", ObjectInfo: ObjectInfo{Size: 1}}, WithAtomic()); err == nil {
+		t.Errorf("replaced a folder")
+	}
+}
+
+func TestRename(t *testing.T) {
+	d := NewMemoryDevice()
+	root := putFolder(t, d, WPD_DEVICE_OBJECT_ID, "Storage")
+	id := putFile(t, d, root, "a.txt", "a")
+	if err := d.Rename(id, "b.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if o, _ := d.GetObject(id); o.Name != "b.jpg" {
+		t.Errorf("name = %v", o.Name)
+	}
+	if err := d.Rename("missing", "c"); err != HResult(E_FILE_NOT_FOUND) {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func equalMap(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || v != w {
+			return false
+		}
+	}
+	return true
+}
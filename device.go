@@ -0,0 +1,574 @@
+package gowpd
+
+import (
+	"bufio"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Backend is the content interface of a portable device. ChooseDevice opens
+// the WPD backend of a connected device, MemoryBackend keeps objects in memory.
+type Backend interface {
+	EnumObjects(parentId string) ([]string, error)
+	GetValues(id string) (PropertyValues, error)
+	SetValues(id string, props PropertyValues) error
+	// GetSupportedResources lists the resource keys of the object id.
+	GetSupportedResources(id string) ([]PROPERTYKEY, error)
+	// GetResourceAttributes returns the WPD_RESOURCE_ATTRIBUTE_* values of
+	// the resource key of the object id.
+	GetResourceAttributes(id string, key PROPERTYKEY) (PropertyValues, error)
+	// GetStream opens the resource key of the object id.
+	GetStream(id string, key PROPERTYKEY) (io.ReadCloser, int, error)
+	CreateObjectWithPropertiesOnly(props PropertyValues) (string, error)
+	CreateObjectWithPropertiesAndData(props PropertyValues) (ObjectWriter, int, error)
+	// CreateResource writes a resource of the object id described by the
+	// WPD_RESOURCE_ATTRIBUTE_* attrs.
+	CreateResource(id string, attrs PropertyValues) (ObjectWriter, int, error)
+	// Delete, Copy and Move return the status of each object. A result
+	// shorter than ids means the driver did not report per-object results.
+	Delete(option int, ids []string) ([]int32, error)
+	Copy(ids []string, parentId string) ([]int32, error)
+	Move(ids []string, parentId string) ([]int32, error)
+	SupportsCommand(cmd PROPERTYKEY) bool
+	Release()
+}
+
+// ObjectWriter is the data stream of an object being created.
+// ObjectWriter writes the data of a new object or resource. It is done once
+// Commit or Abort is called.
+type ObjectWriter interface {
+	io.Writer
+	Commit() (string, error)
+	// Abort discards the data written.
+	Abort() error
+}
+
+type Device struct {
+	backend Backend
+	CanCopy bool
+	CanMove bool
+	// Retry is applied to enumeration, property reads and transfers. Uploads
+	// are retried as a whole only from files, spools and other io.Seekers.
+	// A folder or file whose create timed out is looked up by name before it
+	// is created again. Nil disables retries.
+	Retry *RetryPolicy
+}
+
+type ObjectInfo struct {
+	ModTime int64
+	Size    int64
+	IsDir   bool
+}
+
+type Object struct {
+	ObjectInfo
+	ChildCount int
+
+	Id          string
+	ParentId    string
+	Name        string
+	ContentType GUID
+	Format      GUID
+}
+
+func NewDevice(b Backend) *Device {
+	d := &Device{backend: b, Retry: DefaultRetryPolicy()}
+	d.CanCopy = d.SupportsCommand(WPD_COMMAND_OBJECT_MANAGEMENT_COPY_OBJECTS)
+	d.CanMove = d.SupportsCommand(WPD_COMMAND_OBJECT_MANAGEMENT_MOVE_OBJECTS)
+	return d
+}
+
+func (d *Device) Release() {
+	d.backend.Release()
+}
+
+func (d *Device) GetObject(id string) (o *Object, err error) {
+	var v PropertyValues
+	err = d.Retry.Do(func() (err error) {
+		v, err = d.backend.GetValues(id)
+		return
+	})
+	if err != nil {
+		return
+	}
+	o = &Object{}
+	o.Id = id
+	o.ParentId = v.String(WPD_OBJECT_PARENT_ID)
+	o.Name = v.String(WPD_OBJECT_ORIGINAL_FILE_NAME)
+	o.Size = int64(v.Uint64(WPD_OBJECT_SIZE))
+	if t := v.Time(WPD_OBJECT_DATE_MODIFIED); !t.IsZero() {
+		o.ModTime = t.Unix()
+	}
+	o.ContentType = v.Guid(WPD_OBJECT_CONTENT_TYPE)
+	o.Format = v.Guid(WPD_OBJECT_FORMAT)
+	o.IsDir = o.ContentType == WPD_CONTENT_TYPE_FUNCTIONAL_OBJECT || o.ContentType == WPD_CONTENT_TYPE_FOLDER
+	return
+}
+
+func (d *Device) GetChildIds(id string) ([]string, error) {
+	var ids []string
+	err := d.Retry.Do(func() (err error) {
+		ids, err = d.backend.EnumObjects(id)
+		return
+	})
+	return ids, err
+}
+
+// GetChildObjects returns the children of the object id. Children which
+// cannot be read are nil, and the first of their errors is returned.
+func (d *Device) GetChildObjects(id string) (ar []*Object, err error) {
+	ids, err := d.GetChildIds(id)
+	if err != nil {
+		return
+	}
+	ar = make([]*Object, len(ids))
+	for i, id := range ids {
+		o, e := d.GetObject(id)
+		if e != nil && err == nil {
+			err = e
+		}
+		ar[i] = o
+	}
+	return
+}
+
+func (d *Device) findObject(path string, id string, curPath string) *Object {
+	objs, _ := d.GetChildObjects(id)
+	for _, o := range objs {
+		if o == nil {
+			continue
+		}
+		newPath := curPath + o.Name + PathSeparator
+		if path == newPath {
+			return o
+		} else if strings.Index(path, newPath) == 0 {
+			if o.IsDir {
+				rs := d.findObject(path, o.Id, newPath)
+				if rs != nil {
+					return rs
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (d *Device) FindObject(path string) *Object {
+	path = CleanPath(path) + PathSeparator
+	obj := d.findObject(path, WPD_DEVICE_OBJECT_ID, "")
+	return obj
+}
+
+func (d *Device) GetReader(id string) (*BufReadCloser, error) {
+	return d.OpenResource(id, WPD_RESOURCE_DEFAULT)
+}
+
+func (d *Device) CopyFromDevice(dst string, id string, opts ...CopyOption) (int64, error) {
+	o := newCopyOptions(opts)
+	size := int64(0)
+	if o.progress != nil || o.tracker != nil || o.resume || o.verify != VERIFY_NONE {
+		obj, err := d.GetObject(id)
+		if err != nil {
+			return 0, err
+		}
+		size = obj.Size
+	}
+	return d.copyFromDevice(dst, id, size, o)
+}
+
+func (d *Device) copyFromDevice(dst string, id string, size int64, o *copyOptions) (int64, error) {
+	var offset int64
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if o.resume {
+		var ok bool
+		offset, ok = resumeOffset(dst, size)
+		if ok && offset == size {
+			return 0, nil
+		}
+		if offset > 0 {
+			flag = os.O_WRONLY | os.O_APPEND
+		}
+	}
+	reader, err := d.OpenRange(id, offset, -1)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+	src, h := o.hashing(reader)
+	if h != nil && offset > 0 {
+		if err = hashPrefix(h, dst, offset); err != nil {
+			return 0, err
+		}
+	}
+
+	f, err := os.OpenFile(dst, flag, 0666)
+	if err != nil {
+		return 0, err
+	}
+	writer := NewBufWriteCloser(f, 0)
+	src, done := o.trackFile(src, size)
+	defer done()
+	if offset > 0 && o.tracker != nil {
+		o.tracker.Add(offset)
+	}
+	n, err := io.Copy(writer, src)
+	if cerr := writer.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = verifyDownload(dst, size, h, o)
+	}
+	return n, err
+}
+
+// hashPrefix feeds h with the first n bytes of the file path.
+func hashPrefix(h hash.Hash, path string, n int64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.CopyN(h, f, n)
+	return err
+}
+
+// verifyDownload checks the file dst downloaded from an object of size
+// bytes. h is the hash of the data read from the device.
+func verifyDownload(dst string, size int64, h hash.Hash, o *copyOptions) error {
+	if o.verify == VERIFY_NONE {
+		return nil
+	}
+	info, err := os.Stat(dst)
+	if err != nil {
+		return err
+	}
+	if info.Size() != size {
+		return sizeError(dst, info.Size(), size)
+	}
+	if h == nil {
+		return nil
+	}
+	sum, err := hashFile(dst, o.hashAlgo)
+	if err != nil {
+		return err
+	}
+	return checkHash(dst, sum, h)
+}
+
+func (d *Device) CopyObjectFromDevice(dst string, obj *Object, opts ...CopyOption) (int64, error) {
+	return d.copyObjectFromDevice(dst, obj, newCopyOptions(opts))
+}
+
+func (d *Device) copyObjectFromDevice(dst string, obj *Object, o *copyOptions) (int64, error) {
+	written, err := d.copyFromDevice(dst, obj.Id, obj.Size, o)
+	if err != nil {
+		return 0, err
+	}
+	return written, SetFileTime(dst, obj.ModTime)
+}
+
+func (d *Device) CopyToDevice(parentId string, src string, opts ...CopyOption) (int64, error) {
+	info, err := os.Lstat(src)
+	if info == nil || info.IsDir() {
+		return 0, err
+	}
+	_, n, err := d.uploadFile(parentId, src, info, newCopyOptions(opts))
+	return n, err
+}
+
+func (d *Device) uploadFile(parentId string, src string, info os.FileInfo, opts *copyOptions) (string, int64, error) {
+	o := ObjectFromFileInfo(src, info)
+	f, err := os.Open(o.Id)
+	if err != nil {
+		return "", 0, err
+	}
+	reader := &fileReader{NewBufReadCloser(f, 0), f, f}
+	defer reader.Close()
+	return d.upload(parentId, reader, o, opts)
+}
+
+func (d *Device) CopyObjectToDevice(parentId string, src io.Reader, obj *Object, opts ...CopyOption) (int64, error) {
+	_, n, err := d.upload(parentId, src, obj, newCopyOptions(opts))
+	return n, err
+}
+
+func (d *Device) upload(parentId string, src io.Reader, obj *Object, o *copyOptions) (string, int64, error) {
+	named := *obj
+	named.Name = o.fileNameOf(obj.Name)
+	if o.atomic {
+		return d.uploadAtomic(parentId, src, &named, o)
+	}
+	return d.uploadAs(parentId, named.Name, src, &named, o)
+}
+
+// uploadAs uploads src as the file name in the folder parentId. Nothing is
+// committed if src cannot be read to the end. A name the device rejects is
+// sanitized and tried once more.
+//
+// If src is an io.Seeker, like files and spools, the whole upload is retried
+// from the start of src until an object is committed. Otherwise only the
+// creation of the object is retried.
+func (d *Device) uploadAs(parentId string, fileName string, src io.Reader, obj *Object, o *copyOptions) (string, int64, error) {
+	f := o.startFile(obj.Size)
+	defer f.done()
+	p := d.Retry
+	seeker, ok := src.(io.Seeker)
+	if !ok || p == nil {
+		return d.uploadOnce(parentId, fileName, src, obj, o, f, p)
+	}
+	start, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return d.uploadOnce(parentId, fileName, src, obj, o, f, p)
+	}
+	for attempt := 1; ; attempt++ {
+		id, n, err := d.uploadOnce(parentId, fileName, src, obj, o, f, nil)
+		if err == nil || id != "" || attempt >= p.MaxAttempts || !p.retryable(err) {
+			return id, n, err
+		}
+		p.wait(attempt)
+		if _, err = seeker.Seek(start, io.SeekStart); err != nil {
+			return "", n, err
+		}
+		f.rewind()
+	}
+}
+
+// uploadOnce uploads src like uploadAs, counting its bytes to f and retrying
+// the creation of the object by retry.
+func (d *Device) uploadOnce(parentId string, fileName string, src io.Reader, obj *Object, o *copyOptions, f *fileProgress, retry *RetryPolicy) (string, int64, error) {
+	meta, src := o.readMetadata(src, obj.Size)
+	t, src := o.detectType(obj.Name, src)
+	prop := PropertyValues{
+		WPD_OBJECT_PARENT_ID:          parentId,
+		WPD_OBJECT_NAME:               o.nameOf(fileName),
+		WPD_OBJECT_ORIGINAL_FILE_NAME: fileName,
+		WPD_OBJECT_SIZE:               uint64(obj.Size),
+		WPD_OBJECT_DATE_MODIFIED:      time.Unix(obj.ModTime, 0),
+		WPD_OBJECT_FORMAT:             t.Format,
+		WPD_OBJECT_CONTENT_TYPE:       t.ContentType,
+	}
+	for k, v := range meta {
+		prop[k] = v
+	}
+	// the object is only made once its stream is committed, so creating the
+	// stream is retried
+	var stream ObjectWriter
+	var size int
+	create := func() (err error) {
+		stream, size, err = d.backend.CreateObjectWithPropertiesAndData(prop)
+		return
+	}
+	err := retry.Do(create)
+	if IsNameRejected(err) {
+		if name, objName, ok := o.sanitized(fileName); ok {
+			fileName = name
+			prop[WPD_OBJECT_NAME] = objName
+			prop[WPD_OBJECT_ORIGINAL_FILE_NAME] = name
+			err = retry.Do(create)
+		}
+	}
+	if err != nil {
+		return "", 0, err
+	}
+
+	writer := bufio.NewWriterSize(stream, size)
+	src, h := o.hashing(f.reader(src))
+	n, err := io.Copy(writer, src)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err != nil {
+		stream.Abort()
+		return "", n, err
+	}
+	id, err := stream.Commit()
+	if err != nil && d.Retry != nil && d.Retry.retryable(err) {
+		// a commit which timed out may have made the object after all
+		if id = d.findChild(parentId, fileName, obj); id != "" {
+			err = nil
+		}
+	}
+	if err == nil {
+		err = d.verifyUpload(id, fileName, n, obj.Size, h, o)
+	}
+	if err == nil {
+		err = d.uploadThumbnail(id, o)
+	}
+	return id, n, err
+}
+
+// verifyUpload checks the object id of n bytes written for an upload of size
+// bytes. h is the hash of the data written.
+func (d *Device) verifyUpload(id string, fileName string, n int64, size int64, h hash.Hash, o *copyOptions) error {
+	if o.verify == VERIFY_NONE {
+		return nil
+	}
+	if n != size {
+		return sizeError(fileName, n, size)
+	}
+	c, err := d.GetObject(id)
+	if err != nil {
+		return err
+	}
+	if c.Size != size {
+		return sizeError(fileName, c.Size, size)
+	}
+	if h == nil {
+		return nil
+	}
+	sum, err := d.Hash(id, o.hashAlgo)
+	if err != nil {
+		return err
+	}
+	return checkHash(fileName, sum, h)
+}
+
+// Rename changes the file name of the object id. The object name follows
+// NAME_STRIP_EXT.
+func (d *Device) Rename(id string, fileName string) error {
+	return d.rename(id, fileName, NAME_STRIP_EXT.ObjectName(fileName))
+}
+
+func (d *Device) rename(id string, fileName string, name string) error {
+	props := PropertyValues{
+		WPD_OBJECT_NAME:               name,
+		WPD_OBJECT_ORIGINAL_FILE_NAME: fileName,
+	}
+	return d.Retry.Do(func() error {
+		return d.backend.SetValues(id, props)
+	})
+}
+
+func (d *Device) Delete(id string) error {
+	_, err := d.DeleteMany([]string{id}, false)
+	return err
+}
+
+// DeleteMany deletes ids in one request and returns the error of each object.
+// Folders are deleted with their contents if recursive is set.
+func (d *Device) DeleteMany(ids []string, recursive bool) ([]error, error) {
+	option := PORTABLE_DEVICE_DELETE_NO_RECURSION
+	if recursive {
+		option = PORTABLE_DEVICE_DELETE_WITH_RECURSION
+	}
+	return batch("delete", ids, func(ids []string) ([]int32, error) {
+		return d.backend.Delete(option, ids)
+	})
+}
+
+func (d *Device) SupportsCommand(cmd PROPERTYKEY) bool {
+	return d.backend.SupportsCommand(cmd)
+}
+
+func (d *Device) Copy(parentId string, id string) error {
+	_, err := d.CopyMany(parentId, []string{id})
+	return err
+}
+
+// CopyMany copies ids into parentId in one request and returns the error of
+// each object.
+func (d *Device) CopyMany(parentId string, ids []string) ([]error, error) {
+	return batch("copy", ids, func(ids []string) ([]int32, error) {
+		return d.backend.Copy(ids, parentId)
+	})
+}
+
+// Move moves the object id into the folder parentId. The object keeps its
+// id.
+func (d *Device) Move(parentId string, id string) error {
+	_, err := d.MoveMany(parentId, []string{id})
+	return err
+}
+
+// MoveMany moves ids into parentId in one request and returns the error of
+// each object.
+func (d *Device) MoveMany(parentId string, ids []string) ([]error, error) {
+	return batch("move", ids, func(ids []string) ([]int32, error) {
+		return d.backend.Move(ids, parentId)
+	})
+}
+
+// batch runs call for all ids at once and decodes the per-object results.
+// If the driver rejects the whole request without reporting which objects
+// failed, the ids are retried one by one.
+func batch(op string, ids []string, call func([]string) ([]int32, error)) ([]error, error) {
+	results := make([]error, len(ids))
+	if len(ids) == 0 {
+		return results, nil
+	}
+	hrs, err := call(ids)
+	if len(hrs) == len(ids) {
+		for i, hr := range hrs {
+			results[i] = hresultError(hr)
+		}
+	} else if err == nil {
+		return results, nil
+	} else if len(ids) == 1 {
+		results[0] = err
+	} else {
+		for i, id := range ids {
+			hrs, err := call([]string{id})
+			if err != nil {
+				results[i] = err
+			} else if len(hrs) == 1 {
+				results[i] = hresultError(hrs[0])
+			}
+		}
+	}
+	n := 0
+	for _, err := range results {
+		if err != nil {
+			n++
+		}
+	}
+	if n == 0 {
+		return results, nil
+	}
+	if len(ids) == 1 {
+		return results, results[0]
+	}
+	return results, fmt.Errorf("Failed to %v %v of %v objects", op, n, len(ids))
+}
+
+func (d *Device) CreateFolder(parentId string, name string) (string, error) {
+	prop := PropertyValues{
+		WPD_OBJECT_PARENT_ID:          parentId,
+		WPD_OBJECT_NAME:               name,
+		WPD_OBJECT_ORIGINAL_FILE_NAME: name,
+		WPD_OBJECT_CONTENT_TYPE:       WPD_CONTENT_TYPE_FOLDER,
+	}
+	var id string
+	attempt := 0
+	err := d.Retry.Do(func() (err error) {
+		if attempt++; attempt > 1 {
+			// the last attempt may have made the folder after all
+			if id = d.findChild(parentId, name, nil); id != "" {
+				return nil
+			}
+		}
+		id, err = d.backend.CreateObjectWithPropertiesOnly(prop)
+		return
+	})
+	return id, err
+}
+
+// findChild returns the id of the child of parentId named fileName, which is
+// a folder, or a file of the size and modification time of obj if obj is not
+// nil. It finds the object of a create whose result was lost, like by a
+// timeout, so the create is not repeated.
+func (d *Device) findChild(parentId string, fileName string, obj *Object) string {
+	objs, _ := d.GetChildObjects(parentId)
+	for _, o := range objs {
+		if o == nil || o.Name != fileName {
+			continue
+		}
+		if obj == nil && o.IsDir || obj != nil && !o.IsDir && o.Size == obj.Size && o.ModTime == obj.ModTime {
+			return o.Id
+		}
+	}
+	return ""
+}
@@ -0,0 +1,238 @@
+package gowpd
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func putFile(t *testing.T, d *Device, parentId string, name string, data string) string {
+	t.Helper()
+	obj := &Object{Name: name, ObjectInfo: ObjectInfo{Size: int64(len(data)), ModTime: time.Now().Unix()}}
+	if _, err := d.CopyObjectToDevice(parentId, strings.NewReader(data), obj); err != nil {
+		t.Fatal(err)
+	}
+	return childId(t, d, parentId, name)
+}
+
+func putFolder(t *testing.T, d *Device, parentId string, name string) string {
+	t.Helper()
+	id, err := d.CreateFolder(parentId, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func childId(t *testing.T, d *Device, parentId string, name string) string {
+	t.Helper()
+	objs, err := d.GetChildObjects(parentId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, o := range objs {
+		if o.Name == name {
+			return o.Id
+		}
+	}
+	return ""
+}
+
+func TestDeleteMany(t *testing.T) {
+	d := NewMemoryDevice()
+	root := putFolder(t, d, WPD_DEVICE_OBJECT_ID, "Storage")
+	a := putFile(t, d, root, "a.txt", "a")
+	dir := putFolder(t, d, root, "dir")
+	putFile(t, d, dir, "b.txt", "b")
+
+	results, err := d.DeleteMany([]string{a, "missing", dir}, false)
+	if err == nil {
+		t.Errorf("expected error")
+	}
+	if results[0] != nil {
+		t.Errorf("a: %v", results[0])
+	}
+	if results[1] != HResult(E_FILE_NOT_FOUND) {
+		t.Errorf("missing: %v", results[1])
+	}
+	if results[2] != HResult(E_DIR_NOT_EMPTY) {
+		t.Errorf("dir: %v", results[2])
+	}
+	if childId(t, d, root, "a.txt") != "" || childId(t, d, root, "dir") == "" {
+		t.Errorf("unexpected contents after delete")
+	}
+
+	results, err = d.DeleteMany([]string{dir}, true)
+	if err != nil || results[0] != nil {
+		t.Errorf("%v %v", err, results)
+	}
+	if ids, _ := d.GetChildIds(root); len(ids) != 0 {
+		t.Errorf("left %v", ids)
+	}
+}
+
+func TestCopyMany(t *testing.T) {
+	d := NewMemoryDevice()
+	root := putFolder(t, d, WPD_DEVICE_OBJECT_ID, "Storage")
+	dst := putFolder(t, d, root, "dst")
+	a := putFile(t, d, root, "a.txt", "aaa")
+	dir := putFolder(t, d, root, "dir")
+	putFile(t, d, dir, "b.txt", "b")
+
+	results, err := d.CopyMany(dst, []string{a, dir, "missing"})
+	if err == nil || results[0] != nil || results[1] != nil || results[2] == nil {
+		t.Errorf("%v %v", err, results)
+	}
+	o, _ := d.GetObject(childId(t, d, dst, "a.txt"))
+	if o == nil || o.Size != 3 {
+		t.Errorf("a.txt not copied: %v", o)
+	}
+	if childId(t, d, childId(t, d, dst, "dir"), "b.txt") == "" {
+		t.Errorf("dir not copied recursively")
+	}
+}
+
+func TestMoveMany(t *testing.T) {
+	d := NewMemoryDevice()
+	if !d.CanMove {
+		t.Errorf("memory device cannot move")
+	}
+	root := putFolder(t, d, WPD_DEVICE_OBJECT_ID, "Storage")
+	dst := putFolder(t, d, root, "dst")
+	a := putFile(t, d, root, "a.txt", "aaa")
+	dir := putFolder(t, d, root, "dir")
+	putFile(t, d, dir, "b.txt", "b")
+
+	results, err := d.MoveMany(dst, []string{a, dir, "missing"})
+	if err == nil || results[0] != nil || results[1] != nil || results[2] == nil {
+		t.Errorf("%v %v", err, results)
+	}
+	if id := childId(t, d, dst, "a.txt"); id != a {
+		t.Errorf("a.txt moved as %v", id)
+	}
+	if childId(t, d, childId(t, d, dst, "dir"), "b.txt") == "" {
+		t.Errorf("dir moved without its contents")
+	}
+	if ids, _ := d.GetChildIds(root); len(ids) != 1 {
+		t.Errorf("left %v", ids)
+	}
+	if err = d.Move(dir, dst); err == nil {
+		t.Errorf("folder moved into itself")
+	}
+}
+
+// singleBackend rejects requests for more than one object without reporting
+// per-object results, like some MTP drivers.
+type singleBackend struct {
+	*MemoryBackend
+	calls int
+}
+
+func (b *singleBackend) Delete(option int, ids []string) ([]int32, error) {
+	b.calls++
+	if len(ids) > 1 {
+		return nil, HResult(E_NOTIMPL)
+	}
+	return b.MemoryBackend.Delete(option, ids)
+}
+
+func TestDeleteManyFallback(t *testing.T) {
+	b := &singleBackend{MemoryBackend: NewMemoryBackend()}
+	d := NewDevice(b)
+	root := putFolder(t, d, WPD_DEVICE_OBJECT_ID, "Storage")
+	a := putFile(t, d, root, "a.txt", "a")
+	c := putFile(t, d, root, "c.txt", "c")
+
+	results, err := d.DeleteMany([]string{a, "missing", c}, false)
+	if b.calls != 4 {
+		t.Errorf("calls = %v", b.calls)
+	}
+	if err == nil || results[0] != nil || results[1] == nil || results[2] != nil {
+		t.Errorf("%v %v", err, results)
+	}
+	if ids, _ := d.GetChildIds(root); len(ids) != 0 {
+		t.Errorf("left %v", ids)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	ids := []string{"a", "b"}
+	tests := []struct {
+		name  string
+		hrs   []int32
+		err   error
+		fails []bool
+	}{
+		{"all ok", []int32{S_OK, S_OK}, nil, []bool{false, false}},
+		{"partial", []int32{S_OK, E_FAIL}, nil, []bool{false, true}},
+		{"no results", nil, nil, []bool{false, false}},
+		{"results with error", []int32{E_FAIL, S_OK}, HResult(E_FAIL), []bool{true, false}},
+	}
+	for _, tt := range tests {
+		results, err := batch("test", ids, func(ids []string) ([]int32, error) {
+			return tt.hrs, tt.err
+		})
+		failed := false
+		for i, r := range results {
+			if (r != nil) != tt.fails[i] {
+				t.Errorf("%v: result %v = %v", tt.name, i, r)
+			}
+			failed = failed || r != nil
+		}
+		if (err != nil) != failed {
+			t.Errorf("%v: err = %v", tt.name, err)
+		}
+	}
+}
+
+func TestGetChildObjectsError(t *testing.T) {
+	b := NewMemoryBackend()
+	d := NewDevice(b)
+	root := putFolder(t, d, WPD_DEVICE_OBJECT_ID, "Storage")
+	a := putFile(t, d, root, "a.txt", "a")
+	putFile(t, d, root, "b.txt", "b")
+	b.Fault = func(op string, ids []string) error {
+		if op == "GetValues" && ids[0] == a {
+			return HResult(E_ACCESSDENIED)
+		}
+		return nil
+	}
+	objs, err := d.GetChildObjects(root)
+	if err != HResult(E_ACCESSDENIED) {
+		t.Errorf("err = %v", err)
+	}
+	if len(objs) != 2 || objs[0] != nil || objs[1] == nil || objs[1].Name != "b.txt" {
+		t.Errorf("objects = %v", objs)
+	}
+}
+
+func TestUploadAbort(t *testing.T) {
+	b := NewMemoryBackend()
+	d := NewDevice(b)
+	root := putFolder(t, d, WPD_DEVICE_OBJECT_ID, "Storage")
+	id := putFile(t, d, root, "a.txt", "a")
+	b.Fault = func(op string, ids []string) error {
+		if op == "Write" {
+			return HResult(E_ACCESSDENIED)
+		}
+		return nil
+	}
+	obj := &Object{Name: "b.txt", ObjectInfo: ObjectInfo{Size: 1}}
+	if _, err := d.CopyObjectToDevice(root, strings.NewReader("b"), obj); err != HResult(E_ACCESSDENIED) {
+		t.Errorf("upload: %v", err)
+	}
+	if childId(t, d, root, "b.txt") != "" {
+		t.Errorf("failed upload committed")
+	}
+	res := &Resource{Key: WPD_RESOURCE_ALBUM_ART, Size: 3}
+	if err := d.CreateResource(id, strings.NewReader("art"), res); err != HResult(E_ACCESSDENIED) {
+		t.Errorf("resource: %v", err)
+	}
+	b.Fault = nil
+	if err := d.CreateResource(id, strings.NewReader("ar"), res); err == nil {
+		t.Errorf("short resource: expected error")
+	}
+	if b.writers != 0 {
+		t.Errorf("%v writers not aborted", b.writers)
+	}
+}
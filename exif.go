@@ -0,0 +1,133 @@
+package gowpd
+
+import (
+	"encoding/binary"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	exifImageWidth       = 0x0100
+	exifImageHeight      = 0x0101
+	exifIFDPointer       = 0x8769
+	exifDateTimeOriginal = 0x9003
+	exifPixelXDimension  = 0xA002
+	exifPixelYDimension  = 0xA003
+)
+
+// readJPEG reads the frame size and EXIF data of a JPEG file.
+func readJPEG(r io.ReaderAt, size int64) (*Metadata, error) {
+	m := &Metadata{}
+	off := int64(2)
+	for off+4 <= size {
+		header, err := readSection(r, off, 4)
+		if err != nil {
+			return nil, err
+		}
+		if header[0] != 0xFF {
+			break
+		}
+		marker := header[1]
+		n := int64(binary.BigEndian.Uint16(header[2:]))
+		if marker == 0xD9 || marker == 0xDA || n < 2 {
+			// end of image or start of scan
+			break
+		}
+		switch {
+		case marker == 0xE1:
+			b, err := readSection(r, off+4, n-2)
+			if err != nil {
+				return nil, err
+			}
+			if strings.HasPrefix(string(b), "Exif\x00\x00") {
+				readExif(b[6:], m)
+			}
+		case marker >= 0xC0 && marker <= 0xCF && marker != 0xC4 && marker != 0xC8 && marker != 0xCC:
+			// start of frame: precision, height, width
+			b, err := readSection(r, off+4, 5)
+			if err != nil {
+				return nil, err
+			}
+			m.Height = int(binary.BigEndian.Uint16(b[1:]))
+			m.Width = int(binary.BigEndian.Uint16(b[3:]))
+			return m, nil
+		}
+		off += 2 + n
+	}
+	return m, nil
+}
+
+// readExif reads the TIFF structure of EXIF data into m.
+func readExif(b []byte, m *Metadata) {
+	if len(b) < 8 {
+		return
+	}
+	var order binary.ByteOrder
+	switch string(b[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return
+	}
+	var width, height int
+	var visit func(off uint32, depth int)
+	visit = func(off uint32, depth int) {
+		if depth > 2 || int64(off)+2 > int64(len(b)) {
+			return
+		}
+		count := int(order.Uint16(b[off:]))
+		for i := 0; i < count; i++ {
+			e := int(off) + 2 + 12*i
+			if e+12 > len(b) {
+				return
+			}
+			tag := order.Uint16(b[e:])
+			typ := order.Uint16(b[e+2:])
+			n := order.Uint32(b[e+4:])
+			value := func() uint32 {
+				if typ == 3 {
+					return uint32(order.Uint16(b[e+8:]))
+				}
+				return order.Uint32(b[e+8:])
+			}
+			switch tag {
+			case exifImageWidth, exifPixelXDimension:
+				width = int(value())
+			case exifImageHeight, exifPixelYDimension:
+				height = int(value())
+			case exifIFDPointer:
+				visit(value(), depth+1)
+			case exifDateTimeOriginal:
+				start := order.Uint32(b[e+8:])
+				if typ == 2 && n >= 19 && int64(start)+19 <= int64(len(b)) {
+					t, err := time.ParseInLocation("2006:01:02 15:04:05", string(b[start:start+19]), time.Local)
+					if err == nil {
+						m.DateTaken = t
+					}
+				}
+			}
+		}
+	}
+	visit(order.Uint32(b[4:]), 0)
+	if width > 0 && height > 0 {
+		m.Width, m.Height = width, height
+	}
+}
+
+// readPNG reads the image size of a PNG file.
+func readPNG(r io.ReaderAt, size int64) (*Metadata, error) {
+	b, err := readSection(r, 8, 16)
+	if err != nil {
+		return nil, err
+	}
+	if string(b[4:8]) != "IHDR" {
+		return nil, nil
+	}
+	return &Metadata{
+		Width:  int(binary.BigEndian.Uint32(b[8:])),
+		Height: int(binary.BigEndian.Uint32(b[12:])),
+	}, nil
+}
@@ -0,0 +1,95 @@
+package gowpd
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	PathSeparator = string(os.PathSeparator)
+)
+
+type BufReadCloser struct {
+	reader *bufio.Reader
+	closer io.Closer
+}
+
+func NewBufReadCloser(s io.ReadCloser, size int) *BufReadCloser {
+	if size <= 0 {
+		return &BufReadCloser{bufio.NewReader(s), s}
+	}
+	return &BufReadCloser{bufio.NewReaderSize(s, size), s}
+}
+
+func (o *BufReadCloser) Read(buf []byte) (int, error) {
+	return o.reader.Read(buf)
+}
+
+func (o *BufReadCloser) Close() error {
+	return o.closer.Close()
+}
+
+// fileReader is a buffered file that can also be read at any offset without
+// disturbing the buffer.
+type fileReader struct {
+	*BufReadCloser
+	io.ReaderAt
+	file io.ReadSeeker
+}
+
+// Seek sets the offset of the next Read, dropping the buffer.
+func (o *fileReader) Seek(offset int64, whence int) (int64, error) {
+	if whence == io.SeekCurrent {
+		offset -= int64(o.reader.Buffered())
+	}
+	pos, err := o.file.Seek(offset, whence)
+	if err == nil {
+		o.reader.Reset(o.file)
+	}
+	return pos, err
+}
+
+type BufWriteCloser struct {
+	writer *bufio.Writer
+	closer io.Closer
+}
+
+func NewBufWriteCloser(s io.WriteCloser, size int) *BufWriteCloser {
+	if size <= 0 {
+		return &BufWriteCloser{bufio.NewWriter(s), s}
+	}
+	return &BufWriteCloser{bufio.NewWriterSize(s, size), s}
+}
+
+func (o *BufWriteCloser) Write(buf []byte) (int, error) {
+	return o.writer.Write(buf)
+}
+func (o *BufWriteCloser) Close() error {
+	o.writer.Flush()
+	return o.closer.Close()
+}
+
+func ObjectFromFileInfo(path string, info os.FileInfo) *Object {
+	var o Object
+	o.Name = info.Name()
+	o.Size = info.Size()
+	o.ModTime = info.ModTime().Unix()
+	o.IsDir = info.IsDir()
+	o.Id = path
+	return &o
+}
+
+func SetFileTime(path string, t int64) error {
+	tm := time.Unix(t, 0)
+	return os.Chtimes(path, tm, tm)
+}
+
+func CleanPath(path string) string {
+	if "/" != PathSeparator {
+		path = strings.ReplaceAll(path, "/", PathSeparator)
+	}
+	return strings.TrimRight(path, PathSeparator)
+}
@@ -0,0 +1,104 @@
+package gowpd
+
+import (
+	"encoding/binary"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	flacStreamInfo    = 0
+	flacVorbisComment = 4
+)
+
+// readFLAC reads the stream info and Vorbis comments of a FLAC file.
+func readFLAC(r io.ReaderAt, size int64) (*Metadata, error) {
+	m := &Metadata{}
+	off := int64(4)
+	for off+4 <= size {
+		header, err := readSection(r, off, 4)
+		if err != nil {
+			return nil, err
+		}
+		last := header[0]&0x80 != 0
+		n := int64(header[1])<<16 | int64(header[2])<<8 | int64(header[3])
+		off += 4
+		switch header[0] & 0x7F {
+		case flacStreamInfo:
+			b, err := readSection(r, off, n)
+			if err != nil {
+				return nil, err
+			}
+			if len(b) >= 18 {
+				// 20 bits sample rate, 3 channels, 5 bits per sample,
+				// 36 total samples
+				v := binary.BigEndian.Uint64(b[10:18])
+				rate := v >> 44
+				samples := v & (1<<36 - 1)
+				if rate > 0 {
+					m.Duration = time.Duration(samples) * time.Second / time.Duration(rate)
+				}
+			}
+		case flacVorbisComment:
+			b, err := readSection(r, off, n)
+			if err != nil {
+				return nil, err
+			}
+			readVorbisComment(b, m)
+		}
+		off += n
+		if last {
+			break
+		}
+	}
+	return m, nil
+}
+
+// readVorbisComment reads the fields of a Vorbis comment block into m.
+func readVorbisComment(b []byte, m *Metadata) {
+	next := func() (string, bool) {
+		if len(b) < 4 {
+			return "", false
+		}
+		size := binary.LittleEndian.Uint32(b)
+		if int64(size) > int64(len(b)-4) {
+			return "", false
+		}
+		n := int(size)
+		s := string(b[4 : 4+n])
+		b = b[4+n:]
+		return s, true
+	}
+	if _, ok := next(); !ok {
+		return
+	}
+	if len(b) < 4 {
+		return
+	}
+	count := int(binary.LittleEndian.Uint32(b))
+	b = b[4:]
+	for i := 0; i < count; i++ {
+		c, ok := next()
+		if !ok {
+			return
+		}
+		eq := strings.IndexByte(c, '=')
+		if eq < 0 {
+			continue
+		}
+		value := c[eq+1:]
+		switch strings.ToUpper(c[:eq]) {
+		case "TITLE":
+			m.Title = value
+		case "ARTIST":
+			m.Artist = value
+		case "ALBUM":
+			m.Album = value
+		case "GENRE":
+			m.Genre = value
+		case "TRACKNUMBER":
+			m.Track = leadingInt(value)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package gowpd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// MTP object format codes. The WPD format GUID of a code is FormatGUID(code).
+const (
+	MTP_FORMAT_UNDEFINED = 0x3000
+	MTP_FORMAT_TEXT      = 0x3004
+	MTP_FORMAT_HTML      = 0x3005
+	MTP_FORMAT_WAVE      = 0x3008
+	MTP_FORMAT_MP3       = 0x3009
+	MTP_FORMAT_AVI       = 0x300A
+	MTP_FORMAT_MPEG      = 0x300B
+	MTP_FORMAT_ASF       = 0x300C
+	MTP_FORMAT_EXIF_JPEG = 0x3801
+	MTP_FORMAT_BMP       = 0x3804
+	MTP_FORMAT_GIF       = 0x3807
+	MTP_FORMAT_PNG       = 0x380B
+	MTP_FORMAT_TIFF      = 0x380D
+	MTP_FORMAT_HEIF      = 0x3812 // as used by Android
+	MTP_FORMAT_WMA       = 0xB901
+	MTP_FORMAT_OGG       = 0xB902
+	MTP_FORMAT_AAC       = 0xB903
+	MTP_FORMAT_FLAC      = 0xB906
+	MTP_FORMAT_WMV       = 0xB981
+	MTP_FORMAT_MP4       = 0xB982
+	MTP_FORMAT_3GP       = 0xB984
+)
+
+var (
+	WPD_OBJECT_FORMAT = PROPERTYKEY{GUID{0xEF6B490D, 0x5CD8, 0x437A, [8]byte{0xAF, 0xFC, 0xDA, 0x8B, 0x60, 0xEE, 0x4A, 0x3C}}, 6}
+
+	WPD_OBJECT_FORMAT_UNSPECIFIED = FormatGUID(MTP_FORMAT_UNDEFINED)
+
+	WPD_CONTENT_TYPE_IMAGE        = GUID{0xEF2107D5, 0xA52A, 0x4243, [8]byte{0xA2, 0x6B, 0x62, 0xD4, 0x17, 0x6D, 0x76, 0x03}}
+	WPD_CONTENT_TYPE_VIDEO        = GUID{0x9261B03C, 0x3D78, 0x4519, [8]byte{0x85, 0xE3, 0x02, 0xC5, 0xE1, 0xF5, 0x0B, 0xB9}}
+	WPD_CONTENT_TYPE_AUDIO        = GUID{0x4AD2C85E, 0x5E2D, 0x45E5, [8]byte{0x88, 0x64, 0x4F, 0x22, 0x9E, 0x3C, 0x6C, 0xF0}}
+	WPD_CONTENT_TYPE_DOCUMENT     = GUID{0x680ADF52, 0x950A, 0x4041, [8]byte{0x9B, 0x41, 0x65, 0xE3, 0x93, 0x64, 0x81, 0x55}}
+	WPD_CONTENT_TYPE_GENERIC_FILE = GUID{0x0085E0A6, 0x8D34, 0x45D7, [8]byte{0xBC, 0x5C, 0x44, 0x7E, 0x59, 0xC7, 0x3D, 0x48}}
+)
+
+// FormatGUID returns the WPD format GUID of an MTP format code.
+func FormatGUID(code uint16) GUID {
+	return GUID{uint32(code) << 16, 0xAE6C, 0x4804, [8]byte{0x98, 0xBA, 0xC5, 0x7B, 0x46, 0x96, 0x5F, 0xE7}}
+}
+
+// FileType is the format and content type of an object.
+type FileType struct {
+	Format      GUID
+	ContentType GUID
+}
+
+func fileType(code uint16, contentType GUID) FileType {
+	return FileType{FormatGUID(code), contentType}
+}
+
+var (
+	typeGeneric = fileType(MTP_FORMAT_UNDEFINED, WPD_CONTENT_TYPE_GENERIC_FILE)
+
+	typesByExt = map[string]FileType{
+		".jpg":  fileType(MTP_FORMAT_EXIF_JPEG, WPD_CONTENT_TYPE_IMAGE),
+		".jpeg": fileType(MTP_FORMAT_EXIF_JPEG, WPD_CONTENT_TYPE_IMAGE),
+		".png":  fileType(MTP_FORMAT_PNG, WPD_CONTENT_TYPE_IMAGE),
+		".gif":  fileType(MTP_FORMAT_GIF, WPD_CONTENT_TYPE_IMAGE),
+		".bmp":  fileType(MTP_FORMAT_BMP, WPD_CONTENT_TYPE_IMAGE),
+		".tif":  fileType(MTP_FORMAT_TIFF, WPD_CONTENT_TYPE_IMAGE),
+		".tiff": fileType(MTP_FORMAT_TIFF, WPD_CONTENT_TYPE_IMAGE),
+		".heic": fileType(MTP_FORMAT_HEIF, WPD_CONTENT_TYPE_IMAGE),
+		".heif": fileType(MTP_FORMAT_HEIF, WPD_CONTENT_TYPE_IMAGE),
+		".mp3":  fileType(MTP_FORMAT_MP3, WPD_CONTENT_TYPE_AUDIO),
+		".wav":  fileType(MTP_FORMAT_WAVE, WPD_CONTENT_TYPE_AUDIO),
+		".flac": fileType(MTP_FORMAT_FLAC, WPD_CONTENT_TYPE_AUDIO),
+		".aac":  fileType(MTP_FORMAT_AAC, WPD_CONTENT_TYPE_AUDIO),
+		".m4a":  fileType(MTP_FORMAT_MP4, WPD_CONTENT_TYPE_AUDIO),
+		".ogg":  fileType(MTP_FORMAT_OGG, WPD_CONTENT_TYPE_AUDIO),
+		".oga":  fileType(MTP_FORMAT_OGG, WPD_CONTENT_TYPE_AUDIO),
+		".wma":  fileType(MTP_FORMAT_WMA, WPD_CONTENT_TYPE_AUDIO),
+		".mp4":  fileType(MTP_FORMAT_MP4, WPD_CONTENT_TYPE_VIDEO),
+		".m4v":  fileType(MTP_FORMAT_MP4, WPD_CONTENT_TYPE_VIDEO),
+		".mov":  fileType(MTP_FORMAT_MP4, WPD_CONTENT_TYPE_VIDEO),
+		".3gp":  fileType(MTP_FORMAT_3GP, WPD_CONTENT_TYPE_VIDEO),
+		".avi":  fileType(MTP_FORMAT_AVI, WPD_CONTENT_TYPE_VIDEO),
+		".mpg":  fileType(MTP_FORMAT_MPEG, WPD_CONTENT_TYPE_VIDEO),
+		".mpeg": fileType(MTP_FORMAT_MPEG, WPD_CONTENT_TYPE_VIDEO),
+		".wmv":  fileType(MTP_FORMAT_WMV, WPD_CONTENT_TYPE_VIDEO),
+		".asf":  fileType(MTP_FORMAT_ASF, WPD_CONTENT_TYPE_VIDEO),
+		".txt":  fileType(MTP_FORMAT_TEXT, WPD_CONTENT_TYPE_DOCUMENT),
+		".csv":  fileType(MTP_FORMAT_TEXT, WPD_CONTENT_TYPE_DOCUMENT),
+		".htm":  fileType(MTP_FORMAT_HTML, WPD_CONTENT_TYPE_DOCUMENT),
+		".html": fileType(MTP_FORMAT_HTML, WPD_CONTENT_TYPE_DOCUMENT),
+		".pdf":  fileType(MTP_FORMAT_UNDEFINED, WPD_CONTENT_TYPE_DOCUMENT),
+		".doc":  fileType(MTP_FORMAT_UNDEFINED, WPD_CONTENT_TYPE_DOCUMENT),
+		".docx": fileType(MTP_FORMAT_UNDEFINED, WPD_CONTENT_TYPE_DOCUMENT),
+		".epub": fileType(MTP_FORMAT_UNDEFINED, WPD_CONTENT_TYPE_DOCUMENT),
+	}
+)
+
+// TypeByExtension returns the type of a file by the extension of its name.
+func TypeByExtension(name string) (FileType, bool) {
+	t, ok := typesByExt[strings.ToLower(filepath.Ext(name))]
+	return t, ok
+}
+
+// TypeByContent returns the type of a file by its first bytes.
+func TypeByContent(head []byte) (FileType, bool) {
+	if t, ok := typeByMagic(head); ok {
+		return t, true
+	}
+	return typeByFrame(head)
+}
+
+func typeByMagic(head []byte) (FileType, bool) {
+	has := func(off int, magic string) bool {
+		return len(head) >= off+len(magic) && string(head[off:off+len(magic)]) == magic
+	}
+	switch {
+	case has(0, "\xFF\xD8\xFF"):
+		return typesByExt[".jpg"], true
+	case has(0, "\x89PNG\r\n\x1A\n"):
+		return typesByExt[".png"], true
+	case has(0, "GIF87a"), has(0, "GIF89a"):
+		return typesByExt[".gif"], true
+	case has(0, "II*\x00"), has(0, "MM\x00*"):
+		return typesByExt[".tif"], true
+	case has(0, "RIFF") && has(8, "WAVE"):
+		return typesByExt[".wav"], true
+	case has(0, "RIFF") && has(8, "AVI "):
+		return typesByExt[".avi"], true
+	case has(0, "fLaC"):
+		return typesByExt[".flac"], true
+	case has(0, "OggS"):
+		return typesByExt[".ogg"], true
+	case has(0, "ID3"):
+		return typesByExt[".mp3"], true
+	case has(0, "%PDF-"):
+		return typesByExt[".pdf"], true
+	case has(4, "ftyp"):
+		return isoType(head), true
+	}
+	return FileType{}, false
+}
+
+// typeByFrame recognises the short signatures of bitmaps and audio frames,
+// which text and other data may start with as well. The fields following
+// them are checked too.
+func typeByFrame(head []byte) (FileType, bool) {
+	switch {
+	case len(head) >= 18 && head[0] == 'B' && head[1] == 'M' &&
+		binary.LittleEndian.Uint32(head[6:]) == 0 && bmpHeaderSize(binary.LittleEndian.Uint32(head[14:])):
+		return typesByExt[".bmp"], true
+	case len(head) >= 3 && head[0] == 0xFF && head[1]&0xF6 == 0xF0 && head[2]>>2&0xF < 13:
+		// ADTS, layer 0, known sampling rate
+		return typesByExt[".aac"], true
+	case len(head) >= 3 && head[0] == 0xFF && head[1]&0xE6 == 0xE2 && head[1]&0x18 != 0x08 &&
+		head[2]>>4 != 0xF && head[2]&0x0C != 0x0C:
+		// MPEG audio layer III, known version, bitrate and sampling rate
+		return typesByExt[".mp3"], true
+	}
+	return FileType{}, false
+}
+
+// bmpHeaderSize reports whether n is the size of a known bitmap info header.
+func bmpHeaderSize(n uint32) bool {
+	switch n {
+	case 12, 40, 52, 56, 64, 108, 124:
+		return true
+	}
+	return false
+}
+
+// isoType returns the type of an ISO base media file by its major brand.
+func isoType(head []byte) FileType {
+	if len(head) < 12 {
+		return typesByExt[".mp4"]
+	}
+	brand := string(head[8:12])
+	switch {
+	case brand == "heic" || brand == "heix" || brand == "mif1" || brand == "msf1" || brand == "hevc":
+		return typesByExt[".heic"]
+	case brand == "M4A " || brand == "M4B ":
+		return typesByExt[".m4a"]
+	case strings.HasPrefix(brand, "3gp"):
+		return typesByExt[".3gp"]
+	}
+	return typesByExt[".mp4"]
+}
+
+// DetectType returns the type of a file by its first bytes, or by the
+// extension of its name if the content is not recognised. The short
+// signatures of bitmaps and MP3 or AAC frames are only trusted for names of
+// unknown extension. Unknown files are generic files of unspecified format.
+func DetectType(name string, head []byte) FileType {
+	e, known := TypeByExtension(name)
+	if t, ok := typeByMagic(head); ok {
+		// the content tells MP4 audio from video only by brand
+		if known && e.Format == t.Format {
+			return e
+		}
+		return t
+	}
+	if known {
+		return e
+	}
+	if t, ok := typeByFrame(head); ok {
+		return t
+	}
+	return typeGeneric
+}
+
+const sniffLength = 64
+
+// WithFileType sets the format and content type of uploaded objects instead
+// of detecting them.
+func WithFileType(t FileType) CopyOption {
+	return func(o *copyOptions) {
+		o.fileType = &t
+	}
+}
+
+// detectType returns the type of the file name read from src and a reader
+// returning the whole content of src.
+func (o *copyOptions) detectType(name string, src io.Reader) (FileType, io.Reader) {
+	if o.fileType != nil {
+		return *o.fileType, src
+	}
+	r := bufio.NewReaderSize(src, sniffLength)
+	head, _ := r.Peek(sniffLength)
+	return DetectType(name, head), r
+}
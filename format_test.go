@@ -0,0 +1,97 @@
+package gowpd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFormatGUID(t *testing.T) {
+	if s := FormatGUID(MTP_FORMAT_MP4).String(); s != "b9820000-ae6c-4804-98ba-c57b46965fe7" {
+		t.Errorf("mp4 = %v", s)
+	}
+	if s := WPD_OBJECT_FORMAT_UNSPECIFIED.String(); s != "30000000-ae6c-4804-98ba-c57b46965fe7" {
+		t.Errorf("unspecified = %v", s)
+	}
+}
+
+func TestDetectType(t *testing.T) {
+	ftyp := func(brand string) string {
+		return "\x00\x00\x00\x18ftyp" + brand + "\x00\x00\x00\x00"
+	}
+	tests := []struct {
+		name        string
+		head        string
+		format      uint16
+		contentType GUID
+	}{
+		{"a.jpg", "", MTP_FORMAT_EXIF_JPEG, WPD_CONTENT_TYPE_IMAGE},
+		{"A.JPEG", "", MTP_FORMAT_EXIF_JPEG, WPD_CONTENT_TYPE_IMAGE},
+		{"photo", "\xFF\xD8\xFF\xE1\x00\x10Exif", MTP_FORMAT_EXIF_JPEG, WPD_CONTENT_TYPE_IMAGE},
+		{"wrong.txt", "\x89PNG\r\n\x1A\n\x00\x00", MTP_FORMAT_PNG, WPD_CONTENT_TYPE_IMAGE},
+		{"anim.dat", "GIF89a", MTP_FORMAT_GIF, WPD_CONTENT_TYPE_IMAGE},
+		{"scan", "II*\x00", MTP_FORMAT_TIFF, WPD_CONTENT_TYPE_IMAGE},
+		{"IMG_1.HEIC", ftyp("heic"), MTP_FORMAT_HEIF, WPD_CONTENT_TYPE_IMAGE},
+		{"x", ftyp("mif1"), MTP_FORMAT_HEIF, WPD_CONTENT_TYPE_IMAGE},
+		{"clip", ftyp("isom"), MTP_FORMAT_MP4, WPD_CONTENT_TYPE_VIDEO},
+		{"song.m4a", ftyp("isom"), MTP_FORMAT_MP4, WPD_CONTENT_TYPE_AUDIO},
+		{"song", ftyp("M4A "), MTP_FORMAT_MP4, WPD_CONTENT_TYPE_AUDIO},
+		{"call", ftyp("3gp4"), MTP_FORMAT_3GP, WPD_CONTENT_TYPE_VIDEO},
+		{"a.mp3", "", MTP_FORMAT_MP3, WPD_CONTENT_TYPE_AUDIO},
+		{"tagged", "ID3\x04\x00", MTP_FORMAT_MP3, WPD_CONTENT_TYPE_AUDIO},
+		{"raw", "\xFF\xFB\x90\x64", MTP_FORMAT_MP3, WPD_CONTENT_TYPE_AUDIO},
+		{"adts", "\xFF\xF1\x50\x80", MTP_FORMAT_AAC, WPD_CONTENT_TYPE_AUDIO},
+		{"lossless", "fLaC\x00\x00\x00\x22", MTP_FORMAT_FLAC, WPD_CONTENT_TYPE_AUDIO},
+		{"a.ogg", "OggS", MTP_FORMAT_OGG, WPD_CONTENT_TYPE_AUDIO},
+		{"a.wav", "RIFF\x24\x00\x00\x00WAVEfmt ", MTP_FORMAT_WAVE, WPD_CONTENT_TYPE_AUDIO},
+		{"a", "RIFF\x24\x00\x00\x00AVI LIST", MTP_FORMAT_AVI, WPD_CONTENT_TYPE_VIDEO},
+		{"paper", "%PDF-1.7", MTP_FORMAT_UNDEFINED, WPD_CONTENT_TYPE_DOCUMENT},
+		{"notes.TXT", "hello", MTP_FORMAT_TEXT, WPD_CONTENT_TYPE_DOCUMENT},
+		{"image", "BM\x36\x00\x0C\x00\x00\x00\x00\x00\x36\x00\x00\x00\x28\x00\x00\x00", MTP_FORMAT_BMP, WPD_CONTENT_TYPE_IMAGE},
+		// short signatures do not override a known extension
+		{"minutes.txt", "BM\x36\x00\x0C\x00\x00\x00\x00\x00\x36\x00\x00\x00\x28\x00\x00\x00", MTP_FORMAT_TEXT, WPD_CONTENT_TYPE_DOCUMENT},
+		{"cars.csv", "BMW,320i,2019\nAudi,A4,2020\n", MTP_FORMAT_TEXT, WPD_CONTENT_TYPE_DOCUMENT},
+		{"voice.aac", "\xFF\xFB\x90\x64", MTP_FORMAT_AAC, WPD_CONTENT_TYPE_AUDIO},
+		{"b.txt", "\xFF\xF1\x50\x80", MTP_FORMAT_TEXT, WPD_CONTENT_TYPE_DOCUMENT},
+		// nor are they trusted without the fields following them
+		{"data.bin", "BMW,320i,2019\nAudi,A4,2020\n", MTP_FORMAT_UNDEFINED, WPD_CONTENT_TYPE_GENERIC_FILE},
+		{"data.bin", "\xFF\xFB\xF0\x00", MTP_FORMAT_UNDEFINED, WPD_CONTENT_TYPE_GENERIC_FILE},
+		{"data.bin", "\xFF\xF1\xFC\x00", MTP_FORMAT_UNDEFINED, WPD_CONTENT_TYPE_GENERIC_FILE},
+		{"archive.tar.gz", "\x1F\x8B\x08", MTP_FORMAT_UNDEFINED, WPD_CONTENT_TYPE_GENERIC_FILE},
+		{".nomedia", "", MTP_FORMAT_UNDEFINED, WPD_CONTENT_TYPE_GENERIC_FILE},
+	}
+	for _, tt := range tests {
+		got := DetectType(tt.name, []byte(tt.head))
+		if got.Format != FormatGUID(tt.format) || got.ContentType != tt.contentType {
+			t.Errorf("%q: %v %v", tt.name, got.Format, got.ContentType)
+		}
+	}
+}
+
+func TestUploadType(t *testing.T) {
+	b := NewMemoryBackend()
+	d := NewDevice(b)
+	root := putFolder(t, d, WPD_DEVICE_OBJECT_ID, "Storage")
+	data := "\x89PNG\r\n\x1A\n" + testData(100)
+	obj := &Object{Name: "image", ObjectInfo: ObjectInfo{Size: int64(len(data))}}
+	if _, err := d.CopyObjectToDevice(root, strings.NewReader(data), obj, WithAtomic()); err != nil {
+		t.Fatal(err)
+	}
+	o, _ := d.GetObject(childId(t, d, root, "image"))
+	if o.Format != FormatGUID(MTP_FORMAT_PNG) || o.ContentType != WPD_CONTENT_TYPE_IMAGE {
+		t.Errorf("object = %+v", o)
+	}
+	got := make([]byte, len(data))
+	if _, err := d.ReadAt(o.Id, got, 0); err != nil || string(got) != data {
+		t.Errorf("content differs: %v", err)
+	}
+
+	voice := FileType{FormatGUID(MTP_FORMAT_AAC), WPD_CONTENT_TYPE_AUDIO}
+	obj = &Object{Name: "memo.bin", ObjectInfo: ObjectInfo{Size: 3}}
+	if _, err := d.CopyObjectToDevice(root, strings.NewReader("abc"), obj, WithFileType(voice)); err != nil {
+		t.Fatal(err)
+	}
+	o, _ = d.GetObject(childId(t, d, root, "memo.bin"))
+	if o.Format != voice.Format || o.ContentType != voice.ContentType {
+		t.Errorf("object = %+v", o)
+	}
+}
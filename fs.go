@@ -0,0 +1,114 @@
+// +build go1.16
+
+package gowpd
+
+import (
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+)
+
+// FS returns the tree below the folder rootId as an fs.FS. Files are opened
+// as *ObjectFile.
+func (d *Device) FS(rootId string) fs.FS {
+	return &deviceFS{d, rootId}
+}
+
+type deviceFS struct {
+	d      *Device
+	rootId string
+}
+
+func (fsys *deviceFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	obj, err := fsys.d.GetObject(fsys.rootId)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	if name == "." {
+		root := *obj
+		root.Name = "."
+		return &ObjectFile{d: fsys.d, obj: &root}, nil
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if !obj.IsDir {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		objs, err := fsys.d.GetChildObjects(obj.Id)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		obj = nil
+		for _, o := range objs {
+			if o != nil && o.Name == elem {
+				obj = o
+				break
+			}
+		}
+		if obj == nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+	}
+	return &ObjectFile{d: fsys.d, obj: obj}, nil
+}
+
+// ReadDir lists a folder opened by FS. Objects of the same name as an
+// earlier one are left out.
+func (f *ObjectFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !f.obj.IsDir {
+		return nil, &fs.PathError{Op: "readdir", Path: f.obj.Name, Err: fs.ErrInvalid}
+	}
+	if !f.listed {
+		objs, err := f.d.GetChildObjects(f.obj.Id)
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: f.obj.Name, Err: err}
+		}
+		names := make(map[string]bool)
+		for _, o := range objs {
+			if o != nil && !names[o.Name] && fs.ValidPath(o.Name) && !strings.Contains(o.Name, "/") {
+				names[o.Name] = true
+				f.children = append(f.children, o)
+			}
+		}
+		sort.Slice(f.children, func(i, j int) bool {
+			return f.children[i].Name < f.children[j].Name
+		})
+		f.listed = true
+	}
+	objs := f.children
+	if n > 0 && len(objs) > n {
+		objs = objs[:n]
+	}
+	f.children = f.children[len(objs):]
+	entries := make([]fs.DirEntry, len(objs))
+	for i, o := range objs {
+		entries[i] = dirEntry{objectFileInfo{o}}
+	}
+	if n > 0 && len(entries) == 0 {
+		return entries, io.EOF
+	}
+	return entries, nil
+}
+
+type dirEntry struct {
+	info objectFileInfo
+}
+
+func (e dirEntry) Name() string {
+	return e.info.Name()
+}
+
+func (e dirEntry) IsDir() bool {
+	return e.info.IsDir()
+}
+
+func (e dirEntry) Type() fs.FileMode {
+	return e.info.Mode().Type()
+}
+
+func (e dirEntry) Info() (fs.FileInfo, error) {
+	return e.info, nil
+}
@@ -0,0 +1,37 @@
+// +build go1.16
+
+package gowpd
+
+import (
+	"io/fs"
+	"testing"
+	"testing/fstest"
+)
+
+func TestFS(t *testing.T) {
+	d := NewMemoryDevice()
+	root := putFolder(t, d, WPD_DEVICE_OBJECT_ID, "Storage")
+	putFile(t, d, root, "a.txt", "aaa")
+	dir := putFolder(t, d, root, "DCIM")
+	putFile(t, d, dir, "b.jpg", testData(100000))
+	putFolder(t, d, dir, "empty")
+
+	fsys := d.FS(root)
+	if err := fstest.TestFS(fsys, "a.txt", "DCIM/b.jpg", "DCIM/empty"); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fsys.Open("DCIM/b.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := f.(*ObjectFile); !ok {
+		t.Errorf("file is %T", f)
+	}
+	f.Close()
+	if _, err := fsys.Open("DCIM/missing"); err == nil {
+		t.Errorf("opened missing file")
+	}
+	if data, err := fs.ReadFile(fsys, "a.txt"); err != nil || string(data) != "aaa" {
+		t.Errorf("ReadFile = %q %v", data, err)
+	}
+}
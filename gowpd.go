@@ -4,39 +4,17 @@ package gowpd
 
 import (
 	"io"
-	"os"
+	"runtime"
 	"strings"
+	"syscall"
+	"time"
+	"unsafe"
 )
 
 var (
 	deviceManager *IPortableDeviceManager
 )
 
-type Device struct {
-	device     *IPortableDevice
-	content    *IPortableDeviceContent
-	properties *IPortableDeviceProperties
-	keys       *IPortableDeviceKeyCollection
-	resources  *IPortableDeviceResources
-	CanCopy    bool
-}
-
-type ObjectInfo struct {
-	ModTime int64
-	Size    int64
-	IsDir   bool
-}
-
-type Object struct {
-	ObjectInfo
-	ChildCount int
-
-	Id          string
-	ParentId    string
-	Name        string
-	ContentType GUID
-}
-
 func Init() error {
 	_, err := CoInitializeEx()
 	if err != nil {
@@ -88,60 +66,104 @@ func GetDeviceId(name string) int {
 	return -1
 }
 
+type wpdBackend struct {
+	device     *IPortableDevice
+	content    *IPortableDeviceContent
+	properties *IPortableDeviceProperties
+	keys       *IPortableDeviceKeyCollection
+	resources  *IPortableDeviceResources
+}
+
 func ChooseDevice(id int) (d *Device, err error) {
-	d = &Device{}
+	b := &wpdBackend{}
+	d = &Device{backend: b}
 	cInfo := getClientInformation()
 	defer cInfo.Release()
-	d.device, _, err = deviceManager.ChooseDevice(id, cInfo)
+	b.device, _, err = deviceManager.ChooseDevice(id, cInfo)
 	if err != nil {
 		return
 	}
-	d.content, _, err = d.device.Content()
+	b.content, _, err = b.device.Content()
 	if err != nil {
 		return
 	}
-	d.properties, _, err = d.content.Properties()
+	b.properties, _, err = b.content.Properties()
 	if err != nil {
 		return
 	}
-	d.resources, _, err = d.content.Transfer()
+	b.resources, _, err = b.content.Transfer()
 	if err != nil {
 		return
 	}
-	d.CanCopy = d.SupportsCommand(WPD_COMMAND_OBJECT_MANAGEMENT_COPY_OBJECTS)
+	d = NewDevice(b)
 	return
 }
 
-func (d *Device) Release() {
-	d.resources.Release()
-	d.properties.Release()
-	d.content.Release()
-	d.device.Release()
+func (b *wpdBackend) Release() {
+	b.resources.Release()
+	b.properties.Release()
+	b.content.Release()
+	b.device.Release()
 }
 
-func (d *Device) GetObject(id string) (o *Object, err error) {
-	var v *IPortableDeviceValues
-	v, _, err = d.properties.GetValues(id, d.keys)
+func (b *wpdBackend) GetValues(id string) (PropertyValues, error) {
+	v, _, err := b.properties.GetValues(id, b.keys)
 	defer v.Release()
 	if err != nil {
-		return
+		return nil, err
 	}
-	o = &Object{}
-	o.Id = id
-	o.ParentId, _, err = v.GetStringValue(WPD_OBJECT_PARENT_ID)
-	o.Name, _, err = v.GetStringValue(WPD_OBJECT_ORIGINAL_FILE_NAME)
-	var size uint64
-	size, _, err = v.GetUnsignedLargeIntegerValue(WPD_OBJECT_SIZE)
-	o.Size = int64(size)
-	o.ModTime, _, err = v.GetUnixTimeValue(WPD_OBJECT_DATE_MODIFIED)
-	o.ContentType, _, err = v.GetGuidValue(WPD_OBJECT_CONTENT_TYPE)
-	o.IsDir = o.ContentType == WPD_CONTENT_TYPE_FUNCTIONAL_OBJECT || o.ContentType == WPD_CONTENT_TYPE_FOLDER
-	return
+	return toPropertyValues(v)
+}
+
+func toPropertyValues(v *IPortableDeviceValues) (PropertyValues, error) {
+	n, _, err := v.GetCount()
+	if err != nil {
+		return nil, err
+	}
+	values := make(PropertyValues, n)
+	for i := uint32(0); i < n; i++ {
+		key, pv, hr, _ := v.GetAt(i)
+		if hr < 0 {
+			continue
+		}
+		if val := PropVariantToValue(pv); val != nil {
+			values[key] = val
+		}
+		PropVariantClear(pv)
+	}
+	return values, nil
 }
 
-func (d *Device) GetChildIds(id string) (ids []string, err error) {
+func (b *wpdBackend) SetValues(id string, props PropertyValues) error {
+	prop, err := newPortableDeviceValues(props)
+	if err != nil {
+		return err
+	}
+	defer prop.Release()
+	results, hr, _ := b.properties.SetValues(id, prop)
+	if results != nil {
+		defer results.Release()
+	}
+	if hr < 0 || results == nil {
+		return hresultError(hr)
+	}
+	n, _, _ := results.GetCount()
+	for i := uint32(0); i < n; i++ {
+		_, pv, hr, _ := results.GetAt(i)
+		if hr < 0 {
+			continue
+		}
+		if pv.Vt == VT_ERROR && int32(pv.Val1) < 0 {
+			err = HResult(int32(pv.Val1))
+		}
+		PropVariantClear(pv)
+	}
+	return err
+}
+
+func (b *wpdBackend) EnumObjects(id string) (ids []string, err error) {
 	var enum *IEnumPortableDeviceObjectIDs
-	enum, _, err = d.content.EnumObjects(id)
+	enum, _, err = b.content.EnumObjects(id)
 	if err != nil {
 		return
 	}
@@ -158,130 +180,151 @@ func (d *Device) GetChildIds(id string) (ids []string, err error) {
 	return
 }
 
-func (d *Device) GetChildObjects(id string) (ar []*Object, err error) {
-	ids, err := d.GetChildIds(id)
+func (b *wpdBackend) GetStream(id string, key PROPERTYKEY) (io.ReadCloser, int, error) {
+	stream, size, _, err := b.resources.GetStream(id, key)
 	if err != nil {
-		return
-	}
-	ar = make([]*Object, len(ids))
-	for i, id := range ids {
-		var o *Object
-		o, err = d.GetObject(id)
-		ar[i] = o
+		return nil, 0, err
 	}
-	return
+	return &StreamReader{stream}, int(size), nil
 }
 
-func (d *Device) findObject(path string, id string, curPath string) *Object {
-	objs, _ := d.GetChildObjects(id)
-	for _, o := range objs {
-		newPath := curPath + o.Name + PathSeparator
-		if path == newPath {
-			return o
-		} else if strings.Index(path, newPath) == 0 {
-			if o.IsDir {
-				rs := d.findObject(path, o.Id, newPath)
-				if rs != nil {
-					return rs
-				}
-			}
+func (b *wpdBackend) GetSupportedResources(id string) ([]PROPERTYKEY, error) {
+	col, _, err := b.resources.GetSupportedResources(id)
+	if err != nil {
+		return nil, err
+	}
+	defer col.Release()
+	n, _, err := col.GetCount()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]PROPERTYKEY, 0, n)
+	for i := 0; i < n; i++ {
+		key, hr, _ := col.GetAt(i)
+		if hr < 0 {
+			continue
 		}
+		keys = append(keys, key)
 	}
-	return nil
-}
-
-func (d *Device) FindObject(path string) *Object {
-	path = CleanPath(path) + PathSeparator
-	obj := d.findObject(path, WPD_DEVICE_OBJECT_ID, "")
-	return obj
+	return keys, nil
 }
 
-func (d *Device) GetReader(id string) (*BufReadCloser, error) {
-	stream, size, _, err := d.resources.GetStream(id)
+func (b *wpdBackend) GetResourceAttributes(id string, key PROPERTYKEY) (PropertyValues, error) {
+	v, _, err := b.resources.GetResourceAttributes(id, key)
 	if err != nil {
 		return nil, err
 	}
-	return NewBufReadCloser(&StreamReader{stream}, int(size)), nil
+	defer v.Release()
+	return toPropertyValues(v)
 }
 
-func (d *Device) CopyFromDevice(dst string, id string) (int64, error) {
-	reader, err := d.GetReader(id)
-	if err != nil {
-		return 0, err
-	}
-	defer reader.Close()
+// wpdResourceWriter is the stream of a resource being written.
+type wpdResourceWriter struct {
+	id     string
+	stream *IStream
+}
 
-	f, err := os.Create(dst)
-	if err != nil {
-		return 0, err
+func (o *wpdResourceWriter) Write(buf []byte) (int, error) {
+	n, hr, err := o.stream.Write(buf, uint32(len(buf)))
+	if hr >= 0 {
+		err = nil
 	}
-	writer := NewBufWriteCloser(f, 0)
-	defer writer.Close()
-	return io.Copy(writer, reader)
+	return int(n), err
+}
+
+func (o *wpdResourceWriter) Commit() (string, error) {
+	defer o.stream.Release()
+	_, err := o.stream.Commit(STGC_DEFAULT)
+	return o.id, err
+}
+
+func (o *wpdResourceWriter) Abort() error {
+	defer o.stream.Release()
+	_, err := o.stream.Revert()
+	return err
 }
 
-func (d *Device) CopyObjectFromDevice(dst string, obj *Object) (int64, error) {
-	written, err := d.CopyFromDevice(dst, obj.Id)
+func (b *wpdBackend) CreateResource(id string, attrs PropertyValues) (ObjectWriter, int, error) {
+	values := PropertyValues{WPD_OBJECT_ID: id}
+	for key, val := range attrs {
+		values[key] = val
+	}
+	prop, err := newPortableDeviceValues(values)
 	if err != nil {
-		return 0, err
+		return nil, 0, err
 	}
-	return written, SetFileTime(dst, obj.ModTime)
+	defer prop.Release()
+	stream, size, _, err := b.resources.CreateResource(prop)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &wpdResourceWriter{id, stream}, int(size), nil
+}
+
+type wpdObjectWriter struct {
+	*StreamWriter
+}
+
+func (o wpdObjectWriter) Commit() (string, error) {
+	id, _, err := o.StreamWriter.Commit()
+	return id, err
 }
 
-func (d *Device) CopyToDevice(parentId string, src string) (int64, error) {
-	info, err := os.Lstat(src)
-	if info == nil || info.IsDir() {
-		return 0, err
+func (b *wpdBackend) CreateObjectWithPropertiesAndData(props PropertyValues) (ObjectWriter, int, error) {
+	prop, err := newPortableDeviceValues(props)
+	if err != nil {
+		return nil, 0, err
 	}
-	o := ObjectFromFileInfo(src, info)
-	f, err := os.Open(o.Id)
+	defer prop.Release()
+	stream, size, _, err := b.content.CreateObjectWithPropertiesAndData(prop)
 	if err != nil {
-		return 0, err
+		return nil, 0, err
 	}
-	reader := NewBufReadCloser(f, 0)
-	defer reader.Close()
-	return d.CopyObjectToDevice(parentId, reader, o)
+	return wpdObjectWriter{&StreamWriter{stream}}, int(size), nil
 }
 
-func (d *Device) CopyObjectToDevice(parentId string, src io.Reader, obj *Object) (int64, error) {
-	var prop *IPortableDeviceValues
-	_, err := CoCreateInstance(CLSID_PortableDeviceValues, IID_IPortableDeviceValues, &prop)
+func (b *wpdBackend) CreateObjectWithPropertiesOnly(props PropertyValues) (string, error) {
+	prop, err := newPortableDeviceValues(props)
 	if err != nil {
-		return 0, err
-	}
-	prop.SetStringValue(WPD_OBJECT_PARENT_ID, parentId)
-	ind := strings.Index(obj.Name, ".")
-	name := obj.Name
-	if ind > 0 {
-		name = name[0:ind]
-	}
-	prop.SetStringValue(WPD_OBJECT_NAME, name)
-	prop.SetStringValue(WPD_OBJECT_ORIGINAL_FILE_NAME, obj.Name)
-	prop.SetUnsignedLargeIntegerValue(WPD_OBJECT_SIZE, uint64(obj.Size))
-	prop.SetUnixTimeValue(WPD_OBJECT_DATE_MODIFIED, obj.ModTime)
+		return "", err
+	}
 	defer prop.Release()
-	stream, size, _, err := d.content.CreateObjectWithPropertiesAndData(prop)
+	id, _, err := b.content.CreateObjectWithPropertiesOnly(prop)
+	return id, err
+}
+
+func (b *wpdBackend) Delete(option int, ids []string) ([]int32, error) {
+	list, err := getPropVariantCollection(ids)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
+	defer list.Release()
+	results, _, err := b.content.Delete(option, list)
+	return getResults(results), err
+}
 
-	writer := NewBufWriteCloser(&StreamWriter{stream}, int(size))
-	n, _ := io.Copy(writer, src)
-	return n, writer.Close()
+func (b *wpdBackend) Copy(ids []string, parentId string) ([]int32, error) {
+	list, err := getPropVariantCollection(ids)
+	if err != nil {
+		return nil, err
+	}
+	defer list.Release()
+	results, _, err := b.content.Copy(list, parentId)
+	return getResults(results), err
 }
 
-func (d *Device) Delete(id string) error {
-	list, err := getPropVariantCollection(id)
+func (b *wpdBackend) Move(ids []string, parentId string) ([]int32, error) {
+	list, err := getPropVariantCollection(ids)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer list.Release()
-	_, _, err = d.content.Delete(PORTABLE_DEVICE_DELETE_NO_RECURSION, list)
-	return err
+	results, _, err := b.content.Move(list, parentId)
+	return getResults(results), err
 }
 
-func (d *Device) SupportsCommand(cmd PROPERTYKEY) bool {
-	capa, _, err := d.device.Capabilities()
+func (b *wpdBackend) SupportsCommand(cmd PROPERTYKEY) bool {
+	capa, _, err := b.device.Capabilities()
 	if err != nil {
 		return false
 	}
@@ -302,28 +345,69 @@ func (d *Device) SupportsCommand(cmd PROPERTYKEY) bool {
 	return false
 }
 
-func (d *Device) Copy(parentId string, id string) error {
-	list, err := getPropVariantCollection(id)
+func newPortableDeviceValues(props PropertyValues) (*IPortableDeviceValues, error) {
+	var prop *IPortableDeviceValues
+	_, err := CoCreateInstance(CLSID_PortableDeviceValues, IID_IPortableDeviceValues, &prop)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer list.Release()
-	_, _, err = d.content.Copy(list, parentId)
-	return err
+	for key, val := range props {
+		switch v := val.(type) {
+		case string:
+			prop.SetStringValue(key, v)
+		case uint32:
+			prop.SetUnsignedIntegerValue(key, v)
+		case uint64:
+			prop.SetUnsignedLargeIntegerValue(key, v)
+		case bool:
+			prop.SetBoolValue(key, v)
+		case GUID:
+			prop.SetGuidValue(key, v)
+		case PROPERTYKEY:
+			prop.SetKeyValue(key, v)
+		case time.Time:
+			prop.SetUnixTimeValue(key, v.Unix())
+		}
+	}
+	return prop, nil
 }
 
-func (d *Device) CreateFolder(parentId string, name string) (string, error) {
-	var prop *IPortableDeviceValues
-	_, err := CoCreateInstance(CLSID_PortableDeviceValues, IID_IPortableDeviceValues, &prop)
-	if err != nil {
-		return "", err
+func getPropVariantCollection(ids []string) (*IPortableDevicePropVariantCollection, error) {
+	var list *IPortableDevicePropVariantCollection
+	hr, err := CoCreateInstance(CLSID_PortableDevicePropVariantCollection, IID_IPortableDevicePropVariantCollection, &list)
+	if hr < 0 {
+		return nil, err
 	}
-	prop.SetStringValue(WPD_OBJECT_PARENT_ID, parentId)
-	prop.SetStringValue(WPD_OBJECT_NAME, name)
-	prop.SetStringValue(WPD_OBJECT_ORIGINAL_FILE_NAME, name)
-	prop.SetGuidValue(WPD_OBJECT_CONTENT_TYPE, WPD_CONTENT_TYPE_FOLDER)
-	defer prop.Release()
+	for _, id := range ids {
+		var pv PROPVARIANT
+		pv.Vt = VT_LPWSTR
+		pt := syscall.StringToUTF16Ptr(id)
+		pv.Val1 = uintptr(unsafe.Pointer(pt))
+		list.Add(&pv)
+		runtime.KeepAlive(pt)
+	}
+	return list, nil
+}
 
-	id, _, err := d.content.CreateObjectWithPropertiesOnly(prop)
-	return id, err
+func getResults(list *IPortableDevicePropVariantCollection) []int32 {
+	if list == nil {
+		return nil
+	}
+	defer list.Release()
+	n, _, err := list.GetCount()
+	if err != nil {
+		return nil
+	}
+	hrs := make([]int32, n)
+	for i := uint32(0); i < n; i++ {
+		pv, _, err := list.GetAt(i)
+		if err != nil {
+			return nil
+		}
+		if pv.Vt == VT_ERROR {
+			hrs[i] = int32(pv.Val1)
+		}
+		PropVariantClear(pv)
+	}
+	return hrs
 }
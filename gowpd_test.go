@@ -1,8 +1,14 @@
+// +build windows
+
 package gowpd
 
 import (
 	"os"
+	"runtime"
+	"strings"
+	"syscall"
 	"testing"
+	"unsafe"
 )
 
 func TestMain(m *testing.M) {
@@ -13,6 +19,33 @@ func TestMain(m *testing.M) {
 	}
 	os.Exit(m.Run())
 }
+func TestPropVariantToValue(t *testing.T) {
+	var pv PROPVARIANT
+	pv.Vt = VT_UI8
+	*(*uint64)(unsafe.Pointer(&pv.Val1)) = 1<<40 + 1
+	if v := PropVariantToValue(&pv); v != uint64(1<<40+1) {
+		t.Errorf("VT_UI8 = %v", v)
+	}
+	pv.Vt = VT_I8
+	*(*int64)(unsafe.Pointer(&pv.Val1)) = -1 << 40
+	if v := PropVariantToValue(&pv); v != int64(-1<<40) {
+		t.Errorf("VT_I8 = %v", v)
+	}
+
+	long := strings.Repeat("a", MAX_PATH*2)
+	s, _ := syscall.UTF16FromString(long)
+	pv.Vt = VT_LPWSTR
+	*(**uint16)(unsafe.Pointer(&pv.Val1)) = &s[0]
+	if v := PropVariantToValue(&pv); v != long {
+		t.Errorf("VT_LPWSTR length = %v", len(v.(string)))
+	}
+	runtime.KeepAlive(s)
+	pv.Val1 = 0
+	if v := PropVariantToValue(&pv); v != "" {
+		t.Errorf("VT_LPWSTR nil = %q", v)
+	}
+}
+
 func TestGetDevice(t *testing.T) {
 	n := GetDeviceCount()
 	if n == 0 {
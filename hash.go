@@ -0,0 +1,100 @@
+package gowpd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+)
+
+type HashAlgo int
+
+const (
+	HASH_SHA256 HashAlgo = iota
+	HASH_XXH64
+)
+
+func (a HashAlgo) New() hash.Hash {
+	if a == HASH_XXH64 {
+		return newXXH64()
+	}
+	return sha256.New()
+}
+
+func (a HashAlgo) String() string {
+	if a == HASH_XXH64 {
+		return "xxh64"
+	}
+	return "sha256"
+}
+
+// Hash reads the object id and returns its hash.
+func (d *Device) Hash(id string, algo HashAlgo) ([]byte, error) {
+	r, err := d.OpenRange(id, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return hashReader(r, algo)
+}
+
+func hashReader(r io.Reader, algo HashAlgo) ([]byte, error) {
+	h := algo.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+func hashFile(path string, algo HashAlgo) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return hashReader(f, algo)
+}
+
+type VerifyMode int
+
+const (
+	VERIFY_NONE VerifyMode = iota
+	// VERIFY_SIZE compares the size reported for the copy with the source.
+	VERIFY_SIZE
+	// VERIFY_HASH also reads the copy back and compares its hash with the
+	// hash of the data sent.
+	VERIFY_HASH
+)
+
+// WithVerify checks every copied file with mode. algo is the hash used by
+// VERIFY_HASH.
+func WithVerify(mode VerifyMode, algo HashAlgo) CopyOption {
+	return func(o *copyOptions) {
+		o.verify = mode
+		o.hashAlgo = algo
+	}
+}
+
+// hashing returns a reader of r which feeds the hash h, and h, if the copy
+// is verified by hash.
+func (o *copyOptions) hashing(r io.Reader) (io.Reader, hash.Hash) {
+	if o.verify < VERIFY_HASH {
+		return r, nil
+	}
+	h := o.hashAlgo.New()
+	return io.TeeReader(r, h), h
+}
+
+func sizeError(name string, size, want int64) error {
+	return fmt.Errorf("Size mismatch : %v (%v of %v bytes)", name, size, want)
+}
+
+// checkHash compares the hash of the copy with the hash of the data sent.
+func checkHash(name string, sum []byte, h hash.Hash) error {
+	if !bytes.Equal(sum, h.Sum(nil)) {
+		return fmt.Errorf("Hash mismatch : %v", name)
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package gowpd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestXXH64(t *testing.T) {
+	tests := []struct {
+		in   string
+		want uint64
+	}{
+		{"", 0xef46db3751d8e999},
+		{"a", 0xd24ec4f1a98c6e5b},
+		{"abc", 0x44bc2cf5ad770999},
+	}
+	for _, tt := range tests {
+		h := newXXH64()
+		h.Write([]byte(tt.in))
+		if got := h.Sum64(); got != tt.want {
+			t.Errorf("%q: %#x", tt.in, got)
+		}
+	}
+
+	data := []byte(testData(1000))
+	h := newXXH64()
+	h.Write(data)
+	want := h.Sum64()
+	for _, chunk := range []int{1, 7, 31, 32, 33, 100} {
+		h.Reset()
+		for b := data; len(b) > 0; {
+			n := chunk
+			if n > len(b) {
+				n = len(b)
+			}
+			h.Write(b[:n])
+			b = b[n:]
+		}
+		if got := h.Sum64(); got != want {
+			t.Errorf("chunks of %v: %#x, want %#x", chunk, got, want)
+		}
+	}
+}
+
+func TestHash(t *testing.T) {
+	d := NewMemoryDevice()
+	root := putFolder(t, d, WPD_DEVICE_OBJECT_ID, "Storage")
+	id := putFile(t, d, root, "a", "abc")
+	sum, err := d.Hash(id, HASH_SHA256)
+	want := sha256.Sum256([]byte("abc"))
+	if err != nil || string(sum) != string(want[:]) {
+		t.Errorf("sha256 = %x %v", sum, err)
+	}
+	sum, err = d.Hash(id, HASH_XXH64)
+	if err != nil || hex.EncodeToString(sum) != "44bc2cf5ad770999" {
+		t.Errorf("xxh64 = %x %v", sum, err)
+	}
+}
+
+// lossyBackend damages data like a cheap MTP implementation: streams stop
+// after limit bytes and written data has its first byte changed.
+type lossyBackend struct {
+	*MemoryBackend
+	limit   int64
+	corrupt bool
+}
+
+func (b *lossyBackend) GetStream(id string, key PROPERTYKEY) (io.ReadCloser, int, error) {
+	stream, size, err := b.MemoryBackend.GetStream(id, key)
+	if err != nil || b.limit == 0 {
+		return stream, size, err
+	}
+	return &limitedReadCloser{io.LimitReader(stream, b.limit), stream}, size, nil
+}
+
+func (b *lossyBackend) CreateObjectWithPropertiesAndData(props PropertyValues) (ObjectWriter, int, error) {
+	w, size, err := b.MemoryBackend.CreateObjectWithPropertiesAndData(props)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &lossyWriter{w, b, false}, size, nil
+}
+
+type lossyWriter struct {
+	ObjectWriter
+	b       *lossyBackend
+	started bool
+}
+
+func (w *lossyWriter) Write(p []byte) (int, error) {
+	if w.b.corrupt && !w.started && len(p) > 0 {
+		c := append([]byte{p[0] ^ 1}, p[1:]...)
+		w.started = true
+		return w.ObjectWriter.Write(c)
+	}
+	w.started = true
+	return w.ObjectWriter.Write(p)
+}
+
+func TestVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gowpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := testData(10000)
+	b := &lossyBackend{MemoryBackend: NewMemoryBackend()}
+	d := NewDevice(b)
+	root := putFolder(t, d, WPD_DEVICE_OBJECT_ID, "Storage")
+	id := putFile(t, d, root, "photo.jpg", data)
+	dst := filepath.Join(dir, "photo.jpg")
+
+	// truncated download
+	b.limit = 6000
+	if _, err := d.CopyFromDevice(dst, id); err != nil {
+		t.Errorf("unverified copy: %v", err)
+	}
+	if _, err := d.CopyFromDevice(dst, id, WithVerify(VERIFY_SIZE, HASH_SHA256)); err == nil {
+		t.Errorf("truncated download not detected")
+	}
+	b.limit = 0
+	for _, algo := range []HashAlgo{HASH_SHA256, HASH_XXH64} {
+		if _, err := d.CopyFromDevice(dst, id, WithVerify(VERIFY_HASH, algo)); err != nil {
+			t.Errorf("%v: %v", algo, err)
+		}
+	}
+
+	// resumed download is hashed as a whole
+	ioutil.WriteFile(dst, []byte(data[:4000]), 0644)
+	if _, err := d.CopyFromDevice(dst, id, WithResume(), WithVerify(VERIFY_HASH, HASH_XXH64)); err != nil {
+		t.Errorf("resume: %v", err)
+	}
+
+	// upload corrupted by the device passes the size check only
+	b.corrupt = true
+	obj := &Object{Name: "b.jpg", ObjectInfo: ObjectInfo{Size: int64(len(data))}}
+	if _, err := d.CopyObjectToDevice(root, strings.NewReader(data), obj, WithVerify(VERIFY_SIZE, HASH_SHA256)); err != nil {
+		t.Errorf("size: %v", err)
+	}
+	_, err = d.CopyObjectToDevice(root, strings.NewReader(data), obj, WithVerify(VERIFY_HASH, HASH_SHA256))
+	if err == nil || !strings.HasPrefix(err.Error(), "Hash mismatch") {
+		t.Errorf("corrupted upload: %v", err)
+	}
+
+	// short source
+	b.corrupt = false
+	obj.Size = 20000
+	if _, err := d.CopyObjectToDevice(root, strings.NewReader(data), obj, WithVerify(VERIFY_SIZE, HASH_SHA256)); err == nil {
+		t.Errorf("short upload not detected")
+	}
+}
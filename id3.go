@@ -0,0 +1,196 @@
+package gowpd
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+var errTagSize = errors.New("Invalid tag size")
+
+// readID3 reads an ID3v2.2, 2.3 or 2.4 tag at the start of r.
+func readID3(r io.ReaderAt, size int64) (*Metadata, error) {
+	header, err := readSection(r, 0, 10)
+	if err != nil {
+		return nil, err
+	}
+	version := header[3]
+	if version < 2 || version > 4 {
+		return nil, nil
+	}
+	tagSize := int64(syncsafe(header[6:10]))
+	if tagSize > size-10 {
+		// parse what there is of a tag cut short
+		tagSize = size - 10
+	}
+	tag, err := readSection(r, 10, tagSize)
+	if err != nil {
+		return nil, err
+	}
+	if header[5]&0x80 != 0 && version < 4 {
+		tag = unsynchronise(tag)
+	}
+	if header[5]&0x40 != 0 && version >= 3 && len(tag) >= 4 {
+		// extended header
+		// sizes are kept as int64 to stay positive on 32-bit platforms
+		n := int64(binary.BigEndian.Uint32(tag)) + 4
+		if version == 4 {
+			n = int64(syncsafe(tag[:4]))
+		}
+		if n > int64(len(tag)) {
+			return nil, errTagSize
+		}
+		tag = tag[n:]
+	}
+
+	m := &Metadata{}
+	idLen, headerLen := 4, 10
+	if version == 2 {
+		idLen, headerLen = 3, 6
+	}
+	for len(tag) >= headerLen && tag[0] != 0 {
+		id := string(tag[:idLen])
+		var size int64
+		switch version {
+		case 2:
+			size = int64(tag[3])<<16 | int64(tag[4])<<8 | int64(tag[5])
+		case 3:
+			size = int64(binary.BigEndian.Uint32(tag[4:8]))
+		default:
+			size = int64(syncsafe(tag[4:8]))
+		}
+		if size > int64(len(tag)-headerLen) {
+			break
+		}
+		n := int(size)
+		body := tag[headerLen : headerLen+n]
+		if version == 4 {
+			format := tag[9]
+			if format&0x02 != 0 {
+				body = unsynchronise(body)
+			}
+			if format&0x01 != 0 && len(body) >= 4 {
+				// data length indicator
+				body = body[4:]
+			}
+		}
+		tag = tag[headerLen+n:]
+		switch id {
+		case "TIT2", "TT2":
+			m.Title = id3Text(body)
+		case "TPE1", "TP1":
+			m.Artist = id3Text(body)
+		case "TALB", "TAL":
+			m.Album = id3Text(body)
+		case "TCON", "TCO":
+			m.Genre = id3Genre(id3Text(body))
+		case "TRCK", "TRK":
+			m.Track = leadingInt(id3Text(body))
+		case "TLEN", "TLE":
+			if ms := leadingInt(id3Text(body)); ms > 0 {
+				m.Duration = time.Duration(ms) * time.Millisecond
+			}
+		}
+	}
+	return m, nil
+}
+
+func syncsafe(b []byte) int {
+	return int(b[0]&0x7F)<<21 | int(b[1]&0x7F)<<14 | int(b[2]&0x7F)<<7 | int(b[3]&0x7F)
+}
+
+// unsynchronise removes the zero bytes inserted after 0xFF.
+func unsynchronise(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	for i := 0; i < len(b); i++ {
+		out = append(out, b[i])
+		if b[i] == 0xFF && i+1 < len(b) && b[i+1] == 0 {
+			i++
+		}
+	}
+	return out
+}
+
+// id3Text decodes a text frame. Of several values the first is returned.
+func id3Text(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	enc, b := b[0], b[1:]
+	var s string
+	switch enc {
+	case 0:
+		r := make([]rune, len(b))
+		for i, c := range b {
+			r[i] = rune(c)
+		}
+		s = string(r)
+	case 1, 2:
+		order := binary.ByteOrder(binary.BigEndian)
+		if enc == 1 && len(b) >= 2 {
+			if b[0] == 0xFF && b[1] == 0xFE {
+				order = binary.LittleEndian
+			}
+			b = b[2:]
+		}
+		u := make([]uint16, len(b)/2)
+		for i := range u {
+			u[i] = order.Uint16(b[2*i:])
+		}
+		s = string(utf16.Decode(u))
+	default:
+		s = string(b)
+	}
+	if i := strings.IndexByte(s, 0); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s)
+}
+
+// id3Genre resolves the "(17)" and "17" references of ID3v1 genres.
+func id3Genre(s string) string {
+	ref := s
+	if strings.HasPrefix(ref, "(") {
+		if i := strings.IndexByte(ref, ')'); i > 0 {
+			if rest := ref[i+1:]; rest != "" {
+				return rest
+			}
+			ref = ref[1:i]
+		}
+	}
+	if n, err := strconv.Atoi(ref); err == nil && n >= 0 && n < len(id3v1Genres) {
+		return id3v1Genres[n]
+	}
+	return s
+}
+
+// leadingInt parses the number at the start of s, like "3" of "3/12".
+func leadingInt(s string) int {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	n, _ := strconv.Atoi(s[:i])
+	return n
+}
+
+var id3v1Genres = []string{
+	"Blues", "Classic Rock", "Country", "Dance", "Disco", "Funk", "Grunge",
+	"Hip-Hop", "Jazz", "Metal", "New Age", "Oldies", "Other", "Pop", "R&B",
+	"Rap", "Reggae", "Rock", "Techno", "Industrial", "Alternative", "Ska",
+	"Death Metal", "Pranks", "Soundtrack", "Euro-Techno", "Ambient",
+	"Trip-Hop", "Vocal", "Jazz+Funk", "Fusion", "Trance", "Classical",
+	"Instrumental", "Acid", "House", "Game", "Sound Clip", "Gospel", "Noise",
+	"AlternRock", "Bass", "Soul", "Punk", "Space", "Meditative",
+	"Instrumental Pop", "Instrumental Rock", "Ethnic", "Gothic", "Darkwave",
+	"Techno-Industrial", "Electronic", "Pop-Folk", "Eurodance", "Dream",
+	"Southern Rock", "Comedy", "Cult", "Gangsta", "Top 40", "Christian Rap",
+	"Pop/Funk", "Jungle", "Native American", "Cabaret", "New Wave",
+	"Psychadelic", "Rave", "Showtunes", "Trailer", "Lo-Fi", "Tribal",
+	"Acid Punk", "Acid Jazz", "Polka", "Retro", "Musical", "Rock & Roll",
+	"Hard Rock",
+}
@@ -0,0 +1,522 @@
+package gowpd
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MemoryBackend is a Backend keeping objects in memory. It behaves like a
+// device driver and is used to run transfers without a connected device.
+type MemoryBackend struct {
+	mu      sync.Mutex
+	objects map[string]*memObject
+	nextId  int
+	// writers is the number of writers neither committed nor aborted.
+	writers int
+
+	// Commands lists the commands reported by SupportsCommand.
+	Commands []PROPERTYKEY
+	// Fault is called before every backend call with its name and the ids
+	// involved. A non-nil error fails the call.
+	Fault func(op string, ids []string) error
+}
+
+type memObject struct {
+	props     PropertyValues
+	data      []byte
+	resources map[PROPERTYKEY]*memResource
+	children  []string
+}
+
+// memResource is a resource other than the data of an object.
+type memResource struct {
+	data   []byte
+	format GUID
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	m := &MemoryBackend{objects: make(map[string]*memObject)}
+	m.objects[WPD_DEVICE_OBJECT_ID] = &memObject{props: PropertyValues{
+		WPD_OBJECT_NAME:               WPD_DEVICE_OBJECT_ID,
+		WPD_OBJECT_ORIGINAL_FILE_NAME: WPD_DEVICE_OBJECT_ID,
+		WPD_OBJECT_CONTENT_TYPE:       WPD_CONTENT_TYPE_FUNCTIONAL_OBJECT,
+	}}
+	m.Commands = []PROPERTYKEY{
+		WPD_COMMAND_OBJECT_MANAGEMENT_COPY_OBJECTS,
+		WPD_COMMAND_OBJECT_MANAGEMENT_MOVE_OBJECTS,
+	}
+	return m
+}
+
+func NewMemoryDevice() *Device {
+	return NewDevice(NewMemoryBackend())
+}
+
+func (m *MemoryBackend) fault(op string, ids ...string) error {
+	if m.Fault == nil {
+		return nil
+	}
+	return m.Fault(op, ids)
+}
+
+func (m *MemoryBackend) Release() {
+}
+
+func (m *MemoryBackend) SupportsCommand(cmd PROPERTYKEY) bool {
+	for _, c := range m.Commands {
+		if c == cmd {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MemoryBackend) EnumObjects(parentId string) ([]string, error) {
+	if err := m.fault("EnumObjects", parentId); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	o := m.objects[parentId]
+	if o == nil {
+		return nil, HResult(E_FILE_NOT_FOUND)
+	}
+	return append([]string(nil), o.children...), nil
+}
+
+func (m *MemoryBackend) GetValues(id string) (PropertyValues, error) {
+	if err := m.fault("GetValues", id); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	o := m.objects[id]
+	if o == nil {
+		return nil, HResult(E_FILE_NOT_FOUND)
+	}
+	v := make(PropertyValues, len(o.props))
+	for key, val := range o.props {
+		v[key] = val
+	}
+	return v, nil
+}
+
+// SetValues changes the properties of the object id. The parent, size and
+// content type cannot be changed.
+func (m *MemoryBackend) SetValues(id string, props PropertyValues) error {
+	if err := m.fault("SetValues", id); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	o := m.objects[id]
+	if o == nil {
+		return HResult(E_FILE_NOT_FOUND)
+	}
+	for key := range props {
+		switch key {
+		case WPD_OBJECT_PARENT_ID, WPD_OBJECT_SIZE, WPD_OBJECT_CONTENT_TYPE:
+			return HResult(E_ACCESSDENIED)
+		}
+	}
+	if id == WPD_DEVICE_OBJECT_ID {
+		return HResult(E_ACCESSDENIED)
+	}
+	for key, val := range props {
+		o.props[key] = val
+	}
+	return nil
+}
+
+func (m *MemoryBackend) GetStream(id string, key PROPERTYKEY) (io.ReadCloser, int, error) {
+	if err := m.fault("GetStream", id); err != nil {
+		return nil, 0, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	o := m.objects[id]
+	if o == nil {
+		return nil, 0, HResult(E_FILE_NOT_FOUND)
+	}
+	if isFolder(o.props) {
+		return nil, 0, HResult(E_INVALIDARG)
+	}
+	if key == WPD_RESOURCE_DEFAULT {
+		return &memReader{bytes.NewReader(o.data)}, 0, nil
+	}
+	r, ok := o.resources[key]
+	if !ok {
+		return nil, 0, HResult(E_NOT_SUPPORTED)
+	}
+	return &memReader{bytes.NewReader(r.data)}, 0, nil
+}
+
+// GetSupportedResources lists WPD_RESOURCE_DEFAULT for files and the keys
+// of the resources written to the object id.
+func (m *MemoryBackend) GetSupportedResources(id string) ([]PROPERTYKEY, error) {
+	if err := m.fault("GetSupportedResources", id); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	o := m.objects[id]
+	if o == nil {
+		return nil, HResult(E_FILE_NOT_FOUND)
+	}
+	var keys []PROPERTYKEY
+	if !isFolder(o.props) {
+		keys = append(keys, WPD_RESOURCE_DEFAULT)
+	}
+	for key := range o.resources {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Pid < keys[j].Pid
+	})
+	return keys, nil
+}
+
+// GetResourceAttributes describes the resource key of the object id. Every
+// resource can be read and written, and all but the data can be deleted.
+func (m *MemoryBackend) GetResourceAttributes(id string, key PROPERTYKEY) (PropertyValues, error) {
+	if err := m.fault("GetResourceAttributes", id); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	o := m.objects[id]
+	if o == nil {
+		return nil, HResult(E_FILE_NOT_FOUND)
+	}
+	v := PropertyValues{
+		WPD_RESOURCE_ATTRIBUTE_RESOURCE_KEY: key,
+		WPD_RESOURCE_ATTRIBUTE_CAN_READ:     true,
+		WPD_RESOURCE_ATTRIBUTE_CAN_WRITE:    true,
+		WPD_RESOURCE_ATTRIBUTE_CAN_DELETE:   key != WPD_RESOURCE_DEFAULT,
+	}
+	if key == WPD_RESOURCE_DEFAULT && !isFolder(o.props) {
+		v[WPD_RESOURCE_ATTRIBUTE_TOTAL_SIZE] = uint64(len(o.data))
+		if f, ok := o.props[WPD_OBJECT_FORMAT]; ok {
+			v[WPD_RESOURCE_ATTRIBUTE_FORMAT] = f
+		}
+		return v, nil
+	}
+	r, ok := o.resources[key]
+	if !ok {
+		return nil, HResult(E_NOT_SUPPORTED)
+	}
+	v[WPD_RESOURCE_ATTRIBUTE_TOTAL_SIZE] = uint64(len(r.data))
+	v[WPD_RESOURCE_ATTRIBUTE_FORMAT] = r.format
+	return v, nil
+}
+
+// CreateResource writes a resource of the object id. Writing
+// WPD_RESOURCE_DEFAULT replaces the data of the object.
+func (m *MemoryBackend) CreateResource(id string, attrs PropertyValues) (ObjectWriter, int, error) {
+	if err := m.fault("CreateResource", id); err != nil {
+		return nil, 0, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	o := m.objects[id]
+	if o == nil {
+		return nil, 0, HResult(E_FILE_NOT_FOUND)
+	}
+	key, ok := attrs[WPD_RESOURCE_ATTRIBUTE_RESOURCE_KEY].(PROPERTYKEY)
+	if !ok || isFolder(o.props) {
+		return nil, 0, HResult(E_INVALIDARG)
+	}
+	format, _ := attrs[WPD_RESOURCE_ATTRIBUTE_FORMAT].(GUID)
+	m.writers++
+	return &memResourceWriter{memWriter: memWriter{m: m}, id: id, key: key, format: format}, 0, nil
+}
+
+// memWriter counts the writers of a MemoryBackend which are not done.
+type memWriter struct {
+	m    *MemoryBackend
+	done bool
+}
+
+// end marks the writer as done, once committed or aborted. It must be
+// called with m.mu held.
+func (w *memWriter) end() {
+	if !w.done {
+		w.done = true
+		w.m.writers--
+	}
+}
+
+func (w *memWriter) Abort() error {
+	w.m.mu.Lock()
+	defer w.m.mu.Unlock()
+	w.end()
+	return nil
+}
+
+type memResourceWriter struct {
+	memWriter
+	id     string
+	key    PROPERTYKEY
+	format GUID
+	buf    bytes.Buffer
+}
+
+func (w *memResourceWriter) Write(p []byte) (int, error) {
+	if err := w.m.fault("Write", w.id); err != nil {
+		return 0, err
+	}
+	return w.buf.Write(p)
+}
+
+func (w *memResourceWriter) Commit() (string, error) {
+	err := w.m.fault("Commit", w.id)
+	w.m.mu.Lock()
+	defer w.m.mu.Unlock()
+	w.end()
+	if err != nil {
+		return "", err
+	}
+	o := w.m.objects[w.id]
+	if o == nil {
+		return "", HResult(E_FILE_NOT_FOUND)
+	}
+	data := append([]byte(nil), w.buf.Bytes()...)
+	if w.key == WPD_RESOURCE_DEFAULT {
+		o.data = data
+		o.props[WPD_OBJECT_SIZE] = uint64(len(data))
+		return w.id, nil
+	}
+	if o.resources == nil {
+		o.resources = make(map[PROPERTYKEY]*memResource)
+	}
+	o.resources[w.key] = &memResource{data, w.format}
+	return w.id, nil
+}
+
+type memReader struct {
+	*bytes.Reader
+}
+
+func (r *memReader) Close() error {
+	return nil
+}
+
+func (m *MemoryBackend) CreateObjectWithPropertiesOnly(props PropertyValues) (string, error) {
+	parentId := props.String(WPD_OBJECT_PARENT_ID)
+	if err := m.fault("CreateObjectWithPropertiesOnly", parentId); err != nil {
+		return "", err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.create(props, nil)
+}
+
+func (m *MemoryBackend) CreateObjectWithPropertiesAndData(props PropertyValues) (ObjectWriter, int, error) {
+	parentId := props.String(WPD_OBJECT_PARENT_ID)
+	if err := m.fault("CreateObjectWithPropertiesAndData", parentId); err != nil {
+		return nil, 0, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.checkParent(parentId); err != nil {
+		return nil, 0, err
+	}
+	m.writers++
+	return &memObjectWriter{memWriter: memWriter{m: m}, props: props}, 0, nil
+}
+
+func (m *MemoryBackend) checkParent(parentId string) error {
+	p := m.objects[parentId]
+	if p == nil {
+		return HResult(E_FILE_NOT_FOUND)
+	}
+	if !isFolder(p.props) {
+		return HResult(E_INVALIDARG)
+	}
+	return nil
+}
+
+func (m *MemoryBackend) create(props PropertyValues, data []byte) (string, error) {
+	parentId := props.String(WPD_OBJECT_PARENT_ID)
+	if err := m.checkParent(parentId); err != nil {
+		return "", err
+	}
+	m.nextId++
+	id := "o" + strconv.Itoa(m.nextId)
+	o := &memObject{props: make(PropertyValues, len(props)+2), data: data}
+	for key, val := range props {
+		o.props[key] = val
+	}
+	if _, ok := o.props[WPD_OBJECT_CONTENT_TYPE]; !ok {
+		o.props[WPD_OBJECT_CONTENT_TYPE] = GUID{}
+	}
+	if !isFolder(o.props) {
+		o.props[WPD_OBJECT_SIZE] = uint64(len(data))
+	}
+	if _, ok := o.props[WPD_OBJECT_DATE_MODIFIED]; !ok {
+		o.props[WPD_OBJECT_DATE_MODIFIED] = time.Now()
+	}
+	m.objects[id] = o
+	p := m.objects[parentId]
+	p.children = append(p.children, id)
+	return id, nil
+}
+
+type memObjectWriter struct {
+	memWriter
+	props PropertyValues
+	buf   bytes.Buffer
+}
+
+func (w *memObjectWriter) Write(p []byte) (int, error) {
+	id := w.props.String(WPD_OBJECT_PARENT_ID)
+	if err := w.m.fault("Write", id); err != nil {
+		return 0, err
+	}
+	return w.buf.Write(p)
+}
+
+func (w *memObjectWriter) Commit() (string, error) {
+	err := w.m.fault("Commit", w.props.String(WPD_OBJECT_PARENT_ID))
+	w.m.mu.Lock()
+	defer w.m.mu.Unlock()
+	w.end()
+	if err != nil {
+		return "", err
+	}
+	return w.m.create(w.props, w.buf.Bytes())
+}
+
+func (m *MemoryBackend) Delete(option int, ids []string) ([]int32, error) {
+	if err := m.fault("Delete", ids...); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	hrs := make([]int32, len(ids))
+	for i, id := range ids {
+		o := m.objects[id]
+		if o == nil || id == WPD_DEVICE_OBJECT_ID {
+			hrs[i] = E_FILE_NOT_FOUND
+		} else if len(o.children) > 0 && option != PORTABLE_DEVICE_DELETE_WITH_RECURSION {
+			hrs[i] = E_DIR_NOT_EMPTY
+		} else {
+			m.remove(id)
+		}
+	}
+	return hrs, nil
+}
+
+func (m *MemoryBackend) remove(id string) {
+	o := m.objects[id]
+	// the children unlink themselves from o
+	for _, c := range append([]string(nil), o.children...) {
+		m.remove(c)
+	}
+	m.unlink(id)
+	delete(m.objects, id)
+}
+
+// unlink removes id from the children of its parent.
+func (m *MemoryBackend) unlink(id string) {
+	p := m.objects[m.objects[id].props.String(WPD_OBJECT_PARENT_ID)]
+	if p == nil {
+		return
+	}
+	for i, c := range p.children {
+		if c == id {
+			p.children = append(p.children[:i], p.children[i+1:]...)
+			break
+		}
+	}
+}
+
+func (m *MemoryBackend) Copy(ids []string, parentId string) ([]int32, error) {
+	if err := m.fault("Copy", ids...); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.checkParent(parentId); err != nil {
+		return nil, err
+	}
+	hrs := make([]int32, len(ids))
+	for i, id := range ids {
+		if m.objects[id] == nil || id == WPD_DEVICE_OBJECT_ID {
+			hrs[i] = E_FILE_NOT_FOUND
+		} else if m.isAncestor(id, parentId) {
+			hrs[i] = E_INVALIDARG
+		} else {
+			m.copy(id, parentId)
+		}
+	}
+	return hrs, nil
+}
+
+func (m *MemoryBackend) Move(ids []string, parentId string) ([]int32, error) {
+	if err := m.fault("Move", ids...); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.checkParent(parentId); err != nil {
+		return nil, err
+	}
+	hrs := make([]int32, len(ids))
+	for i, id := range ids {
+		o := m.objects[id]
+		if o == nil || id == WPD_DEVICE_OBJECT_ID {
+			hrs[i] = E_FILE_NOT_FOUND
+		} else if m.isAncestor(id, parentId) {
+			hrs[i] = E_INVALIDARG
+		} else {
+			m.unlink(id)
+			o.props[WPD_OBJECT_PARENT_ID] = parentId
+			p := m.objects[parentId]
+			p.children = append(p.children, id)
+		}
+	}
+	return hrs, nil
+}
+
+func (m *MemoryBackend) copy(id string, parentId string) {
+	o := m.objects[id]
+	props := make(PropertyValues, len(o.props))
+	for key, val := range o.props {
+		props[key] = val
+	}
+	props[WPD_OBJECT_PARENT_ID] = parentId
+	newId, _ := m.create(props, append([]byte(nil), o.data...))
+	for key, r := range o.resources {
+		c := m.objects[newId]
+		if c.resources == nil {
+			c.resources = make(map[PROPERTYKEY]*memResource)
+		}
+		c.resources[key] = &memResource{append([]byte(nil), r.data...), r.format}
+	}
+	for _, c := range o.children {
+		m.copy(c, newId)
+	}
+}
+
+func (m *MemoryBackend) isAncestor(id string, descendantId string) bool {
+	for o := m.objects[descendantId]; descendantId != ""; o = m.objects[descendantId] {
+		if descendantId == id {
+			return true
+		}
+		if o == nil {
+			break
+		}
+		descendantId = o.props.String(WPD_OBJECT_PARENT_ID)
+	}
+	return false
+}
+
+func isFolder(props PropertyValues) bool {
+	t := props.Guid(WPD_OBJECT_CONTENT_TYPE)
+	return t == WPD_CONTENT_TYPE_FOLDER || t == WPD_CONTENT_TYPE_FUNCTIONAL_OBJECT
+}
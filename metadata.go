@@ -0,0 +1,134 @@
+package gowpd
+
+import (
+	"bytes"
+	"io"
+	"time"
+)
+
+var (
+	WPD_OBJECT_DATE_AUTHORED = PROPERTYKEY{GUID{0xEF6B490D, 0x5CD8, 0x437A, [8]byte{0xAF, 0xFC, 0xDA, 0x8B, 0x60, 0xEE, 0x4A, 0x3C}}, 20}
+	WPD_MEDIA_TITLE          = PROPERTYKEY{GUID{0x2ED8BA05, 0x0AD3, 0x42DC, [8]byte{0xB0, 0xE0, 0xBC, 0x95, 0xAC, 0x39, 0x6A, 0xC8}}, 18}
+	WPD_MEDIA_DURATION       = PROPERTYKEY{GUID{0x2ED8BA05, 0x0AD3, 0x42DC, [8]byte{0xB0, 0xE0, 0xBC, 0x95, 0xAC, 0x39, 0x6A, 0xC8}}, 19}
+	WPD_MEDIA_WIDTH          = PROPERTYKEY{GUID{0x2ED8BA05, 0x0AD3, 0x42DC, [8]byte{0xB0, 0xE0, 0xBC, 0x95, 0xAC, 0x39, 0x6A, 0xC8}}, 22}
+	WPD_MEDIA_HEIGHT         = PROPERTYKEY{GUID{0x2ED8BA05, 0x0AD3, 0x42DC, [8]byte{0xB0, 0xE0, 0xBC, 0x95, 0xAC, 0x39, 0x6A, 0xC8}}, 23}
+	WPD_MEDIA_ARTIST         = PROPERTYKEY{GUID{0x2ED8BA05, 0x0AD3, 0x42DC, [8]byte{0xB0, 0xE0, 0xBC, 0x95, 0xAC, 0x39, 0x6A, 0xC8}}, 24}
+	WPD_MEDIA_GENRE          = PROPERTYKEY{GUID{0x2ED8BA05, 0x0AD3, 0x42DC, [8]byte{0xB0, 0xE0, 0xBC, 0x95, 0xAC, 0x39, 0x6A, 0xC8}}, 32}
+	WPD_MUSIC_ALBUM          = PROPERTYKEY{GUID{0xB324F56A, 0xDC5D, 0x46E5, [8]byte{0xB6, 0xDF, 0xD2, 0xEA, 0x41, 0x48, 0x88, 0xC6}}, 3}
+	WPD_MUSIC_TRACK          = PROPERTYKEY{GUID{0xB324F56A, 0xDC5D, 0x46E5, [8]byte{0xB6, 0xDF, 0xD2, 0xEA, 0x41, 0x48, 0x88, 0xC6}}, 4}
+)
+
+// METADATA_HEAD_SIZE is how much of a stream which cannot be read at random
+// offsets is searched for tags.
+const METADATA_HEAD_SIZE = 256 * 1024
+
+// Metadata is the media information found in the tags of a file.
+type Metadata struct {
+	Title     string
+	Artist    string
+	Album     string
+	Genre     string
+	Track     int
+	Duration  time.Duration
+	Width     int
+	Height    int
+	DateTaken time.Time
+}
+
+// Values returns the WPD properties of the fields which are set.
+func (m *Metadata) Values() PropertyValues {
+	v := make(PropertyValues)
+	setString := func(key PROPERTYKEY, s string) {
+		if s != "" {
+			v[key] = s
+		}
+	}
+	setString(WPD_MEDIA_TITLE, m.Title)
+	setString(WPD_MEDIA_ARTIST, m.Artist)
+	setString(WPD_MUSIC_ALBUM, m.Album)
+	setString(WPD_MEDIA_GENRE, m.Genre)
+	if m.Track > 0 {
+		v[WPD_MUSIC_TRACK] = uint32(m.Track)
+	}
+	if m.Duration > 0 {
+		v[WPD_MEDIA_DURATION] = uint64(m.Duration / time.Millisecond)
+	}
+	if m.Width > 0 && m.Height > 0 {
+		v[WPD_MEDIA_WIDTH] = uint32(m.Width)
+		v[WPD_MEDIA_HEIGHT] = uint32(m.Height)
+	}
+	if !m.DateTaken.IsZero() {
+		v[WPD_OBJECT_DATE_AUTHORED] = m.DateTaken
+	}
+	return v
+}
+
+// ReadMetadata reads the ID3v2, FLAC, MP4 or EXIF tags of the size bytes of
+// r. It returns nil if the format has no tags it knows.
+func ReadMetadata(r io.ReaderAt, size int64) (*Metadata, error) {
+	head := make([]byte, 16)
+	n, err := r.ReadAt(head, 0)
+	if n < len(head) && err != nil && err != io.EOF {
+		return nil, err
+	}
+	head = head[:n]
+	switch {
+	case bytes.HasPrefix(head, []byte("ID3")):
+		return readID3(r, size)
+	case bytes.HasPrefix(head, []byte("fLaC")):
+		return readFLAC(r, size)
+	case len(head) >= 8 && string(head[4:8]) == "ftyp":
+		return readMP4(r, size)
+	case bytes.HasPrefix(head, []byte("\xFF\xD8\xFF")):
+		return readJPEG(r, size)
+	case bytes.HasPrefix(head, []byte("\x89PNG\r\n\x1A\n")):
+		return readPNG(r, size)
+	}
+	return nil, nil
+}
+
+// WithMetadata sets the media properties of uploaded objects from the tags
+// of their data. Sources other than files are searched in their first
+// METADATA_HEAD_SIZE bytes only.
+func WithMetadata() CopyOption {
+	return func(o *copyOptions) {
+		o.metadata = true
+	}
+}
+
+// readMetadata returns the media properties of the upload src of size bytes
+// and a reader returning the whole content of src.
+func (o *copyOptions) readMetadata(src io.Reader, size int64) (PropertyValues, io.Reader) {
+	if !o.metadata {
+		return nil, src
+	}
+	var m *Metadata
+	if ra, ok := src.(io.ReaderAt); ok {
+		m, _ = ReadMetadata(ra, size)
+	} else {
+		var head bytes.Buffer
+		io.CopyN(&head, src, METADATA_HEAD_SIZE)
+		m, _ = ReadMetadata(bytes.NewReader(head.Bytes()), int64(head.Len()))
+		src = io.MultiReader(&head, src)
+	}
+	if m == nil {
+		return nil, src
+	}
+	return m.Values(), src
+}
+
+// readSection returns the n bytes of r at off, or an error if there are
+// fewer.
+func readSection(r io.ReaderAt, off int64, n int64) ([]byte, error) {
+	if n < 0 || n > 64*1024*1024 {
+		return nil, errTagSize
+	}
+	buf := make([]byte, n)
+	if _, err := r.ReadAt(buf, off); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf, nil
+}
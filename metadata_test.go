@@ -0,0 +1,244 @@
+package gowpd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func id3Frame(id string, body string) string {
+	b := make([]byte, 10)
+	copy(b, id)
+	binary.BigEndian.PutUint32(b[4:], uint32(len(body)))
+	return string(b) + body
+}
+
+func testID3() []byte {
+	frames := id3Frame("TIT2", "\x00Song") +
+		id3Frame("TPE1", "\x01\xFF\xFEA\x00r\x00t\x00") +
+		id3Frame("TALB", "\x03Album") +
+		id3Frame("TCON", "\x00(13)") +
+		id3Frame("TRCK", "\x003/12") +
+		id3Frame("TLEN", "\x00185000")
+	n := len(frames)
+	header := []byte{'I', 'D', '3', 3, 0, 0, byte(n >> 21 & 0x7F), byte(n >> 14 & 0x7F), byte(n >> 7 & 0x7F), byte(n & 0x7F)}
+	return append(append(header, frames...), make([]byte, 100)...)
+}
+
+func testFLAC() []byte {
+	var b bytes.Buffer
+	b.WriteString("fLaC")
+	b.Write([]byte{flacStreamInfo, 0, 0, 34})
+	info := make([]byte, 34)
+	binary.BigEndian.PutUint64(info[10:], 44100<<44|1<<41|15<<36|44100*3)
+	b.Write(info)
+	var c bytes.Buffer
+	vorbisString := func(s string) {
+		binary.Write(&c, binary.LittleEndian, uint32(len(s)))
+		c.WriteString(s)
+	}
+	vorbisString("vendor")
+	binary.Write(&c, binary.LittleEndian, uint32(3))
+	vorbisString("title=Song")
+	vorbisString("ARTIST=Artist")
+	vorbisString("TRACKNUMBER=7")
+	b.Write([]byte{0x80 | flacVorbisComment, 0, byte(c.Len() >> 8), byte(c.Len())})
+	b.Write(c.Bytes())
+	return b.Bytes()
+}
+
+func mp4Box(typ string, body ...[]byte) []byte {
+	b := bytes.Join(body, nil)
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header, uint32(8+len(b)))
+	copy(header[4:], typ)
+	return append(header, b...)
+}
+
+func testMP4() []byte {
+	mvhd := make([]byte, 100)
+	binary.BigEndian.PutUint32(mvhd[12:], 1000)
+	binary.BigEndian.PutUint32(mvhd[16:], 5500)
+	tkhd := make([]byte, 84)
+	binary.BigEndian.PutUint32(tkhd[76:], 640<<16)
+	binary.BigEndian.PutUint32(tkhd[80:], 480<<16)
+	data := func(value []byte) []byte {
+		return mp4Box("data", make([]byte, 8), value)
+	}
+	ilst := mp4Box("ilst",
+		mp4Box("\xA9nam", data([]byte("Clip"))),
+		mp4Box("\xA9ART", data([]byte("Artist"))),
+		mp4Box("gnre", data([]byte{0, 14})),
+		mp4Box("trkn", data([]byte{0, 0, 0, 2, 0, 9, 0, 0})))
+	return bytes.Join([][]byte{
+		mp4Box("ftyp", []byte("isom\x00\x00\x02\x00isommp41")),
+		mp4Box("moov",
+			mp4Box("mvhd", mvhd),
+			mp4Box("trak", mp4Box("tkhd", tkhd)),
+			mp4Box("udta", mp4Box("meta", make([]byte, 4), ilst))),
+		mp4Box("mdat", make([]byte, 64)),
+	}, nil)
+}
+
+func testJPEG() []byte {
+	tiff := []byte("II*\x00\x08\x00\x00\x00")
+	entry := func(tag, typ uint16, n, value uint32) []byte {
+		b := make([]byte, 12)
+		binary.LittleEndian.PutUint16(b, tag)
+		binary.LittleEndian.PutUint16(b[2:], typ)
+		binary.LittleEndian.PutUint32(b[4:], n)
+		binary.LittleEndian.PutUint32(b[8:], value)
+		return b
+	}
+	// IFD0 at 8 points to the EXIF IFD at 26, whose date is at 44
+	tiff = append(tiff, 1, 0)
+	tiff = append(tiff, entry(exifIFDPointer, 4, 1, 26)...)
+	tiff = append(tiff, 0, 0, 0, 0, 1, 0)
+	tiff = append(tiff, entry(exifDateTimeOriginal, 2, 20, 44)...)
+	tiff = append(tiff, 0, 0, 0, 0)
+	tiff = append(tiff, "2021:05:06 07:08:09\x00"...)
+
+	var b bytes.Buffer
+	b.Write([]byte{0xFF, 0xD8})
+	app1 := append([]byte("Exif\x00\x00"), tiff...)
+	b.Write([]byte{0xFF, 0xE1, byte((len(app1) + 2) >> 8), byte(len(app1) + 2)})
+	b.Write(app1)
+	b.Write([]byte{0xFF, 0xC0, 0, 17, 8, 0x02, 0x58, 0x03, 0x20, 3})
+	b.Write(make([]byte, 9))
+	b.Write([]byte{0xFF, 0xD9})
+	return b.Bytes()
+}
+
+func testPNG() []byte {
+	b := []byte("\x89PNG\r\n\x1A\n\x00\x00\x00\x0DIHDR")
+	size := make([]byte, 8)
+	binary.BigEndian.PutUint32(size, 1920)
+	binary.BigEndian.PutUint32(size[4:], 1080)
+	return append(append(b, size...), 8, 6, 0, 0, 0, 0, 0, 0, 0)
+}
+
+func TestReadMetadata(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want Metadata
+	}{
+		{"id3", testID3(), Metadata{Title: "Song", Artist: "Art", Album: "Album", Genre: "Pop", Track: 3, Duration: 185 * time.Second}},
+		{"flac", testFLAC(), Metadata{Title: "Song", Artist: "Artist", Track: 7, Duration: 3 * time.Second}},
+		{"mp4", testMP4(), Metadata{Title: "Clip", Artist: "Artist", Genre: "Pop", Track: 2, Duration: 5500 * time.Millisecond, Width: 640, Height: 480}},
+		{"jpeg", testJPEG(), Metadata{Width: 800, Height: 600, DateTaken: time.Date(2021, 5, 6, 7, 8, 9, 0, time.Local)}},
+		{"png", testPNG(), Metadata{Width: 1920, Height: 1080}},
+	}
+	for _, tt := range tests {
+		m, err := ReadMetadata(bytes.NewReader(tt.data), int64(len(tt.data)))
+		if err != nil || m == nil {
+			t.Errorf("%v: %v %v", tt.name, m, err)
+			continue
+		}
+		if !m.DateTaken.Equal(tt.want.DateTaken) {
+			t.Errorf("%v: date = %v", tt.name, m.DateTaken)
+		}
+		m.DateTaken = tt.want.DateTaken
+		if *m != tt.want {
+			t.Errorf("%v: %+v", tt.name, *m)
+		}
+	}
+
+	if m, err := ReadMetadata(strings.NewReader("plain text"), 10); m != nil || err != nil {
+		t.Errorf("text: %v %v", m, err)
+	}
+	// a tag claiming more than the file holds
+	data := testMP4()[:60]
+	if _, err := ReadMetadata(bytes.NewReader(data), int64(len(data))); err == nil {
+		t.Errorf("truncated mp4: expected error")
+	}
+}
+
+func TestUploadMetadata(t *testing.T) {
+	d := NewMemoryDevice()
+	root := putFolder(t, d, WPD_DEVICE_OBJECT_ID, "Storage")
+	data := testID3()
+	upload := func(name string, src func() io.Reader, opts ...CopyOption) PropertyValues {
+		obj := &Object{Name: name, ObjectInfo: ObjectInfo{Size: int64(len(data))}}
+		if _, err := d.CopyObjectToDevice(root, src(), obj, opts...); err != nil {
+			t.Fatal(err)
+		}
+		v, err := d.backend.GetValues(childId(t, d, root, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	v := upload("a.mp3", func() io.Reader { return bytes.NewReader(data) }, WithMetadata())
+	if v.String(WPD_MEDIA_TITLE) != "Song" || v[WPD_MUSIC_TRACK] != uint32(3) || v.Uint64(WPD_MEDIA_DURATION) != 185000 {
+		t.Errorf("reader at: %v", v)
+	}
+	if v.Guid(WPD_OBJECT_FORMAT) != FormatGUID(MTP_FORMAT_MP3) {
+		t.Errorf("format: %v", v.Guid(WPD_OBJECT_FORMAT))
+	}
+
+	// a stream is searched in its head and still uploaded whole
+	v = upload("b.mp3", func() io.Reader {
+		r := bytes.NewReader(data)
+		return readerFunc(r.Read)
+	}, WithMetadata())
+	if v.String(WPD_MUSIC_ALBUM) != "Album" || v.Uint64(WPD_OBJECT_SIZE) != uint64(len(data)) {
+		t.Errorf("stream: %v", v)
+	}
+
+	v = upload("c.mp3", func() io.Reader { return bytes.NewReader(data) })
+	if _, ok := v[WPD_MEDIA_TITLE]; ok {
+		t.Errorf("metadata without option: %v", v)
+	}
+
+	dir, err := ioutil.TempDir("", "gowpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "d.jpg")
+	if err := ioutil.WriteFile(src, testJPEG(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.CopyToDevice(root, src, WithMetadata()); err != nil {
+		t.Fatal(err)
+	}
+	v, _ = d.backend.GetValues(childId(t, d, root, "d.jpg"))
+	if v[WPD_MEDIA_WIDTH] != uint32(800) || v[WPD_MEDIA_HEIGHT] != uint32(600) || v.Time(WPD_OBJECT_DATE_AUTHORED).IsZero() {
+		t.Errorf("file: %v", v)
+	}
+}
+
+// id3Tag returns an ID3v2.3 tag of body with the header flags.
+func id3Tag(flags byte, body string) []byte {
+	n := len(body)
+	header := []byte{'I', 'D', '3', 3, 0, flags, byte(n >> 21 & 0x7F), byte(n >> 14 & 0x7F), byte(n >> 7 & 0x7F), byte(n & 0x7F)}
+	return append(header, body...)
+}
+
+func TestReadMetadataSizes(t *testing.T) {
+	// sizes of 0xFFFFFFFF are negative as int on 32-bit platforms
+	data := id3Tag(0x40, "\xFF\xFF\xFF\xFF"+id3Frame("TIT2", "\x00Song"))
+	if _, err := ReadMetadata(bytes.NewReader(data), int64(len(data))); err != errTagSize {
+		t.Errorf("extended header: %v", err)
+	}
+	frame := id3Frame("TIT2", "\x00Song")
+	data = id3Tag(0, id3Frame("TPE1", "\x00Art")+frame[:4]+"\xFF\xFF\xFF\xFF"+frame[8:])
+	if m, err := ReadMetadata(bytes.NewReader(data), int64(len(data))); err != nil || m == nil || m.Artist != "Art" || m.Title != "" {
+		t.Errorf("frame: %+v %v", m, err)
+	}
+
+	data = testFLAC()
+	i := bytes.Index(data, []byte("title="))
+	binary.LittleEndian.PutUint32(data[i-4:], 0xFFFFFFFF)
+	if m, err := ReadMetadata(bytes.NewReader(data), int64(len(data))); err != nil || m == nil || m.Title != "" {
+		t.Errorf("flac: %+v %v", m, err)
+	}
+}
@@ -0,0 +1,145 @@
+package gowpd
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// readMP4 reads the duration, video size and iTunes tags of an ISO base
+// media file.
+func readMP4(r io.ReaderAt, size int64) (*Metadata, error) {
+	m := &Metadata{}
+	err := mp4Boxes(r, 0, size, func(typ string, off, n int64) error {
+		if typ == "moov" {
+			return readMoov(r, off, off+n, m)
+		}
+		return nil
+	})
+	return m, err
+}
+
+// mp4Boxes calls fn with the type and body of each box from off to end.
+func mp4Boxes(r io.ReaderAt, off int64, end int64, fn func(typ string, off, n int64) error) error {
+	for off+8 <= end {
+		header, err := readSection(r, off, 8)
+		if err != nil {
+			return err
+		}
+		n := int64(binary.BigEndian.Uint32(header))
+		typ := string(header[4:8])
+		bodyOff := off + 8
+		switch n {
+		case 0:
+			n = end - off
+		case 1:
+			large, err := readSection(r, off+8, 8)
+			if err != nil {
+				return err
+			}
+			n = int64(binary.BigEndian.Uint64(large))
+			bodyOff += 8
+		}
+		if n < bodyOff-off || off+n > end {
+			return errTagSize
+		}
+		if err = fn(typ, bodyOff, off+n-bodyOff); err != nil {
+			return err
+		}
+		off += n
+	}
+	return nil
+}
+
+func readMoov(r io.ReaderAt, off int64, end int64, m *Metadata) error {
+	return mp4Boxes(r, off, end, func(typ string, off, n int64) error {
+		switch typ {
+		case "mvhd":
+			b, err := readSection(r, off, n)
+			if err != nil {
+				return err
+			}
+			readMvhd(b, m)
+		case "trak":
+			return mp4Boxes(r, off, off+n, func(typ string, off, n int64) error {
+				if typ != "tkhd" || n < 8 {
+					return nil
+				}
+				b, err := readSection(r, off+n-8, 8)
+				if err != nil {
+					return err
+				}
+				// 16.16 fixed point, zero for audio tracks
+				w := int(binary.BigEndian.Uint32(b) >> 16)
+				h := int(binary.BigEndian.Uint32(b[4:]) >> 16)
+				if w > 0 && h > 0 && m.Width == 0 {
+					m.Width, m.Height = w, h
+				}
+				return nil
+			})
+		case "udta":
+			return readMoov(r, off, off+n, m)
+		case "meta":
+			// full box: version and flags come first
+			return mp4Boxes(r, off+4, off+n, func(typ string, off, n int64) error {
+				if typ != "ilst" {
+					return nil
+				}
+				return readIlst(r, off, off+n, m)
+			})
+		}
+		return nil
+	})
+}
+
+func readMvhd(b []byte, m *Metadata) {
+	var scale, duration uint64
+	switch {
+	case len(b) >= 32 && b[0] == 1:
+		scale = uint64(binary.BigEndian.Uint32(b[20:]))
+		duration = binary.BigEndian.Uint64(b[24:])
+	case len(b) >= 20:
+		scale = uint64(binary.BigEndian.Uint32(b[12:]))
+		duration = uint64(binary.BigEndian.Uint32(b[16:]))
+	}
+	if scale > 0 {
+		m.Duration = time.Duration(duration) * time.Second / time.Duration(scale)
+	}
+}
+
+// readIlst reads the iTunes tags.
+func readIlst(r io.ReaderAt, off int64, end int64, m *Metadata) error {
+	return mp4Boxes(r, off, end, func(item string, off, n int64) error {
+		return mp4Boxes(r, off, off+n, func(typ string, off, n int64) error {
+			if typ != "data" || n < 8 {
+				return nil
+			}
+			b, err := readSection(r, off, n)
+			if err != nil {
+				return err
+			}
+			value := b[8:]
+			switch item {
+			case "\xA9nam":
+				m.Title = string(value)
+			case "\xA9ART":
+				m.Artist = string(value)
+			case "\xA9alb":
+				m.Album = string(value)
+			case "\xA9gen":
+				m.Genre = string(value)
+			case "gnre":
+				if len(value) >= 2 {
+					if g := int(binary.BigEndian.Uint16(value)); g > 0 && g <= len(id3v1Genres) {
+						m.Genre = id3v1Genres[g-1]
+					}
+				}
+			case "trkn":
+				if len(value) >= 4 {
+					m.Track = int(binary.BigEndian.Uint16(value[2:]))
+				}
+			}
+			return nil
+		})
+	})
+}
@@ -0,0 +1,171 @@
+package gowpd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MTP operation and response codes and PTP container types.
+const (
+	MTP_OPERATION_OPEN_SESSION          = 0x1002
+	MTP_OPERATION_GET_PARTIAL_OBJECT_64 = 0x95C1
+
+	MTP_RESPONSE_OK                    = 0x2001
+	MTP_RESPONSE_INVALID_OBJECT_HANDLE = 0x2009
+	MTP_RESPONSE_DEVICE_BUSY           = 0x2019
+	MTP_RESPONSE_SESSION_ALREADY_OPEN  = 0x201E
+
+	PTP_CONTAINER_COMMAND  = 1
+	PTP_CONTAINER_DATA     = 2
+	PTP_CONTAINER_RESPONSE = 3
+
+	ptpHeaderSize = 12
+	// maxPartialSize is the most bytes asked for by one GetPartialObject64.
+	maxPartialSize = 1 << 30
+)
+
+// MTPResponse is an MTP response code other than OK.
+type MTPResponse uint16
+
+func (r MTPResponse) Error() string {
+	return fmt.Sprintf("MTP response (%#04x)", uint16(r))
+}
+
+// MTPSession issues MTP operations over Transport, which carries the
+// containers of the bulk pipes of a device. It is the part of a pure-Go
+// backend which reads objects in parts.
+type MTPSession struct {
+	Transport io.ReadWriter
+
+	mu            sync.Mutex
+	transactionId uint32
+}
+
+// OpenSession opens the session id on the device.
+func (s *MTPSession) OpenSession(id uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.transactionId = 0
+	_, err := s.transaction(MTP_OPERATION_OPEN_SESSION, []uint32{id}, nil)
+	if err == MTPResponse(MTP_RESPONSE_SESSION_ALREADY_OPEN) {
+		err = nil
+	}
+	return err
+}
+
+// ReadPartial implements PartialReader with GetPartialObject64. id is an
+// object id of the MTP class driver, "o" followed by the hex object handle.
+func (s *MTPSession) ReadPartial(id string, offset int64, buf []byte) (int, error) {
+	handle, err := objectHandle(id)
+	if err != nil {
+		return 0, err
+	}
+	if len(buf) > maxPartialSize {
+		buf = buf[:maxPartialSize]
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	params := []uint32{handle, uint32(offset), uint32(uint64(offset) >> 32), uint32(len(buf))}
+	return s.transaction(MTP_OPERATION_GET_PARTIAL_OBJECT_64, params, buf)
+}
+
+// objectHandle returns the MTP object handle of the object id.
+func objectHandle(id string) (uint32, error) {
+	if !strings.HasPrefix(id, "o") {
+		return 0, HResult(E_INVALIDARG)
+	}
+	h, err := strconv.ParseUint(id[1:], 16, 32)
+	if err != nil {
+		return 0, HResult(E_INVALIDARG)
+	}
+	return uint32(h), nil
+}
+
+// transaction sends the operation code with params and reads the data of
+// the device into buf until the response. It returns the bytes of data read.
+func (s *MTPSession) transaction(code uint16, params []uint32, buf []byte) (int, error) {
+	s.transactionId++
+	cmd := make([]byte, ptpHeaderSize+4*len(params))
+	putContainerHeader(cmd, len(cmd), PTP_CONTAINER_COMMAND, code, s.transactionId)
+	for i, p := range params {
+		binary.LittleEndian.PutUint32(cmd[ptpHeaderSize+4*i:], p)
+	}
+	if _, err := s.Transport.Write(cmd); err != nil {
+		return 0, err
+	}
+	n := 0
+	for {
+		length, typ, resp, err := s.readContainerHeader()
+		if err != nil {
+			return n, err
+		}
+		switch typ {
+		case PTP_CONTAINER_DATA:
+			size := int64(length) - ptpHeaderSize
+			if size > int64(len(buf)-n) {
+				return n, fmt.Errorf("MTP data too long : %v", size)
+			}
+			m, err := io.ReadFull(s.Transport, buf[n:n+int(size)])
+			n += m
+			if err != nil {
+				return n, err
+			}
+		case PTP_CONTAINER_RESPONSE:
+			if _, err = io.CopyN(ioutil.Discard, s.Transport, int64(length)-ptpHeaderSize); err != nil {
+				return n, err
+			}
+			switch resp {
+			case MTP_RESPONSE_OK:
+				return n, nil
+			case MTP_RESPONSE_DEVICE_BUSY:
+				return n, HResult(E_BUSY)
+			}
+			return n, MTPResponse(resp)
+		default:
+			return n, fmt.Errorf("MTP container type : %v", typ)
+		}
+	}
+}
+
+// readContainerHeader reads the header of the next container of the
+// transaction being run.
+func (s *MTPSession) readContainerHeader() (length uint32, typ uint16, code uint16, err error) {
+	var h [ptpHeaderSize]byte
+	if _, err = io.ReadFull(s.Transport, h[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	length = binary.LittleEndian.Uint32(h[0:])
+	typ = binary.LittleEndian.Uint16(h[4:])
+	code = binary.LittleEndian.Uint16(h[6:])
+	if length < ptpHeaderSize {
+		err = fmt.Errorf("MTP container length : %v", length)
+	} else if id := binary.LittleEndian.Uint32(h[8:]); id != s.transactionId {
+		err = fmt.Errorf("MTP transaction id : %v != %v", id, s.transactionId)
+	}
+	return
+}
+
+func putContainerHeader(b []byte, length int, typ uint16, code uint16, transactionId uint32) {
+	binary.LittleEndian.PutUint32(b[0:], uint32(length))
+	binary.LittleEndian.PutUint16(b[4:], typ)
+	binary.LittleEndian.PutUint16(b[6:], code)
+	binary.LittleEndian.PutUint32(b[8:], transactionId)
+}
+
+// MTPBackend is Backend reading objects in parts through Session.
+type MTPBackend struct {
+	Backend
+	Session *MTPSession
+}
+
+func (b *MTPBackend) ReadPartial(id string, offset int64, buf []byte) (int, error) {
+	return b.Session.ReadPartial(id, offset, buf)
+}
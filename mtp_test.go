@@ -0,0 +1,116 @@
+package gowpd
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// mtpResponder answers MTP operations on conn like a device serving the
+// objects of b.
+type mtpResponder struct {
+	conn net.Conn
+	b    *MemoryBackend
+	// busy is the number of partial reads answered with DEVICE_BUSY.
+	busy     int
+	requests [][]uint32
+}
+
+func (r *mtpResponder) serve() {
+	for {
+		var h [ptpHeaderSize]byte
+		if _, err := io.ReadFull(r.conn, h[:]); err != nil {
+			return
+		}
+		params := make([]uint32, (binary.LittleEndian.Uint32(h[0:])-ptpHeaderSize)/4)
+		if err := binary.Read(r.conn, binary.LittleEndian, params); err != nil {
+			return
+		}
+		code := binary.LittleEndian.Uint16(h[6:])
+		tid := binary.LittleEndian.Uint32(h[8:])
+		switch code {
+		case MTP_OPERATION_OPEN_SESSION:
+			r.send(PTP_CONTAINER_RESPONSE, MTP_RESPONSE_OK, tid, nil)
+		case MTP_OPERATION_GET_PARTIAL_OBJECT_64:
+			r.requests = append(r.requests, params)
+			if r.busy > 0 {
+				r.busy--
+				r.send(PTP_CONTAINER_RESPONSE, MTP_RESPONSE_DEVICE_BUSY, tid, nil)
+				continue
+			}
+			id := "o" + strconv.FormatUint(uint64(params[0]), 16)
+			stream, _, err := r.b.GetStream(id, WPD_RESOURCE_DEFAULT)
+			if err != nil {
+				r.send(PTP_CONTAINER_RESPONSE, MTP_RESPONSE_INVALID_OBJECT_HANDLE, tid, nil)
+				continue
+			}
+			buf := make([]byte, params[3])
+			offset := int64(params[1]) | int64(params[2])<<32
+			n, _ := stream.(io.ReaderAt).ReadAt(buf, offset)
+			stream.Close()
+			r.send(PTP_CONTAINER_DATA, code, tid, buf[:n])
+			r.send(PTP_CONTAINER_RESPONSE, MTP_RESPONSE_OK, tid, nil)
+		}
+	}
+}
+
+func (r *mtpResponder) send(typ uint16, code uint16, tid uint32, payload []byte) {
+	b := make([]byte, ptpHeaderSize+len(payload))
+	putContainerHeader(b, len(b), typ, code, tid)
+	copy(b[ptpHeaderSize:], payload)
+	r.conn.Write(b)
+}
+
+func TestMTPSession(t *testing.T) {
+	host, dev := net.Pipe()
+	defer host.Close()
+	mem := NewMemoryBackend()
+	r := &mtpResponder{conn: dev, b: mem}
+	go r.serve()
+	s := &MTPSession{Transport: host}
+	if err := s.OpenSession(1); err != nil {
+		t.Fatal(err)
+	}
+
+	var delays []time.Duration
+	d := NewDevice(&MTPBackend{mem, s})
+	d.Retry = testRetryPolicy(&delays)
+	root := putFolder(t, d, WPD_DEVICE_OBJECT_ID, "Storage")
+	data := testData(1000)
+	id := putFile(t, d, root, "a", data)
+
+	rc, err := d.OpenRange(id, 10, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil || string(got) != data[10:15] {
+		t.Errorf("range = %q, %v", got, err)
+	}
+	buf := make([]byte, 20)
+	r.busy = 1
+	if n, err := d.ReadAt(id, buf, 995); n != 5 || err != io.EOF || string(buf[:n]) != data[995:] {
+		t.Errorf("ReadAt at end = %v %v", n, err)
+	}
+	if len(delays) != 1 {
+		t.Errorf("delays = %v", delays)
+	}
+
+	if n, err := s.ReadPartial(id, 1<<32+5, buf); n != 0 || err != nil {
+		t.Errorf("beyond 4 GiB = %v %v", n, err)
+	}
+	if p := r.requests[len(r.requests)-1]; p[1] != 5 || p[2] != 1 || p[3] != 20 {
+		t.Errorf("params = %v", p)
+	}
+	if _, err := s.ReadPartial("o99", 0, buf); err != MTPResponse(MTP_RESPONSE_INVALID_OBJECT_HANDLE) {
+		t.Errorf("invalid handle: %v", err)
+	}
+	if _, err := s.ReadPartial(WPD_DEVICE_OBJECT_ID, 0, buf); err != HResult(E_INVALIDARG) {
+		t.Errorf("device id: %v", err)
+	}
+}
@@ -0,0 +1,174 @@
+package gowpd
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// NamePolicy derives WPD_OBJECT_NAME of an uploaded object from its file
+// name, which is WPD_OBJECT_ORIGINAL_FILE_NAME.
+type NamePolicy int
+
+const (
+	// NAME_STRIP_EXT drops the last extension: "archive.tar.gz" is named
+	// "archive.tar". Names starting with their only dot, like ".nomedia",
+	// are kept.
+	NAME_STRIP_EXT NamePolicy = iota
+	// NAME_FULL uses the whole file name.
+	NAME_FULL
+)
+
+func (p NamePolicy) ObjectName(fileName string) string {
+	if p == NAME_FULL {
+		return fileName
+	}
+	ext := filepath.Ext(fileName)
+	if ext == fileName {
+		return fileName
+	}
+	return fileName[:len(fileName)-len(ext)]
+}
+
+// WithNamePolicy sets how uploaded objects are named.
+func WithNamePolicy(p NamePolicy) CopyOption {
+	return func(o *copyOptions) {
+		o.namePolicy = p
+	}
+}
+
+// WithObjectName names an uploaded object name, keeping the file name of the
+// source as its WPD_OBJECT_ORIGINAL_FILE_NAME. UploadTree ignores it, as it
+// would give every file the same name.
+func WithObjectName(name string) CopyOption {
+	return func(o *copyOptions) {
+		o.objectName = name
+	}
+}
+
+// WithSanitizer replaces the parts of file names which s does not allow
+// before uploading. Names the device rejects anyway are changed by
+// DefaultSanitizer and uploaded once more, with or without WithSanitizer.
+func WithSanitizer(s *Sanitizer) CopyOption {
+	return func(o *copyOptions) {
+		o.sanitizer = s
+	}
+}
+
+func (o *copyOptions) nameOf(fileName string) string {
+	if o.objectName != "" {
+		return o.objectName
+	}
+	return o.namePolicy.ObjectName(fileName)
+}
+
+func (o *copyOptions) fileNameOf(name string) string {
+	if o.sanitizer == nil || o.sanitizer.Check(name) == nil {
+		return name
+	}
+	return o.sanitizer.Sanitize(name)
+}
+
+// sanitized returns the file name and object name to try again after the
+// device rejected those of fileName, and whether they changed.
+func (o *copyOptions) sanitized(fileName string) (string, string, bool) {
+	s := DefaultSanitizer()
+	name := s.Sanitize(fileName)
+	objName := s.Sanitize(o.nameOf(name))
+	return name, objName, name != fileName || objName != o.nameOf(fileName)
+}
+
+// Sanitizer makes file names acceptable to a device.
+type Sanitizer struct {
+	// Illegal are the characters replaced by Replacement. Control characters
+	// are always replaced.
+	Illegal     string
+	Replacement string
+	// MaxLength is the maximum length in UTF-16 code units, as MTP counts
+	// it. Longer names are shortened keeping the extension. Zero means no
+	// limit.
+	MaxLength int
+}
+
+// DefaultSanitizer returns the rules of FAT file systems and MTP strings,
+// which most devices enforce.
+func DefaultSanitizer() *Sanitizer {
+	return &Sanitizer{
+		Illegal:     `\/:*?"<>|`,
+		Replacement: "_",
+		MaxLength:   254,
+	}
+}
+
+func (s *Sanitizer) illegal(r rune) bool {
+	return r < 0x20 || r == 0x7F || strings.ContainsRune(s.Illegal, r)
+}
+
+// Check returns an error describing why name is not allowed, or nil.
+func (s *Sanitizer) Check(name string) error {
+	switch {
+	case name == "" || name == "." || name == "..":
+		return fmt.Errorf("Invalid name : %q", name)
+	case !utf8.ValidString(name):
+		return fmt.Errorf("Invalid encoding : %q", name)
+	case strings.IndexFunc(name, s.illegal) >= 0:
+		return fmt.Errorf("Invalid character : %q", name)
+	case strings.TrimRight(name, ". ") != name:
+		return fmt.Errorf("Invalid name ending : %q", name)
+	case s.MaxLength > 0 && utf16Len(name) > s.MaxLength:
+		return fmt.Errorf("Name too long : %q", name)
+	}
+	return nil
+}
+
+// Sanitize returns name changed to pass Check.
+func (s *Sanitizer) Sanitize(name string) string {
+	if !utf8.ValidString(name) {
+		name = strings.ToValidUTF8(name, s.Replacement)
+	}
+	var b strings.Builder
+	for _, r := range name {
+		if s.illegal(r) {
+			b.WriteString(s.Replacement)
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	name = strings.TrimRight(b.String(), ". ")
+	if s.MaxLength > 0 && utf16Len(name) > s.MaxLength {
+		ext := filepath.Ext(name)
+		if ext == name || utf16Len(ext) >= s.MaxLength/2 {
+			ext = ""
+		}
+		base := name[:len(name)-len(ext)]
+		for utf16Len(base)+utf16Len(ext) > s.MaxLength {
+			_, size := utf8.DecodeLastRuneInString(base)
+			base = base[:len(base)-size]
+		}
+		name = strings.TrimRight(base, ". ") + ext
+	}
+	if name == "" || name == "." || name == ".." {
+		name = s.Replacement
+	}
+	return name
+}
+
+func utf16Len(s string) int {
+	n := 0
+	for _, r := range s {
+		if r >= 0x10000 {
+			n += 2
+		} else {
+			n++
+		}
+	}
+	return n
+}
+
+// IsNameRejected reports whether err is a device refusing the name of an
+// object.
+func IsNameRejected(err error) bool {
+	hr, ok := ErrorCode(err)
+	return ok && (hr == E_INVALID_NAME || hr == E_FILENAME_TOO_LONG)
+}
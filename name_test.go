@@ -0,0 +1,151 @@
+package gowpd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNamePolicy(t *testing.T) {
+	tests := []struct {
+		fileName string
+		strip    string
+	}{
+		{"archive.tar.gz", "archive.tar"},
+		{"my.holiday.jpg", "my.holiday"},
+		{"photo.jpg", "photo"},
+		{".nomedia", ".nomedia"},
+		{".config.json", ".config"},
+		{"README", "README"},
+		{"name.", "name"},
+	}
+	for _, tt := range tests {
+		if got := NAME_STRIP_EXT.ObjectName(tt.fileName); got != tt.strip {
+			t.Errorf("strip %q = %q, want %q", tt.fileName, got, tt.strip)
+		}
+		if got := NAME_FULL.ObjectName(tt.fileName); got != tt.fileName {
+			t.Errorf("full %q = %q", tt.fileName, got)
+		}
+	}
+}
+
+func TestSanitizer(t *testing.T) {
+	s := DefaultSanitizer()
+	s.MaxLength = 12
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"photo.jpg", "photo.jpg"},
+		{`a:b?.jpg`, "a_b_.jpg"},
+		{"tab\there", "tab_here"},
+		{`x<>|"*/\y`, "x_______y"},
+		{"trailing. .", "trailing"},
+		{"averylongname.jpg", "averylon.jpg"},
+		{"averylongnamewithoutext", "averylongnam"},
+		{"short.averylongextension", "short.averyl"},
+		{"日本語の写真です.jpeg", "日本語の写真で.jpeg"},
+		{"😀😀😀😀😀😀.a", "😀😀😀😀😀.a"},
+		{"...", "_"},
+		{"", "_"},
+		{"bad\xffutf8", "bad_utf8"},
+	}
+	for _, tt := range tests {
+		got := s.Sanitize(tt.name)
+		if got != tt.want {
+			t.Errorf("Sanitize(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+		if err := s.Check(got); err != nil {
+			t.Errorf("Check(%q) = %v", got, err)
+		}
+		if (s.Check(tt.name) == nil) != (tt.name == tt.want) {
+			t.Errorf("Check(%q) = %v", tt.name, s.Check(tt.name))
+		}
+	}
+}
+
+func TestUploadNames(t *testing.T) {
+	b := NewMemoryBackend()
+	d := NewDevice(b)
+	root := putFolder(t, d, WPD_DEVICE_OBJECT_ID, "Storage")
+	tests := []struct {
+		fileName string
+		opts     []CopyOption
+		name     string
+		original string
+	}{
+		{"archive.tar.gz", nil, "archive.tar", "archive.tar.gz"},
+		{"my.holiday.jpg", []CopyOption{WithNamePolicy(NAME_FULL)}, "my.holiday.jpg", "my.holiday.jpg"},
+		{"track01.mp3", []CopyOption{WithObjectName("First Song")}, "First Song", "track01.mp3"},
+		{"a:b.jpg", []CopyOption{WithSanitizer(DefaultSanitizer())}, "a_b", "a_b.jpg"},
+		{"c?.jpg", []CopyOption{WithSanitizer(DefaultSanitizer()), WithAtomic()}, "c_", "c_.jpg"},
+	}
+	for _, tt := range tests {
+		obj := &Object{Name: tt.fileName, ObjectInfo: ObjectInfo{Size: 1}}
+		if _, err := d.CopyObjectToDevice(root, strings.NewReader("x"), obj, tt.opts...); err != nil {
+			t.Fatal(err)
+		}
+		id := childId(t, d, root, tt.original)
+		v, err := b.GetValues(id)
+		if err != nil {
+			t.Errorf("%v: %v", tt.fileName, err)
+			continue
+		}
+		if name := v.String(WPD_OBJECT_NAME); name != tt.name {
+			t.Errorf("%v: name = %q, want %q", tt.fileName, name, tt.name)
+		}
+	}
+}
+
+func TestUploadRejectedName(t *testing.T) {
+	lenient := &Sanitizer{Illegal: "?", Replacement: "-"}
+	tests := []struct {
+		fileName string
+		op       string
+		opts     []CopyOption
+		original string
+		err      bool
+	}{
+		{"a:b.jpg", "CreateObjectWithPropertiesAndData", nil, "a_b.jpg", false},
+		{"c?:.jpg", "CreateObjectWithPropertiesAndData", []CopyOption{WithSanitizer(lenient)}, "c-_.jpg", false},
+		// only the temporary name is rejected
+		{"d:.jpg", "CreateObjectWithPropertiesAndData", []CopyOption{WithAtomic()}, "d:.jpg", false},
+		{"e:.jpg", "SetValues", []CopyOption{WithAtomic()}, "e_.jpg", false},
+		{"fine.jpg", "CreateObjectWithPropertiesAndData", nil, "", true},
+	}
+	for _, tt := range tests {
+		b := NewMemoryBackend()
+		d := NewDevice(b)
+		root := putFolder(t, d, WPD_DEVICE_OBJECT_ID, "Storage")
+		rejected := 0
+		b.Fault = func(op string, ids []string) error {
+			if op == tt.op {
+				rejected++
+				if rejected == 1 {
+					return HResult(E_INVALID_NAME)
+				}
+			}
+			return nil
+		}
+		obj := &Object{Name: tt.fileName, ObjectInfo: ObjectInfo{Size: 1}}
+		_, err := d.CopyObjectToDevice(root, strings.NewReader("x"), obj, tt.opts...)
+		b.Fault = nil
+		if (err != nil) != tt.err {
+			t.Errorf("%v: err = %v", tt.fileName, err)
+		}
+		if tt.err {
+			continue
+		}
+		if got := childNames(t, d, root); !equalMap(got, map[string]string{tt.original: "x"}) {
+			t.Errorf("%v: objects = %v", tt.fileName, got)
+		}
+	}
+}
+
+func TestIsNameRejected(t *testing.T) {
+	if !IsNameRejected(HResult(E_INVALID_NAME)) || !IsNameRejected(HResult(E_FILENAME_TOO_LONG)) {
+		t.Errorf("name errors not detected")
+	}
+	if IsNameRejected(HResult(E_ACCESSDENIED)) || IsNameRejected(nil) {
+		t.Errorf("other errors detected")
+	}
+}
@@ -0,0 +1,195 @@
+package gowpd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	OBJECT_FILE_BLOCK_SIZE  = 64 * 1024
+	OBJECT_FILE_CACHE_BLOCK = 8
+)
+
+// ObjectFile reads an object like an os.File. Data is fetched in blocks,
+// the last few of which are cached, so small reads at scattered offsets
+// (zip directories, MP4 atoms, EXIF headers) do not read the whole object.
+// ReadAt may be called concurrently, as by zip.Reader.
+type ObjectFile struct {
+	d      *Device
+	obj    *Object
+	offset int64
+
+	// mu guards the stream and the cache.
+	mu        sync.Mutex
+	stream    io.ReadCloser
+	streamPos int64
+	blocks    []*fileBlock
+
+	children []*Object
+	listed   bool
+}
+
+type fileBlock struct {
+	start int64
+	data  []byte
+}
+
+// Open returns the object id as an ObjectFile.
+func (d *Device) Open(id string) (*ObjectFile, error) {
+	obj, err := d.GetObject(id)
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectFile{d: d, obj: obj}, nil
+}
+
+func (f *ObjectFile) Object() *Object {
+	return f.obj
+}
+
+func (f *ObjectFile) Stat() (os.FileInfo, error) {
+	return objectFileInfo{f.obj}, nil
+}
+
+func (f *ObjectFile) Read(buf []byte) (int, error) {
+	n, err := f.ReadAt(buf, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *ObjectFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.obj.Size
+	}
+	if offset < 0 {
+		return f.offset, errors.New("Seek : negative position")
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *ObjectFile) ReadAt(buf []byte, offset int64) (int, error) {
+	if f.obj.IsDir {
+		return 0, fmt.Errorf("Is a folder : %v", f.obj.Name)
+	}
+	if offset < 0 {
+		return 0, errors.New("ReadAt : negative offset")
+	}
+	n := 0
+	for n < len(buf) {
+		pos := offset + int64(n)
+		if pos >= f.obj.Size {
+			return n, io.EOF
+		}
+		b, err := f.block(pos - pos%OBJECT_FILE_BLOCK_SIZE)
+		if err != nil {
+			return n, err
+		}
+		off := int(pos - b.start)
+		if off >= len(b.data) {
+			return n, io.ErrUnexpectedEOF
+		}
+		n += copy(buf[n:], b.data[off:])
+	}
+	return n, nil
+}
+
+// block returns the block starting at start from the cache, or reads it.
+// Consecutive blocks are read from one stream. Blocks are not changed once
+// read.
+func (f *ObjectFile) block(start int64) (*fileBlock, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, b := range f.blocks {
+		if b.start == start {
+			copy(f.blocks[1:i+1], f.blocks[:i])
+			f.blocks[0] = b
+			return b, nil
+		}
+	}
+	if f.stream == nil || f.streamPos != start {
+		f.closeStream()
+		stream, err := f.d.OpenRange(f.obj.Id, start, -1)
+		if err != nil {
+			return nil, err
+		}
+		f.stream = stream
+		f.streamPos = start
+	}
+	size := f.obj.Size - start
+	if size > OBJECT_FILE_BLOCK_SIZE {
+		size = OBJECT_FILE_BLOCK_SIZE
+	}
+	b := &fileBlock{start: start, data: make([]byte, size)}
+	n, err := io.ReadFull(f.stream, b.data)
+	f.streamPos += int64(n)
+	if err != nil {
+		f.closeStream()
+		if err != io.ErrUnexpectedEOF || n == 0 {
+			return nil, err
+		}
+		b.data = b.data[:n]
+	}
+	if len(f.blocks) < OBJECT_FILE_CACHE_BLOCK {
+		f.blocks = append(f.blocks, nil)
+	}
+	copy(f.blocks[1:], f.blocks)
+	f.blocks[0] = b
+	return b, nil
+}
+
+func (f *ObjectFile) closeStream() {
+	if f.stream != nil {
+		f.stream.Close()
+		f.stream = nil
+	}
+}
+
+func (f *ObjectFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closeStream()
+	f.blocks = nil
+	return nil
+}
+
+type objectFileInfo struct {
+	obj *Object
+}
+
+func (fi objectFileInfo) Name() string {
+	return fi.obj.Name
+}
+
+func (fi objectFileInfo) Size() int64 {
+	return fi.obj.Size
+}
+
+func (fi objectFileInfo) Mode() os.FileMode {
+	if fi.obj.IsDir {
+		return os.ModeDir | 0555
+	}
+	return 0444
+}
+
+func (fi objectFileInfo) ModTime() time.Time {
+	return time.Unix(fi.obj.ModTime, 0)
+}
+
+func (fi objectFileInfo) IsDir() bool {
+	return fi.obj.IsDir
+}
+
+func (fi objectFileInfo) Sys() interface{} {
+	return fi.obj
+}
@@ -0,0 +1,148 @@
+package gowpd
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+)
+
+// openCounter counts the streams opened on a MemoryBackend.
+type openCounter struct {
+	*MemoryBackend
+	opens int
+}
+
+func (b *openCounter) GetStream(id string, key PROPERTYKEY) (io.ReadCloser, int, error) {
+	b.opens++
+	return b.MemoryBackend.GetStream(id, key)
+}
+
+func TestObjectFile(t *testing.T) {
+	data := testData(3*OBJECT_FILE_BLOCK_SIZE + 100)
+	b := &openCounter{MemoryBackend: NewMemoryBackend()}
+	d := NewDevice(b)
+	root := putFolder(t, d, WPD_DEVICE_OBJECT_ID, "Storage")
+	id := putFile(t, d, root, "a.bin", data)
+
+	f, err := d.Open(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.Name() != "a.bin" || info.Size() != int64(len(data)) || info.IsDir() {
+		t.Errorf("stat = %v %v", info, err)
+	}
+
+	// sequential reads use one stream
+	got, err := ioutil.ReadAll(f)
+	if err != nil || string(got) != data {
+		t.Fatalf("ReadAll = %v %v", len(got), err)
+	}
+	if b.opens != 1 {
+		t.Errorf("opens = %v", b.opens)
+	}
+	if n, err := f.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Errorf("read at end = %v %v", n, err)
+	}
+
+	pos, err := f.Seek(-10, io.SeekEnd)
+	if err != nil || pos != int64(len(data)-10) {
+		t.Errorf("seek = %v %v", pos, err)
+	}
+	buf := make([]byte, 20)
+	n, err := f.Read(buf)
+	if n != 10 || err != nil || string(buf[:n]) != data[len(data)-10:] {
+		t.Errorf("read = %v %v", n, err)
+	}
+	pos, _ = f.Seek(-20, io.SeekCurrent)
+	if pos != int64(len(data)-20) {
+		t.Errorf("seek = %v", pos)
+	}
+	if _, err := f.Seek(-1, io.SeekStart); err == nil {
+		t.Errorf("negative seek allowed")
+	}
+
+	// reads across a block boundary, served from the cache
+	opens := b.opens
+	off := int64(OBJECT_FILE_BLOCK_SIZE - 5)
+	n, err = f.ReadAt(buf, off)
+	if n != 20 || err != nil || string(buf) != data[off:off+20] {
+		t.Errorf("ReadAt = %v %v", n, err)
+	}
+	n, err = f.ReadAt(buf, int64(len(data)-5))
+	if n != 5 || err != io.EOF {
+		t.Errorf("ReadAt at end = %v %v", n, err)
+	}
+	if b.opens != opens {
+		t.Errorf("cached blocks read again")
+	}
+}
+
+func TestObjectFileZip(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range []string{"a.txt", "b.txt"} {
+		w, _ := zw.Create(name)
+		w.Write([]byte(testData(200000)))
+	}
+	zw.Close()
+
+	b := &openCounter{MemoryBackend: NewMemoryBackend()}
+	d := NewDevice(b)
+	root := putFolder(t, d, WPD_DEVICE_OBJECT_ID, "Storage")
+	id := putFile(t, d, root, "a.zip", buf.String())
+
+	f, err := d.Open(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := zip.NewReader(f, f.Object().Size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != 2 || zr.File[1].Name != "b.txt" {
+		t.Errorf("files = %v", zr.File)
+	}
+	// the central directory is found without reading the whole archive
+	if len(f.blocks) > 2 {
+		t.Errorf("read %v blocks", len(f.blocks))
+	}
+}
+
+func TestObjectFileConcurrent(t *testing.T) {
+	d := NewMemoryDevice()
+	root := putFolder(t, d, WPD_DEVICE_OBJECT_ID, "Storage")
+	data := testData(20 * OBJECT_FILE_BLOCK_SIZE)
+	id := putFile(t, d, root, "a.bin", data)
+	f, err := d.Open(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			buf := make([]byte, 3000)
+			for j := 0; j < 40; j++ {
+				off := int64((i*7919 + j*104729) % (len(data) - len(buf)))
+				if _, err := f.ReadAt(buf, off); err != nil {
+					t.Error(err)
+					return
+				}
+				if string(buf) != data[off:off+int64(len(buf))] {
+					t.Errorf("data at %v", off)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
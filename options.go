@@ -0,0 +1,112 @@
+package gowpd
+
+import (
+	"io"
+)
+
+// CopyOption changes how a transfer is done.
+type CopyOption func(o *copyOptions)
+
+type copyOptions struct {
+	progress ProgressFunc
+	tracker  *ProgressTracker
+	resume   bool
+	atomic   bool
+	verify   VerifyMode
+	hashAlgo HashAlgo
+
+	spoolMemory int64
+	spoolDir    string
+
+	namePolicy NamePolicy
+	objectName string
+	sanitizer  *Sanitizer
+	fileType   *FileType
+	metadata   bool
+	thumbnail  []byte
+	rules      *Rules
+}
+
+func newCopyOptions(opts []CopyOption) *copyOptions {
+	o := &copyOptions{spoolMemory: DEFAULT_SPOOL_MEMORY}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithProgress reports the progress of the transfer to fn. Tree transfers
+// report the whole tree as one job.
+func WithProgress(fn ProgressFunc) CopyOption {
+	return func(o *copyOptions) {
+		o.progress = fn
+	}
+}
+
+// WithTracker adds the transfer to t, which may be shared by many transfers.
+func WithTracker(t *ProgressTracker) CopyOption {
+	return func(o *copyOptions) {
+		o.tracker = t
+	}
+}
+
+// startTracking returns the tracker of a transfer of files files of total
+// bytes, or nil if progress is not reported.
+func (o *copyOptions) startTracking(total int64, files int) *ProgressTracker {
+	if o.tracker == nil && o.progress != nil {
+		o.tracker = NewProgressTracker(total, files, o.progress)
+	}
+	return o.tracker
+}
+
+// trackFile counts the bytes read from r as one file of size bytes. The
+// returned func must be called when the file is done.
+func (o *copyOptions) trackFile(r io.Reader, size int64) (io.Reader, func()) {
+	f := o.startFile(size)
+	return f.reader(r), f.done
+}
+
+// fileProgress counts the bytes of one file to the tracker of a transfer.
+// The bytes can be taken back to read the file again.
+type fileProgress struct {
+	tracker *ProgressTracker
+	n       int64
+}
+
+// startFile starts counting a file of size bytes, which must be done.
+func (o *copyOptions) startFile(size int64) *fileProgress {
+	t := o.startTracking(size, 1)
+	if t != nil {
+		t.StartFile(size)
+	}
+	return &fileProgress{tracker: t}
+}
+
+// reader returns r counting the bytes read from it.
+func (f *fileProgress) reader(r io.Reader) io.Reader {
+	if f.tracker == nil {
+		return r
+	}
+	return io.TeeReader(r, f)
+}
+
+func (f *fileProgress) Write(buf []byte) (int, error) {
+	f.n += int64(len(buf))
+	f.tracker.Add(int64(len(buf)))
+	return len(buf), nil
+}
+
+// rewind takes back the bytes counted so far.
+func (f *fileProgress) rewind() {
+	if f.tracker != nil && f.n > 0 {
+		f.tracker.Add(-f.n)
+	}
+	f.n = 0
+}
+
+// done marks the file as done.
+func (f *fileProgress) done() {
+	if f.tracker != nil {
+		f.tracker.FinishFile()
+	}
+}
@@ -0,0 +1,158 @@
+package gowpd
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_PROGRESS_INTERVAL = 200 * time.Millisecond
+)
+
+// Progress is a snapshot of a running transfer. Total is 0 while unknown.
+type Progress struct {
+	Done      int64
+	Total     int64
+	FilesDone int
+	Files     int
+	Rate      float64 // bytes per second
+	ETA       time.Duration
+}
+
+type ProgressFunc func(p Progress)
+
+// ProgressChan returns a ProgressFunc sending to ch. Updates are dropped
+// while ch is full so a slow reader never stalls the transfer.
+func ProgressChan(ch chan<- Progress) ProgressFunc {
+	return func(p Progress) {
+		select {
+		case ch <- p:
+		default:
+		}
+	}
+}
+
+// ProgressTracker counts the bytes of one or more transfers and reports
+// them to a ProgressFunc at most once per Interval, and at the end of each
+// file. It is safe for concurrent use.
+type ProgressTracker struct {
+	Interval time.Duration
+
+	mu         sync.Mutex
+	fn         ProgressFunc
+	p          Progress
+	fixed      bool
+	start      time.Time
+	lastReport time.Time
+	now        func() time.Time
+}
+
+// NewProgressTracker returns a tracker for files files of total bytes. If
+// files is 0, the totals grow as each file is started.
+func NewProgressTracker(total int64, files int, fn ProgressFunc) *ProgressTracker {
+	t := &ProgressTracker{Interval: DEFAULT_PROGRESS_INTERVAL, fn: fn, now: time.Now}
+	t.p.Total = total
+	t.p.Files = files
+	t.fixed = files > 0
+	return t
+}
+
+// StartFile announces a file of size bytes.
+func (t *ProgressTracker) StartFile(size int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.start.IsZero() {
+		t.start = t.now()
+	}
+	if !t.fixed {
+		t.p.Total += size
+		t.p.Files++
+	}
+}
+
+// FinishFile marks a file as done and reports the progress.
+func (t *ProgressTracker) FinishFile() {
+	t.mu.Lock()
+	t.p.FilesDone++
+	p := t.progress()
+	t.lastReport = t.now()
+	t.mu.Unlock()
+	t.report(p)
+}
+
+func (t *ProgressTracker) Add(n int64) {
+	t.mu.Lock()
+	now := t.now()
+	if t.start.IsZero() {
+		t.start = now
+	}
+	t.p.Done += n
+	if now.Sub(t.lastReport) < t.Interval {
+		t.mu.Unlock()
+		return
+	}
+	t.lastReport = now
+	p := t.progress()
+	t.mu.Unlock()
+	t.report(p)
+}
+
+func (t *ProgressTracker) Progress() Progress {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.progress()
+}
+
+func (t *ProgressTracker) progress() Progress {
+	p := t.p
+	elapsed := t.now().Sub(t.start).Seconds()
+	if t.start.IsZero() || elapsed <= 0 {
+		return p
+	}
+	p.Rate = float64(p.Done) / elapsed
+	if p.Rate > 0 && p.Total > p.Done {
+		p.ETA = time.Duration(float64(p.Total-p.Done) / p.Rate * float64(time.Second))
+	}
+	return p
+}
+
+func (t *ProgressTracker) report(p Progress) {
+	if t.fn != nil {
+		t.fn(p)
+	}
+}
+
+func (t *ProgressTracker) Reader(r io.Reader) io.Reader {
+	return &progressReader{r, t}
+}
+
+func (t *ProgressTracker) Writer(w io.Writer) io.Writer {
+	return &progressWriter{w, t}
+}
+
+type progressReader struct {
+	reader  io.Reader
+	tracker *ProgressTracker
+}
+
+func (o *progressReader) Read(buf []byte) (int, error) {
+	n, err := o.reader.Read(buf)
+	if n > 0 {
+		o.tracker.Add(int64(n))
+	}
+	return n, err
+}
+
+type progressWriter struct {
+	writer  io.Writer
+	tracker *ProgressTracker
+}
+
+func (o *progressWriter) Write(buf []byte) (int, error) {
+	n, err := o.writer.Write(buf)
+	if n > 0 {
+		o.tracker.Add(int64(n))
+	}
+	return n, err
+}
@@ -0,0 +1,134 @@
+package gowpd
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+func TestProgressTracker(t *testing.T) {
+	clock := &fakeClock{time.Unix(1000, 0)}
+	var reports []Progress
+	tr := NewProgressTracker(1000, 2, func(p Progress) {
+		reports = append(reports, p)
+	})
+	tr.now = clock.now
+	tr.Interval = time.Second
+
+	tr.StartFile(400)
+	r := tr.Reader(strings.NewReader(strings.Repeat("x", 400)))
+	buf := make([]byte, 100)
+	for i := 0; i < 4; i++ {
+		clock.advance(500 * time.Millisecond)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// first read is reported at once, the next one a second later
+	if len(reports) != 2 || reports[0].Done != 100 {
+		t.Fatalf("reports = %v", reports)
+	}
+	p := reports[1]
+	if p.Done != 300 || p.Total != 1000 || p.Rate != 200 || p.ETA != 3500*time.Millisecond {
+		t.Errorf("progress = %+v", p)
+	}
+	tr.FinishFile()
+	if len(reports) != 3 || reports[2].FilesDone != 1 || reports[2].Files != 2 {
+		t.Errorf("reports = %v", reports)
+	}
+
+	tr.StartFile(600)
+	var out bytes.Buffer
+	w := tr.Writer(&out)
+	clock.advance(time.Second)
+	w.Write(make([]byte, 600))
+	tr.FinishFile()
+	p = tr.Progress()
+	if p.Done != 1000 || p.Total != 1000 || p.FilesDone != 2 || p.ETA != 0 || out.Len() != 600 {
+		t.Errorf("progress = %+v", p)
+	}
+}
+
+func TestProgressTrackerGrowing(t *testing.T) {
+	tr := NewProgressTracker(0, 0, nil)
+	tr.StartFile(10)
+	tr.StartFile(20)
+	tr.Add(15)
+	p := tr.Progress()
+	if p.Total != 30 || p.Files != 2 || p.Done != 15 {
+		t.Errorf("progress = %+v", p)
+	}
+}
+
+func TestProgressChan(t *testing.T) {
+	ch := make(chan Progress, 1)
+	fn := ProgressChan(ch)
+	fn(Progress{Done: 1})
+	fn(Progress{Done: 2})
+	if p := <-ch; p.Done != 1 {
+		t.Errorf("progress = %+v", p)
+	}
+}
+
+func TestCopyWithProgress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gowpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFile(t, filepath.Join(dir, "src", "a"), strings.Repeat("a", 100), time.Now())
+	writeFile(t, filepath.Join(dir, "src", "d", "b"), strings.Repeat("b", 50), time.Now())
+
+	d := NewMemoryDevice()
+	root := putFolder(t, d, WPD_DEVICE_OBJECT_ID, "Storage")
+	var last Progress
+	fn := func(p Progress) { last = p }
+
+	if _, err := d.UploadTree(filepath.Join(dir, "src"), root, WithProgress(fn)); err != nil {
+		t.Fatal(err)
+	}
+	if last.Done != 150 || last.Total != 150 || last.FilesDone != 2 || last.Files != 2 {
+		t.Errorf("upload progress = %+v", last)
+	}
+
+	last = Progress{}
+	if _, err := d.DownloadTree(root, filepath.Join(dir, "dst"), WithProgress(fn)); err != nil {
+		t.Fatal(err)
+	}
+	if last.Done != 150 || last.Total != 150 || last.FilesDone != 2 || last.Files != 2 {
+		t.Errorf("download progress = %+v", last)
+	}
+
+	last = Progress{}
+	a := childId(t, d, root, "a")
+	if _, err := d.CopyFromDevice(filepath.Join(dir, "a"), a, WithProgress(fn)); err != nil {
+		t.Fatal(err)
+	}
+	if last.Done != 100 || last.Total != 100 || last.FilesDone != 1 {
+		t.Errorf("copy progress = %+v", last)
+	}
+
+	tr := NewProgressTracker(0, 0, nil)
+	d.CopyToDevice(root, filepath.Join(dir, "a"), WithTracker(tr))
+	d.CopyObjectToDevice(root, strings.NewReader("xyz"), &Object{Name: "c", ObjectInfo: ObjectInfo{Size: 3}}, WithTracker(tr))
+	if p := tr.Progress(); p.Done != 103 || p.Total != 103 || p.FilesDone != 2 {
+		t.Errorf("tracker progress = %+v", p)
+	}
+}
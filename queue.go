@@ -0,0 +1,274 @@
+package gowpd
+
+import (
+	"fmt"
+	"sync"
+)
+
+const (
+	DEFAULT_QUEUE_JOBS       = 4
+	DEFAULT_QUEUE_PER_DEVICE = 1
+)
+
+// Job is a transfer run by a Queue. Run is passed the options that add the
+// transfer to the progress of the queue.
+type Job struct {
+	Name     string
+	Priority int
+	// Devices are the devices used by the job.
+	Devices []*Device
+	Run     func(opts ...CopyOption) error
+	// Err is the result of the job once it is done.
+	Err error
+
+	seq    int
+	next   *Job
+	parent *Job
+}
+
+// Queue runs jobs concurrently. Jobs of higher priority start first, but a
+// job whose devices are busy does not hold back jobs on other devices.
+type Queue struct {
+	// MaxJobs is the number of jobs running at the same time.
+	MaxJobs int
+	// MaxPerDevice is the number of jobs using one device at the same time.
+	// MTP devices handle one transfer at a time.
+	MaxPerDevice int
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	tracker *ProgressTracker
+	jobs    []*Job
+	pending []*Job
+	busy    map[*Device]int
+	running int
+	paused  bool
+	seq     int
+}
+
+// NewQueue returns a queue reporting the progress of all its jobs to fn,
+// which may be nil.
+func NewQueue(fn ProgressFunc) *Queue {
+	q := &Queue{
+		MaxJobs:      DEFAULT_QUEUE_JOBS,
+		MaxPerDevice: DEFAULT_QUEUE_PER_DEVICE,
+		tracker:      NewProgressTracker(0, 0, fn),
+		busy:         make(map[*Device]int),
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// Add queues job. It starts as soon as its devices are free.
+func (q *Queue) Add(job *Job) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.jobs = append(q.jobs, job)
+	q.add(job)
+}
+
+func (q *Queue) add(job *Job) {
+	q.seq++
+	job.seq = q.seq
+	i := len(q.pending)
+	for i > 0 && q.pending[i-1].Priority < job.Priority {
+		i--
+	}
+	q.pending = append(q.pending, nil)
+	copy(q.pending[i+1:], q.pending[i:])
+	q.pending[i] = job
+	q.dispatch()
+}
+
+// Pause stops starting jobs. Running jobs are finished.
+func (q *Queue) Pause() {
+	q.mu.Lock()
+	q.paused = true
+	q.mu.Unlock()
+}
+
+func (q *Queue) Resume() {
+	q.mu.Lock()
+	q.paused = false
+	q.dispatch()
+	q.mu.Unlock()
+}
+
+func (q *Queue) Progress() Progress {
+	return q.tracker.Progress()
+}
+
+// Wait waits until all jobs are done. It does not return while the queue is
+// paused with jobs left.
+func (q *Queue) Wait() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.pending) > 0 || q.running > 0 {
+		q.cond.Wait()
+	}
+	n := 0
+	for _, j := range q.jobs {
+		if j.Err != nil {
+			n++
+		}
+	}
+	if n == 0 {
+		return nil
+	}
+	return fmt.Errorf("Failed %v of %v jobs", n, len(q.jobs))
+}
+
+// dispatch starts the pending jobs which can run. q.mu must be held.
+func (q *Queue) dispatch() {
+	for i := 0; i < len(q.pending) && !q.paused && q.running < q.maxJobs(); {
+		j := q.pending[i]
+		if !q.free(j) {
+			i++
+			continue
+		}
+		q.pending = append(q.pending[:i], q.pending[i+1:]...)
+		q.start(j)
+	}
+}
+
+func (q *Queue) maxJobs() int {
+	if q.MaxJobs <= 0 {
+		return 1
+	}
+	return q.MaxJobs
+}
+
+func (q *Queue) free(j *Job) bool {
+	max := q.MaxPerDevice
+	if max <= 0 {
+		max = 1
+	}
+	for _, d := range jobDevices(j) {
+		if q.busy[d] >= max {
+			return false
+		}
+	}
+	return true
+}
+
+func (q *Queue) start(j *Job) {
+	q.running++
+	for _, d := range jobDevices(j) {
+		q.busy[d]++
+	}
+	go func() {
+		err := j.Run(WithTracker(q.tracker))
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		j.Err = err
+		if j.parent != nil {
+			j.parent.Err = err
+		}
+		q.running--
+		for _, d := range jobDevices(j) {
+			q.busy[d]--
+		}
+		if err == nil && j.next != nil {
+			j.next.Priority = j.Priority
+			q.add(j.next)
+		}
+		q.dispatch()
+		q.cond.Broadcast()
+	}()
+}
+
+// Next returns the job which the queue runs once j succeeds, like the
+// upload of DeviceCopyJob, or nil.
+func (j *Job) Next() *Job {
+	return j.next
+}
+
+// jobDevices returns the devices of j without duplicates.
+func jobDevices(j *Job) []*Device {
+	var ds []*Device
+	for _, d := range j.Devices {
+		dup := false
+		for _, e := range ds {
+			dup = dup || e == d
+		}
+		if d != nil && !dup {
+			ds = append(ds, d)
+		}
+	}
+	return ds
+}
+
+// DownloadJob copies obj to the file dst.
+func DownloadJob(d *Device, obj *Object, dst string, opts ...CopyOption) *Job {
+	return &Job{
+		Name:    dst,
+		Devices: []*Device{d},
+		Run: func(qopts ...CopyOption) error {
+			_, err := d.CopyObjectFromDevice(dst, obj, append(opts, qopts...)...)
+			return err
+		},
+	}
+}
+
+// UploadJob copies the file src into the folder parentId.
+func UploadJob(d *Device, parentId string, src string, opts ...CopyOption) *Job {
+	return &Job{
+		Name:    src,
+		Devices: []*Device{d},
+		Run: func(qopts ...CopyOption) error {
+			_, err := d.CopyToDevice(parentId, src, append(opts, qopts...)...)
+			return err
+		},
+	}
+}
+
+// DeviceCopyJob copies obj of the device src into the folder parentId of
+// dst. The object is read into a spool before it is written, so between two
+// devices the next job can read src while this one writes dst. opts are
+// added to the upload.
+func DeviceCopyJob(src *Device, obj *Object, dst *Device, parentId string, opts ...CopyOption) *Job {
+	var s *spool
+	upload := func(qopts ...CopyOption) error {
+		defer s.Close()
+		sized := *obj
+		sized.Size = s.size
+		_, err := dst.CopyObjectToDevice(parentId, s.Reader(), &sized, append(opts, qopts...)...)
+		return err
+	}
+	read := func() (err error) {
+		s, err = src.spoolObject(obj.Id, newCopyOptions(opts))
+		return
+	}
+	if src == dst {
+		return &Job{
+			Name:    obj.Name,
+			Devices: []*Device{src},
+			Run: func(qopts ...CopyOption) error {
+				if err := read(); err != nil {
+					return err
+				}
+				return upload(qopts...)
+			},
+		}
+	}
+	j := &Job{
+		Name:    obj.Name,
+		Devices: []*Device{src},
+		Run: func(qopts ...CopyOption) error {
+			return read()
+		},
+		next: &Job{Name: obj.Name, Devices: []*Device{dst}, Run: upload},
+	}
+	j.next.parent = j
+	return j
+}
+
+// spoolObject reads the object id into a spool.
+func (d *Device) spoolObject(id string, o *copyOptions) (*spool, error) {
+	r, err := d.OpenRange(id, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return newSpool(r, o.spoolMemory, o.spoolDir)
+}
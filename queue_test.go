@@ -0,0 +1,212 @@
+package gowpd
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// latencyBackend is a slow device. It counts the transfers running on it and
+// on all devices sharing its load.
+type latencyBackend struct {
+	*MemoryBackend
+	latency time.Duration
+	load    *load
+	active  int
+	max     int
+}
+
+type load struct {
+	mu     sync.Mutex
+	active int
+	max    int
+}
+
+func newLatencyDevice(l *load) (*Device, *latencyBackend) {
+	b := &latencyBackend{MemoryBackend: NewMemoryBackend(), latency: 10 * time.Millisecond, load: l}
+	return NewDevice(b), b
+}
+
+func (b *latencyBackend) begin() {
+	b.load.mu.Lock()
+	defer b.load.mu.Unlock()
+	b.active++
+	b.load.active++
+	if b.active > b.max {
+		b.max = b.active
+	}
+	if b.load.active > b.load.max {
+		b.load.max = b.load.active
+	}
+}
+
+func (b *latencyBackend) end() {
+	b.load.mu.Lock()
+	defer b.load.mu.Unlock()
+	b.active--
+	b.load.active--
+}
+
+func (b *latencyBackend) GetStream(id string, key PROPERTYKEY) (io.ReadCloser, int, error) {
+	b.begin()
+	time.Sleep(b.latency)
+	stream, size, err := b.MemoryBackend.GetStream(id, key)
+	if err != nil {
+		b.end()
+		return nil, 0, err
+	}
+	return &latencyReader{stream, b}, size, nil
+}
+
+type latencyReader struct {
+	io.ReadCloser
+	b *latencyBackend
+}
+
+func (r *latencyReader) Close() error {
+	r.b.end()
+	return r.ReadCloser.Close()
+}
+
+func (b *latencyBackend) CreateObjectWithPropertiesAndData(props PropertyValues) (ObjectWriter, int, error) {
+	w, size, err := b.MemoryBackend.CreateObjectWithPropertiesAndData(props)
+	if err != nil {
+		return nil, 0, err
+	}
+	b.begin()
+	return &latencyWriter{w, b}, size, nil
+}
+
+type latencyWriter struct {
+	ObjectWriter
+	b *latencyBackend
+}
+
+func (w *latencyWriter) Commit() (string, error) {
+	defer w.b.end()
+	time.Sleep(w.b.latency)
+	return w.ObjectWriter.Commit()
+}
+
+func TestQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gowpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l := &load{}
+	da, ba := newLatencyDevice(l)
+	db, bb := newLatencyDevice(l)
+	var last Progress
+	var mu sync.Mutex
+	q := NewQueue(func(p Progress) {
+		mu.Lock()
+		last = p
+		mu.Unlock()
+	})
+	var jobs []*Job
+	for i, d := range []*Device{da, db} {
+		root := putFolder(t, d, WPD_DEVICE_OBJECT_ID, "Storage")
+		for j := 0; j < 4; j++ {
+			name := strconv.Itoa(i) + "-" + strconv.Itoa(j)
+			obj, _ := d.GetObject(putFile(t, d, root, name, testData(1000)))
+			jobs = append(jobs, DownloadJob(d, obj, filepath.Join(dir, name)))
+		}
+	}
+	for _, j := range jobs {
+		q.Add(j)
+	}
+	if err := q.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if ba.max != 1 || bb.max != 1 || l.max != 2 {
+		t.Errorf("concurrency = %v %v %v", ba.max, bb.max, l.max)
+	}
+	if last.FilesDone != 8 || last.Done != 8000 || last.Total != 8000 {
+		t.Errorf("progress = %+v", last)
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 8 {
+		t.Errorf("%v files", len(files))
+	}
+
+	q.MaxPerDevice = 2
+	for j := 0; j < 4; j++ {
+		q.Add(UploadJob(da, WPD_DEVICE_OBJECT_ID, filepath.Join(dir, "1-"+strconv.Itoa(j))))
+	}
+	q.Wait()
+	if ba.max != 2 {
+		t.Errorf("concurrency = %v", ba.max)
+	}
+}
+
+func TestQueuePriority(t *testing.T) {
+	q := NewQueue(nil)
+	q.MaxJobs = 1
+	q.Pause()
+	var order []string
+	for _, j := range []struct {
+		name     string
+		priority int
+	}{{"a", 0}, {"b", 2}, {"c", 1}, {"d", 2}} {
+		name := j.name
+		q.Add(&Job{Name: name, Priority: j.priority, Run: func(opts ...CopyOption) error {
+			order = append(order, name)
+			return nil
+		}})
+	}
+	q.mu.Lock()
+	running := q.running
+	q.mu.Unlock()
+	if running != 0 {
+		t.Errorf("paused queue started %v jobs", running)
+	}
+	q.Resume()
+	q.Wait()
+	if got := strings.Join(order, ""); got != "bdca" {
+		t.Errorf("order = %v", got)
+	}
+}
+
+func TestDeviceCopyJob(t *testing.T) {
+	l := &load{}
+	da, ba := newLatencyDevice(l)
+	db, bb := newLatencyDevice(l)
+	src := putFolder(t, da, WPD_DEVICE_OBJECT_ID, "Storage")
+	dst := putFolder(t, db, WPD_DEVICE_OBJECT_ID, "Storage")
+	var jobs []*Job
+	for j := 0; j < 4; j++ {
+		id := putFile(t, da, src, strconv.Itoa(j), testData(500+j))
+		obj, _ := da.GetObject(id)
+		jobs = append(jobs, DeviceCopyJob(da, obj, db, dst))
+	}
+	same, _ := da.GetObject(childId(t, da, src, "0"))
+	jobs = append(jobs, DeviceCopyJob(da, same, da, src))
+	jobs = append(jobs, DeviceCopyJob(da, &Object{Id: "missing", Name: "x"}, db, dst))
+	ba.max = 0
+	q := NewQueue(nil)
+	for _, j := range jobs {
+		q.Add(j)
+	}
+	err := q.Wait()
+	if err == nil || err.Error() != "Failed 1 of 6 jobs" {
+		t.Errorf("err = %v", err)
+	}
+	// the next object is read while the last one is written
+	if ba.max != 1 || bb.max != 1 || l.max != 2 {
+		t.Errorf("concurrency = %v %v %v", ba.max, bb.max, l.max)
+	}
+	got := childNames(t, db, dst)
+	if len(got) != 4 || got["3"] != testData(503) {
+		t.Errorf("objects = %v", len(got))
+	}
+	if ids, _ := da.GetChildIds(src); len(ids) != 5 {
+		t.Errorf("objects = %v", len(ids))
+	}
+}
@@ -0,0 +1,125 @@
+package gowpd
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// PartialReader is implemented by backends that read part of an object
+// without opening a stream, like MTPBackend with MTP GetPartialObject64.
+type PartialReader interface {
+	ReadPartial(id string, offset int64, buf []byte) (int, error)
+}
+
+// OpenRange returns a reader of length bytes of the object id starting at
+// offset. A negative length reads to the end of the object. Streams that
+// cannot seek are read from the start and the skipped bytes discarded.
+// A stream failing with a retryable error is reopened where it stopped.
+func (d *Device) OpenRange(id string, offset int64, length int64) (io.ReadCloser, error) {
+	var r io.ReadCloser
+	err := d.Retry.Do(func() (err error) {
+		r, err = d.openRange(id, offset)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	if d.Retry != nil {
+		r = &retryReader{d, id, offset, r}
+	}
+	if length < 0 {
+		return r, nil
+	}
+	return &limitedReadCloser{io.LimitReader(r, length), r}, nil
+}
+
+func (d *Device) openRange(id string, offset int64) (io.ReadCloser, error) {
+	if p, ok := d.backend.(PartialReader); ok {
+		return &partialReader{p, id, offset}, nil
+	}
+	stream, size, err := d.backend.GetStream(id, WPD_RESOURCE_DEFAULT)
+	if err != nil {
+		return nil, err
+	}
+	if err = skip(stream, offset); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return NewBufReadCloser(stream, size), nil
+}
+
+func skip(stream io.Reader, offset int64) error {
+	if offset == 0 {
+		return nil
+	}
+	if s, ok := stream.(io.Seeker); ok {
+		if _, err := s.Seek(offset, io.SeekStart); err == nil {
+			return nil
+		}
+	}
+	n, err := io.CopyN(ioutil.Discard, stream, offset)
+	if n == offset {
+		return nil
+	}
+	if err == nil || err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// ReadAt reads len(buf) bytes of the object id starting at offset.
+func (d *Device) ReadAt(id string, buf []byte, offset int64) (int, error) {
+	r, err := d.OpenRange(id, offset, int64(len(buf)))
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	n, err := io.ReadFull(r, buf)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+type partialReader struct {
+	backend PartialReader
+	id      string
+	offset  int64
+}
+
+func (o *partialReader) Read(buf []byte) (int, error) {
+	n, err := o.backend.ReadPartial(o.id, o.offset, buf)
+	o.offset += int64(n)
+	if n == 0 && err == nil {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (o *partialReader) Close() error {
+	return nil
+}
+
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// WithResume continues a download into an existing shorter file instead of
+// starting over. A file of the full size is left as it is.
+func WithResume() CopyOption {
+	return func(o *copyOptions) {
+		o.resume = true
+	}
+}
+
+// resumeOffset returns the size of a partial download of size bytes at dst.
+// ok is false if there is nothing to resume.
+func resumeOffset(dst string, size int64) (offset int64, ok bool) {
+	info, err := os.Stat(dst)
+	if err != nil || info.IsDir() || info.Size() > size {
+		return 0, false
+	}
+	return info.Size(), true
+}
@@ -0,0 +1,193 @@
+package gowpd
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var errDisconnected = errors.New("device disconnected")
+
+// streamBackend serves streams that cannot seek and counts the bytes read.
+// After failAfter bytes the stream fails as if the device was unplugged.
+type streamBackend struct {
+	*MemoryBackend
+	read      int64
+	failAfter int64
+}
+
+func (b *streamBackend) GetStream(id string, key PROPERTYKEY) (io.ReadCloser, int, error) {
+	stream, size, err := b.MemoryBackend.GetStream(id, key)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &countingReader{stream, b}, size, nil
+}
+
+type countingReader struct {
+	io.ReadCloser
+	b *streamBackend
+}
+
+func (r *countingReader) Read(buf []byte) (int, error) {
+	if r.b.failAfter > 0 {
+		if r.b.read >= r.b.failAfter {
+			return 0, errDisconnected
+		}
+		if left := r.b.failAfter - r.b.read; int64(len(buf)) > left {
+			buf = buf[:left]
+		}
+	}
+	n, err := r.ReadCloser.Read(buf)
+	r.b.read += int64(n)
+	return n, err
+}
+
+// responderBackend answers partial object requests like an MTP responder
+// and has no streams at all.
+type responderBackend struct {
+	*MemoryBackend
+	requests int
+}
+
+func (b *responderBackend) GetStream(id string, key PROPERTYKEY) (io.ReadCloser, int, error) {
+	return nil, 0, HResult(E_NOTIMPL)
+}
+
+func (b *responderBackend) ReadPartial(id string, offset int64, buf []byte) (int, error) {
+	b.requests++
+	stream, _, err := b.MemoryBackend.GetStream(id, WPD_RESOURCE_DEFAULT)
+	if err != nil {
+		return 0, err
+	}
+	defer stream.Close()
+	return stream.(io.ReaderAt).ReadAt(buf, offset)
+}
+
+func testData(n int) string {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte('a' + i%26)
+	}
+	return string(b)
+}
+
+func TestOpenRange(t *testing.T) {
+	data := testData(1000)
+	backends := map[string]Backend{
+		"seek":      NewMemoryBackend(),
+		"stream":    &streamBackend{MemoryBackend: NewMemoryBackend()},
+		"responder": &responderBackend{MemoryBackend: NewMemoryBackend()},
+	}
+	tests := []struct {
+		offset, length int64
+		want           string
+	}{
+		{0, -1, data},
+		{10, 5, data[10:15]},
+		{990, -1, data[990:]},
+		{990, 100, data[990:]},
+		{1000, -1, ""},
+	}
+	for name, b := range backends {
+		d := NewDevice(b)
+		root := putFolder(t, d, WPD_DEVICE_OBJECT_ID, "Storage")
+		id := putFile(t, d, root, "a", data)
+		for _, tt := range tests {
+			r, err := d.OpenRange(id, tt.offset, tt.length)
+			if err != nil {
+				t.Errorf("%v %v: %v", name, tt, err)
+				continue
+			}
+			got, err := ioutil.ReadAll(r)
+			r.Close()
+			if err != nil || string(got) != tt.want {
+				t.Errorf("%v %v: %q, %v", name, tt, got, err)
+			}
+		}
+		buf := make([]byte, 20)
+		n, err := d.ReadAt(id, buf, 100)
+		if n != 20 || err != nil || string(buf) != data[100:120] {
+			t.Errorf("%v: ReadAt = %v %v", name, n, err)
+		}
+		n, err = d.ReadAt(id, buf, 995)
+		if n != 5 || err != io.EOF || string(buf[:n]) != data[995:] {
+			t.Errorf("%v: ReadAt at end = %v %v", name, n, err)
+		}
+	}
+}
+
+func TestResumeDownload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gowpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := testData(100000)
+	b := &streamBackend{MemoryBackend: NewMemoryBackend()}
+	d := NewDevice(b)
+	root := putFolder(t, d, WPD_DEVICE_OBJECT_ID, "Storage")
+	id := putFile(t, d, root, "video.mp4", data)
+	dst := filepath.Join(dir, "video.mp4")
+
+	b.failAfter = 60000
+	if _, err := d.CopyFromDevice(dst, id); err != errDisconnected {
+		t.Fatalf("err = %v", err)
+	}
+	info, _ := os.Stat(dst)
+	if info == nil || info.Size() != 60000 {
+		t.Fatalf("partial file = %v", info)
+	}
+
+	b.failAfter = 0
+	b.read = 0
+	var last Progress
+	n, err := d.CopyFromDevice(dst, id, WithResume(), WithProgress(func(p Progress) { last = p }))
+	if err != nil || n != 40000 {
+		t.Fatalf("resume = %v %v", n, err)
+	}
+	// the unseekable stream is read from the start and the prefix skipped
+	if b.read != 100000 {
+		t.Errorf("read %v bytes", b.read)
+	}
+	if last.Done != 100000 || last.Total != 100000 {
+		t.Errorf("progress = %+v", last)
+	}
+	got, _ := ioutil.ReadFile(dst)
+	if string(got) != data {
+		t.Errorf("content differs")
+	}
+
+	b.read = 0
+	n, err = d.CopyFromDevice(dst, id, WithResume())
+	if n != 0 || err != nil || b.read != 0 {
+		t.Errorf("complete file downloaded again: %v %v %v", n, err, b.read)
+	}
+}
+
+func TestResumeDownloadSeek(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gowpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := testData(5000)
+	d := NewMemoryDevice()
+	root := putFolder(t, d, WPD_DEVICE_OBJECT_ID, "Storage")
+	id := putFile(t, d, root, "a", data)
+	dst := filepath.Join(dir, "a")
+	if err := ioutil.WriteFile(dst, []byte(data[:1234]), 0644); err != nil {
+		t.Fatal(err)
+	}
+	n, err := d.CopyFromDevice(dst, id, WithResume())
+	if err != nil || n != 5000-1234 {
+		t.Fatalf("resume = %v %v", n, err)
+	}
+	got, _ := ioutil.ReadFile(dst)
+	if string(got) != data {
+		t.Errorf("content differs")
+	}
+}
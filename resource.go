@@ -0,0 +1,185 @@
+package gowpd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+var (
+	WPD_RESOURCE_THUMBNAIL  = PROPERTYKEY{GUID{0xC7C407BA, 0x98FA, 0x46B5, [8]byte{0x99, 0x60, 0x23, 0xFE, 0xC1, 0x24, 0xCF, 0xDE}}, 0}
+	WPD_RESOURCE_ICON       = PROPERTYKEY{GUID{0xF195FED8, 0xAA28, 0x4EE3, [8]byte{0xB1, 0x53, 0xE1, 0x82, 0xDD, 0x5E, 0xDC, 0x39}}, 0}
+	WPD_RESOURCE_AUDIO_CLIP = PROPERTYKEY{GUID{0x3BC13982, 0x85B1, 0x48E0, [8]byte{0x95, 0xA6, 0x8D, 0x3A, 0xD0, 0x6B, 0xE1, 0x17}}, 0}
+	WPD_RESOURCE_ALBUM_ART  = PROPERTYKEY{GUID{0xF02AA354, 0x2300, 0x4E2D, [8]byte{0xA1, 0xB9, 0x3B, 0x67, 0x30, 0xF7, 0xFA, 0x21}}, 0}
+	WPD_RESOURCE_GENERIC    = PROPERTYKEY{GUID{0xB9B9F515, 0xBA70, 0x4647, [8]byte{0x94, 0xDC, 0xFA, 0x49, 0x25, 0xE9, 0x5A, 0x07}}, 0}
+
+	WPD_RESOURCE_ATTRIBUTE_TOTAL_SIZE                = PROPERTYKEY{GUID{0x1EB6F604, 0x9278, 0x429F, [8]byte{0x93, 0xCC, 0x5B, 0xB8, 0xC0, 0x66, 0x56, 0xB6}}, 2}
+	WPD_RESOURCE_ATTRIBUTE_CAN_READ                  = PROPERTYKEY{GUID{0x1EB6F604, 0x9278, 0x429F, [8]byte{0x93, 0xCC, 0x5B, 0xB8, 0xC0, 0x66, 0x56, 0xB6}}, 3}
+	WPD_RESOURCE_ATTRIBUTE_CAN_WRITE                 = PROPERTYKEY{GUID{0x1EB6F604, 0x9278, 0x429F, [8]byte{0x93, 0xCC, 0x5B, 0xB8, 0xC0, 0x66, 0x56, 0xB6}}, 4}
+	WPD_RESOURCE_ATTRIBUTE_CAN_DELETE                = PROPERTYKEY{GUID{0x1EB6F604, 0x9278, 0x429F, [8]byte{0x93, 0xCC, 0x5B, 0xB8, 0xC0, 0x66, 0x56, 0xB6}}, 5}
+	WPD_RESOURCE_ATTRIBUTE_OPTIMAL_READ_BUFFER_SIZE  = PROPERTYKEY{GUID{0x1EB6F604, 0x9278, 0x429F, [8]byte{0x93, 0xCC, 0x5B, 0xB8, 0xC0, 0x66, 0x56, 0xB6}}, 6}
+	WPD_RESOURCE_ATTRIBUTE_OPTIMAL_WRITE_BUFFER_SIZE = PROPERTYKEY{GUID{0x1EB6F604, 0x9278, 0x429F, [8]byte{0x93, 0xCC, 0x5B, 0xB8, 0xC0, 0x66, 0x56, 0xB6}}, 7}
+	WPD_RESOURCE_ATTRIBUTE_FORMAT                    = PROPERTYKEY{GUID{0x1EB6F604, 0x9278, 0x429F, [8]byte{0x93, 0xCC, 0x5B, 0xB8, 0xC0, 0x66, 0x56, 0xB6}}, 8}
+	WPD_RESOURCE_ATTRIBUTE_RESOURCE_KEY              = PROPERTYKEY{GUID{0x1EB6F604, 0x9278, 0x429F, [8]byte{0x93, 0xCC, 0x5B, 0xB8, 0xC0, 0x66, 0x56, 0xB6}}, 9}
+)
+
+// Resource describes a data stream of an object. Every object with data has
+// WPD_RESOURCE_DEFAULT; others hold thumbnails, album art or icons.
+type Resource struct {
+	Key       PROPERTYKEY
+	Size      int64
+	Format    GUID
+	CanRead   bool
+	CanWrite  bool
+	CanDelete bool
+	// ReadBufferSize and WriteBufferSize are the transfer sizes the driver
+	// prefers, or 0 if it does not tell.
+	ReadBufferSize  int
+	WriteBufferSize int
+}
+
+func resourceFromValues(key PROPERTYKEY, v PropertyValues) Resource {
+	flag := func(k PROPERTYKEY) bool {
+		b, _ := v[k].(bool)
+		return b
+	}
+	return Resource{
+		Key:             key,
+		Size:            int64(v.Uint64(WPD_RESOURCE_ATTRIBUTE_TOTAL_SIZE)),
+		Format:          v.Guid(WPD_RESOURCE_ATTRIBUTE_FORMAT),
+		CanRead:         flag(WPD_RESOURCE_ATTRIBUTE_CAN_READ),
+		CanWrite:        flag(WPD_RESOURCE_ATTRIBUTE_CAN_WRITE),
+		CanDelete:       flag(WPD_RESOURCE_ATTRIBUTE_CAN_DELETE),
+		ReadBufferSize:  int(v.Uint64(WPD_RESOURCE_ATTRIBUTE_OPTIMAL_READ_BUFFER_SIZE)),
+		WriteBufferSize: int(v.Uint64(WPD_RESOURCE_ATTRIBUTE_OPTIMAL_WRITE_BUFFER_SIZE)),
+	}
+}
+
+// Resources lists the resources of the object id.
+func (d *Device) Resources(id string) ([]Resource, error) {
+	var keys []PROPERTYKEY
+	err := d.Retry.Do(func() (err error) {
+		keys, err = d.backend.GetSupportedResources(id)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	res := make([]Resource, 0, len(keys))
+	for _, key := range keys {
+		var v PropertyValues
+		err = d.Retry.Do(func() (err error) {
+			v, err = d.backend.GetResourceAttributes(id, key)
+			return
+		})
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, resourceFromValues(key, v))
+	}
+	return res, nil
+}
+
+// Resource returns the resource key of the object id.
+func (d *Device) Resource(id string, key PROPERTYKEY) (*Resource, error) {
+	var v PropertyValues
+	err := d.Retry.Do(func() (err error) {
+		v, err = d.backend.GetResourceAttributes(id, key)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	r := resourceFromValues(key, v)
+	return &r, nil
+}
+
+// OpenResource returns a reader of the resource key of the object id, such
+// as WPD_RESOURCE_DEFAULT for its data or WPD_RESOURCE_THUMBNAIL.
+func (d *Device) OpenResource(id string, key PROPERTYKEY) (*BufReadCloser, error) {
+	var stream io.ReadCloser
+	var size int
+	err := d.Retry.Do(func() (err error) {
+		stream, size, err = d.backend.GetStream(id, key)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	return NewBufReadCloser(stream, size), nil
+}
+
+// Thumbnail returns the thumbnail the device keeps for the object id.
+func (d *Device) Thumbnail(id string) ([]byte, error) {
+	r, err := d.OpenResource(id, WPD_RESOURCE_THUMBNAIL)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// SetThumbnail stores data as the thumbnail of the object id. The format is
+// taken from the content of data.
+func (d *Device) SetThumbnail(id string, data []byte) error {
+	t, _ := TypeByContent(data)
+	res := &Resource{Key: WPD_RESOURCE_THUMBNAIL, Size: int64(len(data)), Format: t.Format}
+	return d.CreateResource(id, bytes.NewReader(data), res)
+}
+
+// WithThumbnail stores data as the thumbnail of an uploaded object. Devices
+// which do not accept thumbnails make their own and the upload succeeds.
+func WithThumbnail(data []byte) CopyOption {
+	return func(o *copyOptions) {
+		o.thumbnail = data
+	}
+}
+
+// CreateResource writes src as the resource res.Key of the object id,
+// replacing the resource if it exists. res.Size bytes are written and
+// nothing is committed if src cannot be read to the end.
+func (d *Device) CreateResource(id string, src io.Reader, res *Resource) error {
+	size := res.Size
+	attrs := PropertyValues{
+		WPD_RESOURCE_ATTRIBUTE_RESOURCE_KEY: res.Key,
+		WPD_RESOURCE_ATTRIBUTE_TOTAL_SIZE:   uint64(size),
+		WPD_RESOURCE_ATTRIBUTE_FORMAT:       res.Format,
+	}
+	var stream ObjectWriter
+	var bufSize int
+	err := d.Retry.Do(func() (err error) {
+		stream, bufSize, err = d.backend.CreateResource(id, attrs)
+		return
+	})
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriterSize(stream, bufSize)
+	n, err := io.Copy(writer, io.LimitReader(src, size))
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil && n != size {
+		err = sizeError(id, n, size)
+	}
+	if err != nil {
+		stream.Abort()
+		return err
+	}
+	_, err = stream.Commit()
+	return err
+}
+
+// uploadThumbnail stores the thumbnail of the options for the uploaded
+// object id.
+func (d *Device) uploadThumbnail(id string, o *copyOptions) error {
+	if o.thumbnail == nil {
+		return nil
+	}
+	if err := d.SetThumbnail(id, o.thumbnail); err != nil && !isRefused(err) {
+		return fmt.Errorf("Thumbnail : %v", err)
+	}
+	return nil
+}
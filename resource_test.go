@@ -0,0 +1,170 @@
+package gowpd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestThumbnail(t *testing.T) {
+	d := NewMemoryDevice()
+	root := putFolder(t, d, WPD_DEVICE_OBJECT_ID, "Storage")
+	id := putFile(t, d, root, "a.jpg", "photo")
+	thumb := testPNG()
+
+	if _, err := d.Thumbnail(id); err != HResult(E_NOT_SUPPORTED) {
+		t.Errorf("no thumbnail: %v", err)
+	}
+	if err := d.SetThumbnail(id, thumb); err != nil {
+		t.Fatal(err)
+	}
+	data, err := d.Thumbnail(id)
+	if err != nil || !bytes.Equal(data, thumb) {
+		t.Errorf("thumbnail = %q %v", data, err)
+	}
+	r, err := d.OpenResource(id, WPD_RESOURCE_DEFAULT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ = ioutil.ReadAll(r)
+	r.Close()
+	if string(data) != "photo" {
+		t.Errorf("data = %q", data)
+	}
+	if err := d.SetThumbnail(root, thumb); err == nil {
+		t.Errorf("folder: expected error")
+	}
+
+	// copies keep their resources
+	dst := putFolder(t, d, root, "dst")
+	if err := d.Copy(dst, id); err != nil {
+		t.Fatal(err)
+	}
+	if data, err = d.Thumbnail(childId(t, d, dst, "a.jpg")); !bytes.Equal(data, thumb) {
+		t.Errorf("copy: %q %v", data, err)
+	}
+}
+
+func TestUploadThumbnail(t *testing.T) {
+	b := NewMemoryBackend()
+	d := NewDevice(b)
+	root := putFolder(t, d, WPD_DEVICE_OBJECT_ID, "Storage")
+	thumb := testPNG()
+	upload := func(name string, opts ...CopyOption) error {
+		obj := &Object{Name: name, ObjectInfo: ObjectInfo{Size: 5, ModTime: time.Now().Unix()}}
+		_, err := d.CopyObjectToDevice(root, strings.NewReader("photo"), obj, append(opts, WithThumbnail(thumb))...)
+		return err
+	}
+
+	if err := upload("a.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := d.Thumbnail(childId(t, d, root, "a.jpg")); !bytes.Equal(data, thumb) {
+		t.Errorf("upload: %q %v", data, err)
+	}
+	if err := upload("a.jpg", WithAtomic()); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := d.Thumbnail(childId(t, d, root, "a.jpg")); !bytes.Equal(data, thumb) {
+		t.Errorf("atomic upload: %q %v", data, err)
+	}
+
+	// a device which makes its own thumbnails
+	b.Fault = func(op string, ids []string) error {
+		if op == "CreateResource" {
+			return HResult(E_NOTIMPL)
+		}
+		return nil
+	}
+	if err := upload("b.jpg"); err != nil {
+		t.Errorf("refused: %v", err)
+	}
+	if childId(t, d, root, "b.jpg") == "" {
+		t.Errorf("refused: object not uploaded")
+	}
+
+	b.Fault = func(op string, ids []string) error {
+		if op == "CreateResource" {
+			return errDisconnected
+		}
+		return nil
+	}
+	if err := upload("c.jpg"); err == nil {
+		t.Errorf("disconnected: expected error")
+	}
+}
+
+func TestResources(t *testing.T) {
+	d := NewMemoryDevice()
+	root := putFolder(t, d, WPD_DEVICE_OBJECT_ID, "Storage")
+	obj := &Object{Name: "a.jpg", ObjectInfo: ObjectInfo{Size: 5}}
+	if _, err := d.CopyObjectToDevice(root, strings.NewReader("photo"), obj, WithThumbnail(testPNG())); err != nil {
+		t.Fatal(err)
+	}
+	id := childId(t, d, root, "a.jpg")
+
+	res, err := d.Resources(id)
+	if err != nil || len(res) != 2 {
+		t.Fatalf("%v %v", res, err)
+	}
+	if r := res[0]; r.Key != WPD_RESOURCE_DEFAULT || r.Size != 5 || r.Format != FormatGUID(MTP_FORMAT_EXIF_JPEG) || !r.CanRead || r.CanDelete {
+		t.Errorf("default: %+v", r)
+	}
+	if r := res[1]; r.Key != WPD_RESOURCE_THUMBNAIL || r.Size != int64(len(testPNG())) || r.Format != FormatGUID(MTP_FORMAT_PNG) || !r.CanWrite || !r.CanDelete {
+		t.Errorf("thumbnail: %+v", r)
+	}
+	if res, err = d.Resources(root); err != nil || len(res) != 0 {
+		t.Errorf("folder: %v %v", res, err)
+	}
+	if _, err = d.Resource(id, WPD_RESOURCE_ALBUM_ART); err != HResult(E_NOT_SUPPORTED) {
+		t.Errorf("album art: %v", err)
+	}
+
+	art := &Resource{Key: WPD_RESOURCE_ALBUM_ART, Size: 3}
+	if err = d.CreateResource(id, strings.NewReader("ar"), art); err == nil {
+		t.Errorf("short source: expected error")
+	}
+	if _, err = d.Resource(id, WPD_RESOURCE_ALBUM_ART); err == nil {
+		t.Errorf("short source committed")
+	}
+	if err = d.CreateResource(id, strings.NewReader("art and more"), art); err != nil {
+		t.Fatal(err)
+	}
+	if r, err := d.Resource(id, WPD_RESOURCE_ALBUM_ART); err != nil || r.Size != 3 {
+		t.Errorf("album art: %+v %v", r, err)
+	}
+
+	data := &Resource{Key: WPD_RESOURCE_DEFAULT, Size: 7}
+	if err = d.CreateResource(id, strings.NewReader("changed"), data); err != nil {
+		t.Fatal(err)
+	}
+	if o, _ := d.GetObject(id); o.Size != 7 {
+		t.Errorf("size = %v", o.Size)
+	}
+}
+
+// keyString formats k like the Windows SDK headers, "{GUID},pid".
+func keyString(k PROPERTYKEY) string {
+	g := k.Fmtid
+	return fmt.Sprintf("{%08X-%04X-%04X-%X-%X},%v", g.Data1, g.Data2, g.Data3, g.Data4[:2], g.Data4[2:], k.Pid)
+}
+
+func TestResourceKeys(t *testing.T) {
+	// the keys of PortableDevice.h
+	keys := map[string]PROPERTYKEY{
+		"{E81E79BE-34F0-41BF-B53F-F1A06AE87842},0": WPD_RESOURCE_DEFAULT,
+		"{C7C407BA-98FA-46B5-9960-23FEC124CFDE},0": WPD_RESOURCE_THUMBNAIL,
+		"{F195FED8-AA28-4EE3-B153-E182DD5EDC39},0": WPD_RESOURCE_ICON,
+		"{3BC13982-85B1-48E0-95A6-8D3AD06BE117},0": WPD_RESOURCE_AUDIO_CLIP,
+		"{F02AA354-2300-4E2D-A1B9-3B6730F7FA21},0": WPD_RESOURCE_ALBUM_ART,
+		"{B9B9F515-BA70-4647-94DC-FA4925E95A07},0": WPD_RESOURCE_GENERIC,
+	}
+	for want, k := range keys {
+		if got := keyString(k); got != want {
+			t.Errorf("%v, want %v", got, want)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package gowpd
+
+import (
+	"io"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy retries device calls failing with transient errors, like the
+// busy and timeout errors MTP devices return while their media scanner runs.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts including the first one.
+	MaxAttempts int
+	// Delay is the wait before the second attempt. It doubles with every
+	// attempt up to MaxDelay.
+	Delay    time.Duration
+	MaxDelay time.Duration
+	// Jitter is the fraction of each delay which is random, from 0 to 1.
+	Jitter float64
+	// Retryable reports whether a call failing with err is tried again.
+	// IsRetryable is used if it is nil.
+	Retryable func(err error) bool
+
+	sleep  func(time.Duration)
+	random func() float64
+}
+
+// DefaultRetryPolicy returns the policy of a new Device.
+func DefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts: 5,
+		Delay:       200 * time.Millisecond,
+		MaxDelay:    5 * time.Second,
+		Jitter:      0.5,
+	}
+}
+
+// IsRetryable reports whether err is a transient device error.
+func IsRetryable(err error) bool {
+	hr, ok := ErrorCode(err)
+	if !ok {
+		return false
+	}
+	switch hr {
+	case E_PENDING, E_BUSY, E_NOT_READY, E_SEM_TIMEOUT, E_TIMEOUT, E_IO_DEVICE:
+		return true
+	}
+	return false
+}
+
+func (p *RetryPolicy) retryable(err error) bool {
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return IsRetryable(err)
+}
+
+// delay returns the wait before attempt, the second attempt being 1.
+func (p *RetryPolicy) delay(attempt int) time.Duration {
+	d := p.Delay
+	for i := 1; i < attempt && (p.MaxDelay <= 0 || d < p.MaxDelay); i++ {
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if p.Jitter > 0 {
+		random := rand.Float64
+		if p.random != nil {
+			random = p.random
+		}
+		d -= time.Duration(float64(d) * p.Jitter * random())
+	}
+	return d
+}
+
+func (p *RetryPolicy) wait(attempt int) {
+	d := p.delay(attempt)
+	if p.sleep != nil {
+		p.sleep(d)
+	} else {
+		time.Sleep(d)
+	}
+}
+
+// Do calls fn until it succeeds, fails with an error that is not retryable
+// or MaxAttempts is reached. A nil policy calls fn once.
+func (p *RetryPolicy) Do(fn func() error) error {
+	err := fn()
+	if p == nil {
+		return err
+	}
+	for attempt := 1; err != nil && attempt < p.MaxAttempts && p.retryable(err); attempt++ {
+		p.wait(attempt)
+		err = fn()
+	}
+	return err
+}
+
+// retryReader reopens the stream of an object at the current position when a
+// read fails with a retryable error.
+type retryReader struct {
+	d      *Device
+	id     string
+	offset int64
+	r      io.ReadCloser
+}
+
+func (o *retryReader) Read(buf []byte) (int, error) {
+	n, err := o.r.Read(buf)
+	o.offset += int64(n)
+	p := o.d.Retry
+	if err == nil || err == io.EOF || p == nil || !p.retryable(err) {
+		return n, err
+	}
+	if n > 0 {
+		// the next read fails again and reopens the stream
+		return n, nil
+	}
+	for attempt := 1; attempt < p.MaxAttempts && p.retryable(err); attempt++ {
+		p.wait(attempt)
+		var r io.ReadCloser
+		if r, err = o.d.openRange(o.id, o.offset); err != nil {
+			continue
+		}
+		o.r.Close()
+		o.r = r
+		n, err = r.Read(buf)
+		o.offset += int64(n)
+		if n > 0 || err == nil || err == io.EOF {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+func (o *retryReader) Close() error {
+	return o.r.Close()
+}
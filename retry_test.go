@@ -0,0 +1,357 @@
+package gowpd
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testRetryPolicy records the delays instead of sleeping.
+func testRetryPolicy(delays *[]time.Duration) *RetryPolicy {
+	p := DefaultRetryPolicy()
+	p.sleep = func(d time.Duration) {
+		*delays = append(*delays, d)
+	}
+	p.random = func() float64 { return 0.5 }
+	return p
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := &RetryPolicy{Delay: 100 * time.Millisecond, MaxDelay: time.Second}
+	want := []time.Duration{100, 200, 400, 800, 1000, 1000}
+	for i, w := range want {
+		if d := p.delay(i + 1); d != w*time.Millisecond {
+			t.Errorf("delay %v = %v", i+1, d)
+		}
+	}
+	p.Jitter = 0.5
+	p.random = func() float64 { return 1 }
+	if d := p.delay(2); d != 100*time.Millisecond {
+		t.Errorf("jitter delay = %v", d)
+	}
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	var delays []time.Duration
+	p := testRetryPolicy(&delays)
+	tests := []struct {
+		err      error
+		fails    int
+		attempts int
+		ok       bool
+	}{
+		{HResult(E_BUSY), 0, 1, true},
+		{HResult(E_BUSY), 2, 3, true},
+		{HResult(E_TIMEOUT), 4, 5, true},
+		{HResult(E_SEM_TIMEOUT), 5, 5, false},
+		{HResult(E_ACCESSDENIED), 2, 1, false},
+		{errors.New("unplugged"), 2, 1, false},
+	}
+	for _, tt := range tests {
+		delays = nil
+		attempts := 0
+		err := p.Do(func() error {
+			attempts++
+			if attempts <= tt.fails {
+				return tt.err
+			}
+			return nil
+		})
+		if attempts != tt.attempts || (err == nil) != tt.ok || len(delays) != attempts-1 {
+			t.Errorf("%v x%v: %v attempts, err %v", tt.err, tt.fails, attempts, err)
+		}
+	}
+	if len(delays) != 0 {
+		t.Errorf("delays = %v", delays)
+	}
+
+	var nilPolicy *RetryPolicy
+	attempts := 0
+	nilPolicy.Do(func() error {
+		attempts++
+		return HResult(E_BUSY)
+	})
+	if attempts != 1 {
+		t.Errorf("nil policy made %v attempts", attempts)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	for _, hr := range []int32{E_PENDING, E_BUSY, E_NOT_READY, E_SEM_TIMEOUT, E_TIMEOUT, E_IO_DEVICE} {
+		if !IsRetryable(HResult(hr)) {
+			t.Errorf("%v not retryable", HResult(hr))
+		}
+	}
+	for _, err := range []error{nil, HResult(E_FILE_NOT_FOUND), HResult(E_FAIL), errDisconnected, io.EOF} {
+		if IsRetryable(err) {
+			t.Errorf("%v retryable", err)
+		}
+	}
+}
+
+// busyFaults fails each call of the ops n times with E_BUSY.
+func busyFaults(n int, ops ...string) func(op string, ids []string) error {
+	calls := make(map[string]int)
+	return func(op string, ids []string) error {
+		for _, o := range ops {
+			if o == op {
+				calls[op]++
+				if calls[op] <= n {
+					return HResult(E_BUSY)
+				}
+				calls[op] = 0
+			}
+		}
+		return nil
+	}
+}
+
+func TestDeviceRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gowpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	b := NewMemoryBackend()
+	d := NewDevice(b)
+	var delays []time.Duration
+	d.Retry = testRetryPolicy(&delays)
+	root := putFolder(t, d, WPD_DEVICE_OBJECT_ID, "Storage")
+	id := putFile(t, d, root, "a", "data")
+
+	b.Fault = busyFaults(3, "EnumObjects", "GetValues", "GetStream", "CreateObjectWithPropertiesAndData", "CreateObjectWithPropertiesOnly", "SetValues")
+	if objs, err := d.GetChildObjects(root); err != nil || len(objs) != 1 {
+		t.Errorf("GetChildObjects = %v %v", objs, err)
+	}
+	if _, err := d.CopyFromDevice(filepath.Join(dir, "a"), id, WithVerify(VERIFY_SIZE, HASH_SHA256)); err != nil {
+		t.Errorf("CopyFromDevice: %v", err)
+	}
+	if _, err := d.CopyObjectToDevice(root, strings.NewReader("b"), &Object{Name: "b", ObjectInfo: ObjectInfo{Size: 1}}); err != nil {
+		t.Errorf("CopyObjectToDevice: %v", err)
+	}
+	if _, err := d.CreateFolder(root, "dir"); err != nil {
+		t.Errorf("CreateFolder: %v", err)
+	}
+	if err := d.Rename(id, "c"); err != nil {
+		t.Errorf("Rename: %v", err)
+	}
+	if len(delays) == 0 || delays[0] != 150*time.Millisecond || delays[1] != 300*time.Millisecond {
+		t.Errorf("delays = %v", delays)
+	}
+
+	b.Fault = busyFaults(5, "GetValues")
+	if _, err := d.GetObject(id); err != HResult(E_BUSY) {
+		t.Errorf("err = %v", err)
+	}
+	d.Retry = nil
+	b.Fault = busyFaults(1, "EnumObjects")
+	if _, err := d.GetChildIds(root); err != HResult(E_BUSY) {
+		t.Errorf("err = %v", err)
+	}
+}
+
+// flakyBackend serves streams failing with a timeout once at each offset of
+// failAt.
+type flakyBackend struct {
+	*MemoryBackend
+	failAt []int64
+	opens  int
+}
+
+func (b *flakyBackend) GetStream(id string, key PROPERTYKEY) (io.ReadCloser, int, error) {
+	b.opens++
+	stream, size, err := b.MemoryBackend.GetStream(id, key)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &flakyReader{stream, b, 0}, size, nil
+}
+
+type flakyReader struct {
+	io.ReadCloser
+	b   *flakyBackend
+	pos int64
+}
+
+func (r *flakyReader) Read(buf []byte) (int, error) {
+	for i, at := range r.b.failAt {
+		if r.pos == at {
+			r.b.failAt = append(r.b.failAt[:i], r.b.failAt[i+1:]...)
+			return 0, HResult(E_SEM_TIMEOUT)
+		}
+		if r.pos < at && int64(len(buf)) > at-r.pos {
+			buf = buf[:at-r.pos]
+		}
+	}
+	n, err := r.ReadCloser.Read(buf)
+	r.pos += int64(n)
+	return n, err
+}
+
+func TestRetryStream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gowpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := testData(100000)
+	b := &flakyBackend{MemoryBackend: NewMemoryBackend(), failAt: []int64{30000, 60000, 90000}}
+	d := NewDevice(b)
+	var delays []time.Duration
+	d.Retry = testRetryPolicy(&delays)
+	root := putFolder(t, d, WPD_DEVICE_OBJECT_ID, "Storage")
+	id := putFile(t, d, root, "a", data)
+
+	dst := filepath.Join(dir, "a")
+	n, err := d.CopyFromDevice(dst, id, WithVerify(VERIFY_HASH, HASH_XXH64))
+	if err != nil || n != 100000 {
+		t.Fatalf("copy = %v %v", n, err)
+	}
+	if b.opens != 4 {
+		t.Errorf("opens = %v", b.opens)
+	}
+	got, _ := ioutil.ReadFile(dst)
+	if string(got) != data {
+		t.Errorf("content differs")
+	}
+
+	b.failAt = []int64{50000}
+	d.Retry = nil
+	if _, err := d.CopyFromDevice(dst, id); err != HResult(E_SEM_TIMEOUT) {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestRetryUpload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gowpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := testData(100000)
+	src := filepath.Join(dir, "a")
+	if err := ioutil.WriteFile(src, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	b := NewMemoryBackend()
+	d := NewDevice(b)
+	var delays []time.Duration
+	d.Retry = testRetryPolicy(&delays)
+	root := putFolder(t, d, WPD_DEVICE_OBJECT_ID, "Storage")
+	// the second write and the first commit time out
+	faults := func() {
+		writes, commits := 0, 0
+		b.Fault = func(op string, ids []string) error {
+			switch op {
+			case "Write":
+				if writes++; writes == 2 {
+					return HResult(E_SEM_TIMEOUT)
+				}
+			case "Commit":
+				if commits++; commits == 1 {
+					return HResult(E_SEM_TIMEOUT)
+				}
+			}
+			return nil
+		}
+	}
+
+	faults()
+	var last Progress
+	if _, err := d.CopyToDevice(root, src, WithProgress(func(p Progress) { last = p })); err != nil {
+		t.Errorf("file: %v", err)
+	}
+	// the bytes of the failed attempts are not counted
+	if last.Done != int64(len(data)) || last.Total != int64(len(data)) || last.FilesDone != 1 {
+		t.Errorf("progress = %+v", last)
+	}
+	faults()
+	obj := &Object{Name: "b", ObjectInfo: ObjectInfo{Size: int64(len(data))}}
+	if _, err := d.CopyObjectToDevice(root, strings.NewReader(data), obj, WithAtomic()); err != nil {
+		t.Errorf("reader: %v", err)
+	}
+	if len(delays) != 4 {
+		t.Errorf("delays = %v", delays)
+	}
+	b.Fault = nil
+	if got := childNames(t, d, root); !equalMap(got, map[string]string{"a": data, "b": data}) {
+		t.Errorf("objects = %v", len(got))
+	}
+
+	// a reader which cannot seek is read only once
+	faults()
+	obj.Name = "c"
+	if _, err := d.CopyObjectToDevice(root, io.MultiReader(strings.NewReader(data)), obj); err != HResult(E_SEM_TIMEOUT) {
+		t.Errorf("err = %v", err)
+	}
+}
+
+// lateBackend makes objects whose creation then times out, like a device
+// answering after the host gave up.
+type lateBackend struct {
+	*MemoryBackend
+	// late is the number of creates which time out.
+	late int
+}
+
+func (b *lateBackend) CreateObjectWithPropertiesOnly(props PropertyValues) (string, error) {
+	id, err := b.MemoryBackend.CreateObjectWithPropertiesOnly(props)
+	if err == nil && b.late > 0 {
+		b.late--
+		return "", HResult(E_TIMEOUT)
+	}
+	return id, err
+}
+
+func (b *lateBackend) CreateObjectWithPropertiesAndData(props PropertyValues) (ObjectWriter, int, error) {
+	w, size, err := b.MemoryBackend.CreateObjectWithPropertiesAndData(props)
+	return &lateWriter{w, b}, size, err
+}
+
+type lateWriter struct {
+	ObjectWriter
+	b *lateBackend
+}
+
+func (w *lateWriter) Commit() (string, error) {
+	id, err := w.ObjectWriter.Commit()
+	if err == nil && w.b.late > 0 {
+		w.b.late--
+		return "", HResult(E_TIMEOUT)
+	}
+	return id, err
+}
+
+func TestRetryCreate(t *testing.T) {
+	b := &lateBackend{MemoryBackend: NewMemoryBackend()}
+	d := NewDevice(b)
+	var delays []time.Duration
+	d.Retry = testRetryPolicy(&delays)
+	root := putFolder(t, d, WPD_DEVICE_OBJECT_ID, "Storage")
+
+	b.late = 1
+	id, err := d.CreateFolder(root, "dir")
+	if err != nil || id == "" || id != childId(t, d, root, "dir") {
+		t.Errorf("folder: %v %v", id, err)
+	}
+	b.late = 1
+	obj := &Object{Name: "a.txt", ObjectInfo: ObjectInfo{Size: 1, ModTime: 100}}
+	if _, err = d.CopyObjectToDevice(root, strings.NewReader("a"), obj); err != nil {
+		t.Errorf("file: %v", err)
+	}
+	// a late commit of a reader which cannot seek is found too
+	b.late = 1
+	obj = &Object{Name: "b.txt", ObjectInfo: ObjectInfo{Size: 1, ModTime: 100}}
+	if _, err = d.CopyObjectToDevice(root, io.MultiReader(strings.NewReader("b")), obj); err != nil {
+		t.Errorf("reader: %v", err)
+	}
+	ids, _ := d.GetChildIds(root)
+	if len(ids) != 3 {
+		t.Errorf("%v objects, want 3", len(ids))
+	}
+}
@@ -0,0 +1,365 @@
+package gowpd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// RULES_FILENAME is the rules file read from the root of a synced tree.
+	RULES_FILENAME = ".gowpdignore"
+
+	SYSTEM_VOLUME_INFO = "System Volume Information"
+)
+
+type ruleKind int
+
+const (
+	rulePath ruleKind = iota
+	ruleSize
+	ruleAge
+	ruleType
+)
+
+// rule is a line of a rules file.
+type rule struct {
+	kind   ruleKind
+	negate bool
+	// dirOnly matches folders only, for patterns ending with "/".
+	dirOnly bool
+	// segs are the pattern elements split at "/". Patterns without a "/"
+	// start with "**" to match at any depth.
+	segs []string
+	// less compares sizes and ages with n as "<" instead of ">".
+	less  bool
+	n     int64
+	types []GUID
+}
+
+// Rules decides which files are left out of listings, syncs and tree
+// copies, like a .gitignore file. Each line is a rule:
+//
+//	# comment
+//	*.tmp          files and folders named so at any depth
+//	/build         build at the root only
+//	cache/         folders only
+//	a/**/b         b in a or any folder below a
+//	!keep.tmp      include what an earlier rule excludes
+//	size>100M      files larger than 100 MiB; k, M and G are binary units
+//	size<1         files smaller than a byte, that is empty files
+//	age>30d        files modified more than 30 days ago; s, m, h, d and w
+//	type:video     files of the content types image, video, audio, document
+//	               or file, separated by commas
+//
+// The last matching rule decides. Size, age and type rules match files
+// only. Leading "\" escapes a "#" or "!" starting a pattern.
+type Rules struct {
+	rules []*rule
+	// Now is the time ages are counted from. It is time.Now if nil.
+	Now func() time.Time
+}
+
+// NewRules returns rules of the given lines.
+func NewRules(lines ...string) (*Rules, error) {
+	r := &Rules{}
+	for _, line := range lines {
+		if err := r.Add(line); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// DefaultRules returns the rules leaving out the folders which Windows and
+// Android keep for themselves.
+func DefaultRules() *Rules {
+	r, _ := NewRules(SYSTEM_VOLUME_INFO+"/", ".trashed-*")
+	return r
+}
+
+// ParseRules reads rules from r, one per line.
+func ParseRules(r io.Reader) (*Rules, error) {
+	rules := &Rules{}
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		if err := rules.Add(s.Text()); err != nil {
+			return nil, fmt.Errorf("Line %v : %v", n, err)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// LoadRules reads the rules file path. A missing file has no rules.
+func LoadRules(path string) (*Rules, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return &Rules{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseRules(f)
+}
+
+// MergeRules returns the rules of rs in order, so rules of later ones win.
+// Nil rules are skipped.
+func MergeRules(rs ...*Rules) *Rules {
+	m := &Rules{}
+	for _, r := range rs {
+		if r == nil {
+			continue
+		}
+		m.rules = append(m.rules, r.rules...)
+		if m.Now == nil {
+			m.Now = r.Now
+		}
+	}
+	return m
+}
+
+// Add appends the rule line. Blank lines and comments are ignored.
+func (r *Rules) Add(line string) error {
+	line = strings.TrimRight(strings.TrimSuffix(line, "\r"), " \t")
+	if line == "" || line[0] == '#' {
+		return nil
+	}
+	ru := &rule{}
+	if line[0] == '!' {
+		ru.negate = true
+		line = line[1:]
+	} else if line[0] == '\\' {
+		line = line[1:]
+	}
+	var err error
+	switch {
+	case strings.HasPrefix(line, "size>"), strings.HasPrefix(line, "size<"):
+		ru.kind = ruleSize
+		ru.less = line[4] == '<'
+		ru.n, err = parseSize(line[5:])
+	case strings.HasPrefix(line, "age>"), strings.HasPrefix(line, "age<"):
+		ru.kind = ruleAge
+		ru.less = line[3] == '<'
+		ru.n, err = parseAge(line[4:])
+	case strings.HasPrefix(line, "type:"):
+		ru.kind = ruleType
+		ru.types, err = parseTypes(line[5:])
+	default:
+		err = ru.parsePattern(line)
+	}
+	if err != nil {
+		return err
+	}
+	r.rules = append(r.rules, ru)
+	return nil
+}
+
+func (ru *rule) parsePattern(pattern string) error {
+	if strings.HasSuffix(pattern, "/") {
+		ru.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+	anchored := strings.Contains(pattern, "/")
+	pattern = strings.TrimLeft(pattern, "/")
+	if pattern == "" {
+		return fmt.Errorf("Empty pattern")
+	}
+	ru.segs = strings.Split(pattern, "/")
+	if !anchored {
+		ru.segs = append([]string{"**"}, ru.segs...)
+	}
+	for _, seg := range ru.segs {
+		if _, err := path.Match(seg, ""); err != nil {
+			return fmt.Errorf("Invalid pattern : %v", pattern)
+		}
+	}
+	return nil
+}
+
+var sizeUnits = map[byte]int64{'k': 1 << 10, 'K': 1 << 10, 'M': 1 << 20, 'G': 1 << 30, 'T': 1 << 40}
+
+func parseSize(s string) (int64, error) {
+	unit := int64(1)
+	if s != "" {
+		if u, ok := sizeUnits[s[len(s)-1]]; ok {
+			unit = u
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid size : %v", s)
+	}
+	return n * unit, nil
+}
+
+var ageUnits = map[byte]int64{'s': 1, 'm': 60, 'h': 3600, 'd': 86400, 'w': 7 * 86400}
+
+// parseAge returns the age s in seconds.
+func parseAge(s string) (int64, error) {
+	if s == "" {
+		return 0, fmt.Errorf("Invalid age : %v", s)
+	}
+	unit, ok := ageUnits[s[len(s)-1]]
+	if !ok {
+		return 0, fmt.Errorf("Invalid age unit : %v", s)
+	}
+	n, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid age : %v", s)
+	}
+	return n * unit, nil
+}
+
+var contentTypes = map[string]GUID{
+	"image":    WPD_CONTENT_TYPE_IMAGE,
+	"video":    WPD_CONTENT_TYPE_VIDEO,
+	"audio":    WPD_CONTENT_TYPE_AUDIO,
+	"document": WPD_CONTENT_TYPE_DOCUMENT,
+	"file":     WPD_CONTENT_TYPE_GENERIC_FILE,
+}
+
+func parseTypes(s string) ([]GUID, error) {
+	var types []GUID
+	for _, name := range strings.Split(s, ",") {
+		t, ok := contentTypes[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("Unknown content type : %v", name)
+		}
+		types = append(types, t)
+	}
+	return types, nil
+}
+
+// contentType returns the content type of obj, by the extension of its
+// name if the object has none.
+func contentType(name string, obj *Object) GUID {
+	if obj.ContentType != (GUID{}) {
+		return obj.ContentType
+	}
+	if t, ok := TypeByExtension(name); ok {
+		return t.ContentType
+	}
+	return WPD_CONTENT_TYPE_GENERIC_FILE
+}
+
+func (ru *rule) match(r *Rules, segs []string, obj *Object) bool {
+	if ru.kind != rulePath {
+		if obj.IsDir {
+			return false
+		}
+	} else if ru.dirOnly && !obj.IsDir {
+		return false
+	}
+	switch ru.kind {
+	case ruleSize:
+		if ru.less {
+			return obj.Size < ru.n
+		}
+		return obj.Size > ru.n
+	case ruleAge:
+		now := time.Now
+		if r.Now != nil {
+			now = r.Now
+		}
+		age := now().Unix() - obj.ModTime
+		if ru.less {
+			return age < ru.n
+		}
+		return age > ru.n
+	case ruleType:
+		t := contentType(segs[len(segs)-1], obj)
+		for _, rt := range ru.types {
+			if rt == t {
+				return true
+			}
+		}
+		return false
+	}
+	return matchSegs(ru.segs, segs)
+}
+
+// matchSegs reports whether the path elements name match the pattern
+// elements pat, where "**" matches any number of elements.
+func matchSegs(pat, name []string) bool {
+	for len(pat) > 0 {
+		if pat[0] == "**" {
+			pat = pat[1:]
+			if len(pat) == 0 {
+				// "a/**" matches what is inside a, not a itself
+				return len(name) > 0
+			}
+			for i := 0; i < len(name); i++ {
+				if matchSegs(pat, name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pat[0], name[0]); !ok {
+			return false
+		}
+		pat, name = pat[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+func splitPath(p string) []string {
+	return strings.Split(strings.Trim(filepath.ToSlash(p), "/"), "/")
+}
+
+// Match reports whether the last rule matching the object obj at path, which
+// is relative to the root of the tree, excludes it. Folders above path are
+// not checked; walks do not enter excluded folders.
+func (r *Rules) Match(path string, obj *Object) bool {
+	if r == nil {
+		return false
+	}
+	return r.match(splitPath(path), obj)
+}
+
+func (r *Rules) match(segs []string, obj *Object) bool {
+	excluded := false
+	for _, ru := range r.rules {
+		if ru.negate == excluded && ru.match(r, segs, obj) {
+			excluded = !ru.negate
+		}
+	}
+	return excluded
+}
+
+// Excluded reports whether obj at path or a folder above it is excluded. As
+// with .gitignore, a file in an excluded folder cannot be included again.
+func (r *Rules) Excluded(path string, obj *Object) bool {
+	if r == nil {
+		return false
+	}
+	segs := splitPath(path)
+	dir := &Object{ObjectInfo: ObjectInfo{IsDir: true}}
+	for i := 1; i < len(segs); i++ {
+		if r.match(segs[:i], dir) {
+			return true
+		}
+	}
+	return r.match(segs, obj)
+}
+
+// WithRules leaves the files and folders excluded by r out of tree copies.
+func WithRules(r *Rules) CopyOption {
+	return func(o *copyOptions) {
+		o.rules = r
+	}
+}
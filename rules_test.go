@@ -0,0 +1,235 @@
+package gowpd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func file(size int64, mtime int64) *Object {
+	return &Object{ObjectInfo: ObjectInfo{Size: size, ModTime: mtime}, ChildCount: -1}
+}
+
+var folder = &Object{ObjectInfo: ObjectInfo{IsDir: true}}
+
+func TestRulesMatch(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	tests := []struct {
+		rules    []string
+		path     string
+		obj      *Object
+		excluded bool
+	}{
+		{nil, "a.txt", file(1, 0), false},
+		// names at any depth
+		{[]string{"*.tmp"}, "a.tmp", file(1, 0), true},
+		{[]string{"*.tmp"}, "d/e/a.tmp", file(1, 0), true},
+		{[]string{"*.tmp"}, "a.tmp.txt", file(1, 0), false},
+		{[]string{"*.tmp"}, "tmp", folder, false},
+		{[]string{"cache"}, "a/cache", folder, true},
+		{[]string{"cache"}, "a/cache", file(1, 0), true},
+		{[]string{"?.txt"}, "a.txt", file(1, 0), true},
+		{[]string{"?.txt"}, "ab.txt", file(1, 0), false},
+		{[]string{"[ab].txt"}, "b.txt", file(1, 0), true},
+		{[]string{"[ab].txt"}, "c.txt", file(1, 0), false},
+		// folders only
+		{[]string{"cache/"}, "a/cache", folder, true},
+		{[]string{"cache/"}, "a/cache", file(1, 0), false},
+		// anchored
+		{[]string{"/build"}, "build", folder, true},
+		{[]string{"/build"}, "src/build", folder, false},
+		{[]string{"d/*.jpg"}, "d/a.jpg", file(1, 0), true},
+		{[]string{"d/*.jpg"}, "x/d/a.jpg", file(1, 0), false},
+		{[]string{"d/*.jpg"}, "d/e/a.jpg", file(1, 0), false},
+		// **
+		{[]string{"**/thumbs"}, "thumbs", folder, true},
+		{[]string{"**/thumbs"}, "a/b/thumbs", folder, true},
+		{[]string{"a/**/b"}, "a/b", file(1, 0), true},
+		{[]string{"a/**/b"}, "a/x/y/b", file(1, 0), true},
+		{[]string{"a/**/b"}, "x/a/b", file(1, 0), false},
+		{[]string{"a/**"}, "a", folder, false},
+		{[]string{"a/**"}, "a/x/y", file(1, 0), true},
+		{[]string{"DCIM/**/*.mp4"}, "DCIM/Camera/v.mp4", file(1, 0), true},
+		// negation, last match wins
+		{[]string{"*.log", "!keep.log"}, "keep.log", file(1, 0), false},
+		{[]string{"*.log", "!keep.log"}, "other.log", file(1, 0), true},
+		{[]string{"!keep.log", "*.log"}, "keep.log", file(1, 0), true},
+		{[]string{"*", "!*.jpg"}, "a.jpg", file(1, 0), false},
+		{[]string{"*", "!*.jpg"}, "a.png", file(1, 0), true},
+		// escapes and comments
+		{[]string{`\#a`}, "#a", file(1, 0), true},
+		{[]string{`\!a`}, "!a", file(1, 0), true},
+		{[]string{"#a"}, "#a", file(1, 0), false},
+		{[]string{"a.txt  "}, "a.txt", file(1, 0), true},
+		// sizes
+		{[]string{"size>1k"}, "a", file(1025, 0), true},
+		{[]string{"size>1k"}, "a", file(1024, 0), false},
+		{[]string{"size>2M"}, "a", file(3<<20, 0), true},
+		{[]string{"size>1G"}, "a", file(1<<30, 0), false},
+		{[]string{"size<1"}, "a", file(0, 0), true},
+		{[]string{"size<1"}, "a", file(1, 0), false},
+		{[]string{"size<1"}, "d", folder, false},
+		{[]string{"size>0", "!size>10"}, "a", file(11, 0), false},
+		// ages from now
+		{[]string{"age>1d"}, "a", file(1, 1000000-86401), true},
+		{[]string{"age>1d"}, "a", file(1, 1000000-86400), false},
+		{[]string{"age<2h"}, "a", file(1, 1000000-3600), true},
+		{[]string{"age<2h"}, "a", file(1, 1000000-7200), false},
+		{[]string{"age>1w"}, "a", file(1, 0), true},
+		{[]string{"age>30m"}, "d", folder, false},
+		// content types
+		{[]string{"type:video"}, "a.mp4", file(1, 0), true},
+		{[]string{"type:video"}, "a.jpg", file(1, 0), false},
+		{[]string{"type:image,audio"}, "a.JPG", file(1, 0), true},
+		{[]string{"type:image, audio"}, "a.mp3", file(1, 0), true},
+		{[]string{"type:file"}, "a.xyz", file(1, 0), true},
+		{[]string{"type:document"}, "d", folder, false},
+		{[]string{"*", "!type:image"}, "a.png", file(1, 0), false},
+		{[]string{"*", "!type:image"}, "a.txt", file(1, 0), true},
+		{[]string{"type:video"}, "a.bin", &Object{ContentType: WPD_CONTENT_TYPE_VIDEO, ChildCount: -1}, true},
+	}
+	for _, tt := range tests {
+		r, err := NewRules(tt.rules...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Now = func() time.Time { return now }
+		if got := r.Match(filepath.FromSlash(tt.path), tt.obj); got != tt.excluded {
+			t.Errorf("%q: %v = %v, want %v", tt.rules, tt.path, got, tt.excluded)
+		}
+	}
+}
+
+func TestRulesExcluded(t *testing.T) {
+	r, _ := NewRules("build/", "!build/keep.txt", "*.tmp", "!/d/x.tmp")
+	tests := []struct {
+		path     string
+		excluded bool
+	}{
+		{"build/a.txt", true},
+		// a folder excluded above cannot be included again
+		{"build/keep.txt", true},
+		{"src/build/deep/a.txt", true},
+		{"d/x.tmp", false},
+		{"d/y.tmp", true},
+		{"d/e/a.txt", false},
+	}
+	for _, tt := range tests {
+		if got := r.Excluded(filepath.FromSlash(tt.path), file(1, 0)); got != tt.excluded {
+			t.Errorf("%v = %v", tt.path, got)
+		}
+	}
+	var none *Rules
+	if none.Excluded("a", file(1, 0)) || none.Match("a", file(1, 0)) {
+		t.Errorf("nil rules exclude")
+	}
+}
+
+func TestRulesDefault(t *testing.T) {
+	r := DefaultRules()
+	if !r.Match(SYSTEM_VOLUME_INFO, folder) || !r.Match(".trashed-1600000000-a.jpg", file(1, 0)) {
+		t.Errorf("system folders listed")
+	}
+	if r.Match("a.jpg", file(1, 0)) {
+		t.Errorf("a.jpg excluded")
+	}
+}
+
+func TestParseRules(t *testing.T) {
+	data := "# photos only\r\n\n*\n!*/\n!type:image\nsize>10M\n"
+	r, err := ParseRules(strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Match("d", folder) || r.Match(filepath.Join("d", "a.jpg"), file(1, 0)) {
+		t.Errorf("photo excluded")
+	}
+	if !r.Match("a.txt", file(1, 0)) || !r.Match("big.jpg", file(11<<20, 0)) {
+		t.Errorf("other files included")
+	}
+
+	for _, line := range []string{"size>", "size>x", "size>-1", "age>1", "age>d", "age>1y", "type:", "type:movie", "[a", "/", "!"} {
+		if _, err := NewRules(line); err == nil {
+			t.Errorf("%q accepted", line)
+		}
+	}
+	if _, err := ParseRules(strings.NewReader("a\nsize>1q\n")); err == nil || !strings.Contains(err.Error(), "Line 2") {
+		t.Errorf("error = %v", err)
+	}
+}
+
+func TestLoadRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gowpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, RULES_FILENAME)
+	r, err := LoadRules(path)
+	if err != nil || r.Match("a", file(1, 0)) {
+		t.Errorf("missing file : %v", err)
+	}
+	ioutil.WriteFile(path, []byte("*.tmp\n"), 0644)
+	if r, err = LoadRules(path); err != nil || !r.Match("a.tmp", file(1, 0)) {
+		t.Errorf("loaded %v", err)
+	}
+
+	cli, _ := NewRules("!a.tmp")
+	m := MergeRules(nil, r, cli)
+	if m.Match("a.tmp", file(1, 0)) || !m.Match("b.tmp", file(1, 0)) {
+		t.Errorf("merged rules")
+	}
+}
+
+func TestTreeRules(t *testing.T) {
+	src, err := ioutil.TempDir("", "gowpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	mtime := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, name := range []string{"a.jpg", "a.tmp", filepath.Join("cache", "b.jpg"), filepath.Join("d", "c.jpg")} {
+		writeFile(t, filepath.Join(src, name), "data", mtime)
+	}
+	r, _ := NewRules("*.tmp", "cache/")
+	paths := func(results []TransferResult) string {
+		var s []string
+		for _, rs := range results {
+			s = append(s, filepath.ToSlash(rs.Path))
+		}
+		sort.Strings(s)
+		return strings.Join(s, " ")
+	}
+
+	d := NewMemoryDevice()
+	root := putFolder(t, d, WPD_DEVICE_OBJECT_ID, "Storage")
+	results, err := d.UploadTree(src, root, WithRules(r))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := paths(results); got != "a.jpg d d/c.jpg" {
+		t.Errorf("uploaded %v", got)
+	}
+
+	// the device gets the excluded files, which are not downloaded
+	d.UploadTree(src, root)
+	dst, err := ioutil.TempDir("", "gowpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+	results, err = d.DownloadTree(root, dst, WithRules(r))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := paths(results); got != "a.jpg d d/c.jpg" {
+		t.Errorf("downloaded %v", got)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "cache")); !os.IsNotExist(err) {
+		t.Errorf("cache downloaded")
+	}
+}
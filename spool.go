@@ -0,0 +1,89 @@
+package gowpd
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+const (
+	DEFAULT_SPOOL_MEMORY = 4 * 1024 * 1024
+)
+
+// WithSpool sets how data of unknown length is held before it is uploaded.
+// Up to maxMemory bytes are kept in memory, anything larger is written to a
+// temporary file in dir, or the default temporary directory if dir is empty.
+func WithSpool(maxMemory int64, dir string) CopyOption {
+	return func(o *copyOptions) {
+		o.spoolMemory = maxMemory
+		o.spoolDir = dir
+	}
+}
+
+// spool holds the whole content of a reader so its size is known.
+type spool struct {
+	data []byte
+	file *os.File
+	size int64
+}
+
+// newSpool reads src to the end, in memory if it fits in maxMemory bytes and
+// into a temporary file in dir otherwise.
+func newSpool(src io.Reader, maxMemory int64, dir string) (*spool, error) {
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, io.LimitReader(src, maxMemory+1))
+	if err != nil {
+		return nil, err
+	}
+	if n <= maxMemory {
+		return &spool{data: buf.Bytes(), size: n}, nil
+	}
+	f, err := ioutil.TempFile(dir, "gowpd-spool-")
+	if err != nil {
+		return nil, err
+	}
+	s := &spool{file: f}
+	if s.size, err = io.Copy(f, io.MultiReader(&buf, src)); err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reader returns a reader of the whole content, which can seek.
+func (s *spool) Reader() io.Reader {
+	if s.file != nil {
+		return io.NewSectionReader(s.file, 0, s.size)
+	}
+	return bytes.NewReader(s.data)
+}
+
+func (s *spool) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	s.file.Close()
+	err := os.Remove(s.file.Name())
+	s.file = nil
+	return err
+}
+
+// CopyStreamToDevice uploads src, whose length need not be known, as obj in
+// the folder parentId. obj.Size is ignored. src is read to the end before the
+// object is created, so it may be a stream of the same device.
+func (d *Device) CopyStreamToDevice(parentId string, src io.Reader, obj *Object, opts ...CopyOption) (int64, error) {
+	o := newCopyOptions(opts)
+	s, err := newSpool(src, o.spoolMemory, o.spoolDir)
+	if err != nil {
+		return 0, err
+	}
+	defer s.Close()
+	sized := *obj
+	sized.Size = s.size
+	_, n, err := d.upload(parentId, s.Reader(), &sized, o)
+	return n, err
+}
@@ -0,0 +1,120 @@
+package gowpd
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// readerFunc hides the type of a reader, like a pipe of unknown length.
+type readerFunc func([]byte) (int, error)
+
+func (f readerFunc) Read(buf []byte) (int, error) {
+	return f(buf)
+}
+
+func TestSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gowpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := testData(1000)
+	tests := []struct {
+		maxMemory int64
+		onDisk    bool
+	}{
+		{2000, false},
+		{1000, false},
+		{999, true},
+		{0, true},
+	}
+	for _, tt := range tests {
+		s, err := newSpool(strings.NewReader(data), tt.maxMemory, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files, _ := ioutil.ReadDir(dir)
+		if s.size != 1000 || (s.file != nil) != tt.onDisk || (len(files) == 1) != tt.onDisk {
+			t.Errorf("%v: size %v, files %v", tt.maxMemory, s.size, len(files))
+		}
+		got, _ := ioutil.ReadAll(s.Reader())
+		if string(got) != data {
+			t.Errorf("%v: content differs", tt.maxMemory)
+		}
+		s.Close()
+		if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+			t.Errorf("%v: temporary file left", tt.maxMemory)
+		}
+	}
+
+	errRead := errors.New("read failed")
+	sent := false
+	src := readerFunc(func(buf []byte) (int, error) {
+		if sent {
+			return 0, errRead
+		}
+		sent = true
+		return copy(buf, data), nil
+	})
+	if _, err := newSpool(src, 10, dir); err != errRead {
+		t.Errorf("err = %v", err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("temporary file left after error")
+	}
+}
+
+func TestCopyStreamToDevice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gowpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	b := NewMemoryBackend()
+	d := NewDevice(b)
+	root := putFolder(t, d, WPD_DEVICE_OBJECT_ID, "Storage")
+	data := testData(5000)
+
+	spooled := -1
+	b.Fault = func(op string, ids []string) error {
+		if op == "CreateObjectWithPropertiesAndData" {
+			files, _ := ioutil.ReadDir(dir)
+			spooled = len(files)
+		}
+		return nil
+	}
+	src := io.MultiReader(strings.NewReader(data[:3000]), strings.NewReader(data[3000:]))
+	n, err := d.CopyStreamToDevice(root, src, &Object{Name: "a.tar"}, WithSpool(1024, dir))
+	if err != nil || n != 5000 {
+		t.Fatalf("copy = %v %v", n, err)
+	}
+	if spooled != 1 {
+		t.Errorf("spooled to %v files", spooled)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("temporary file left")
+	}
+	o, _ := d.GetObject(childId(t, d, root, "a.tar"))
+	if o == nil || o.Size != 5000 {
+		t.Errorf("object = %+v", o)
+	}
+
+	// a stream of the same device
+	r, err := d.GetReader(o.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err = d.CopyStreamToDevice(root, r, &Object{Name: "b.tar"}, WithSpool(1024, dir))
+	r.Close()
+	if err != nil || n != 5000 {
+		t.Fatalf("copy = %v %v", n, err)
+	}
+	buf := make([]byte, 5000)
+	if _, err := d.ReadAt(childId(t, d, root, "b.tar"), buf, 0); err != nil || string(buf) != data {
+		t.Errorf("content differs: %v", err)
+	}
+}
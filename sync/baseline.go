@@ -0,0 +1,34 @@
+package sync
+
+import (
+	"github.com/tobwithu/gowpd"
+)
+
+// Baseline is the state of both trees of a two-way sync after the last
+// sync, by path. Changes are what differs from it.
+type Baseline struct {
+	A map[string]*gowpd.Object
+	B map[string]*gowpd.Object
+}
+
+func NewBaseline() *Baseline {
+	return &Baseline{make(map[string]*gowpd.Object), make(map[string]*gowpd.Object)}
+}
+
+// LoadBaseline reads the baseline from the state file path. A missing file
+// is an empty baseline, as before the first sync.
+func LoadBaseline(path string) (*Baseline, error) {
+	s, err := LoadState(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Baseline{s.Objects("A"), s.Objects("B")}, nil
+}
+
+// Save writes the baseline to the state file path, as sides "A" and "B".
+func (b *Baseline) Save(path string) error {
+	s := NewState()
+	s.SetObjects("A", b.A)
+	s.SetObjects("B", b.B)
+	return s.Save(path)
+}
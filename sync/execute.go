@@ -0,0 +1,316 @@
+package sync
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/tobwithu/gowpd"
+)
+
+// Execute carries out the actions of p. Destinations replaced by a folder or
+// file of the other type are deleted first, with the files below them.
+// Folders are made and files moved in order while the copies run on queue,
+// which may be nil, and the deletions follow once the copies are done. An
+// action replacing a destination which cannot be deleted fails with the
+// error of the deletion. Deletions with a NewPath move their file
+// there, and the quarantine of p is pruned then. Failed actions do not stop
+// the others; their Err is set. Actions of a loaded plan which failed with
+// ErrPlanChanged are left out. The steps are logged to the journal of p, if
+// it has one.
+func Execute(p *Plan, queue *gowpd.Queue) error {
+	return execute(queue, p)
+}
+
+// execute carries out the actions of plans phase by phase, so the copies of
+// all plans run on the queue together.
+func execute(queue *gowpd.Queue, plans ...*Plan) error {
+	if queue == nil {
+		queue = gowpd.NewQueue(nil)
+	}
+	// done holds the actions carried out or failed ahead of their phase
+	done := make(map[*Action]bool)
+	for _, p := range plans {
+		replaced := p.typeChanges()
+		if len(replaced) == 0 {
+			continue
+		}
+		for _, a := range p.Actions {
+			if a.Type == ACTION_DELETE && a.Src == nil && inside(replaced, a.Path) && a.Err != ErrPlanChanged {
+				done[a] = true
+				a.Err = p.delete(a)
+			}
+		}
+		for i, a := range p.Actions {
+			if a.Type == ACTION_DELETE && a.Src != nil && a.Err != ErrPlanChanged {
+				done[a] = true
+				a.Err = p.delete(a)
+				if a.Err != nil && i+1 < len(p.Actions) && p.Actions[i+1].Path == a.Path {
+					done[p.Actions[i+1]] = true
+					p.Actions[i+1].Err = a.Err
+				}
+			}
+		}
+	}
+	for _, p := range plans {
+		for _, a := range p.Actions {
+			if a.Type == ACTION_MKDIR && !done[a] && a.Err != ErrPlanChanged {
+				a.Err = p.run(a, func() error {
+					return p.Dst.Mkdir(a.Path)
+				})
+			}
+		}
+	}
+	for _, p := range plans {
+		for _, a := range p.Actions {
+			if a.Type == ACTION_MOVE && a.Err != ErrPlanChanged {
+				a.Err = p.run(a, func() error {
+					return p.Dst.Move(a.OldPath, a.Path, a.Dst)
+				})
+			}
+		}
+	}
+	jobs := make(map[*Action]*gowpd.Job)
+	for _, p := range plans {
+		for _, a := range p.Actions {
+			var j *gowpd.Job
+			var err error
+			if a.Err == ErrPlanChanged || done[a] {
+				continue
+			}
+			switch a.Type {
+			case ACTION_COPY, ACTION_OVERWRITE:
+				j, err = copyJob(p.Src, p.Dst, a)
+			case ACTION_KEEP_BOTH:
+				j = keepBothJob(p.Src, p.Dst, a)
+			default:
+				continue
+			}
+			if err != nil {
+				a.Err = err
+				continue
+			}
+			p.logJob(a, j)
+			jobs[a] = j
+			queue.Add(j)
+		}
+	}
+	queue.Wait()
+	for a, j := range jobs {
+		a.Err = j.Err
+	}
+	n, total := 0, 0
+	for _, p := range plans {
+		for _, a := range p.Actions {
+			if a.Type == ACTION_DELETE && !done[a] && a.Err != ErrPlanChanged {
+				a.Err = p.delete(a)
+			}
+			if a.Err != nil {
+				n++
+			}
+		}
+		total += len(p.Actions)
+	}
+	var err error
+	for _, p := range plans {
+		if p.Quarantine != nil {
+			if perr := p.Quarantine.Prune(p.Dst); perr != nil && err == nil {
+				err = perr
+			}
+		}
+	}
+	if n > 0 {
+		return fmt.Errorf("Failed %v of %v actions", n, total)
+	}
+	return err
+}
+
+// delete deletes the destination of the action a of p, or moves it to
+// a.NewPath.
+func (p *Plan) delete(a *Action) error {
+	return p.run(a, func() error {
+		if a.NewPath != "" {
+			return quarantineFile(p.Dst, a)
+		}
+		return p.Dst.Delete(a.Path, a.Dst)
+	})
+}
+
+// run carries out the action a of p by do and logs its steps to the journal
+// of p. An action whose start cannot be logged is not carried out.
+func (p *Plan) run(a *Action, do func() error) error {
+	j := p.journal
+	if j == nil {
+		return do()
+	}
+	if err := j.log(STEP_STARTED, p, a, nil); err != nil {
+		return err
+	}
+	err := do()
+	j.finish(p, a, err)
+	return err
+}
+
+// logJob makes the job of the action a of p log its steps to the journal of
+// p like run. The action is done once the last job of the chain is done, or
+// one of them fails.
+func (p *Plan) logJob(a *Action, job *gowpd.Job) {
+	j := p.journal
+	if j == nil {
+		return
+	}
+	for c := job; c != nil; c = c.Next() {
+		run, first, last := c.Run, c == job, c.Next() == nil
+		c.Run = func(opts ...gowpd.CopyOption) error {
+			if first {
+				if err := j.log(STEP_STARTED, p, a, nil); err != nil {
+					return err
+				}
+			}
+			err := run(opts...)
+			if err != nil || last {
+				j.finish(p, a, err)
+			}
+			return err
+		}
+	}
+}
+
+// SyncedList returns the source list of p once it is executed, with the
+// entries of old for the actions which failed, so the list of a sync only
+// changes for completed actions. old may be nil.
+func (p *Plan) SyncedList(old map[string]*gowpd.Object) map[string]*gowpd.Object {
+	list := make(map[string]*gowpd.Object, len(p.SrcList))
+	for k, o := range p.SrcList {
+		list[k] = o
+	}
+	for _, a := range p.Actions {
+		if a.Err == nil || a.Type == ACTION_DELETE {
+			continue
+		}
+		if o := old[a.Path]; o != nil {
+			list[a.Path] = o
+		} else {
+			delete(list, a.Path)
+		}
+	}
+	return list
+}
+
+// copyJob returns the job copying the file of a from src to dst. Transfers
+// of local folders and devices use the direct gowpd jobs, other trees are
+// copied through Open and Write.
+func copyJob(src, dst Tree, a *Action) (*gowpd.Job, error) {
+	obj := a.Src
+	switch d := dst.(type) {
+	case *DirTree:
+		filename := d.path(a.Path)
+		switch s := src.(type) {
+		case *DirTree:
+			return &gowpd.Job{Name: a.Path, Run: func(opts ...gowpd.CopyOption) error {
+				return copyFile(s.path(a.Path), filename)
+			}}, nil
+		case *DeviceTree:
+			job := gowpd.DownloadJob(s.Device, obj, tempPath(filename))
+			run := job.Run
+			job.Run = func(opts ...gowpd.CopyOption) error {
+				return writeFile(filename, func(tmp string) error {
+					return run(opts...)
+				})
+			}
+			return job, nil
+		}
+	case *DeviceTree:
+		parentId, err := d.folderId(filepath.Dir(a.Path))
+		if err != nil {
+			return nil, err
+		}
+		switch s := src.(type) {
+		case *DirTree:
+			return gowpd.UploadJob(d.Device, parentId, s.path(a.Path), gowpd.WithAtomic()), nil
+		case *DeviceTree:
+			if s.Device == d.Device && d.Device.CanCopy {
+				old := a.Dst
+				return &gowpd.Job{Name: a.Path, Devices: []*gowpd.Device{d.Device}, Run: func(opts ...gowpd.CopyOption) error {
+					err := d.Device.Copy(parentId, obj.Id)
+					if err == nil && old != nil {
+						err = d.Delete(a.Path, old)
+					}
+					return err
+				}}, nil
+			}
+			return gowpd.DeviceCopyJob(s.Device, obj, d.Device, parentId, gowpd.WithAtomic()), nil
+		}
+	}
+	return &gowpd.Job{Name: a.Path, Devices: treeDevices(src, dst), Run: func(opts ...gowpd.CopyOption) error {
+		return copyVia(src, obj, dst, a.Path)
+	}}, nil
+}
+
+// keepBothJob returns the job saving the file a.Dst of dst as a.NewPath on
+// both trees before replacing it with a.Src of src. The steps run in order
+// through Open and Write.
+func keepBothJob(src, dst Tree, a *Action) *gowpd.Job {
+	return &gowpd.Job{Name: a.Path, Devices: treeDevices(src, dst), Run: func(opts ...gowpd.CopyOption) error {
+		if err := copyVia(dst, a.Dst, dst, a.NewPath); err != nil {
+			return err
+		}
+		if err := copyVia(dst, a.Dst, src, a.NewPath); err != nil {
+			return err
+		}
+		return copyVia(src, a.Src, dst, a.Path)
+	}}
+}
+
+// copyVia copies the file obj of src to path of dst.
+func copyVia(src Tree, obj *gowpd.Object, dst Tree, path string) error {
+	r, err := src.Open(obj)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return dst.Write(path, obj, r)
+}
+
+// treeDevices returns the devices used by copying between src and dst.
+func treeDevices(trees ...Tree) []*gowpd.Device {
+	var ds []*gowpd.Device
+	for _, t := range trees {
+		if d, ok := t.(*DeviceTree); ok {
+			ds = append(ds, d.Device)
+		}
+	}
+	return ds
+}
+
+func copyFile(src, dst string) error {
+	return writeFile(dst, func(tmp string) error {
+		var err error
+		var srcfd *os.File
+		var dstfd *os.File
+		var srcinfo os.FileInfo
+
+		if srcfd, err = os.Open(src); err != nil {
+			return err
+		}
+		defer srcfd.Close()
+
+		if dstfd, err = os.Create(tmp); err != nil {
+			return err
+		}
+		_, err = io.Copy(dstfd, srcfd)
+		if cerr := dstfd.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		if srcinfo, err = os.Stat(src); err != nil {
+			return err
+		}
+		os.Chmod(tmp, srcinfo.Mode())
+		tm := srcinfo.ModTime()
+		return os.Chtimes(tmp, tm, tm)
+	})
+}
@@ -0,0 +1,187 @@
+package sync
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tobwithu/gowpd"
+)
+
+func TestExecute(t *testing.T) {
+	dirSrc, dirDst := tempTree(t), tempTree(t)
+	defer os.RemoveAll(dirSrc.Root)
+	defer os.RemoveAll(dirDst.Root)
+
+	// two folders of one device
+	d := gowpd.NewMemoryDevice()
+	root, _ := d.CreateFolder(gowpd.WPD_DEVICE_OBJECT_ID, "Storage")
+	d.CreateFolder(root, "src")
+	d.CreateFolder(root, "dst")
+	devSrc, _ := NewDeviceTree(d, filepath.Join("Storage", "src"))
+	devDst, _ := NewDeviceTree(d, filepath.Join("Storage", "dst"))
+
+	tests := []struct {
+		name     string
+		src, dst Tree
+		canCopy  bool
+	}{
+		{"dir to dir", dirSrc, dirDst, false},
+		{"dir to device", dirSrc, NewMemoryTree(), false},
+		{"device to dir", NewMemoryTree(), tempTree(t), false},
+		{"device to device", NewMemoryTree(), NewMemoryTree(), false},
+		{"same device", devSrc, devDst, false},
+		{"same device copy", devSrc, devDst, true},
+	}
+	for _, tt := range tests {
+		if dt, ok := tt.dst.(*DirTree); ok && dt != dirDst {
+			defer os.RemoveAll(dt.Root)
+		}
+		d.CanCopy = tt.canCopy
+		put(t, tt.src, "a.txt", "a", 100)
+		put(t, tt.src, "b.txt", "b2", 200)
+		put(t, tt.src, filepath.Join("dir", "sub", "c.txt"), "c", 100)
+		put(t, tt.dst, "b.txt", "b", 100)
+		put(t, tt.dst, filepath.Join("old", "x.txt"), "x", 100)
+
+		p, err := NewPlan(tt.src, tt.dst, &Options{Mode: MODE_MIRROR})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = Execute(p, nil); err != nil {
+			t.Errorf("%v: %v", tt.name, err)
+		}
+		want := contents(t, tt.src)
+		if got := contents(t, tt.dst); !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: %v, want %v", tt.name, got, want)
+		}
+		p, _ = NewPlan(tt.src, tt.dst, &Options{Mode: MODE_MIRROR})
+		if len(p.Actions) != 0 {
+			t.Errorf("%v: left %q", tt.name, actions(p))
+		}
+	}
+}
+
+func TestExecuteErrors(t *testing.T) {
+	errFull := errors.New("device full")
+	b := gowpd.NewMemoryBackend()
+	d := gowpd.NewDevice(b)
+	d.CreateFolder(gowpd.WPD_DEVICE_OBJECT_ID, "Storage")
+	dst, _ := NewDeviceTree(d, "Storage")
+	src := NewMemoryTree()
+	put(t, src, "a.txt", "a", 100)
+	put(t, src, "b.txt", "b", 100)
+	put(t, src, filepath.Join("dir", "c.txt"), "c", 100)
+	put(t, dst, "x.txt", "x", 100)
+
+	b.Fault = func(op string, ids []string) error {
+		if op == "CreateObjectWithPropertiesOnly" {
+			return errFull
+		}
+		return nil
+	}
+	p, err := NewPlan(src, dst, &Options{Mode: MODE_MIRROR})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = Execute(p, nil); err == nil {
+		t.Errorf("expected error")
+	}
+	failed := make(map[string]error)
+	for _, a := range p.Actions {
+		if a.Err != nil {
+			failed[filepath.ToSlash(a.Path)] = a.Err
+		}
+	}
+	// the folder is not made, so its file cannot be copied
+	if len(failed) != 2 || failed["dir"] != errFull || failed["dir/c.txt"] == nil {
+		t.Errorf("%v", failed)
+	}
+	got := contents(t, dst)
+	if !reflect.DeepEqual(got, map[string]string{"a.txt": "a", "b.txt": "b"}) {
+		t.Errorf("%v", got)
+	}
+}
+
+func TestExecuteTypeChange(t *testing.T) {
+	dirDst := tempTree(t)
+	defer os.RemoveAll(dirDst.Root)
+	for _, dst := range []Tree{dirDst, NewMemoryTree()} {
+		src := NewMemoryTree()
+		put(t, src, filepath.Join("d", "x.txt"), "x", 100)
+		put(t, src, "f", "f", 100)
+		put(t, dst, "d", "d", 100)
+		put(t, dst, filepath.Join("f", "sub", "y.txt"), "y", 100)
+
+		p, err := NewPlan(src, dst, &Options{Mode: MODE_COPY})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{"delete d", "mkdir d", "copy d/x.txt", "delete f", "copy f", "delete f/sub/y.txt", "delete f/sub"}
+		if got := actions(p); !reflect.DeepEqual(got, want) {
+			t.Errorf("%T: %q", dst, got)
+		}
+		if err = Execute(p, nil); err != nil {
+			t.Errorf("%T: %v", dst, err)
+		}
+		if got := contents(t, dst); !reflect.DeepEqual(got, contents(t, src)) {
+			t.Errorf("%T: %v", dst, got)
+		}
+	}
+}
+
+func TestExecuteLocalAtomic(t *testing.T) {
+	dst := tempTree(t)
+	defer os.RemoveAll(dst.Root)
+	put(t, dst, "a.txt", "old", 100)
+	put(t, dst, "b.txt", "old", 100)
+
+	// a write cut short keeps the old file
+	obj := &gowpd.Object{Name: "a.txt", ObjectInfo: gowpd.ObjectInfo{Size: 10, ModTime: 200}}
+	r := io.MultiReader(strings.NewReader("new"), &failReader{errUnplugged})
+	if err := dst.Write("a.txt", obj, r); err != errUnplugged {
+		t.Errorf("err = %v", err)
+	}
+	// so does a download cut short
+	src, b := deviceTree(t)
+	put(t, src, "b.txt", "new", 200)
+	p, err := NewPlan(src, dst, &Options{Mode: MODE_COPY})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Fault = func(op string, ids []string) error {
+		if op == "GetStream" {
+			return errUnplugged
+		}
+		return nil
+	}
+	if err = Execute(p, nil); err == nil {
+		t.Errorf("expected error")
+	}
+	b.Fault = nil
+	if got := contents(t, dst); !reflect.DeepEqual(got, map[string]string{"a.txt": "old", "b.txt": "old"}) {
+		t.Errorf("%v", got)
+	}
+
+	if err = Execute(p, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := contents(t, dst); !reflect.DeepEqual(got, map[string]string{"a.txt": "old", "b.txt": "new"}) {
+		t.Errorf("%v", got)
+	}
+	if o, _ := os.Stat(filepath.Join(dst.Root, "b.txt")); o == nil || o.ModTime().Unix() != 200 {
+		t.Errorf("b.txt = %v", o)
+	}
+}
+
+type failReader struct {
+	err error
+}
+
+func (r *failReader) Read(buf []byte) (int, error) {
+	return 0, r.err
+}
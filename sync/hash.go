@@ -0,0 +1,79 @@
+package sync
+
+import (
+	"encoding/hex"
+	"io"
+
+	"github.com/tobwithu/gowpd"
+)
+
+// Sides of Options.HashCache for the trees of a one-way plan.
+const (
+	HASH_SIDE_SRC = "src"
+	HASH_SIDE_DST = "dst"
+)
+
+// hasher computes the digests of the files of a tree. Digests are cached by
+// path while the size and modification time of the file are unchanged.
+type hasher struct {
+	tree  Tree
+	cache map[string]*Entry
+}
+
+// newHasher returns the hasher of tree caching in the side of opts.HashCache,
+// or nil if opts.Hash is not set.
+func newHasher(tree Tree, opts *Options, side string) *hasher {
+	if !opts.Hash {
+		return nil
+	}
+	h := &hasher{tree: tree}
+	if s := opts.HashCache; s != nil {
+		h.cache = s.Sides[side]
+		if h.cache == nil {
+			h.cache = make(map[string]*Entry)
+			s.Sides[side] = h.cache
+		}
+	} else {
+		h.cache = make(map[string]*Entry)
+	}
+	return h
+}
+
+// cached returns the digest of path cached for the size and modification
+// time of obj, or "".
+func (h *hasher) cached(path string, obj *gowpd.Object) string {
+	if e := h.cache[path]; e != nil && e.Size == obj.Size && e.ModTime == obj.ModTime {
+		return e.Hash
+	}
+	return ""
+}
+
+// hash returns the digest of the file obj at path, or "" if it cannot be
+// read.
+func (h *hasher) hash(path string, obj *gowpd.Object) string {
+	if s := h.cached(path, obj); s != "" {
+		return s
+	}
+	r, err := h.tree.Open(obj)
+	if err != nil {
+		return ""
+	}
+	defer r.Close()
+	d := gowpd.HASH_SHA256.New()
+	if _, err = io.Copy(d, r); err != nil {
+		return ""
+	}
+	s := gowpd.HASH_SHA256.String() + ":" + hex.EncodeToString(d.Sum(nil))
+	h.cache[path] = &Entry{Path: path, ModTime: obj.ModTime, Size: obj.Size, ChildCount: -1, Hash: s}
+	return s
+}
+
+// sameData reports whether the files a of ha and b of hb have the same
+// size and digest. Hashers are nil without Options.Hash.
+func sameData(ha *hasher, pa string, a *gowpd.Object, hb *hasher, pb string, b *gowpd.Object) bool {
+	if ha == nil || hb == nil || a.IsDir || b.IsDir || a.Size != b.Size {
+		return false
+	}
+	s := ha.hash(pa, a)
+	return s != "" && s == hb.hash(pb, b)
+}
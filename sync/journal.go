@@ -0,0 +1,390 @@
+package sync
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	gosync "sync"
+	"time"
+
+	"github.com/tobwithu/gowpd"
+)
+
+const (
+	JOURNAL_FORMAT  = "gowpd-sync-journal"
+	JOURNAL_VERSION = 1
+)
+
+// Steps of an action in a journal.
+const (
+	STEP_PLANNED = "planned"
+	STEP_STARTED = "started"
+	STEP_DONE    = "done"
+	STEP_FAILED  = "failed"
+)
+
+// journalHeader is the first line of a journal.
+type journalHeader struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+	// Created is when the run started, in Unix time.
+	Created int64 `json:"created"`
+	Plans   int   `json:"plans"`
+}
+
+// journalRecord is a step of the action Index of the plan Plan. Planned
+// steps hold the action.
+type journalRecord struct {
+	Step   string      `json:"step"`
+	Plan   int         `json:"plan"`
+	Index  int         `json:"index"`
+	Action *planAction `json:"action,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// Journal is a write-ahead log of the execution of plans. The actions are
+// written when it is created, and each one is logged when it starts and when
+// it is done. Every line is synced to the file before the step goes on, so
+// a run cut short, like by unplugging a device, is recovered from with
+// LoadJournal.
+type Journal struct {
+	path    string
+	mu      gosync.Mutex
+	f       *os.File
+	plans   map[*Plan]int
+	actions map[*Action]int
+}
+
+// CreateJournal writes the actions of plans to the journal file path and
+// attaches it to the plans, so Execute and ExecuteTwoWay log their steps.
+// The plans of a TwoWayPlan are AtoB and BtoA.
+func CreateJournal(path string, plans ...*Plan) (*Journal, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	j := &Journal{path: path, f: f, plans: make(map[*Plan]int), actions: make(map[*Action]int)}
+	bw := bufio.NewWriter(f)
+	enc := json.NewEncoder(bw)
+	err = enc.Encode(&journalHeader{JOURNAL_FORMAT, JOURNAL_VERSION, time.Now().Unix(), len(plans)})
+	for i, p := range plans {
+		j.plans[p] = i
+		for k, a := range p.Actions {
+			j.actions[a] = k
+			if err == nil && a.Type != ACTION_SKIP && a.Err != ErrPlanChanged {
+				err = enc.Encode(&journalRecord{Step: STEP_PLANNED, Plan: i, Index: k, Action: toPlanAction(a)})
+			}
+		}
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	for _, p := range plans {
+		p.journal = j
+	}
+	return j, nil
+}
+
+// log writes the step of the action a of p and syncs it.
+func (j *Journal) log(step string, p *Plan, a *Action, err error) error {
+	r := &journalRecord{Step: step, Plan: j.plans[p], Index: j.actions[a]}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.f == nil {
+		return fmt.Errorf("Journal closed : %v", j.path)
+	}
+	if _, err = j.f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return j.f.Sync()
+}
+
+// finish logs the action a of p as done, or failed with err.
+func (j *Journal) finish(p *Plan, a *Action, err error) {
+	if err != nil {
+		j.log(STEP_FAILED, p, a, err)
+	} else {
+		j.log(STEP_DONE, p, a, nil)
+	}
+}
+
+// Close detaches the journal from its plans and removes it. It is closed
+// once the result of the run is saved, like the list or the baseline of the
+// sync; a journal which is left is recovered from by the next run.
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for p := range j.plans {
+		if p.journal == j {
+			p.journal = nil
+		}
+	}
+	if j.f == nil {
+		return nil
+	}
+	err := j.f.Close()
+	j.f = nil
+	if rerr := os.Remove(j.path); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// Recovery is what the journal of a run which was cut short tells.
+type Recovery struct {
+	// Done and Unfinished hold the actions of each plan of the run, in the
+	// order of the journal, which completed, and which started but did not
+	// complete. Err of the failed ones is set.
+	Done       [][]*Action
+	Unfinished [][]*Action
+}
+
+// LoadJournal reads the journal file path, which a run cut short did not
+// close. It returns nil if there is none. A last line which was cut short
+// is left out.
+func LoadJournal(path string) (*Recovery, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := readJournal(bufio.NewReader(f))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid journal : %v (%v)", path, err)
+	}
+	return r, nil
+}
+
+func readJournal(r *bufio.Reader) (*Recovery, error) {
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("no header")
+	}
+	var h journalHeader
+	if err = json.Unmarshal(line, &h); err != nil {
+		return nil, err
+	}
+	if h.Format != JOURNAL_FORMAT {
+		return nil, fmt.Errorf("format %q", h.Format)
+	}
+	if h.Version > JOURNAL_VERSION {
+		return nil, fmt.Errorf("unsupported version %v", h.Version)
+	}
+	planned := make([][]*Action, h.Plans)
+	byIndex := make([]map[int]*Action, h.Plans)
+	for i := range byIndex {
+		byIndex[i] = make(map[int]*Action)
+	}
+	steps := make(map[*Action]string)
+	for n := 2; ; n++ {
+		line, err = r.ReadBytes('\n')
+		if err != nil {
+			// the run stopped while writing the last line
+			break
+		}
+		var rec journalRecord
+		if err = json.Unmarshal(line, &rec); err != nil {
+			return nil, fmt.Errorf("line %v: %v", n, err)
+		}
+		if rec.Plan < 0 || rec.Plan >= h.Plans {
+			return nil, fmt.Errorf("line %v: plan %v", n, rec.Plan)
+		}
+		if rec.Step == STEP_PLANNED {
+			if rec.Action == nil {
+				return nil, fmt.Errorf("line %v: no action", n)
+			}
+			a, err := rec.Action.action()
+			if err != nil {
+				return nil, fmt.Errorf("line %v: %v", n, err)
+			}
+			planned[rec.Plan] = append(planned[rec.Plan], a)
+			byIndex[rec.Plan][rec.Index] = a
+			continue
+		}
+		a := byIndex[rec.Plan][rec.Index]
+		if a == nil {
+			return nil, fmt.Errorf("line %v: action %v not planned", n, rec.Index)
+		}
+		steps[a] = rec.Step
+		if rec.Step == STEP_FAILED {
+			a.Err = errors.New(rec.Error)
+		}
+	}
+	rc := &Recovery{Done: make([][]*Action, h.Plans), Unfinished: make([][]*Action, h.Plans)}
+	for i, actions := range planned {
+		for _, a := range actions {
+			switch steps[a] {
+			case STEP_DONE:
+				rc.Done[i] = append(rc.Done[i], a)
+			case STEP_STARTED, STEP_FAILED:
+				rc.Unfinished[i] = append(rc.Unfinished[i], a)
+			}
+		}
+	}
+	return rc, nil
+}
+
+// partialWrite is a file an action writes, which is complete if it is one
+// of objs.
+type partialWrite struct {
+	path string
+	objs []*gowpd.Object
+}
+
+// isFile reports whether o is the file c by size and modification time.
+func isFile(o, c *gowpd.Object) bool {
+	return o != nil && c != nil && !o.IsDir && !c.IsDir && o.ModTime == c.ModTime && o.Size == c.Size
+}
+
+// writes returns the files the action a writes on its destination, listed
+// as dstList, and on its source.
+func (a *Action) writes(dstList map[string]*gowpd.Object) (dst, src []partialWrite) {
+	switch a.Type {
+	case ACTION_COPY, ACTION_OVERWRITE:
+		dst = append(dst, partialWrite{a.Path, []*gowpd.Object{a.Src, a.Dst}})
+	case ACTION_KEEP_BOTH:
+		// the copies are removed while the file they keep is in place, as
+		// the rerun keeps it again
+		var kept []*gowpd.Object
+		if !isFile(dstList[a.Path], a.Dst) {
+			kept = append(kept, a.Dst)
+		}
+		dst = append(dst, partialWrite{a.NewPath, kept}, partialWrite{a.Path, []*gowpd.Object{a.Src, a.Dst}})
+		src = append(src, partialWrite{a.NewPath, kept})
+	case ACTION_DELETE:
+		if a.NewPath != "" {
+			dst = append(dst, partialWrite{a.NewPath, []*gowpd.Object{a.Dst}})
+		}
+	}
+	return
+}
+
+// Clean removes what the unfinished actions left behind: the temporary
+// objects of uploads and files written in part, which are neither the file
+// copied nor the file it replaces. src and dst are the trees of the first
+// plan; the second plan of a two-way run goes the other way.
+func (r *Recovery) Clean(src, dst Tree) error {
+	n := 0
+	for _, actions := range r.Unfinished {
+		n += len(actions)
+	}
+	if n == 0 {
+		return nil
+	}
+	trees := []Tree{src, dst}
+	lists := make([]map[string]*gowpd.Object, len(trees))
+	for i, tree := range trees {
+		list, err := tree.ListFiles(false)
+		if err != nil {
+			return err
+		}
+		lists[i] = list
+	}
+	writes := make([][]partialWrite, len(trees))
+	for i, actions := range r.Unfinished {
+		s, d := i%2, 1-i%2
+		for _, a := range actions {
+			dw, sw := a.writes(lists[d])
+			writes[d] = append(writes[d], dw...)
+			writes[s] = append(writes[s], sw...)
+		}
+	}
+	n, total := 0, 0
+	for i, tree := range trees {
+		for _, w := range writes[i] {
+			for _, k := range w.leftovers(lists[i]) {
+				total++
+				if err := tree.Delete(k, lists[i][k]); err != nil {
+					n++
+				}
+				delete(lists[i], k)
+			}
+		}
+	}
+	if n > 0 {
+		return fmt.Errorf("Failed to clean %v of %v objects", n, total)
+	}
+	return nil
+}
+
+// leftovers returns the paths of list which w left unfinished.
+func (w partialWrite) leftovers(list map[string]*gowpd.Object) []string {
+	var paths []string
+	tmp := tempPath(w.path)
+	if o := list[tmp]; o != nil && !o.IsDir {
+		paths = append(paths, tmp)
+	}
+	o := list[w.path]
+	if o == nil || o.IsDir {
+		return paths
+	}
+	for _, c := range w.objs {
+		if isFile(o, c) {
+			return paths
+		}
+	}
+	return append(paths, w.path)
+}
+
+// ApplyList sets the source files of the completed actions of the first
+// plan in list, the source list of the last one-way sync like
+// Options.Exclude.
+func (r *Recovery) ApplyList(list map[string]*gowpd.Object) {
+	if len(r.Done) == 0 {
+		return
+	}
+	for _, a := range r.Done[0] {
+		switch a.Type {
+		case ACTION_COPY, ACTION_OVERWRITE, ACTION_MKDIR, ACTION_MOVE:
+			list[a.Path] = a.Src
+		}
+	}
+}
+
+// ApplyBaseline sets the entries of base for the completed actions of a
+// two-way run, whose plans are AtoB and BtoA, so the next plan does not take
+// them for changes. Other entries are left alone.
+func (r *Recovery) ApplyBaseline(base *Baseline) {
+	for i, actions := range r.Done {
+		src, dst := base.A, base.B
+		if i%2 == 1 {
+			src, dst = dst, src
+		}
+		for _, a := range actions {
+			switch a.Type {
+			case ACTION_DELETE:
+				delete(src, a.Path)
+				delete(dst, a.Path)
+			case ACTION_MOVE:
+				delete(src, a.OldPath)
+				delete(dst, a.OldPath)
+				src[a.Path], dst[a.Path] = a.Src, a.Src
+			case ACTION_COPY, ACTION_OVERWRITE, ACTION_MKDIR:
+				src[a.Path], dst[a.Path] = a.Src, a.Src
+			case ACTION_KEEP_BOTH:
+				src[a.Path], dst[a.Path] = a.Src, a.Src
+				src[a.NewPath], dst[a.NewPath] = a.Dst, a.Dst
+			}
+		}
+	}
+}
@@ -0,0 +1,411 @@
+package sync
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	gosync "sync"
+	"testing"
+
+	"github.com/tobwithu/gowpd"
+)
+
+var errUnplugged = errors.New("unplugged")
+
+// deviceTree returns the tree of an empty folder of a memory device and its
+// backend.
+func deviceTree(t *testing.T) (*DeviceTree, *gowpd.MemoryBackend) {
+	t.Helper()
+	b := gowpd.NewMemoryBackend()
+	d := gowpd.NewDevice(b)
+	if _, err := d.CreateFolder(gowpd.WPD_DEVICE_OBJECT_ID, "Storage"); err != nil {
+		t.Fatal(err)
+	}
+	tree, err := NewDeviceTree(d, "Storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree, b
+}
+
+// unplugAfter makes every call of b after the first n fail, like a device
+// unplugged during a sync.
+func unplugAfter(b *gowpd.MemoryBackend, n int) {
+	var mu gosync.Mutex
+	calls := 0
+	b.Fault = func(op string, ids []string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		if calls > n {
+			return errUnplugged
+		}
+		return nil
+	}
+}
+
+// hasTemp reports whether m has a temporary object of an upload.
+func hasTemp(m map[string]string) bool {
+	for k := range m {
+		if strings.HasSuffix(k, gowpd.ATOMIC_TEMP_SUFFIX) {
+			return true
+		}
+	}
+	return false
+}
+
+// crash closes the journal file of j without removing it, as a run which
+// is cut short leaves it.
+func crash(t *testing.T, j *Journal) {
+	t.Helper()
+	if err := j.f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	j.f = nil
+}
+
+func TestJournalRecovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gowpd-sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "journal")
+	opts := &Options{Mode: MODE_MIRROR, DetectMoves: true}
+	temps := false
+	for n := 0; ; n++ {
+		if n > 1000 {
+			t.Fatal("sync never completes")
+		}
+		src := NewMemoryTree()
+		put(t, src, "a.txt", "a", 100)
+		put(t, src, "b.txt", "b2", 200)
+		put(t, src, filepath.Join("d", "e.txt"), "e", 100)
+		put(t, src, "m2.txt", "m", 100)
+		dst, b := deviceTree(t)
+		put(t, dst, "b.txt", "b", 100)
+		put(t, dst, "m1.txt", "m", 100)
+		put(t, dst, "x.txt", "x", 100)
+		put(t, dst, filepath.Join("y", "z.txt"), "z", 100)
+		want := contents(t, src)
+
+		p, err := NewPlan(src, dst, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		j, err := CreateJournal(path, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		unplugAfter(b, n)
+		err = Execute(p, nil)
+		b.Fault = nil
+		if err == nil {
+			if err = j.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err = os.Stat(path); !os.IsNotExist(err) {
+				t.Errorf("journal kept")
+			}
+			if got := contents(t, dst); !reflect.DeepEqual(got, want) {
+				t.Errorf("step %v: %v", n, got)
+			}
+			break
+		}
+
+		// the list of an interrupted sync only has the completed files
+		got := contents(t, dst)
+		for k, o := range p.SyncedList(nil) {
+			if !o.IsDir && got[k] != want[k] {
+				t.Errorf("step %v: %v listed as synced", n, k)
+			}
+		}
+		temps = temps || hasTemp(got)
+
+		crash(t, j)
+		r, err := LoadJournal(path)
+		if err != nil || r == nil {
+			t.Fatalf("step %v: %v", n, err)
+		}
+		if err = r.Clean(src, dst); err != nil {
+			t.Errorf("step %v: %v", n, err)
+		}
+		got = contents(t, dst)
+		if hasTemp(got) {
+			t.Errorf("step %v: temporary objects left %v", n, got)
+		}
+		list := make(map[string]*gowpd.Object)
+		r.ApplyList(list)
+		for k, o := range list {
+			if !o.IsDir && got[k] != want[k] {
+				t.Errorf("step %v: %v recovered as synced", n, k)
+			}
+		}
+
+		// the rerun takes up the actions which did not complete
+		p, err = NewPlan(src, dst, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, a := range p.Actions {
+			for _, d := range r.Done[0] {
+				if a.Path == d.Path {
+					t.Errorf("step %v: %v %v again", n, a.Type, a.Path)
+				}
+			}
+		}
+		if err = Execute(p, nil); err != nil {
+			t.Fatalf("step %v: %v", n, err)
+		}
+		if got := contents(t, dst); !reflect.DeepEqual(got, want) {
+			t.Errorf("step %v: %v", n, got)
+		}
+	}
+	if !temps {
+		t.Errorf("no upload was cut short")
+	}
+}
+
+func TestJournalTwoWay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gowpd-sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "journal")
+	opts := &Options{Conflict: CONFLICT_KEEP_BOTH, DetectMoves: true}
+	setup := func() (Tree, Tree, *gowpd.MemoryBackend, *Baseline) {
+		a := NewMemoryTree()
+		b, mb := deviceTree(t)
+		for _, tree := range []Tree{a, b} {
+			put(t, tree, "c.txt", "c", 100)
+			put(t, tree, "f.txt", "f", 101)
+			put(t, tree, "g.txt", "g", 102)
+			put(t, tree, "h.txt", "h", 103)
+			put(t, tree, "m1.txt", "moved", 100)
+		}
+		p, err := NewTwoWayPlan(a, b, nil, opts)
+		if err == nil {
+			err = ExecuteTwoWay(p, nil)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		put(t, a, "a.txt", "a", 100)
+		put(t, a, "c.txt", "ca", 200)
+		put(t, a, "f.txt", "f2", 200)
+		del(t, a, "g.txt")
+		put(t, a, "m2.txt", "moved", 100)
+		del(t, a, "m1.txt")
+		put(t, b, filepath.Join("d", "b.txt"), "bb", 104)
+		put(t, b, "c.txt", "cb", 300)
+		del(t, b, "h.txt")
+		return a, b, mb, p.Base
+	}
+
+	a, b, _, base := setup()
+	p, err := NewTwoWayPlan(a, b, base, opts)
+	if err == nil {
+		err = ExecuteTwoWay(p, nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := contents(t, a)
+
+	for n := 0; ; n++ {
+		if n > 1000 {
+			t.Fatal("sync never completes")
+		}
+		a, b, mb, base := setup()
+		p, err := NewTwoWayPlan(a, b, base, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		j, err := CreateJournal(path, p.AtoB, p.BtoA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		unplugAfter(mb, n)
+		err = ExecuteTwoWay(p, nil)
+		mb.Fault = nil
+		if err == nil {
+			j.Close()
+			break
+		}
+
+		// the baseline of the interrupted sync is not saved
+		crash(t, j)
+		r, err := LoadJournal(path)
+		if err != nil || r == nil {
+			t.Fatalf("step %v: %v", n, err)
+		}
+		if err = r.Clean(a, b); err != nil {
+			t.Errorf("step %v: %v", n, err)
+		}
+		r.ApplyBaseline(base)
+		if p, err = NewTwoWayPlan(a, b, base, opts); err == nil {
+			err = ExecuteTwoWay(p, nil)
+		}
+		if err != nil {
+			t.Fatalf("step %v: %v", n, err)
+		}
+		for _, tree := range []Tree{a, b} {
+			if got := contents(t, tree); !reflect.DeepEqual(got, want) {
+				t.Errorf("step %v: %T %v", n, tree, got)
+			}
+		}
+		p, err = NewTwoWayPlan(a, b, p.Base, opts)
+		if err != nil || len(p.AtoB.Actions)+len(p.BtoA.Actions) > 0 || len(p.Conflicts) > 0 {
+			t.Errorf("step %v: not in sync %q %q %v", n, actions(p.AtoB), actions(p.BtoA), err)
+		}
+	}
+}
+
+func TestJournalClean(t *testing.T) {
+	src, dst := NewMemoryTree(), tempTree(t)
+	defer os.RemoveAll(dst.Root)
+	path := filepath.Join(dst.Root, "journal")
+	put(t, src, "a.txt", "a", 100)
+	put(t, src, "b.txt", "b2", 200)
+	put(t, src, "c.txt", "c2", 200)
+	put(t, src, "d.txt", "d2", 200)
+	put(t, dst, "b.txt", "b", 100)
+	put(t, dst, "c.txt", "c", 100)
+	put(t, dst, "d.txt", "d", 100)
+	p, _ := NewPlan(src, dst, &Options{Ignore: func(path string, obj *gowpd.Object) bool {
+		return path == "journal"
+	}})
+	j, err := CreateJournal(path, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range p.Actions {
+		if a.Path != "d.txt" {
+			j.log(STEP_STARTED, p, a, nil)
+		}
+	}
+	crash(t, j)
+	// a.txt is written in part and c.txt completely, the upload of b.txt is
+	// cut short and d.txt is not started
+	put(t, dst, "a.txt", "", 300)
+	put(t, dst, gowpd.ATOMIC_TEMP_PREFIX+"b.txt"+gowpd.ATOMIC_TEMP_SUFFIX, "b", 300)
+	put(t, dst, "c.txt", "c2", 200)
+	put(t, dst, "d.txt", "", 300)
+
+	r, err := LoadJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Unfinished[0]) != 3 || len(r.Done[0]) != 0 {
+		t.Errorf("unfinished %v done %v", len(r.Unfinished[0]), len(r.Done[0]))
+	}
+	if err = r.Clean(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	got := contents(t, dst)
+	delete(got, "journal")
+	if want := map[string]string{"b.txt": "b", "c.txt": "c2", "d.txt": ""}; !reflect.DeepEqual(got, want) {
+		t.Errorf("%v", got)
+	}
+}
+
+func TestJournalDeviceCopy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gowpd-sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "journal")
+	for _, fail := range []bool{false, true} {
+		src, _ := deviceTree(t)
+		dst, b := deviceTree(t)
+		put(t, src, "a.txt", "a", 100)
+		p, err := NewPlan(src, dst, &Options{Mode: MODE_MIRROR})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the upload is chained to the read of the source
+		job, _ := copyJob(src, dst, p.Actions[0])
+		if job.Next() == nil {
+			t.Fatalf("job not chained")
+		}
+		j, err := CreateJournal(path, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fail {
+			b.Fault = func(op string, ids []string) error {
+				if op == "Commit" {
+					return errUnplugged
+				}
+				return nil
+			}
+		}
+		if err = Execute(p, nil); (err != nil) != fail {
+			t.Errorf("fail %v: %v", fail, err)
+		}
+		crash(t, j)
+		r, err := LoadJournal(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		done, unfinished := 1, 0
+		if fail {
+			done, unfinished = 0, 1
+		}
+		if len(r.Done[0]) != done || len(r.Unfinished[0]) != unfinished {
+			t.Errorf("fail %v: done %v unfinished %v", fail, r.Done[0], r.Unfinished[0])
+		}
+	}
+}
+
+func TestLoadJournal(t *testing.T) {
+	src, dst := testTrees(t)
+	p, _ := NewPlan(src, dst, &Options{Mode: MODE_MIRROR})
+	dir, err := ioutil.TempDir("", "gowpd-sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "journal")
+	if r, err := LoadJournal(path); r != nil || err != nil {
+		t.Errorf("missing journal : %v %v", r, err)
+	}
+
+	j, err := CreateJournal(path, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range p.Actions[:2] {
+		j.log(STEP_STARTED, p, a, nil)
+	}
+	j.log(STEP_DONE, p, p.Actions[0], nil)
+	j.log(STEP_FAILED, p, p.Actions[1], errUnplugged)
+	crash(t, j)
+	// the run stopped while writing a line
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString(`{"step":"done","plan":0,"ind`)
+	f.Close()
+	r, err := LoadJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Done[0]) != 1 || r.Done[0][0].Path != p.Actions[0].Path {
+		t.Errorf("done %v", r.Done[0])
+	}
+	if len(r.Unfinished[0]) != 1 || r.Unfinished[0][0].Err == nil || r.Unfinished[0][0].Err.Error() != errUnplugged.Error() {
+		t.Errorf("unfinished %v", r.Unfinished[0])
+	}
+
+	for _, data := range []string{"", "{}\n", `{"format":"gowpd-sync-journal","version":2}` + "\n",
+		`{"format":"gowpd-sync-journal","version":1,"plans":1}` + "\n" + `{"step":"done","plan":0,"index":0}` + "\n"} {
+		ioutil.WriteFile(path, []byte(data), 0644)
+		if _, err := LoadJournal(path); err == nil {
+			t.Errorf("%q accepted", data)
+		}
+	}
+}
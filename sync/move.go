@@ -0,0 +1,64 @@
+package sync
+
+import (
+	"path/filepath"
+
+	"github.com/tobwithu/gowpd"
+)
+
+// detectMoves turns the copies of p into moves of destination files which
+// p deletes and which have the same data. Without hashers a file matches by
+// size and modification time if no other file of p has them.
+func detectMoves(p *Plan, hs, hd *hasher) {
+	type info = gowpd.ObjectInfo
+	copies := make(map[info]int)
+	deletes := make(map[int64][]*Action)
+	n := make(map[info]int)
+	for _, a := range p.Actions {
+		switch {
+		case a.Type == ACTION_COPY && !a.Src.IsDir:
+			copies[a.Src.ObjectInfo]++
+		case a.Type == ACTION_DELETE && a.Src == nil && !a.Dst.IsDir:
+			deletes[a.Dst.Size] = append(deletes[a.Dst.Size], a)
+			n[a.Dst.ObjectInfo]++
+		}
+	}
+	moved := make(map[*Action]bool)
+	for _, a := range p.Actions {
+		if a.Type != ACTION_COPY || a.Src.IsDir {
+			continue
+		}
+		for _, del := range deletes[a.Src.Size] {
+			if moved[del] || !canMove(p.Dst, del.Path, a.Path) {
+				continue
+			}
+			if hs != nil {
+				if !sameData(hs, a.Path, a.Src, hd, del.Path, del.Dst) {
+					continue
+				}
+			} else if del.Dst.ObjectInfo != a.Src.ObjectInfo || copies[a.Src.ObjectInfo] != 1 || n[del.Dst.ObjectInfo] != 1 {
+				continue
+			}
+			moved[del] = true
+			a.Type = ACTION_MOVE
+			a.Dst = del.Dst
+			a.OldPath = del.Path
+			break
+		}
+	}
+	actions := p.Actions[:0]
+	for _, a := range p.Actions {
+		if !moved[a] {
+			actions = append(actions, a)
+		}
+	}
+	p.Actions = actions
+}
+
+// canMove reports whether dst can move a file from one path to another.
+func canMove(dst Tree, from, to string) bool {
+	if d, ok := dst.(*DeviceTree); ok && !d.Device.CanMove {
+		return filepath.Dir(from) == filepath.Dir(to)
+	}
+	return true
+}
@@ -0,0 +1,222 @@
+package sync
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/tobwithu/gowpd"
+)
+
+func TestDetectMoves(t *testing.T) {
+	dir := tempTree(t)
+	defer os.RemoveAll(dir.Root)
+	for _, dst := range []Tree{NewMemoryTree(), dir} {
+		src := NewMemoryTree()
+		put(t, src, "b.mp4", "video", 100)
+		put(t, src, filepath.Join("d", "c.jpg"), "photo", 200)
+		put(t, src, "e.txt", "e", 100)
+		put(t, dst, "a.mp4", "video", 100)
+		put(t, dst, "c.jpg", "photo", 200)
+		put(t, dst, "x.txt", "x", 50)
+		before, _ := dst.ListFiles(false)
+
+		p, err := NewPlan(src, dst, &Options{Mode: MODE_MIRROR, DetectMoves: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{"move b.mp4", "mkdir d", "move d/c.jpg", "copy e.txt", "delete x.txt"}
+		if got := actions(p); !reflect.DeepEqual(got, want) {
+			t.Errorf("%T: %q", dst, got)
+		}
+		if a := p.Actions[0]; a.OldPath != "a.mp4" || a.Dst.Id != before["a.mp4"].Id {
+			t.Errorf("%T: move %+v", dst, a)
+		}
+		if err = Execute(p, nil); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := contents(t, dst), contents(t, src); !reflect.DeepEqual(got, want) {
+			t.Errorf("%T: %v", dst, got)
+		}
+		after, _ := dst.ListFiles(false)
+		if _, ok := dst.(*DeviceTree); ok && after["b.mp4"].Id != before["a.mp4"].Id {
+			t.Errorf("moved file has a new id")
+		}
+		if o := after[filepath.Join("d", "c.jpg")]; o.ModTime != 200 {
+			t.Errorf("%T: moved %+v", dst, o)
+		}
+	}
+}
+
+func TestDetectMovesAmbiguous(t *testing.T) {
+	src, dst := NewMemoryTree(), NewMemoryTree()
+	// same size and time, so only the data tells which is which
+	put(t, src, "c.txt", "aa", 100)
+	put(t, src, "d.txt", "bb", 100)
+	put(t, dst, "a.txt", "aa", 100)
+	put(t, dst, "b.txt", "bb", 100)
+
+	p, _ := NewPlan(src, dst, &Options{Mode: MODE_MIRROR, DetectMoves: true})
+	want := []string{"copy c.txt", "copy d.txt", "delete b.txt", "delete a.txt"}
+	if got := actions(p); !reflect.DeepEqual(got, want) {
+		t.Errorf("without hash %q", got)
+	}
+	p, _ = NewPlan(src, dst, &Options{Mode: MODE_MIRROR, DetectMoves: true, Hash: true})
+	want = []string{"move c.txt", "move d.txt"}
+	if got := actions(p); !reflect.DeepEqual(got, want) {
+		t.Errorf("with hash %q", got)
+	}
+	if p.Actions[0].OldPath != "a.txt" || p.Actions[1].OldPath != "b.txt" {
+		t.Errorf("moves from %v %v", p.Actions[0].OldPath, p.Actions[1].OldPath)
+	}
+
+	// a copy mode plan keeps the destination files
+	p, _ = NewPlan(src, dst, &Options{DetectMoves: true, Hash: true})
+	want = []string{"copy c.txt", "copy d.txt", "skip b.txt (not in source)", "skip a.txt (not in source)"}
+	if got := actions(p); !reflect.DeepEqual(got, want) {
+		t.Errorf("copy mode %q", got)
+	}
+}
+
+func TestDetectMovesCannotMove(t *testing.T) {
+	b := gowpd.NewMemoryBackend()
+	b.Commands = nil
+	d := gowpd.NewDevice(b)
+	d.CreateFolder(gowpd.WPD_DEVICE_OBJECT_ID, "Storage")
+	dst, _ := NewDeviceTree(d, "Storage")
+	src := NewMemoryTree()
+	put(t, src, "b.txt", "b", 100)
+	put(t, src, filepath.Join("d", "c.txt"), "cc", 100)
+	put(t, dst, "a.txt", "b", 100)
+	put(t, dst, "c.txt", "cc", 100)
+
+	// renames in a folder work without the move command
+	p, _ := NewPlan(src, dst, &Options{Mode: MODE_MIRROR, DetectMoves: true})
+	want := []string{"move b.txt", "mkdir d", "copy d/c.txt", "delete c.txt"}
+	if got := actions(p); !reflect.DeepEqual(got, want) {
+		t.Errorf("%q", got)
+	}
+	if err := Execute(p, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := contents(t, dst), contents(t, src); !reflect.DeepEqual(got, want) {
+		t.Errorf("%v", got)
+	}
+}
+
+func TestPlanHash(t *testing.T) {
+	b := gowpd.NewMemoryBackend()
+	reads := 0
+	b.Fault = func(op string, ids []string) error {
+		if op == "GetStream" {
+			reads++
+		}
+		return nil
+	}
+	d := gowpd.NewDevice(b)
+	d.CreateFolder(gowpd.WPD_DEVICE_OBJECT_ID, "Storage")
+	src, _ := NewDeviceTree(d, "Storage")
+	dst := NewMemoryTree()
+	// touched without a change
+	put(t, src, "a.txt", "aa", 300)
+	put(t, dst, "a.txt", "aa", 100)
+	// changed without a change of size
+	put(t, src, "b.txt", "b2", 300)
+	put(t, dst, "b.txt", "b1", 100)
+
+	p, _ := NewPlan(src, dst, nil)
+	if got, want := actions(p), []string{"overwrite a.txt", "overwrite b.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("without hash %q", got)
+	}
+	cache := NewState()
+	opts := &Options{Hash: true, HashCache: cache}
+	reads = 0
+	p, _ = NewPlan(src, dst, opts)
+	if got, want := actions(p), []string{"overwrite b.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("with hash %q", got)
+	}
+	if reads != 2 {
+		t.Errorf("read %v source files", reads)
+	}
+	e := cache.Sides[HASH_SIDE_SRC]["a.txt"]
+	if e == nil || e.ModTime != 300 || e.Size != 2 || e.Hash == "" || e.Hash != cache.Sides[HASH_SIDE_DST]["a.txt"].Hash {
+		t.Fatalf("cached %+v", e)
+	}
+
+	// digests are reused while size and time are the same
+	reads = 0
+	NewPlan(src, dst, opts)
+	if reads != 0 {
+		t.Errorf("read %v source files again", reads)
+	}
+	put(t, src, "a.txt", "ab", 400)
+	p, _ = NewPlan(src, dst, opts)
+	if reads != 1 {
+		t.Errorf("read %v changed files", reads)
+	}
+	if got, want := actions(p), []string{"overwrite a.txt", "overwrite b.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("changed %q", got)
+	}
+}
+
+func TestTwoWayMoves(t *testing.T) {
+	a, b, base := synced(t, func(tree Tree) {
+		put(t, tree, "a.mp4", "video", 100)
+		put(t, tree, filepath.Join("d", "c.jpg"), "photo", 100)
+	})
+	del(t, a, "a.mp4")
+	put(t, a, "renamed.mp4", "video", 100)
+	del(t, b, filepath.Join("d", "c.jpg"))
+	del(t, b, "d")
+	put(t, b, "c.jpg", "photo", 100)
+
+	p, err := NewTwoWayPlan(a, b, base, &Options{DetectMoves: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := actions(p.AtoB), []string{"move renamed.mp4"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("a to b %q", got)
+	}
+	if got, want := actions(p.BtoA), []string{"move c.jpg", "delete d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("b to a %q", got)
+	}
+	if err = ExecuteTwoWay(p, nil); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"renamed.mp4": "video", "c.jpg": "photo"}
+	for _, tree := range []Tree{a, b} {
+		if got := contents(t, tree); !reflect.DeepEqual(got, want) {
+			t.Errorf("%v", got)
+		}
+	}
+	p, _ = NewTwoWayPlan(a, b, p.Base, &Options{DetectMoves: true})
+	if len(p.AtoB.Actions) != 0 || len(p.BtoA.Actions) != 0 {
+		t.Errorf("after sync %q %q", actions(p.AtoB), actions(p.BtoA))
+	}
+}
+
+func TestTwoWayHash(t *testing.T) {
+	a, b := NewMemoryTree(), NewMemoryTree()
+	put(t, a, "f.txt", "same", 100)
+	put(t, b, "f.txt", "same", 200)
+	opts := &Options{Hash: true, HashCache: NewState()}
+	p, err := NewTwoWayPlan(a, b, nil, opts)
+	if err != nil || len(p.Conflicts) != 0 || len(p.AtoB.Actions) != 0 || len(p.BtoA.Actions) != 0 {
+		t.Fatalf("same data %v %q %q %v", p.Conflicts, actions(p.AtoB), actions(p.BtoA), err)
+	}
+	if err = ExecuteTwoWay(p, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// touched on a, changed on b
+	put(t, a, "f.txt", "same", 300)
+	put(t, b, "f.txt", "diff", 250)
+	p, err = NewTwoWayPlan(a, b, p.Base, opts)
+	if err != nil || len(p.Conflicts) != 0 {
+		t.Fatalf("conflicts %v %v", p.Conflicts, err)
+	}
+	if got, want := actions(p.BtoA), []string{"overwrite f.txt"}; !reflect.DeepEqual(got, want) || len(p.AtoB.Actions) != 0 {
+		t.Errorf("%q %q", actions(p.AtoB), got)
+	}
+}
@@ -0,0 +1,391 @@
+package sync
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"github.com/tobwithu/gowpd"
+)
+
+// States of a source file compared with the destination.
+const (
+	ST_NEW = iota
+	ST_NEWER
+	ST_SAME
+	ST_OLDER
+	ST_NOT_EXIST
+	// ST_TYPE_CHANGED is a folder over a destination file or a file over a
+	// destination folder.
+	ST_TYPE_CHANGED
+)
+
+// Mode is what a plan does about the differences of two trees.
+type Mode int
+
+const (
+	// MODE_COPY copies new and newer files of the source.
+	MODE_COPY Mode = iota
+	// MODE_DELETE deletes files which are not in the source.
+	MODE_DELETE
+	// MODE_MIRROR makes the destination equal to the source.
+	MODE_MIRROR
+)
+
+type ActionType int
+
+const (
+	ACTION_COPY ActionType = iota
+	ACTION_OVERWRITE
+	ACTION_DELETE
+	ACTION_MKDIR
+	ACTION_SKIP
+	// ACTION_KEEP_BOTH saves the destination file as NewPath on both trees
+	// before overwriting it.
+	ACTION_KEEP_BOTH
+	// ACTION_MOVE moves the destination file at OldPath to Path instead of
+	// copying the source file.
+	ACTION_MOVE
+)
+
+var actionNames = []string{"copy", "overwrite", "delete", "mkdir", "skip", "keep both", "move"}
+
+func (t ActionType) String() string {
+	if t < 0 || int(t) >= len(actionNames) {
+		return "unknown"
+	}
+	return actionNames[t]
+}
+
+// Reasons of ACTION_SKIP.
+const (
+	SKIP_OLDER      = "destination is newer"
+	SKIP_EXCLUDED   = "unchanged since excluded"
+	SKIP_NOT_IN_SRC = "not in source"
+)
+
+// Action is a step of a plan on the file or folder Path.
+type Action struct {
+	Type ActionType
+	Path string
+	// Src and Dst are the listed objects, nil if there is none.
+	Src *gowpd.Object
+	Dst *gowpd.Object
+	// Reason tells why an action is skipped.
+	Reason string
+	// NewPath is where ACTION_KEEP_BOTH saves the destination file, and
+	// where ACTION_DELETE moves it to with a quarantine.
+	NewPath string
+	// OldPath is where ACTION_MOVE takes the destination file from.
+	OldPath string
+	// Err is the result of the action once the plan is executed.
+	Err error
+}
+
+type Options struct {
+	Mode Mode
+	// SkipEmptyDirs leaves folders out of the comparison which are empty
+	// once files are left out, and SkipEmptyFiles zero-byte files, like
+	// placeholders such as ".nomedia". Clean sets both.
+	SkipEmptyDirs  bool
+	SkipEmptyFiles bool
+	Clean          bool
+	// Exclude holds files which are not copied unless they have changed
+	// since, like the source files of the last sync.
+	Exclude map[string]*gowpd.Object
+	// Ignore leaves the path out of the comparison if it returns true.
+	Ignore func(path string, obj *gowpd.Object) bool
+	// Rules leaves the files it excludes out of the comparison, after the
+	// rules of the gowpd.RULES_FILENAME files at the roots of both trees.
+	// Files excluded on one side are left alone on the other. The rules
+	// files are not synced.
+	Rules *gowpd.Rules
+	// Hash compares files of the same size by the SHA-256 digest of their
+	// data instead of their modification time, so files touched without a
+	// change are not copied.
+	Hash bool
+	// HashCache keeps the digests between syncs, as sides HASH_SIDE_SRC and
+	// HASH_SIDE_DST, or "A" and "B" for two-way plans. A digest is reused
+	// while the size and modification time of its file are the same. It may
+	// be nil.
+	HashCache *State
+	// DetectMoves moves a file on the destination instead of copying it if
+	// the file is deleted at another path, with the same size and
+	// modification time, or digest with Hash.
+	DetectMoves bool
+	// Time tells when files count as the same although their modification
+	// times differ.
+	Time TimePolicy
+	// MaxDelete and MaxDeletePercent make a plan fail which deletes more
+	// files than that, or than that percentage of the destination files.
+	// Zero is no limit.
+	MaxDelete        int
+	MaxDeletePercent float64
+	// Quarantine moves the files deletions would remove into a folder of
+	// the destination. It may be nil.
+	Quarantine *Quarantine
+	// Conflict and ConflictSuffix are for two-way plans. An empty suffix is
+	// DEFAULT_CONFLICT_SUFFIX.
+	Conflict       ConflictPolicy
+	ConflictSuffix string
+}
+
+// list lists trees and removes the paths of opts.Ignore and the rules and
+// the empty folders and files of the options from the lists.
+func (opts *Options) list(trees ...Tree) ([]map[string]*gowpd.Object, error) {
+	var lists []map[string]*gowpd.Object
+	for _, t := range trees {
+		list, err := t.ListFiles(false)
+		if err != nil {
+			return nil, err
+		}
+		lists = append(lists, list)
+	}
+	var rs []*gowpd.Rules
+	for i, list := range lists {
+		r, err := readRules(trees[i], list[gowpd.RULES_FILENAME])
+		if err != nil {
+			return nil, err
+		}
+		rs = append(rs, r)
+		delete(list, gowpd.RULES_FILENAME)
+	}
+	if opts.Quarantine != nil {
+		rs = append(rs, opts.Quarantine.rule())
+	}
+	rules := gowpd.MergeRules(append(rs, opts.Rules)...)
+	for _, list := range lists {
+		for k, o := range list {
+			if rules.Excluded(k, o) || opts.Ignore != nil && opts.Ignore(k, o) {
+				delete(list, k)
+			}
+		}
+		Clean(list, opts.Clean || opts.SkipEmptyDirs, opts.Clean || opts.SkipEmptyFiles)
+	}
+	return lists, nil
+}
+
+// readRules reads the rules file obj of tree, which may be nil.
+func readRules(tree Tree, obj *gowpd.Object) (*gowpd.Rules, error) {
+	if obj == nil || obj.IsDir {
+		return nil, nil
+	}
+	r, err := tree.Open(obj)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	rules, err := gowpd.ParseRules(r)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %v : %v", gowpd.RULES_FILENAME, err)
+	}
+	return rules, nil
+}
+
+// Plan is the list of actions syncing Dst with Src. Copies and folders come
+// in path order, followed by deletions deepest first. A destination file or
+// folder replaced by one of the other type is deleted by an action with Src
+// set, which comes right before the action making the folder or copying the
+// file.
+type Plan struct {
+	Src     Tree
+	Dst     Tree
+	SrcList map[string]*gowpd.Object
+	DstList map[string]*gowpd.Object
+	Actions []*Action
+	// Quarantine is Options.Quarantine of the plan.
+	Quarantine *Quarantine
+
+	journal *Journal
+}
+
+// NewPlan lists src and dst and compares them. opts may be nil. A plan
+// deleting more files than opts allow is returned with an error.
+func NewPlan(src, dst Tree, opts *Options) (*Plan, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	lists, err := opts.list(src, dst)
+	if err != nil {
+		return nil, err
+	}
+	srcList, dstList := lists[0], lists[1]
+	p := &Plan{Src: src, Dst: dst, SrcList: srcList, DstList: dstList}
+	hs := newHasher(src, opts, HASH_SIDE_SRC)
+	hd := newHasher(dst, opts, HASH_SIDE_DST)
+	add := func(t ActionType, k string, reason string) {
+		p.Actions = append(p.Actions, &Action{Type: t, Path: k, Src: srcList[k], Dst: dstList[k], Reason: reason})
+	}
+	if opts.Mode != MODE_DELETE {
+		opts.Time.CheckSrc(srcList, dstList, func(state int, k string, s *gowpd.Object) {
+			if state != ST_NEW && sameData(hs, k, s, hd, k, dstList[k]) {
+				return
+			}
+			switch state {
+			case ST_TYPE_CHANGED:
+				add(ACTION_DELETE, k, "")
+				if s.IsDir {
+					add(ACTION_MKDIR, k, "")
+				} else {
+					add(ACTION_COPY, k, "")
+				}
+			case ST_NEW, ST_NEWER:
+				if e := opts.Exclude[k]; e != nil {
+					if s.IsDir || opts.Time.Compare(s, e) <= 0 {
+						add(ACTION_SKIP, k, SKIP_EXCLUDED)
+						return
+					}
+				}
+				switch {
+				case state == ST_NEWER:
+					add(ACTION_OVERWRITE, k, "")
+				case s.IsDir:
+					add(ACTION_MKDIR, k, "")
+				default:
+					add(ACTION_COPY, k, "")
+				}
+			case ST_OLDER:
+				add(ACTION_SKIP, k, SKIP_OLDER)
+			}
+		})
+	}
+	// the files below a replaced folder go with it
+	replaced := p.typeChanges()
+	CheckDst(srcList, dstList, func(k string, d *gowpd.Object) {
+		if opts.Mode == MODE_COPY && !inside(replaced, k) {
+			add(ACTION_SKIP, k, SKIP_NOT_IN_SRC)
+		} else {
+			add(ACTION_DELETE, k, "")
+		}
+	})
+	if opts.DetectMoves {
+		detectMoves(p, hs, hd)
+	}
+	opts.quarantine(p)
+	return p, opts.checkDeletes(p)
+}
+
+// typeChanges returns the paths whose destination is deleted to be replaced
+// by a folder or file of the other type.
+func (p *Plan) typeChanges() map[string]bool {
+	paths := make(map[string]bool)
+	for _, a := range p.Actions {
+		if a.Type == ACTION_DELETE && a.Src != nil {
+			paths[a.Path] = true
+		}
+	}
+	return paths
+}
+
+// inside reports whether path is one of paths or below one of them.
+func inside(paths map[string]bool, path string) bool {
+	for ; path != "." && path != string(filepath.Separator); path = filepath.Dir(path) {
+		if paths[path] {
+			return true
+		}
+	}
+	return false
+}
+
+func SortKey(m map[string]*gowpd.Object) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// TimePolicy tells when files of the same size are the same although their
+// modification times differ, as they do between file systems of different
+// precision, across daylight saving time changes, or on devices which set
+// the time of uploaded files themselves. The zero value compares exactly.
+type TimePolicy struct {
+	// Tolerance is the largest difference in seconds of the same time, like
+	// 2 for FAT.
+	Tolerance int64
+	// HourOffsets is the largest number of whole hours, give or take
+	// Tolerance, which a time may be off by, like 1 for daylight saving time.
+	HourOffsets int64
+	// SizeOnly compares files by size only.
+	SizeOnly bool
+}
+
+// SameTime reports whether the modification times a and b are the same.
+func (tp TimePolicy) SameTime(a, b int64) bool {
+	d := a - b
+	if d < 0 {
+		d = -d
+	}
+	if d <= tp.Tolerance {
+		return true
+	}
+	h := (d + 1800) / 3600
+	off := d - h*3600
+	if off < 0 {
+		off = -off
+	}
+	return h <= tp.HourOffsets && off <= tp.Tolerance
+}
+
+// Compare returns 0 if the files a and b are the same, 1 if a is newer or
+// of a different size at the same time, and -1 if a is older. Folders are
+// the same, and a file and a folder differ by 1; CheckSrc reports them as
+// ST_TYPE_CHANGED instead.
+func (tp TimePolicy) Compare(a, b *gowpd.Object) int {
+	if a.IsDir || b.IsDir {
+		if a.IsDir == b.IsDir {
+			return 0
+		}
+		return 1
+	}
+	same := tp.SizeOnly || tp.SameTime(a.ModTime, b.ModTime)
+	switch {
+	case same && a.Size == b.Size:
+		return 0
+	case same || a.ModTime > b.ModTime:
+		return 1
+	}
+	return -1
+}
+
+type Handler func(state int, path string, obj *gowpd.Object)
+
+// CheckSrc calls handle in path order for the files of srcList which differ
+// from dstList. Folders are only reported if they are new or replace a file.
+func CheckSrc(srcList, dstList map[string]*gowpd.Object, handle Handler) {
+	TimePolicy{}.CheckSrc(srcList, dstList, handle)
+}
+
+// CheckSrc is CheckSrc comparing files by tp.
+func (tp TimePolicy) CheckSrc(srcList, dstList map[string]*gowpd.Object, handle Handler) {
+	sk := SortKey(srcList)
+	for _, k := range sk {
+		s := srcList[k]
+		d := dstList[k]
+		if d == nil {
+			handle(ST_NEW, k, s)
+		} else if s.IsDir != d.IsDir {
+			handle(ST_TYPE_CHANGED, k, s)
+		} else if !s.IsDir {
+			switch tp.Compare(s, d) {
+			case 1:
+				handle(ST_NEWER, k, s)
+			case -1:
+				handle(ST_OLDER, k, s)
+			}
+		}
+	}
+}
+
+// CheckDst calls handle for the objects of dstList which are not in srcList,
+// children before their folders.
+func CheckDst(srcList, dstList map[string]*gowpd.Object, handle func(path string, obj *gowpd.Object)) {
+	dk := SortKey(dstList)
+	for i := len(dk) - 1; i >= 0; i-- {
+		k := dk[i]
+		if srcList[k] == nil {
+			handle(k, dstList[k])
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package sync
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/tobwithu/gowpd"
+)
+
+// actions describes the actions of p, like "skip c.txt (destination is
+// newer)".
+func actions(p *Plan) []string {
+	var s []string
+	for _, a := range p.Actions {
+		d := fmt.Sprintf("%v %v", a.Type, filepath.ToSlash(a.Path))
+		if a.Reason != "" {
+			d += " (" + a.Reason + ")"
+		}
+		s = append(s, d)
+	}
+	return s
+}
+
+// testTrees returns a source with new, newer, older and unchanged files
+// and a destination with files the source does not have.
+func testTrees(t *testing.T) (Tree, Tree) {
+	src, dst := NewMemoryTree(), NewMemoryTree()
+	put(t, src, "a.txt", "a", 100)
+	put(t, src, "b.txt", "b2", 200)
+	put(t, src, "c.txt", "c", 100)
+	put(t, src, "d.txt", "d", 100)
+	put(t, src, filepath.Join("dir", "e.txt"), "e", 100)
+	put(t, dst, "b.txt", "b", 100)
+	put(t, dst, "c.txt", "c2", 200)
+	put(t, dst, "d.txt", "d", 100)
+	put(t, dst, "x.txt", "x", 100)
+	put(t, dst, filepath.Join("y", "z.txt"), "z", 100)
+	return src, dst
+}
+
+func TestNewPlan(t *testing.T) {
+	tests := []struct {
+		mode Mode
+		want []string
+	}{
+		{MODE_COPY, []string{
+			"copy a.txt", "overwrite b.txt", "skip c.txt (destination is newer)", "mkdir dir", "copy dir/e.txt",
+			"skip y/z.txt (not in source)", "skip y (not in source)", "skip x.txt (not in source)",
+		}},
+		{MODE_DELETE, []string{"delete y/z.txt", "delete y", "delete x.txt"}},
+		{MODE_MIRROR, []string{
+			"copy a.txt", "overwrite b.txt", "skip c.txt (destination is newer)", "mkdir dir", "copy dir/e.txt",
+			"delete y/z.txt", "delete y", "delete x.txt",
+		}},
+	}
+	for _, tt := range tests {
+		src, dst := testTrees(t)
+		p, err := NewPlan(src, dst, &Options{Mode: tt.mode})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := actions(p); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("mode %v: %q", tt.mode, got)
+		}
+		if len(p.SrcList) != 6 || len(p.DstList) != 6 {
+			t.Errorf("mode %v: lists %v %v", tt.mode, SortKey(p.SrcList), SortKey(p.DstList))
+		}
+	}
+}
+
+func TestPlanExclude(t *testing.T) {
+	src, dst := testTrees(t)
+	exclude := map[string]*gowpd.Object{
+		// unchanged since the last sync
+		"a.txt": {ObjectInfo: gowpd.ObjectInfo{ModTime: 100, Size: 1}},
+		// changed since
+		"b.txt": {ObjectInfo: gowpd.ObjectInfo{ModTime: 100, Size: 1}},
+		"dir":   {ObjectInfo: gowpd.ObjectInfo{ModTime: 50, IsDir: true}},
+	}
+	ignore := func(path string, obj *gowpd.Object) bool {
+		return filepath.Dir(path) == "y" || path == "y"
+	}
+	p, err := NewPlan(src, dst, &Options{Exclude: exclude, Ignore: ignore})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"skip a.txt (unchanged since excluded)", "overwrite b.txt", "skip c.txt (destination is newer)",
+		"skip dir (unchanged since excluded)", "copy dir/e.txt", "skip x.txt (not in source)",
+	}
+	if got := actions(p); !reflect.DeepEqual(got, want) {
+		t.Errorf("%q", got)
+	}
+}
+
+func TestPlanClean(t *testing.T) {
+	src, dst := NewMemoryTree(), NewMemoryTree()
+	put(t, src, "empty.txt", "", 100)
+	src.Mkdir("empty")
+	put(t, dst, "old.txt", "", 100)
+
+	p, _ := NewPlan(src, dst, &Options{Mode: MODE_MIRROR, Clean: true})
+	if got := actions(p); len(got) != 0 {
+		t.Errorf("clean: %q", got)
+	}
+	p, _ = NewPlan(src, dst, &Options{Mode: MODE_MIRROR})
+	want := []string{"mkdir empty", "copy empty.txt", "delete old.txt"}
+	if got := actions(p); !reflect.DeepEqual(got, want) {
+		t.Errorf("%q", got)
+	}
+}
+
+func TestCheckSrc(t *testing.T) {
+	obj := func(mtime int64, size int64, dir bool) *gowpd.Object {
+		return &gowpd.Object{ObjectInfo: gowpd.ObjectInfo{ModTime: mtime, Size: size, IsDir: dir}}
+	}
+	srcList := map[string]*gowpd.Object{
+		"dir":    obj(200, 0, true),
+		"new":    obj(100, 1, false),
+		"newer":  obj(200, 1, false),
+		"older":  obj(100, 1, false),
+		"same":   obj(100, 1, false),
+		"size":   obj(100, 2, false),
+		"file":   obj(100, 0, true),
+		"folder": obj(100, 1, false),
+	}
+	dstList := map[string]*gowpd.Object{
+		"dir":    obj(100, 0, true),
+		"newer":  obj(100, 1, false),
+		"older":  obj(200, 1, false),
+		"same":   obj(100, 1, false),
+		"size":   obj(100, 1, false),
+		"gone":   obj(100, 1, false),
+		"file":   obj(100, 1, false),
+		"folder": obj(100, 0, true),
+	}
+	states := make(map[string]int)
+	CheckSrc(srcList, dstList, func(state int, path string, obj *gowpd.Object) {
+		states[path] = state
+	})
+	want := map[string]int{"new": ST_NEW, "newer": ST_NEWER, "older": ST_OLDER, "size": ST_NEWER, "file": ST_TYPE_CHANGED, "folder": ST_TYPE_CHANGED}
+	if !reflect.DeepEqual(states, want) {
+		t.Errorf("%v", states)
+	}
+	var gone []string
+	CheckDst(srcList, dstList, func(path string, obj *gowpd.Object) {
+		gone = append(gone, path)
+	})
+	if !reflect.DeepEqual(gone, []string{"gone"}) {
+		t.Errorf("%v", gone)
+	}
+}
+
+func TestTimePolicy(t *testing.T) {
+	obj := func(mtime int64, size int64) *gowpd.Object {
+		return &gowpd.Object{ObjectInfo: gowpd.ObjectInfo{ModTime: mtime, Size: size}}
+	}
+	exact := TimePolicy{}
+	fat := TimePolicy{Tolerance: 2}
+	dst := TimePolicy{Tolerance: 2, HourOffsets: 1}
+	size := TimePolicy{SizeOnly: true}
+	const h = 3600
+	tests := []struct {
+		tp   TimePolicy
+		a, b *gowpd.Object
+		want int
+	}{
+		{exact, obj(100, 1), obj(100, 1), 0},
+		{exact, obj(101, 1), obj(100, 1), 1},
+		{exact, obj(99, 1), obj(100, 1), -1},
+		{exact, obj(100, 2), obj(100, 1), 1},
+		{exact, obj(100, 1), obj(100, 2), 1},
+		{exact, obj(100+h, 1), obj(100, 1), 1},
+		{fat, obj(102, 1), obj(100, 1), 0},
+		{fat, obj(98, 1), obj(100, 1), 0},
+		{fat, obj(103, 1), obj(100, 1), 1},
+		{fat, obj(97, 1), obj(100, 1), -1},
+		{fat, obj(101, 2), obj(100, 1), 1},
+		// a different size within the tolerance is newer either way
+		{fat, obj(99, 2), obj(100, 1), 1},
+		{fat, obj(100+h, 1), obj(100, 1), 1},
+		{dst, obj(100+h, 1), obj(100, 1), 0},
+		{dst, obj(100-h, 1), obj(100, 1), 0},
+		{dst, obj(102+h, 1), obj(100, 1), 0},
+		{dst, obj(98-h, 1), obj(100, 1), 0},
+		{dst, obj(103+h, 1), obj(100, 1), 1},
+		{dst, obj(100+2*h, 1), obj(100, 1), 1},
+		{dst, obj(100-2*h, 1), obj(100, 1), -1},
+		{dst, obj(100+h/2, 1), obj(100, 1), 1},
+		{dst, obj(100+h, 2), obj(100, 1), 1},
+		{TimePolicy{HourOffsets: 2}, obj(100+2*h, 1), obj(100, 1), 0},
+		{TimePolicy{HourOffsets: 2}, obj(101+2*h, 1), obj(100, 1), 1},
+		{size, obj(5000, 1), obj(100, 1), 0},
+		{size, obj(100, 1), obj(5000, 1), 0},
+		{size, obj(100, 2), obj(5000, 1), 1},
+		{size, obj(5000, 2), obj(100, 1), 1},
+		{exact, &gowpd.Object{ObjectInfo: gowpd.ObjectInfo{ModTime: 1, IsDir: true}}, &gowpd.Object{ObjectInfo: gowpd.ObjectInfo{ModTime: 2, IsDir: true}}, 0},
+	}
+	for i, tt := range tests {
+		if got := tt.tp.Compare(tt.a, tt.b); got != tt.want {
+			t.Errorf("%v: %+v %v %v = %v, want %v", i, tt.tp, tt.a.ObjectInfo, tt.b.ObjectInfo, got, tt.want)
+		}
+	}
+}
+
+func TestPlanTimePolicy(t *testing.T) {
+	src, dst := NewMemoryTree(), NewMemoryTree()
+	put(t, src, "fat.txt", "a", 1001)
+	put(t, dst, "fat.txt", "a", 1000)
+	put(t, src, "dst.txt", "b", 1000+3600)
+	put(t, dst, "dst.txt", "b", 1000)
+	put(t, src, "changed.txt", "cc", 1001)
+	put(t, dst, "changed.txt", "c", 1000)
+	put(t, src, "upload.txt", "d", 100)
+	put(t, dst, "upload.txt", "d", 9000)
+
+	tests := []struct {
+		tp   TimePolicy
+		want []string
+	}{
+		{TimePolicy{}, []string{"overwrite changed.txt", "overwrite dst.txt", "overwrite fat.txt", "skip upload.txt (destination is newer)"}},
+		{TimePolicy{Tolerance: 2}, []string{"overwrite changed.txt", "overwrite dst.txt", "skip upload.txt (destination is newer)"}},
+		{TimePolicy{Tolerance: 2, HourOffsets: 1}, []string{"overwrite changed.txt", "skip upload.txt (destination is newer)"}},
+		{TimePolicy{SizeOnly: true}, []string{"overwrite changed.txt"}},
+	}
+	for _, tt := range tests {
+		p, err := NewPlan(src, dst, &Options{Time: tt.tp})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := actions(p); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%+v: %q", tt.tp, got)
+		}
+	}
+
+	// the times of excluded files shift too
+	p, _ := NewPlan(src, dst, &Options{Time: TimePolicy{HourOffsets: 1}, Exclude: map[string]*gowpd.Object{
+		"changed.txt": {ObjectInfo: gowpd.ObjectInfo{ModTime: 1001 - 3600, Size: 2}},
+	}})
+	if got := actions(p); len(got) == 0 || got[0] != "skip changed.txt (unchanged since excluded)" {
+		t.Errorf("excluded %q", got)
+	}
+}
+
+func TestPlanRules(t *testing.T) {
+	dir := tempTree(t)
+	defer os.RemoveAll(dir.Root)
+	for _, dst := range []Tree{NewMemoryTree(), dir} {
+		src := NewMemoryTree()
+		put(t, src, gowpd.RULES_FILENAME, "*.tmp\n", 100)
+		put(t, src, "a.txt", "a", 100)
+		put(t, src, "b.tmp", "b", 100)
+		put(t, src, filepath.Join("keep", "y.txt"), "y", 100)
+		put(t, src, "big.bin", "0123456789", 100)
+		put(t, dst, gowpd.RULES_FILENAME, "/keep/\n", 100)
+		put(t, dst, "c.tmp", "c", 100)
+		put(t, dst, "d.txt", "d", 100)
+		put(t, dst, filepath.Join("keep", "x.txt"), "x", 100)
+
+		// rules of either side apply to both, the options last
+		rules, _ := gowpd.NewRules("size>5", "!c.tmp")
+		p, err := NewPlan(src, dst, &Options{Mode: MODE_MIRROR, Rules: rules})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{"copy a.txt", "delete d.txt", "delete c.tmp"}
+		if got := actions(p); !reflect.DeepEqual(got, want) {
+			t.Errorf("%T: %q", dst, got)
+		}
+		if p.SrcList["keep"] != nil || p.SrcList[gowpd.RULES_FILENAME] != nil {
+			t.Errorf("%T: listed %v", dst, SortKey(p.SrcList))
+		}
+
+		put(t, src, filepath.Join("d", "e.tmp"), "e", 100)
+		put(t, src, filepath.Join("d", "f.txt"), "f", 100)
+		lists, err := (&Options{}).list(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if o := lists[0]["d"]; o == nil || o.ChildCount != 1 {
+			t.Errorf("%T: folder %+v", dst, o)
+		}
+	}
+}
+
+func TestPlanRulesInvalid(t *testing.T) {
+	src, dst := testTrees(t)
+	put(t, dst, gowpd.RULES_FILENAME, "size>big\n", 100)
+	if _, err := NewPlan(src, dst, nil); err == nil {
+		t.Errorf("invalid rules accepted")
+	}
+}
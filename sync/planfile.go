@@ -0,0 +1,376 @@
+package sync
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/tobwithu/gowpd"
+)
+
+const (
+	PLAN_FORMAT  = "gowpd-sync-plan"
+	PLAN_VERSION = 1
+)
+
+// ErrPlanChanged is the error of an action of a loaded plan whose files
+// changed since the plan was written.
+var ErrPlanChanged = errors.New("changed since planned")
+
+// Total is the number of actions of a type and the bytes of their files.
+type Total struct {
+	Count int   `json:"count"`
+	Bytes int64 `json:"bytes"`
+}
+
+// size returns the bytes of the file of a, the source file except for
+// deletions.
+func (a *Action) size() int64 {
+	o := a.Src
+	if a.Type == ACTION_DELETE || o == nil {
+		o = a.Dst
+	}
+	if o == nil || o.IsDir {
+		return 0
+	}
+	return o.Size
+}
+
+// Totals returns the totals of the actions of p by type.
+func (p *Plan) Totals() map[ActionType]Total {
+	m := make(map[ActionType]Total)
+	for _, a := range p.Actions {
+		t := m[a.Type]
+		t.Count++
+		t.Bytes += a.size()
+		m[a.Type] = t
+	}
+	return m
+}
+
+func ParseActionType(s string) (ActionType, error) {
+	for i, name := range actionNames {
+		if name == s {
+			return ActionType(i), nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown action : %v", s)
+}
+
+// planObject is a listed object of a plan file.
+type planObject struct {
+	ModTime int64 `json:"mtime"`
+	Size    int64 `json:"size"`
+	IsDir   bool  `json:"dir,omitempty"`
+}
+
+type planAction struct {
+	Type    string      `json:"type"`
+	Path    string      `json:"path"`
+	OldPath string      `json:"old_path,omitempty"`
+	NewPath string      `json:"new_path,omitempty"`
+	Reason  string      `json:"reason,omitempty"`
+	Src     *planObject `json:"src,omitempty"`
+	Dst     *planObject `json:"dst,omitempty"`
+}
+
+func toPlanAction(a *Action) *planAction {
+	return &planAction{
+		Type:    a.Type.String(),
+		Path:    a.Path,
+		OldPath: a.OldPath,
+		NewPath: a.NewPath,
+		Reason:  a.Reason,
+		Src:     toPlanObject(a.Src),
+		Dst:     toPlanObject(a.Dst),
+	}
+}
+
+func (pa *planAction) action() (*Action, error) {
+	t, err := ParseActionType(pa.Type)
+	if err != nil {
+		return nil, err
+	}
+	return &Action{
+		Type:    t,
+		Path:    pa.Path,
+		OldPath: pa.OldPath,
+		NewPath: pa.NewPath,
+		Reason:  pa.Reason,
+		Src:     pa.Src.object(),
+		Dst:     pa.Dst.object(),
+	}, nil
+}
+
+type planFile struct {
+	Format  string           `json:"format"`
+	Version int              `json:"version"`
+	Src     string           `json:"src,omitempty"`
+	Dst     string           `json:"dst,omitempty"`
+	Totals  map[string]Total `json:"totals"`
+	Actions []*planAction    `json:"actions"`
+}
+
+func toPlanObject(o *gowpd.Object) *planObject {
+	if o == nil {
+		return nil
+	}
+	return &planObject{o.ModTime, o.Size, o.IsDir}
+}
+
+func (o *planObject) object() *gowpd.Object {
+	if o == nil {
+		return nil
+	}
+	cnt := -1
+	if o.IsDir {
+		cnt = 0
+	}
+	return &gowpd.Object{ObjectInfo: gowpd.ObjectInfo{ModTime: o.ModTime, Size: o.Size, IsDir: o.IsDir}, ChildCount: cnt}
+}
+
+// treeName describes tree in plan files.
+func treeName(tree Tree) string {
+	switch t := tree.(type) {
+	case *DirTree:
+		return t.Root
+	case *DeviceTree:
+		return t.Root
+	}
+	return ""
+}
+
+// sameTree reports whether the tree name of a plan file is tree. Plans
+// without the name are for any tree.
+func sameTree(name string, tree Tree) bool {
+	return name == "" || filepath.Clean(name) == filepath.Clean(treeName(tree))
+}
+
+// WriteJSON writes p with its totals as JSON, which ReadPlan loads.
+func (p *Plan) WriteJSON(w io.Writer) error {
+	f := planFile{
+		Format:  PLAN_FORMAT,
+		Version: PLAN_VERSION,
+		Src:     treeName(p.Src),
+		Dst:     treeName(p.Dst),
+		Totals:  make(map[string]Total),
+		Actions: []*planAction{},
+	}
+	for t, total := range p.Totals() {
+		f.Totals[t.String()] = total
+	}
+	for _, a := range p.Actions {
+		f.Actions = append(f.Actions, toPlanAction(a))
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(&f)
+}
+
+var planColumns = []string{
+	"type", "path", "old_path", "new_path", "reason",
+	"src_mtime", "src_size", "src_dir", "dst_mtime", "dst_size", "dst_dir",
+}
+
+func objectFields(o *gowpd.Object) []string {
+	if o == nil {
+		return []string{"", "", ""}
+	}
+	return []string{
+		strconv.FormatInt(o.ModTime, 10),
+		strconv.FormatInt(o.Size, 10),
+		strconv.FormatBool(o.IsDir),
+	}
+}
+
+// WriteCSV writes the actions of p as CSV with a header row, which ReadPlan
+// loads.
+func (p *Plan) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write(planColumns)
+	for _, a := range p.Actions {
+		row := []string{a.Type.String(), a.Path, a.OldPath, a.NewPath, a.Reason}
+		row = append(row, objectFields(a.Src)...)
+		row = append(row, objectFields(a.Dst)...)
+		cw.Write(row)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteTable writes the actions of p and their totals as a table to read.
+func (p *Plan) WriteTable(w io.Writer) error {
+	var buf bytes.Buffer
+	tw := tabwriter.NewWriter(&buf, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "ACTION\tPATH\tBYTES\tREASON\n")
+	for _, a := range p.Actions {
+		path := a.Path
+		switch {
+		case a.OldPath != "":
+			path = a.OldPath + " -> " + a.Path
+		case a.NewPath != "":
+			path += " (keep as " + a.NewPath + ")"
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\n", a.Type, path, a.size(), a.Reason)
+	}
+	// the totals are aligned on their own
+	fmt.Fprintln(tw)
+	totals := p.Totals()
+	for i := range actionNames {
+		t := ActionType(i)
+		if total, ok := totals[t]; ok {
+			fmt.Fprintf(tw, "%v\t%v actions\t%v bytes\n", t, total.Count, total.Bytes)
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	// empty reasons leave the padding of the bytes at the end of the lines
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	for _, line := range lines {
+		if _, err := fmt.Fprintln(w, strings.TrimRight(line, " ")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadPlan loads a plan written by WriteJSON or WriteCSV for the trees src
+// and dst, which are listed again with opts. A JSON plan written for other
+// trees is not loaded. Actions whose files changed since are not carried
+// out; their Err is ErrPlanChanged and ReadPlan returns the plan with an
+// error.
+func ReadPlan(r io.Reader, src, dst Tree, opts *Options) (*Plan, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	br := bufio.NewReader(r)
+	b, err := br.Peek(1)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid plan : %v", err)
+	}
+	var actions []*Action
+	if b[0] == '{' {
+		actions, err = readPlanJSON(br, src, dst)
+	} else {
+		actions, err = readPlanCSV(br)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Invalid plan : %v", err)
+	}
+	lists, err := opts.list(src, dst)
+	if err != nil {
+		return nil, err
+	}
+	srcList, dstList := lists[0], lists[1]
+	p := &Plan{Src: src, Dst: dst, SrcList: srcList, DstList: dstList, Actions: actions}
+	n := 0
+	for _, a := range actions {
+		if a.Type == ACTION_SKIP {
+			continue
+		}
+		dstPath := a.Path
+		if a.Type == ACTION_MOVE {
+			dstPath = a.OldPath
+		}
+		s, sok := unchanged(a.Src, srcList[a.Path])
+		d, dok := unchanged(a.Dst, dstList[dstPath])
+		a.Src, a.Dst = s, d
+		if !sok || !dok {
+			a.Err = ErrPlanChanged
+			n++
+		}
+	}
+	opts.quarantine(p)
+	if n > 0 {
+		return p, fmt.Errorf("Plan is out of date : %v of %v actions", n, len(actions))
+	}
+	return p, opts.checkDeletes(p)
+}
+
+// unchanged returns the listed object cur for the planned object planned
+// and whether it is the same, both missing or both folders.
+func unchanged(planned, cur *gowpd.Object) (*gowpd.Object, bool) {
+	if planned == nil || cur == nil {
+		return cur, planned == cur
+	}
+	if planned.IsDir || cur.IsDir {
+		return cur, planned.IsDir == cur.IsDir
+	}
+	return cur, planned.ObjectInfo == cur.ObjectInfo
+}
+
+// readPlanJSON reads the actions of a JSON plan for the trees src and dst.
+func readPlanJSON(r io.Reader, src, dst Tree) ([]*Action, error) {
+	var f planFile
+	if err := json.NewDecoder(r).Decode(&f); err != nil {
+		return nil, err
+	}
+	if f.Format != PLAN_FORMAT {
+		return nil, fmt.Errorf("format %q", f.Format)
+	}
+	if f.Version > PLAN_VERSION {
+		return nil, fmt.Errorf("unsupported version %v", f.Version)
+	}
+	if !sameTree(f.Src, src) || !sameTree(f.Dst, dst) {
+		return nil, fmt.Errorf("planned for %v -> %v", f.Src, f.Dst)
+	}
+	var actions []*Action
+	for _, pa := range f.Actions {
+		a, err := pa.action()
+		if err != nil {
+			return nil, err
+		}
+		actions = append(actions, a)
+	}
+	return actions, nil
+}
+
+func readPlanCSV(r io.Reader) ([]*Action, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = len(planColumns)
+	rows, err := cr.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 || rows[0][0] != planColumns[0] {
+		return nil, fmt.Errorf("no header")
+	}
+	var actions []*Action
+	for i, row := range rows[1:] {
+		t, err := ParseActionType(row[0])
+		if err != nil {
+			return nil, err
+		}
+		a := &Action{Type: t, Path: row[1], OldPath: row[2], NewPath: row[3], Reason: row[4]}
+		if a.Src, err = parseObject(row[5:8]); err == nil {
+			a.Dst, err = parseObject(row[8:11])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("row %v", i+2)
+		}
+		actions = append(actions, a)
+	}
+	return actions, nil
+}
+
+func parseObject(fields []string) (*gowpd.Object, error) {
+	if fields[0] == "" && fields[1] == "" && fields[2] == "" {
+		return nil, nil
+	}
+	mtime, err1 := strconv.ParseInt(fields[0], 10, 64)
+	size, err2 := strconv.ParseInt(fields[1], 10, 64)
+	dir, err3 := strconv.ParseBool(fields[2])
+	if err1 != nil || err2 != nil || err3 != nil {
+		return nil, fmt.Errorf("invalid object")
+	}
+	return (&planObject{mtime, size, dir}).object(), nil
+}
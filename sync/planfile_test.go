@@ -0,0 +1,201 @@
+package sync
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tobwithu/gowpd"
+)
+
+// planned describes the actions of p with the listed objects they expect.
+func planned(p *Plan) []string {
+	obj := func(o *gowpd.Object) string {
+		if o == nil {
+			return "-"
+		}
+		return fmt.Sprintf("%v/%v/%v", o.ModTime, o.Size, o.IsDir)
+	}
+	var s []string
+	for _, a := range p.Actions {
+		s = append(s, fmt.Sprintf("%v %v %v %v %v %v", a.Type, filepath.ToSlash(a.Path),
+			filepath.ToSlash(a.OldPath), a.Reason, obj(a.Src), obj(a.Dst)))
+	}
+	return s
+}
+
+// testPlan returns a mirror plan of testTrees with a move.
+func testPlan(t *testing.T) *Plan {
+	src, dst := testTrees(t)
+	put(t, src, "f.mp4", "video", 100)
+	put(t, dst, filepath.Join("y", "g.mp4"), "video", 100)
+	p, err := NewPlan(src, dst, &Options{Mode: MODE_MIRROR, DetectMoves: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestPlanRoundTrip(t *testing.T) {
+	for _, format := range []string{"json", "csv"} {
+		p := testPlan(t)
+		var buf bytes.Buffer
+		var err error
+		if format == "json" {
+			err = p.WriteJSON(&buf)
+		} else {
+			err = p.WriteCSV(&buf)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := ReadPlan(&buf, p.Src, p.Dst, nil)
+		if err != nil {
+			t.Fatalf("%v: %v", format, err)
+		}
+		if got, want := planned(loaded), planned(p); !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: loaded %q\nwant %q", format, got, want)
+		}
+		if err = Execute(loaded, nil); err != nil {
+			t.Fatal(err)
+		}
+		want := contents(t, p.Src)
+		delete(want, "c.txt")
+		want["c.txt"] = "c2"
+		if got := contents(t, p.Dst); !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: %v", format, got)
+		}
+	}
+}
+
+func TestPlanTotals(t *testing.T) {
+	p := testPlan(t)
+	totals := map[ActionType]Total{
+		ACTION_COPY:      {2, 2},
+		ACTION_OVERWRITE: {1, 2},
+		ACTION_SKIP:      {1, 1},
+		ACTION_MKDIR:     {1, 0},
+		ACTION_MOVE:      {1, 5},
+		ACTION_DELETE:    {3, 2},
+	}
+	if got := p.Totals(); !reflect.DeepEqual(got, totals) {
+		t.Errorf("%v", got)
+	}
+
+	var buf bytes.Buffer
+	if err := p.WriteJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		`"format": "gowpd-sync-plan"`,
+		`"delete": {` + "\n" + `      "count": 3,` + "\n" + `      "bytes": 2`,
+		`"reason": "destination is newer"`,
+	} {
+		if !strings.Contains(buf.String(), s) {
+			t.Errorf("json lacks %q:\n%v", s, buf.String())
+		}
+	}
+
+	buf.Reset()
+	if err := p.WriteTable(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{
+		"ACTION     PATH              BYTES  REASON",
+		"copy       a.txt             1",
+		"overwrite  b.txt             2",
+		"skip       c.txt             1      destination is newer",
+		"mkdir      dir               0",
+		"copy       dir/e.txt         1",
+		"move       y/g.mp4 -> f.mp4  5",
+		"delete     y/z.txt           1",
+		"delete     y                 0",
+		"delete     x.txt             1",
+		"",
+		"copy       2 actions  2 bytes",
+		"overwrite  1 actions  2 bytes",
+		"delete     3 actions  2 bytes",
+		"mkdir      1 actions  0 bytes",
+		"skip       1 actions  1 bytes",
+		"move       1 actions  5 bytes",
+		"",
+	}, "\n")
+	if got := filepath.ToSlash(buf.String()); got != want {
+		t.Errorf("table:\n%v", got)
+	}
+}
+
+func TestPlanChanged(t *testing.T) {
+	p := testPlan(t)
+	var buf bytes.Buffer
+	if err := p.WriteJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	// the source file changed and the destination got a file at a copy
+	put(t, p.Src, "b.txt", "b3", 300)
+	put(t, p.Dst, "a.txt", "mine", 100)
+	// files not in the plan are left alone
+	put(t, p.Src, "new.txt", "n", 100)
+
+	loaded, err := ReadPlan(&buf, p.Src, p.Dst, nil)
+	if err == nil {
+		t.Fatalf("changed trees accepted")
+	}
+	for _, a := range loaded.Actions {
+		changed := a.Path == "a.txt" || a.Path == "b.txt"
+		if (a.Err == ErrPlanChanged) != changed {
+			t.Errorf("%v: %v", a.Path, a.Err)
+		}
+	}
+	Execute(loaded, nil)
+	got := contents(t, p.Dst)
+	if got["a.txt"] != "mine" || got["b.txt"] != "b" || got["new.txt"] != "" || got[filepath.Join("dir", "e.txt")] != "e" {
+		t.Errorf("%v", got)
+	}
+}
+
+func TestReadPlanInvalid(t *testing.T) {
+	src, dst := testTrees(t)
+	for _, data := range []string{
+		"",
+		`{"format": "other", "version": 1}`,
+		`{"format": "gowpd-sync-plan", "version": 99}`,
+		`{"format": "gowpd-sync-plan", "version": 1, "actions": [{"type": "shred", "path": "a"}]}`,
+		"a,b\n",
+		strings.Join(planColumns, ",") + "\ncopy,a.txt,,,,x,1,false,,,\n",
+	} {
+		if _, err := ReadPlan(strings.NewReader(data), src, dst, nil); err == nil {
+			t.Errorf("loaded %q", data)
+		}
+	}
+}
+
+func TestReadPlanTrees(t *testing.T) {
+	src, dst := tempTree(t), tempTree(t)
+	defer os.RemoveAll(src.Root)
+	defer os.RemoveAll(dst.Root)
+	put(t, src, "a.txt", "a", 100)
+	p, err := NewPlan(src, dst, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err = p.WriteJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.String()
+	if _, err = ReadPlan(strings.NewReader(data), dst, src, nil); err == nil {
+		t.Errorf("loaded for swapped trees")
+	}
+	if _, err = ReadPlan(strings.NewReader(data), src, NewMemoryTree(), nil); err == nil {
+		t.Errorf("loaded for another destination")
+	}
+	same, _ := NewDirTree(src.Root + string(filepath.Separator))
+	if _, err = ReadPlan(strings.NewReader(data), same, dst, nil); err != nil {
+		t.Errorf("same trees: %v", err)
+	}
+}
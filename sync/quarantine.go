@@ -0,0 +1,155 @@
+package sync
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tobwithu/gowpd"
+)
+
+const (
+	DEFAULT_QUARANTINE_DIR = ".gowpd-quarantine"
+	// QUARANTINE_TIME_FORMAT names the folder of the files of a sync in the
+	// quarantine folder.
+	QUARANTINE_TIME_FORMAT = "2006-01-02_150405"
+)
+
+// Quarantine keeps the files a sync deletes in a folder of the destination,
+// in a folder named by the time of the plan with their paths below it.
+type Quarantine struct {
+	// Dir is the quarantine folder relative to the root of the destination.
+	// It is DEFAULT_QUARANTINE_DIR if empty, and is left out of the sync.
+	Dir string
+	// Retention is how long the files of a sync are kept. Older ones are
+	// deleted after a sync with the quarantine. Zero keeps them.
+	Retention time.Duration
+	// Now is the time of a plan. It is time.Now if nil.
+	Now func() time.Time
+}
+
+func (q *Quarantine) dir() string {
+	if q.Dir == "" {
+		return DEFAULT_QUARANTINE_DIR
+	}
+	return filepath.Clean(q.Dir)
+}
+
+func (q *Quarantine) now() time.Time {
+	if q.Now != nil {
+		return q.Now()
+	}
+	return time.Now()
+}
+
+// rule returns the rule leaving the quarantine folder out of listings.
+func (q *Quarantine) rule() *gowpd.Rules {
+	r, err := gowpd.NewRules("/" + filepath.ToSlash(q.dir()) + "/")
+	if err != nil {
+		return nil
+	}
+	return r
+}
+
+// quarantine sets where the file deletions of p move their files, unless
+// they have a path, like actions of a loaded plan.
+func (opts *Options) quarantine(p *Plan) {
+	q := opts.Quarantine
+	if q == nil {
+		return
+	}
+	p.Quarantine = q
+	dir := filepath.Join(q.dir(), q.now().Format(QUARANTINE_TIME_FORMAT))
+	for _, a := range p.Actions {
+		if a.Type == ACTION_DELETE && !a.Dst.IsDir && a.NewPath == "" {
+			a.NewPath = filepath.Join(dir, a.Path)
+		}
+	}
+}
+
+// checkDeletes returns an error if p deletes more files than opts allow.
+func (opts *Options) checkDeletes(p *Plan) error {
+	if opts.MaxDelete <= 0 && opts.MaxDeletePercent <= 0 {
+		return nil
+	}
+	n, total := 0, 0
+	for _, a := range p.Actions {
+		if a.Type == ACTION_DELETE && !a.Dst.IsDir {
+			n++
+		}
+	}
+	for _, o := range p.DstList {
+		if !o.IsDir {
+			total++
+		}
+	}
+	if opts.MaxDelete > 0 && n > opts.MaxDelete ||
+		opts.MaxDeletePercent > 0 && float64(n)*100 > opts.MaxDeletePercent*float64(total) {
+		return fmt.Errorf("Too many deletions : %v of %v files", n, total)
+	}
+	return nil
+}
+
+// mkdirAll makes the folder path of tree with the folders above it.
+func mkdirAll(tree Tree, path string) error {
+	dir := ""
+	for _, name := range strings.Split(path, string(filepath.Separator)) {
+		dir = filepath.Join(dir, name)
+		if err := tree.Mkdir(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// quarantineFile moves the file of the deletion a to a.NewPath of dst, or
+// copies and deletes it if dst cannot move it there.
+func quarantineFile(dst Tree, a *Action) error {
+	if err := mkdirAll(dst, filepath.Dir(a.NewPath)); err != nil {
+		return err
+	}
+	if canMove(dst, a.Path, a.NewPath) {
+		return dst.Move(a.Path, a.NewPath, a.Dst)
+	}
+	if err := copyVia(dst, a.Dst, dst, a.NewPath); err != nil {
+		return err
+	}
+	return dst.Delete(a.Path, a.Dst)
+}
+
+// Prune deletes the folders of syncs in the quarantine folder of tree which
+// are older than the retention.
+func (q *Quarantine) Prune(tree Tree) error {
+	if q.Retention <= 0 {
+		return nil
+	}
+	list, err := tree.ListFiles(false)
+	if err != nil {
+		return err
+	}
+	now := q.now()
+	dir := q.dir()
+	var expired []string
+	for _, k := range SortKey(list) {
+		rel, err := filepath.Rel(dir, k)
+		if err != nil || strings.HasPrefix(rel, "..") || rel == "." {
+			continue
+		}
+		name := strings.SplitN(rel, string(filepath.Separator), 2)[0]
+		t, err := time.ParseInLocation(QUARANTINE_TIME_FORMAT, name, now.Location())
+		if err == nil && now.Sub(t) > q.Retention {
+			expired = append(expired, k)
+		}
+	}
+	n := 0
+	for i := len(expired) - 1; i >= 0; i-- {
+		if err := tree.Delete(expired[i], list[expired[i]]); err != nil {
+			n++
+		}
+	}
+	if n > 0 {
+		return fmt.Errorf("Failed to prune %v of %v objects", n, len(expired))
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package sync
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tobwithu/gowpd"
+)
+
+func testQuarantine() *Quarantine {
+	now := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	return &Quarantine{Now: func() time.Time { return now }}
+}
+
+func TestQuarantine(t *testing.T) {
+	dir := tempTree(t)
+	defer os.RemoveAll(dir.Root)
+	b := gowpd.NewMemoryBackend()
+	b.Commands = nil
+	d := gowpd.NewDevice(b)
+	d.CreateFolder(gowpd.WPD_DEVICE_OBJECT_ID, "Storage")
+	noMove, _ := NewDeviceTree(d, "Storage")
+	for _, dst := range []Tree{NewMemoryTree(), dir, noMove} {
+		src := NewMemoryTree()
+		put(t, src, "a.txt", "a", 100)
+		put(t, dst, "a.txt", "a", 100)
+		put(t, dst, "x.txt", "x", 100)
+		put(t, dst, filepath.Join("y", "z.txt"), "z", 100)
+
+		opts := &Options{Mode: MODE_MIRROR, Quarantine: testQuarantine()}
+		p, err := NewPlan(src, dst, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := filepath.Join(DEFAULT_QUARANTINE_DIR, "2020-05-01_120000")
+		var moved []string
+		for _, a := range p.Actions {
+			moved = append(moved, a.NewPath)
+		}
+		if want := []string{filepath.Join(q, "y", "z.txt"), "", filepath.Join(q, "x.txt")}; !reflect.DeepEqual(moved, want) {
+			t.Errorf("%T: %q", dst, moved)
+		}
+		if err = Execute(p, nil); err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]string{
+			"a.txt":                        "a",
+			DEFAULT_QUARANTINE_DIR:         "/",
+			q:                              "/",
+			filepath.Join(q, "x.txt"):      "x",
+			filepath.Join(q, "y"):          "/",
+			filepath.Join(q, "y", "z.txt"): "z",
+		}
+		if got := contents(t, dst); !reflect.DeepEqual(got, want) {
+			t.Errorf("%T: %v", dst, got)
+		}
+		// the quarantine is not synced
+		if p, _ = NewPlan(src, dst, opts); len(p.Actions) != 0 {
+			t.Errorf("%T: after sync %q", dst, actions(p))
+		}
+	}
+}
+
+func TestQuarantinePlanFile(t *testing.T) {
+	src, dst := testTrees(t)
+	p, _ := NewPlan(src, dst, &Options{Mode: MODE_DELETE, Quarantine: testQuarantine()})
+	var buf bytes.Buffer
+	if err := p.WriteJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := ReadPlan(&buf, src, dst, &Options{Mode: MODE_DELETE})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := planned(loaded), planned(p); !reflect.DeepEqual(got, want) {
+		t.Errorf("loaded %q\nwant %q", got, want)
+	}
+	for i, a := range loaded.Actions {
+		if a.NewPath != p.Actions[i].NewPath {
+			t.Errorf("%v to %q", a.Path, a.NewPath)
+		}
+	}
+}
+
+func TestQuarantinePrune(t *testing.T) {
+	src, dst := NewMemoryTree(), NewMemoryTree()
+	put(t, dst, "x.txt", "x", 100)
+	old := filepath.Join(DEFAULT_QUARANTINE_DIR, "2020-04-29_115959")
+	recent := filepath.Join(DEFAULT_QUARANTINE_DIR, "2020-04-30_120000")
+	put(t, dst, filepath.Join(old, "d", "a.txt"), "a", 100)
+	put(t, dst, filepath.Join(recent, "b.txt"), "b", 100)
+	put(t, dst, filepath.Join(DEFAULT_QUARANTINE_DIR, "mine", "c.txt"), "c", 100)
+
+	q := testQuarantine()
+	q.Retention = 48 * time.Hour
+	p, _ := NewPlan(src, dst, &Options{Mode: MODE_MIRROR, Quarantine: q})
+	if got := actions(p); !reflect.DeepEqual(got, []string{"delete x.txt"}) {
+		t.Errorf("%q", got)
+	}
+	if err := Execute(p, nil); err != nil {
+		t.Fatal(err)
+	}
+	got := contents(t, dst)
+	if _, ok := got[old]; ok {
+		t.Errorf("old quarantine kept")
+	}
+	for _, k := range []string{filepath.Join(recent, "b.txt"), filepath.Join(DEFAULT_QUARANTINE_DIR, "mine", "c.txt"), filepath.Join(DEFAULT_QUARANTINE_DIR, "2020-05-01_120000", "x.txt")} {
+		if _, ok := got[k]; !ok {
+			t.Errorf("%v pruned", k)
+		}
+	}
+}
+
+func TestMaxDelete(t *testing.T) {
+	// the mirror plan deletes 2 of the 5 destination files
+	tests := []struct {
+		max     int
+		percent float64
+		ok      bool
+	}{
+		{0, 0, true},
+		{1, 0, false},
+		{2, 0, true},
+		{0, 30, false},
+		{0, 40, true},
+		{5, 30, false},
+	}
+	for _, tt := range tests {
+		src, dst := testTrees(t)
+		p, err := NewPlan(src, dst, &Options{Mode: MODE_MIRROR, MaxDelete: tt.max, MaxDeletePercent: tt.percent})
+		if (err == nil) != tt.ok || p == nil {
+			t.Errorf("max %v %v%%: %v", tt.max, tt.percent, err)
+		}
+	}
+
+	// moves are not deletions
+	src, dst := NewMemoryTree(), NewMemoryTree()
+	put(t, src, "b.txt", "b", 100)
+	put(t, dst, "a.txt", "b", 100)
+	if _, err := NewPlan(src, dst, &Options{Mode: MODE_MIRROR, DetectMoves: true, MaxDelete: 1, MaxDeletePercent: 10}); err != nil {
+		t.Error(err)
+	}
+
+	// a wrong mount point looks like every file was deleted on one side
+	a, b, base := synced(t, func(tree Tree) {
+		put(t, tree, "f.txt", "f", 100)
+		put(t, tree, "g.txt", "g", 100)
+	})
+	del(t, a, "f.txt")
+	del(t, a, "g.txt")
+	if _, err := NewTwoWayPlan(a, b, base, &Options{MaxDeletePercent: 50}); err == nil {
+		t.Errorf("two-way deletions accepted")
+	}
+	if got := contents(t, b); len(got) != 2 {
+		t.Errorf("%v", got)
+	}
+}
@@ -0,0 +1,307 @@
+package sync
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/tobwithu/gowpd"
+)
+
+const (
+	STATE_FORMAT  = "gowpd-sync-state"
+	STATE_VERSION = 1
+	// STATE_BACKUP_EXT is appended to the path of a state file for the
+	// previous version, which is loaded if the state file is damaged.
+	STATE_BACKUP_EXT = ".bak"
+)
+
+// StateHeader is the first line of a state file.
+type StateHeader struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+	// Saved is when the state was saved, in Unix time.
+	Saved int64 `json:"saved"`
+	// Src and Dst describe the synced trees.
+	Src string `json:"src,omitempty"`
+	Dst string `json:"dst,omitempty"`
+	// Entries is the number of entry lines, which tells a truncated file.
+	Entries int `json:"entries"`
+}
+
+// Entry is a file or folder of a state.
+type Entry struct {
+	// Side names the list of the entry, like "A" and "B" of a baseline, and
+	// is empty for a one-way list.
+	Side       string `json:"side,omitempty"`
+	Path       string `json:"path"`
+	ModTime    int64  `json:"mtime"`
+	Size       int64  `json:"size"`
+	ChildCount int    `json:"children"`
+	// Hash is a digest of the file data, if it was computed.
+	Hash string `json:"hash,omitempty"`
+	// Id is the object id of the file, which on a device stays the same
+	// while the file is renamed or moved.
+	Id string `json:"id,omitempty"`
+}
+
+func (e *Entry) Object() *gowpd.Object {
+	return &gowpd.Object{
+		ObjectInfo: gowpd.ObjectInfo{ModTime: e.ModTime, Size: e.Size, IsDir: e.ChildCount >= 0},
+		Id:         e.Id,
+		ChildCount: e.ChildCount,
+	}
+}
+
+// State is the sync state saved between syncs, a list of entries by path
+// for each side.
+type State struct {
+	Header StateHeader
+	Sides  map[string]map[string]*Entry
+	// Recovered is set by LoadState if the state file was damaged or missing
+	// and the backup was loaded instead.
+	Recovered bool
+}
+
+func NewState() *State {
+	return &State{
+		Header: StateHeader{Format: STATE_FORMAT, Version: STATE_VERSION},
+		Sides:  make(map[string]map[string]*Entry),
+	}
+}
+
+// Objects returns the entries of side as listed objects.
+func (s *State) Objects(side string) map[string]*gowpd.Object {
+	list := make(map[string]*gowpd.Object)
+	for k, e := range s.Sides[side] {
+		list[k] = e.Object()
+	}
+	return list
+}
+
+// SetObjects replaces the entries of side with list. Hashes of entries
+// which did not change are kept.
+func (s *State) SetObjects(side string, list map[string]*gowpd.Object) {
+	old := s.Sides[side]
+	entries := make(map[string]*Entry)
+	for k, o := range list {
+		e := &Entry{Side: side, Path: k, ModTime: o.ModTime, Size: o.Size, ChildCount: o.ChildCount, Id: o.Id}
+		if o.IsDir && e.ChildCount < 0 {
+			e.ChildCount = 0
+		} else if !o.IsDir {
+			e.ChildCount = -1
+		}
+		if p := old[k]; p != nil && !o.IsDir && p.ModTime == e.ModTime && p.Size == e.Size {
+			e.Hash = p.Hash
+		}
+		entries[k] = e
+	}
+	s.Sides[side] = entries
+}
+
+// LoadState reads the state file path. A missing file is an empty state,
+// as before the first sync. Lists of the legacy CSV format are migrated. If
+// the file is damaged, the backup of the previous save is loaded.
+func LoadState(path string) (*State, error) {
+	s, err := loadState(path)
+	if err == nil {
+		return s, nil
+	}
+	// the file is missing between the renames of Save
+	bs, berr := loadState(path + STATE_BACKUP_EXT)
+	switch {
+	case berr == nil:
+		bs.Recovered = true
+		return bs, nil
+	case os.IsNotExist(err) && os.IsNotExist(berr):
+		return NewState(), nil
+	case os.IsNotExist(err):
+		return nil, berr
+	}
+	return nil, err
+}
+
+func loadState(path string) (*State, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	b, err := r.Peek(1)
+	if err == io.EOF {
+		return nil, fmt.Errorf("Invalid state : %v (empty)", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if b[0] != '{' {
+		s, err := readLegacyState(r)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid state : %v (%v)", path, err)
+		}
+		return s, nil
+	}
+	s, err := readState(r)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid state : %v (%v)", path, err)
+	}
+	return s, nil
+}
+
+func readState(r *bufio.Reader) (*State, error) {
+	s := NewState()
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("no header")
+	}
+	if err = json.Unmarshal(line, &s.Header); err != nil {
+		return nil, err
+	}
+	if s.Header.Format != STATE_FORMAT {
+		return nil, fmt.Errorf("format %q", s.Header.Format)
+	}
+	if s.Header.Version > STATE_VERSION {
+		return nil, fmt.Errorf("unsupported version %v", s.Header.Version)
+	}
+	n := 0
+	for {
+		line, err = r.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			break
+		}
+		if err != nil {
+			// every line ends with a newline
+			return nil, fmt.Errorf("truncated at entry %v", n+1)
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		e := &Entry{}
+		if err = json.Unmarshal(line, e); err != nil {
+			return nil, fmt.Errorf("entry %v: %v", n+1, err)
+		}
+		s.add(e)
+		n++
+	}
+	if n != s.Header.Entries {
+		return nil, fmt.Errorf("%v of %v entries", n, s.Header.Entries)
+	}
+	return s, nil
+}
+
+func (s *State) add(e *Entry) {
+	side := s.Sides[e.Side]
+	if side == nil {
+		side = make(map[string]*Entry)
+		s.Sides[e.Side] = side
+	}
+	side[e.Path] = e
+}
+
+// readLegacyState reads the CSV lists of path, mtime, size and child count
+// and baselines with the side in front.
+func readLegacyState(r io.Reader) (*State, error) {
+	s := NewState()
+	s.Header.Version = 0
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	rows, err := cr.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	for i, row := range rows {
+		e := &Entry{}
+		switch len(row) {
+		case 4:
+		case 5:
+			e.Side, row = row[0], row[1:]
+		default:
+			return nil, fmt.Errorf("row %v has %v fields", i+1, len(row))
+		}
+		e.Path = row[0]
+		var err1, err2, err3 error
+		e.ModTime, err1 = strconv.ParseInt(row[1], 10, 64)
+		e.Size, err2 = strconv.ParseInt(row[2], 10, 64)
+		e.ChildCount, err3 = strconv.Atoi(row[3])
+		if err1 != nil || err2 != nil || err3 != nil {
+			return nil, fmt.Errorf("row %v", i+1)
+		}
+		s.add(e)
+	}
+	return s, nil
+}
+
+// Save writes the state to the file path. It is written to a temporary
+// file first and renamed over path, keeping the previous file as backup.
+func (s *State) Save(path string) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = s.write(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if _, err = os.Stat(path); err == nil {
+		if err = os.Rename(path, path+STATE_BACKUP_EXT); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *State) write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	h := s.Header
+	h.Format = STATE_FORMAT
+	h.Version = STATE_VERSION
+	h.Saved = time.Now().Unix()
+	h.Entries = 0
+	sides := make([]string, 0, len(s.Sides))
+	for side, entries := range s.Sides {
+		sides = append(sides, side)
+		h.Entries += len(entries)
+	}
+	sort.Strings(sides)
+	enc := json.NewEncoder(bw)
+	if err := enc.Encode(&h); err != nil {
+		return err
+	}
+	for _, side := range sides {
+		entries := s.Sides[side]
+		keys := make([]string, 0, len(entries))
+		for k := range entries {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			e := *entries[k]
+			e.Side, e.Path = side, k
+			if err := enc.Encode(&e); err != nil {
+				return err
+			}
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	s.Header = h
+	return nil
+}
@@ -0,0 +1,181 @@
+package sync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tobwithu/gowpd"
+)
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "gowpd-sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func testState(size int64) *State {
+	s := NewState()
+	s.Header.Src = "MTP0:\\DCIM"
+	s.SetObjects("", map[string]*gowpd.Object{
+		"a.txt": {ObjectInfo: gowpd.ObjectInfo{ModTime: 100, Size: size}, Id: "o1", ChildCount: -1},
+		"d":     {ObjectInfo: gowpd.ObjectInfo{ModTime: 50, IsDir: true}, Id: "o2", ChildCount: 1},
+	})
+	s.Sides[""]["a.txt"].Hash = "sha256:abcd"
+	return s
+}
+
+func TestStateSaveLoad(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state")
+
+	s := testState(3)
+	if err := s.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	got, err := LoadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Recovered || got.Header.Version != STATE_VERSION || got.Header.Entries != 2 || got.Header.Src != s.Header.Src {
+		t.Errorf("header %+v", got.Header)
+	}
+	if !reflect.DeepEqual(got.Sides, s.Sides) {
+		t.Errorf("entries %v", got.Sides[""])
+	}
+	if o := got.Objects("")["a.txt"]; o.Id != "o1" || o.IsDir || o.Size != 3 {
+		t.Errorf("object %+v", o)
+	}
+	if _, err = os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left")
+	}
+
+	// hashes of unchanged files are kept
+	list := got.Objects("")
+	list["b.txt"] = &gowpd.Object{ObjectInfo: gowpd.ObjectInfo{ModTime: 100, Size: 1}, ChildCount: -1}
+	got.SetObjects("", list)
+	if got.Sides[""]["a.txt"].Hash != "sha256:abcd" {
+		t.Errorf("hash dropped")
+	}
+	list["a.txt"].Size = 4
+	got.SetObjects("", list)
+	if got.Sides[""]["a.txt"].Hash != "" {
+		t.Errorf("hash of changed file kept")
+	}
+
+	s, err = LoadState(filepath.Join(dir, "missing"))
+	if err != nil || len(s.Sides) != 0 {
+		t.Errorf("missing state = %v %v", s, err)
+	}
+}
+
+func TestStateMigrate(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, ".kfilesync")
+	legacy := "a.txt,100,3,-1\nd,50,0,1\n\"d\\x, y.txt\",60,2,-1\n"
+	if err := ioutil.WriteFile(path, []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := LoadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Header.Version != 0 || len(s.Sides[""]) != 3 {
+		t.Fatalf("migrated %+v %v", s.Header, s.Sides)
+	}
+	want := map[string]*gowpd.Object{
+		"a.txt":       {ObjectInfo: gowpd.ObjectInfo{ModTime: 100, Size: 3}, ChildCount: -1},
+		"d":           {ObjectInfo: gowpd.ObjectInfo{ModTime: 50, IsDir: true}, ChildCount: 1},
+		"d\\x, y.txt": {ObjectInfo: gowpd.ObjectInfo{ModTime: 60, Size: 2}, ChildCount: -1},
+	}
+	if got := s.Objects(""); !reflect.DeepEqual(got, want) {
+		t.Errorf("objects %v", got)
+	}
+	if err = s.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadFile(path)
+	if !strings.HasPrefix(string(data), `{"format":"gowpd-sync-state","version":1,`) {
+		t.Errorf("saved %q", data)
+	}
+	s, err = LoadState(path)
+	if err != nil || !reflect.DeepEqual(s.Objects(""), want) {
+		t.Errorf("reloaded %v %v", s, err)
+	}
+
+	// baselines with the side in front
+	ioutil.WriteFile(path, []byte("A,a.txt,100,3,-1\nB,a.txt,200,3,-1\n"), 0644)
+	b, err := LoadBaseline(path)
+	if err != nil || b.A["a.txt"].ModTime != 100 || b.B["a.txt"].ModTime != 200 {
+		t.Errorf("baseline %v %v", b, err)
+	}
+
+	ioutil.WriteFile(path, []byte("a.txt,x,3,-1\n"), 0644)
+	os.Remove(path + STATE_BACKUP_EXT)
+	if _, err = LoadState(path); err == nil {
+		t.Errorf("invalid list loaded")
+	}
+}
+
+func TestStateRecover(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state")
+	old, cur := testState(3), testState(4)
+	if err := old.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := cur.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"empty", ""},
+		{"header only", lines[0]},
+		{"entry missing", lines[0] + lines[1]},
+		{"truncated line", lines[0] + lines[1] + lines[2][:10]},
+		{"garbage", lines[0] + "garbage\n" + lines[2]},
+		{"bad header", "{}\n" + lines[1] + lines[2]},
+		{"newer version", strings.Replace(lines[0], `"version":1`, `"version":99`, 1) + lines[1] + lines[2]},
+	}
+	for _, tt := range tests {
+		ioutil.WriteFile(path, []byte(tt.data), 0644)
+		s, err := LoadState(path)
+		if err != nil {
+			t.Errorf("%v: %v", tt.name, err)
+			continue
+		}
+		if !s.Recovered || s.Sides[""]["a.txt"].Size != 3 {
+			t.Errorf("%v: backup not loaded", tt.name)
+		}
+	}
+
+	// a crash between the renames of Save leaves only the backup
+	os.Remove(path)
+	s, err := LoadState(path)
+	if err != nil || !s.Recovered || s.Sides[""]["a.txt"].Size != 3 {
+		t.Errorf("missing state = %v %v", s, err)
+	}
+
+	ioutil.WriteFile(path, []byte("garbage\n"), 0644)
+	ioutil.WriteFile(path+STATE_BACKUP_EXT, []byte("garbage\n"), 0644)
+	if _, err = LoadState(path); err == nil {
+		t.Errorf("damaged state and backup loaded")
+	}
+}
@@ -0,0 +1,344 @@
+// Package sync compares two folder trees and copies the differences, on
+// local folders, MTP devices or memory.
+package sync
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	gosync "sync"
+
+	"github.com/tobwithu/gowpd"
+)
+
+const SYSTEM_VOLUME_INFO = gowpd.SYSTEM_VOLUME_INFO
+
+var defaultRules = gowpd.DefaultRules()
+
+// Tree is a folder tree which files are listed by their path relative to the
+// root.
+type Tree interface {
+	// ListFiles returns the files and folders below the root by path, except
+	// those excluded by the rules of the tree. ChildCount of a folder is the
+	// number of its listed children and -1 for a file. Empty folders and
+	// zero-byte files are left out as by Clean if clean is set.
+	ListFiles(clean bool) (map[string]*gowpd.Object, error)
+	// Open returns the data of the listed file obj.
+	Open(obj *gowpd.Object) (io.ReadCloser, error)
+	// Write creates or replaces the file path with the data of src. The size
+	// and modification time are taken from obj.
+	Write(path string, obj *gowpd.Object, src io.Reader) error
+	Mkdir(path string) error
+	// Move renames or moves the listed file obj from the path from to to,
+	// whose folder exists.
+	Move(from, to string, obj *gowpd.Object) error
+	// Delete removes the listed file or empty folder obj at path.
+	Delete(path string, obj *gowpd.Object) error
+}
+
+// DirTree is a folder of the local file system.
+type DirTree struct {
+	Root string
+	// Rules leaves files out of listings. It is gowpd.DefaultRules if nil.
+	Rules *gowpd.Rules
+}
+
+// NewDirTree returns the tree of the folder root.
+func NewDirTree(root string) (*DirTree, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, fmt.Errorf("Folder not found : %v", root)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("Not a folder : %v", root)
+	}
+	return &DirTree{Root: root}, nil
+}
+
+func (t *DirTree) path(path string) string {
+	return filepath.Join(t.Root, path)
+}
+
+// rulesOf returns r or the default rules if it is nil.
+func rulesOf(r *gowpd.Rules) *gowpd.Rules {
+	if r == nil {
+		return defaultRules
+	}
+	return r
+}
+
+// listFiles adds the objects below the folder path to list. ChildCount is
+// set by Clean.
+func listFiles(path string, curPath string, rules *gowpd.Rules, list map[string]*gowpd.Object) error {
+	infos, err := ioutil.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		o := gowpd.ObjectFromFileInfo(filepath.Join(path, info.Name()), info)
+		rel := filepath.Join(curPath, info.Name())
+		if rules.Match(rel, o) {
+			continue
+		}
+		list[rel] = o
+		if o.IsDir {
+			if err = listFiles(o.Id, rel, rules, list); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Clean removes the zero-byte files of list if files is set, and the
+// folders which are empty then if dirs is set, and counts the children of
+// the folders left again.
+func Clean(list map[string]*gowpd.Object, dirs, files bool) {
+	if files {
+		for k, o := range list {
+			if !o.IsDir && o.Size == 0 {
+				delete(list, k)
+			}
+		}
+	}
+	countChildren(list)
+	if !dirs {
+		return
+	}
+	keys := SortKey(list)
+	for i := len(keys) - 1; i >= 0; i-- {
+		k := keys[i]
+		if o := list[k]; o.IsDir && o.ChildCount == 0 {
+			delete(list, k)
+			if dir := list[filepath.Dir(k)]; dir != nil {
+				dir.ChildCount--
+			}
+		}
+	}
+}
+
+// countChildren sets ChildCount of the folders of list to the number of
+// their listed children.
+func countChildren(list map[string]*gowpd.Object) {
+	for _, o := range list {
+		if o.IsDir {
+			o.ChildCount = 0
+		} else {
+			o.ChildCount = -1
+		}
+	}
+	for k := range list {
+		if dir := list[filepath.Dir(k)]; dir != nil {
+			dir.ChildCount++
+		}
+	}
+}
+
+func (t *DirTree) ListFiles(clean bool) (map[string]*gowpd.Object, error) {
+	list := make(map[string]*gowpd.Object)
+	err := listFiles(t.Root, "", rulesOf(t.Rules), list)
+	Clean(list, clean, clean)
+	return list, err
+}
+
+func (t *DirTree) Open(obj *gowpd.Object) (io.ReadCloser, error) {
+	return os.Open(obj.Id)
+}
+
+// Write writes the file under a temporary name and renames it once it is
+// complete, so an old file is only replaced by a whole new one.
+func (t *DirTree) Write(path string, obj *gowpd.Object, src io.Reader) error {
+	return writeFile(t.path(path), func(tmp string) error {
+		f, err := os.Create(tmp)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, src)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		return gowpd.SetFileTime(tmp, obj.ModTime)
+	})
+}
+
+// tempPath returns the name the file filename is written under until it is
+// complete, the name of the temporary objects of gowpd.WithAtomic.
+func tempPath(filename string) string {
+	return filepath.Join(filepath.Dir(filename), gowpd.ATOMIC_TEMP_PREFIX+filepath.Base(filename)+gowpd.ATOMIC_TEMP_SUFFIX)
+}
+
+// writeFile writes the file filename by write to tempPath(filename) and
+// renames it once write succeeds. The temporary file is removed otherwise.
+func writeFile(filename string, write func(tmp string) error) error {
+	tmp := tempPath(filename)
+	if err := write(tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+func (t *DirTree) Mkdir(path string) error {
+	return os.MkdirAll(t.path(path), os.ModePerm)
+}
+
+func (t *DirTree) Move(from, to string, obj *gowpd.Object) error {
+	return os.Rename(t.path(from), t.path(to))
+}
+
+func (t *DirTree) Delete(path string, obj *gowpd.Object) error {
+	return os.Remove(t.path(path))
+}
+
+// DeviceTree is a folder of a device.
+type DeviceTree struct {
+	Device *gowpd.Device
+	Root   string
+	// Rules leaves objects out of listings. It is gowpd.DefaultRules if nil.
+	Rules *gowpd.Rules
+
+	mu  gosync.Mutex
+	ids map[string]string
+}
+
+// NewDeviceTree returns the tree of the folder root of d.
+func NewDeviceTree(d *gowpd.Device, root string) (*DeviceTree, error) {
+	o := d.FindObject(root)
+	if o == nil {
+		return nil, fmt.Errorf("Folder not found : %v", root)
+	}
+	if !o.IsDir {
+		return nil, fmt.Errorf("Not a folder : %v", root)
+	}
+	return &DeviceTree{Device: d, Root: root, ids: map[string]string{"": o.Id}}, nil
+}
+
+// NewMemoryTree returns the tree of an empty folder of a memory device.
+func NewMemoryTree() *DeviceTree {
+	d := gowpd.NewMemoryDevice()
+	id, _ := d.CreateFolder(gowpd.WPD_DEVICE_OBJECT_ID, "Storage")
+	return &DeviceTree{Device: d, Root: "Storage", ids: map[string]string{"": id}}
+}
+
+// folderId returns the object id of the folder path, which must have been
+// listed or made by the tree.
+func (t *DeviceTree) folderId(path string) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if path == "." {
+		path = ""
+	}
+	id, ok := t.ids[path]
+	if !ok {
+		return "", fmt.Errorf("Folder not found : %v", filepath.Join(t.Root, path))
+	}
+	return id, nil
+}
+
+func (t *DeviceTree) setFolderId(path string, id string) {
+	t.mu.Lock()
+	t.ids[path] = id
+	t.mu.Unlock()
+}
+
+func (t *DeviceTree) listFiles(id string, curPath string, rules *gowpd.Rules, list map[string]*gowpd.Object) error {
+	objs, err := t.Device.GetChildObjects(id)
+	if err != nil {
+		return err
+	}
+	for _, o := range objs {
+		if o == nil {
+			continue
+		}
+		rel := filepath.Join(curPath, o.Name)
+		if rules.Match(rel, o) {
+			continue
+		}
+		list[rel] = o
+		if o.IsDir {
+			t.setFolderId(rel, o.Id)
+			if err = t.listFiles(o.Id, rel, rules, list); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (t *DeviceTree) ListFiles(clean bool) (map[string]*gowpd.Object, error) {
+	id, err := t.folderId("")
+	if err != nil {
+		return nil, err
+	}
+	list := make(map[string]*gowpd.Object)
+	err = t.listFiles(id, "", rulesOf(t.Rules), list)
+	Clean(list, clean, clean)
+	return list, err
+}
+
+func (t *DeviceTree) Open(obj *gowpd.Object) (io.ReadCloser, error) {
+	return t.Device.GetReader(obj.Id)
+}
+
+// Write uploads src with gowpd.WithAtomic, so an old file is only replaced
+// once the new one is complete.
+func (t *DeviceTree) Write(path string, obj *gowpd.Object, src io.Reader) error {
+	parentId, err := t.folderId(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	named := *obj
+	named.Name = filepath.Base(path)
+	_, err = t.Device.CopyObjectToDevice(parentId, src, &named, gowpd.WithAtomic())
+	return err
+}
+
+func (t *DeviceTree) Mkdir(path string) error {
+	if _, err := t.folderId(path); err == nil {
+		return nil
+	}
+	parentId, err := t.folderId(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	id, err := t.Device.CreateFolder(parentId, filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	t.setFolderId(path, id)
+	return nil
+}
+
+// Move moves obj on the device, which keeps its object id, and renames it.
+func (t *DeviceTree) Move(from, to string, obj *gowpd.Object) error {
+	if dir := filepath.Dir(to); filepath.Dir(from) != dir {
+		parentId, err := t.folderId(dir)
+		if err != nil {
+			return err
+		}
+		if err = t.Device.Move(parentId, obj.Id); err != nil {
+			return err
+		}
+	}
+	if name := filepath.Base(to); filepath.Base(from) != name {
+		return t.Device.Rename(obj.Id, name)
+	}
+	return nil
+}
+
+func (t *DeviceTree) Delete(path string, obj *gowpd.Object) error {
+	if err := t.Device.Delete(obj.Id); err != nil {
+		return err
+	}
+	if obj.IsDir {
+		t.mu.Lock()
+		delete(t.ids, path)
+		t.mu.Unlock()
+	}
+	return nil
+}
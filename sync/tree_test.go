@@ -0,0 +1,256 @@
+package sync
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tobwithu/gowpd"
+)
+
+// put writes the file path of tree with its folders.
+func put(t *testing.T, tree Tree, path string, data string, mtime int64) {
+	t.Helper()
+	dir := ""
+	for _, name := range strings.Split(filepath.Dir(path), string(filepath.Separator)) {
+		if name == "." {
+			break
+		}
+		dir = filepath.Join(dir, name)
+		if err := tree.Mkdir(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	obj := &gowpd.Object{Name: filepath.Base(path), ObjectInfo: gowpd.ObjectInfo{Size: int64(len(data)), ModTime: mtime}}
+	if err := tree.Write(path, obj, strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// contents returns the data of the files of tree by path, and "/" for
+// folders.
+func contents(t *testing.T, tree Tree) map[string]string {
+	t.Helper()
+	list, err := tree.ListFiles(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := make(map[string]string)
+	for k, o := range list {
+		if o.IsDir {
+			m[k] = "/"
+			continue
+		}
+		r, err := tree.Open(o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		m[k] = string(data)
+	}
+	return m
+}
+
+// tempTree returns the tree of a new temporary folder, which the caller
+// removes.
+func tempTree(t *testing.T) *DirTree {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "gowpd-sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := NewDirTree(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+func TestListFiles(t *testing.T) {
+	dir := tempTree(t)
+	defer os.RemoveAll(dir.Root)
+	for _, tree := range []Tree{dir, NewMemoryTree()} {
+		put(t, tree, "a.txt", "a", 100)
+		put(t, tree, "empty.txt", "", 100)
+		put(t, tree, filepath.Join("dir", "b.txt"), "b", 100)
+		put(t, tree, filepath.Join(SYSTEM_VOLUME_INFO, "c.txt"), "c", 100)
+		if err := tree.Mkdir(filepath.Join("dir", "sub")); err != nil {
+			t.Fatal(err)
+		}
+
+		list, err := tree.ListFiles(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list) != 5 || list["dir"].ChildCount != 2 || list["a.txt"].ChildCount != -1 || list["a.txt"].ModTime != 100 {
+			t.Errorf("%T: %v", tree, SortKey(list))
+		}
+		list, _ = tree.ListFiles(true)
+		if len(list) != 3 || list["dir"].ChildCount != 1 {
+			t.Errorf("%T clean: %v", tree, SortKey(list))
+		}
+	}
+}
+
+func TestNewTree(t *testing.T) {
+	dir := tempTree(t)
+	defer os.RemoveAll(dir.Root)
+	put(t, dir, "a.txt", "a", 100)
+	if _, err := NewDirTree(filepath.Join(dir.Root, "a.txt")); err == nil {
+		t.Errorf("file: expected error")
+	}
+	if _, err := NewDirTree(filepath.Join(dir.Root, "missing")); err == nil {
+		t.Errorf("missing: expected error")
+	}
+
+	d := gowpd.NewMemoryDevice()
+	root, _ := d.CreateFolder(gowpd.WPD_DEVICE_OBJECT_ID, "Storage")
+	d.CreateFolder(root, "DCIM")
+	tree, err := NewDeviceTree(d, filepath.Join("Storage", "DCIM"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	put(t, tree, filepath.Join("Camera", "a.jpg"), "a", 100)
+	if o := d.FindObject(filepath.Join("Storage", "DCIM", "Camera", "a.jpg")); o == nil || o.Size != 1 {
+		t.Errorf("a.jpg = %v", o)
+	}
+	if _, err := NewDeviceTree(d, filepath.Join("Storage", "Music")); err == nil {
+		t.Errorf("missing: expected error")
+	}
+}
+
+func TestDeviceTreeUnreadable(t *testing.T) {
+	tree, b := deviceTree(t)
+	put(t, tree, "a.txt", "a", 100)
+	put(t, tree, "b.txt", "b", 100)
+	a := tree.Device.FindObject(filepath.Join("Storage", "a.txt"))
+	b.Fault = func(op string, ids []string) error {
+		if op == "GetValues" && ids[0] == a.Id {
+			return gowpd.HResult(gowpd.E_ACCESSDENIED)
+		}
+		return nil
+	}
+	if _, err := tree.ListFiles(false); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestTreeRules(t *testing.T) {
+	dir := tempTree(t)
+	defer os.RemoveAll(dir.Root)
+	for _, tree := range []Tree{dir, NewMemoryTree()} {
+		put(t, tree, "a.jpg", "a", 100)
+		put(t, tree, "b.mp4", "b", 100)
+		put(t, tree, filepath.Join(SYSTEM_VOLUME_INFO, "c.jpg"), "c", 100)
+		rules, _ := gowpd.NewRules("type:video")
+		switch tt := tree.(type) {
+		case *DirTree:
+			tt.Rules = rules
+		case *DeviceTree:
+			tt.Rules = rules
+		}
+		// the rules replace the default ones
+		list, err := tree.ListFiles(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{SYSTEM_VOLUME_INFO, filepath.Join(SYSTEM_VOLUME_INFO, "c.jpg"), "a.jpg"}
+		if got := SortKey(list); !reflect.DeepEqual(got, want) {
+			t.Errorf("%T: %v", tree, got)
+		}
+	}
+}
+
+// listed describes list as paths with the child counts of folders.
+func listed(list map[string]*gowpd.Object) []string {
+	var s []string
+	for _, k := range SortKey(list) {
+		d := filepath.ToSlash(k)
+		if o := list[k]; o.IsDir {
+			d += fmt.Sprintf("/%v", o.ChildCount)
+		}
+		s = append(s, d)
+	}
+	return s
+}
+
+func TestClean(t *testing.T) {
+	dir := tempTree(t)
+	defer os.RemoveAll(dir.Root)
+	for _, tree := range []Tree{dir, NewMemoryTree()} {
+		put(t, tree, "a.txt", "a", 100)
+		put(t, tree, filepath.Join("d", ".nomedia"), "", 100)
+		put(t, tree, filepath.Join("d", "b.txt"), "b", 100)
+		put(t, tree, filepath.Join("f", "z.txt"), "", 100)
+		for _, name := range []string{"e", "g", filepath.Join("g", "h")} {
+			if err := tree.Mkdir(name); err != nil {
+				t.Fatal(err)
+			}
+		}
+		tests := []struct {
+			dirs, files bool
+			rules       []string
+			want        []string
+		}{
+			{false, false, nil, []string{"a.txt", "d/2", "d/.nomedia", "d/b.txt", "e/0", "f/1", "f/z.txt", "g/1", "g/h/0"}},
+			{false, true, nil, []string{"a.txt", "d/1", "d/b.txt", "e/0", "f/0", "g/1", "g/h/0"}},
+			{true, false, nil, []string{"a.txt", "d/2", "d/.nomedia", "d/b.txt", "f/1", "f/z.txt"}},
+			{true, true, nil, []string{"a.txt", "d/1", "d/b.txt"}},
+			// counted after the rules leave files out
+			{true, false, []string{"*.txt"}, []string{"d/1", "d/.nomedia"}},
+			{false, false, []string{"*.txt"}, []string{"d/1", "d/.nomedia", "e/0", "f/0", "g/1", "g/h/0"}},
+		}
+		for _, tt := range tests {
+			rules, _ := gowpd.NewRules(tt.rules...)
+			lists, err := (&Options{SkipEmptyDirs: tt.dirs, SkipEmptyFiles: tt.files, Rules: rules}).list(tree)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := listed(lists[0]); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%T dirs %v files %v rules %q: %q", tree, tt.dirs, tt.files, tt.rules, got)
+			}
+		}
+		list, _ := tree.ListFiles(true)
+		if got, want := listed(list), []string{"a.txt", "d/1", "d/b.txt"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%T clean: %q", tree, got)
+		}
+	}
+}
+
+func TestPlanEmptyFiles(t *testing.T) {
+	dir := tempTree(t)
+	defer os.RemoveAll(dir.Root)
+	for _, dst := range []Tree{dir, NewMemoryTree()} {
+		src := NewMemoryTree()
+		put(t, src, filepath.Join("Music", ".nomedia"), "", 100)
+		put(t, src, filepath.Join("Music", "a.mp3"), "a", 100)
+		if err := src.Mkdir("Empty"); err != nil {
+			t.Fatal(err)
+		}
+		opts := &Options{SkipEmptyDirs: true}
+		p, err := NewPlan(src, dst, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := actions(p), []string{"mkdir Music", "copy Music/.nomedia", "copy Music/a.mp3"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%T: %q", dst, got)
+		}
+		if err = Execute(p, nil); err != nil {
+			t.Fatal(err)
+		}
+		if got, ok := contents(t, dst)[filepath.Join("Music", ".nomedia")]; !ok || got != "" {
+			t.Errorf("%T: .nomedia %q", dst, got)
+		}
+		if p, _ = NewPlan(src, dst, opts); len(p.Actions) != 0 {
+			t.Errorf("%T: after sync %q", dst, actions(p))
+		}
+	}
+}
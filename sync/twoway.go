@@ -0,0 +1,468 @@
+package sync
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tobwithu/gowpd"
+)
+
+// Change is how a file of a tree differs from the baseline.
+type Change int
+
+const (
+	CHANGE_NONE Change = iota
+	CHANGE_NEW
+	CHANGE_MODIFIED
+	CHANGE_DELETED
+)
+
+// changeOf compares the listed object cur with base by tp. Folders only
+// change by being made, deleted or turned into files.
+func changeOf(tp TimePolicy, cur, base *gowpd.Object) Change {
+	switch {
+	case cur == nil && base == nil:
+		return CHANGE_NONE
+	case base == nil:
+		return CHANGE_NEW
+	case cur == nil:
+		return CHANGE_DELETED
+	case cur.IsDir != base.IsDir:
+		return CHANGE_MODIFIED
+	case tp.Compare(cur, base) != 0:
+		return CHANGE_MODIFIED
+	}
+	return CHANGE_NONE
+}
+
+// changeOf is changeOf with the digests of h, which tell a file whose
+// modification time changed without its data.
+func (p *TwoWayPlan) changeOf(h *hasher, k string, cur, base *gowpd.Object) Change {
+	c := changeOf(p.opts.Time, cur, base)
+	if c != CHANGE_MODIFIED || h == nil || cur.IsDir || base.IsDir || cur.Size != base.Size {
+		return c
+	}
+	if s := h.cached(k, base); s != "" && s == h.hash(k, cur) {
+		return CHANGE_NONE
+	}
+	return c
+}
+
+// sameFile reports whether a and b are both missing, both folders, or files
+// which are the same by tp.
+func sameFile(tp TimePolicy, a, b *gowpd.Object) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return tp.Compare(a, b) == 0
+}
+
+// ConflictPolicy is how a two-way sync resolves a file changed on both
+// trees.
+type ConflictPolicy int
+
+const (
+	// CONFLICT_ABORT syncs nothing if there is a conflict.
+	CONFLICT_ABORT ConflictPolicy = iota
+	// CONFLICT_NEWEST keeps the file modified last. A modified file wins
+	// over its deletion.
+	CONFLICT_NEWEST
+	// CONFLICT_KEEP_BOTH keeps the newest file and saves the other one with
+	// the conflict suffix on both trees.
+	CONFLICT_KEEP_BOTH
+	CONFLICT_PREFER_A
+	CONFLICT_PREFER_B
+)
+
+const DEFAULT_CONFLICT_SUFFIX = " (conflict)"
+
+type Side int
+
+const (
+	SIDE_NONE Side = iota
+	SIDE_A
+	SIDE_B
+)
+
+// Conflict is a path changed on both trees.
+type Conflict struct {
+	Path string
+	// A and B are the listed objects, nil if deleted.
+	A *gowpd.Object
+	B *gowpd.Object
+	// Winner is the side kept at Path, or SIDE_NONE if the conflict is not
+	// resolved, like a file which became a folder on one side.
+	Winner Side
+	// KeptAs is where CONFLICT_KEEP_BOTH saves the other file.
+	KeptAs string
+}
+
+// TwoWayPlan is the list of actions bringing the changes of each tree since
+// the baseline to the other one.
+type TwoWayPlan struct {
+	A     Tree
+	B     Tree
+	AList map[string]*gowpd.Object
+	BList map[string]*gowpd.Object
+	// Base is the baseline of the plan, and once the plan is executed the
+	// baseline of the next sync.
+	Base *Baseline
+	// AtoB changes B and BtoA changes A.
+	AtoB      *Plan
+	BtoA      *Plan
+	Conflicts []*Conflict
+
+	opts  *Options
+	taken map[string]bool
+	ha    *hasher
+	hb    *hasher
+}
+
+// NewTwoWayPlan lists a and b and compares them with base, which is nil for
+// the first sync. With CONFLICT_ABORT, conflicts return the plan with an
+// error.
+func NewTwoWayPlan(a, b Tree, base *Baseline, opts *Options) (*TwoWayPlan, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	if base == nil {
+		base = NewBaseline()
+	}
+	lists, err := opts.list(a, b)
+	if err != nil {
+		return nil, err
+	}
+	aList, bList := lists[0], lists[1]
+	p := &TwoWayPlan{
+		A:     a,
+		B:     b,
+		AList: aList,
+		BList: bList,
+		Base:  base,
+		AtoB:  &Plan{Src: a, Dst: b, SrcList: aList, DstList: bList},
+		BtoA:  &Plan{Src: b, Dst: a, SrcList: bList, DstList: aList},
+		opts:  opts,
+		taken: make(map[string]bool),
+		ha:    newHasher(a, opts, "A"),
+		hb:    newHasher(b, opts, "B"),
+	}
+	paths := make(map[string]*gowpd.Object)
+	for _, list := range []map[string]*gowpd.Object{aList, bList, base.A, base.B} {
+		for k, o := range list {
+			paths[k] = o
+			p.taken[k] = true
+		}
+	}
+	for _, k := range SortKey(paths) {
+		p.plan(k)
+	}
+	p.keepFolders()
+	sortActions(p.AtoB)
+	sortActions(p.BtoA)
+	if opts.DetectMoves {
+		detectMoves(p.AtoB, p.ha, p.hb)
+		detectMoves(p.BtoA, p.hb, p.ha)
+	}
+	for _, plan := range []*Plan{p.AtoB, p.BtoA} {
+		opts.quarantine(plan)
+		if err = opts.checkDeletes(plan); err != nil {
+			return p, err
+		}
+	}
+	if err = p.unresolved(); err != nil && opts.Conflict == CONFLICT_ABORT {
+		return p, err
+	}
+	return p, nil
+}
+
+func (p *TwoWayPlan) plan(k string) {
+	a, b := p.AList[k], p.BList[k]
+	ca := p.changeOf(p.ha, k, a, p.Base.A[k])
+	cb := p.changeOf(p.hb, k, b, p.Base.B[k])
+	switch {
+	case ca == CHANGE_NONE && cb == CHANGE_NONE:
+		// in sync, unless the baseline lacks a side
+		if a != nil && b == nil {
+			p.apply(SIDE_A, k)
+		} else if a == nil && b != nil {
+			p.apply(SIDE_B, k)
+		}
+	case cb == CHANGE_NONE:
+		p.apply(SIDE_A, k)
+	case ca == CHANGE_NONE:
+		p.apply(SIDE_B, k)
+	case sameFile(p.opts.Time, a, b) || sameData(p.ha, k, a, p.hb, k, b):
+		// the same change on both sides
+	default:
+		p.resolve(k)
+	}
+}
+
+// apply brings the path k of side to the other tree.
+func (p *TwoWayPlan) apply(side Side, k string) {
+	plan := p.toward(side)
+	s, d := plan.SrcList[k], plan.DstList[k]
+	add := func(t ActionType) {
+		plan.Actions = append(plan.Actions, &Action{Type: t, Path: k, Src: s, Dst: d})
+	}
+	switch {
+	case s != nil && d != nil && s.IsDir != d.IsDir:
+		p.Conflicts = append(p.Conflicts, &Conflict{Path: k, A: p.AList[k], B: p.BList[k]})
+	case s == nil && d != nil:
+		add(ACTION_DELETE)
+	case s == nil || (s.IsDir && d != nil):
+	case s.IsDir:
+		add(ACTION_MKDIR)
+	case d == nil:
+		add(ACTION_COPY)
+	default:
+		add(ACTION_OVERWRITE)
+	}
+}
+
+// toward returns the plan bringing the changes of side to the other tree.
+func (p *TwoWayPlan) toward(side Side) *Plan {
+	if side == SIDE_A {
+		return p.AtoB
+	}
+	return p.BtoA
+}
+
+func (p *TwoWayPlan) resolve(k string) {
+	a, b := p.AList[k], p.BList[k]
+	c := &Conflict{Path: k, A: a, B: b}
+	p.Conflicts = append(p.Conflicts, c)
+	if a != nil && b != nil && a.IsDir != b.IsDir {
+		return
+	}
+	switch p.opts.Conflict {
+	case CONFLICT_ABORT:
+		return
+	case CONFLICT_PREFER_A:
+		c.Winner = SIDE_A
+	case CONFLICT_PREFER_B:
+		c.Winner = SIDE_B
+	default:
+		if a == nil || (b != nil && b.ModTime > a.ModTime) {
+			c.Winner = SIDE_B
+		} else {
+			c.Winner = SIDE_A
+		}
+	}
+	if p.opts.Conflict == CONFLICT_KEEP_BOTH && a != nil && b != nil {
+		c.KeptAs = p.conflictPath(k)
+		plan := p.toward(c.Winner)
+		plan.Actions = append(plan.Actions, &Action{
+			Type:    ACTION_KEEP_BOTH,
+			Path:    k,
+			Src:     plan.SrcList[k],
+			Dst:     plan.DstList[k],
+			NewPath: c.KeptAs,
+		})
+		return
+	}
+	p.apply(c.Winner, k)
+}
+
+// conflictPath returns a free path for the losing file of a conflict at k,
+// like "report (conflict).doc" or "report (conflict 2).doc".
+func (p *TwoWayPlan) conflictPath(k string) string {
+	suffix := p.opts.ConflictSuffix
+	if suffix == "" {
+		suffix = DEFAULT_CONFLICT_SUFFIX
+	}
+	ext := filepath.Ext(k)
+	base := strings.TrimSuffix(k, ext)
+	path := base + suffix + ext
+	for n := 2; p.taken[path]; n++ {
+		s := strings.TrimSuffix(suffix, ")")
+		if s == suffix {
+			path = base + suffix + " " + strconv.Itoa(n) + ext
+		} else {
+			path = base + s + " " + strconv.Itoa(n) + ")" + ext
+		}
+	}
+	p.taken[path] = true
+	return path
+}
+
+// keepFolders keeps a folder deleted on one side if files are copied into
+// it from the other side.
+func (p *TwoWayPlan) keepFolders() {
+	for _, plan := range []*Plan{p.AtoB, p.BtoA} {
+		other := p.AtoB
+		if plan == p.AtoB {
+			other = p.BtoA
+		}
+		deletes := make(map[string]int)
+		for i, a := range other.Actions {
+			if a.Type == ACTION_DELETE && a.Dst.IsDir {
+				deletes[a.Path] = i
+			}
+		}
+		var kept []*Action
+		for _, a := range plan.Actions {
+			if a.Type == ACTION_DELETE || a.Type == ACTION_SKIP {
+				continue
+			}
+			for d := filepath.Dir(a.Path); d != "."; d = filepath.Dir(d) {
+				i, ok := deletes[d]
+				if !ok {
+					continue
+				}
+				delete(deletes, d)
+				del := other.Actions[i]
+				other.Actions[i] = nil
+				kept = append(kept, &Action{Type: ACTION_MKDIR, Path: d, Src: del.Dst})
+			}
+		}
+		plan.Actions = append(plan.Actions, kept...)
+		actions := other.Actions[:0]
+		for _, a := range other.Actions {
+			if a != nil {
+				actions = append(actions, a)
+			}
+		}
+		other.Actions = actions
+	}
+}
+
+// sortActions puts the actions of plan in the order of Plan.
+func sortActions(plan *Plan) {
+	sort.SliceStable(plan.Actions, func(i, j int) bool {
+		a, b := plan.Actions[i], plan.Actions[j]
+		da, db := a.Type == ACTION_DELETE, b.Type == ACTION_DELETE
+		if da != db {
+			return db
+		}
+		if da {
+			return a.Path > b.Path
+		}
+		return a.Path < b.Path
+	})
+}
+
+// unresolved returns an error if there are conflicts without a winner.
+func (p *TwoWayPlan) unresolved() error {
+	n := 0
+	for _, c := range p.Conflicts {
+		if c.Winner == SIDE_NONE {
+			n++
+		}
+	}
+	if n > 0 {
+		return fmt.Errorf("Unresolved conflicts : %v", n)
+	}
+	return nil
+}
+
+// ExecuteTwoWay carries out the actions of p on both trees and sets p.Base
+// to the baseline after it. Paths which failed or have unresolved conflicts
+// keep their old baseline, so the next sync tries them again. Nothing is
+// done for a plan with conflicts under CONFLICT_ABORT. The steps are logged
+// to the journal of AtoB and BtoA, if they have one.
+func ExecuteTwoWay(p *TwoWayPlan, queue *gowpd.Queue) error {
+	if p.opts.Conflict == CONFLICT_ABORT {
+		if err := p.unresolved(); err != nil {
+			return err
+		}
+	}
+	err := execute(queue, p.AtoB, p.BtoA)
+	base, lerr := p.baseline()
+	if lerr != nil {
+		if err == nil {
+			err = lerr
+		}
+		return err
+	}
+	p.Base = base
+	return err
+}
+
+// baseline returns the baseline after the plan: the paths listed in sync by
+// the plan, changed by the completed actions. The files the sync wrote are
+// taken from a new listing of their tree, which is only made if the tree was
+// written to. A file changed by someone else during the sync is thus not
+// taken as synced, unless the sync wrote it.
+func (p *TwoWayPlan) baseline() (*Baseline, error) {
+	base := NewBaseline()
+	for k, a := range p.AList {
+		if b := p.BList[k]; b != nil {
+			base.A[k] = a
+			base.B[k] = b
+		}
+	}
+	lists := make(map[Tree]map[string]*gowpd.Object)
+	var lerr error
+	written := func(tree Tree, k string) *gowpd.Object {
+		list, ok := lists[tree]
+		if !ok {
+			var err error
+			if list, err = tree.ListFiles(false); err != nil && lerr == nil {
+				lerr = err
+			}
+			lists[tree] = list
+		}
+		return list[k]
+	}
+	set := func(m map[string]*gowpd.Object, k string, o *gowpd.Object) {
+		if o == nil {
+			delete(m, k)
+		} else {
+			m[k] = o
+		}
+	}
+	var keep []string
+	for _, plan := range []*Plan{p.AtoB, p.BtoA} {
+		src, dst := base.A, base.B
+		if plan == p.BtoA {
+			src, dst = dst, src
+		}
+		for _, a := range plan.Actions {
+			if a.Err != nil {
+				keep = append(keep, a.Path)
+				if a.OldPath != "" {
+					keep = append(keep, a.OldPath)
+				}
+				if a.NewPath != "" {
+					keep = append(keep, a.NewPath)
+				}
+				continue
+			}
+			switch a.Type {
+			case ACTION_DELETE:
+				delete(src, a.Path)
+				delete(dst, a.Path)
+			case ACTION_MOVE:
+				delete(src, a.OldPath)
+				delete(dst, a.OldPath)
+				set(src, a.Path, a.Src)
+				set(dst, a.Path, written(plan.Dst, a.Path))
+			case ACTION_COPY, ACTION_OVERWRITE, ACTION_MKDIR:
+				set(src, a.Path, a.Src)
+				set(dst, a.Path, written(plan.Dst, a.Path))
+			case ACTION_KEEP_BOTH:
+				set(src, a.Path, a.Src)
+				set(dst, a.Path, written(plan.Dst, a.Path))
+				set(src, a.NewPath, written(plan.Src, a.NewPath))
+				set(dst, a.NewPath, written(plan.Dst, a.NewPath))
+			}
+		}
+	}
+	if lerr != nil {
+		return nil, lerr
+	}
+	for _, c := range p.Conflicts {
+		if c.Winner == SIDE_NONE {
+			keep = append(keep, c.Path)
+		}
+	}
+	for _, k := range keep {
+		set(base.A, k, p.Base.A[k])
+		set(base.B, k, p.Base.B[k])
+	}
+	return base, nil
+}
@@ -0,0 +1,387 @@
+package sync
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/tobwithu/gowpd"
+)
+
+var policies = []ConflictPolicy{CONFLICT_ABORT, CONFLICT_NEWEST, CONFLICT_KEEP_BOTH, CONFLICT_PREFER_A, CONFLICT_PREFER_B}
+
+// del deletes the file or folder path of tree.
+func del(t *testing.T, tree Tree, path string) {
+	t.Helper()
+	list, err := tree.ListFiles(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Delete(path, list[path]); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// synced returns trees in sync with their baseline, after put writes the
+// files of both.
+func synced(t *testing.T, put func(tree Tree)) (Tree, Tree, *Baseline) {
+	t.Helper()
+	a, b := NewMemoryTree(), NewMemoryTree()
+	put(a)
+	put(b)
+	p, err := NewTwoWayPlan(a, b, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ExecuteTwoWay(p, nil); err != nil {
+		t.Fatal(err)
+	}
+	return a, b, p.Base
+}
+
+// twoWayResult is the content of f.txt on both trees after a sync, "" if
+// missing, and of the file kept by CONFLICT_KEEP_BOTH.
+type twoWayResult struct {
+	a, b, kept string
+}
+
+func all(r twoWayResult) map[ConflictPolicy]twoWayResult {
+	m := make(map[ConflictPolicy]twoWayResult)
+	for _, c := range policies {
+		m[c] = r
+	}
+	return m
+}
+
+func TestTwoWay(t *testing.T) {
+	// Sides are unchanged (U), modified (M) or deleted (D) since the
+	// baseline "o", or missing (X) or new (N) without one. A writes "a" at
+	// 200 and B writes "bb" at 300.
+	tests := []struct {
+		base     bool
+		a, b     string
+		conflict bool
+		want     map[ConflictPolicy]twoWayResult
+	}{
+		{true, "U", "U", false, all(twoWayResult{"o", "o", ""})},
+		{true, "U", "M", false, all(twoWayResult{"bb", "bb", ""})},
+		{true, "U", "D", false, all(twoWayResult{"", "", ""})},
+		{true, "M", "U", false, all(twoWayResult{"a", "a", ""})},
+		{true, "D", "U", false, all(twoWayResult{"", "", ""})},
+		{true, "D", "D", false, all(twoWayResult{"", "", ""})},
+		{true, "M", "M", true, map[ConflictPolicy]twoWayResult{
+			CONFLICT_ABORT:     {"a", "bb", ""},
+			CONFLICT_NEWEST:    {"bb", "bb", ""},
+			CONFLICT_KEEP_BOTH: {"bb", "bb", "a"},
+			CONFLICT_PREFER_A:  {"a", "a", ""},
+			CONFLICT_PREFER_B:  {"bb", "bb", ""},
+		}},
+		{true, "M", "D", true, map[ConflictPolicy]twoWayResult{
+			CONFLICT_ABORT:     {"a", "", ""},
+			CONFLICT_NEWEST:    {"a", "a", ""},
+			CONFLICT_KEEP_BOTH: {"a", "a", ""},
+			CONFLICT_PREFER_A:  {"a", "a", ""},
+			CONFLICT_PREFER_B:  {"", "", ""},
+		}},
+		{true, "D", "M", true, map[ConflictPolicy]twoWayResult{
+			CONFLICT_ABORT:     {"", "bb", ""},
+			CONFLICT_NEWEST:    {"bb", "bb", ""},
+			CONFLICT_KEEP_BOTH: {"bb", "bb", ""},
+			CONFLICT_PREFER_A:  {"", "", ""},
+			CONFLICT_PREFER_B:  {"bb", "bb", ""},
+		}},
+		{false, "X", "X", false, all(twoWayResult{"", "", ""})},
+		{false, "X", "N", false, all(twoWayResult{"bb", "bb", ""})},
+		{false, "N", "X", false, all(twoWayResult{"a", "a", ""})},
+		{false, "N", "N", true, map[ConflictPolicy]twoWayResult{
+			CONFLICT_ABORT:     {"a", "bb", ""},
+			CONFLICT_NEWEST:    {"bb", "bb", ""},
+			CONFLICT_KEEP_BOTH: {"bb", "bb", "a"},
+			CONFLICT_PREFER_A:  {"a", "a", ""},
+			CONFLICT_PREFER_B:  {"bb", "bb", ""},
+		}},
+		// the same new file on both sides
+		{false, "N", "S", false, all(twoWayResult{"a", "a", ""})},
+	}
+	change := func(tree Tree, c string, data string, mtime int64) {
+		switch c {
+		case "M", "N":
+			put(t, tree, "f.txt", data, mtime)
+		case "S":
+			put(t, tree, "f.txt", "a", 200)
+		case "D":
+			del(t, tree, "f.txt")
+		}
+	}
+	for _, tt := range tests {
+		for _, policy := range policies {
+			name := tt.a + tt.b
+			a, b, base := synced(t, func(tree Tree) {
+				put(t, tree, "g.txt", "g", 100)
+				if tt.base {
+					put(t, tree, "f.txt", "o", 100)
+				}
+			})
+			change(a, tt.a, "a", 200)
+			change(b, tt.b, "bb", 300)
+
+			opts := &Options{Conflict: policy}
+			p, err := NewTwoWayPlan(a, b, base, opts)
+			if p == nil {
+				t.Fatal(err)
+			}
+			if got := len(p.Conflicts) > 0; got != tt.conflict {
+				t.Errorf("%v %v: conflicts %v", name, policy, p.Conflicts)
+			}
+			if (err != nil) != (tt.conflict && policy == CONFLICT_ABORT) {
+				t.Errorf("%v %v: err = %v", name, policy, err)
+			}
+			err = ExecuteTwoWay(p, nil)
+			if (err != nil) != (tt.conflict && policy == CONFLICT_ABORT) {
+				t.Errorf("%v %v: execute = %v", name, policy, err)
+			}
+
+			want := tt.want[policy]
+			for _, side := range []struct {
+				tree Tree
+				data string
+			}{{a, want.a}, {b, want.b}} {
+				m := map[string]string{"g.txt": "g"}
+				if side.data != "" {
+					m["f.txt"] = side.data
+				}
+				if want.kept != "" {
+					m["f (conflict).txt"] = want.kept
+				}
+				if got := contents(t, side.tree); !reflect.DeepEqual(got, m) {
+					t.Errorf("%v %v: %v", name, policy, got)
+				}
+			}
+			if policy == CONFLICT_ABORT && tt.conflict {
+				continue
+			}
+			p, err = NewTwoWayPlan(a, b, p.Base, opts)
+			if err != nil || len(p.AtoB.Actions) != 0 || len(p.BtoA.Actions) != 0 || len(p.Conflicts) != 0 {
+				t.Errorf("%v %v: after sync %q %q %v %v", name, policy, actions(p.AtoB), actions(p.BtoA), p.Conflicts, err)
+			}
+		}
+	}
+}
+
+func TestTwoWayPlan(t *testing.T) {
+	a, b, base := synced(t, func(tree Tree) {
+		put(t, tree, filepath.Join("d", "x.txt"), "x", 100)
+		put(t, tree, "report.doc", "o", 100)
+		put(t, tree, "report (conflict).doc", "c", 100)
+	})
+	put(t, a, filepath.Join("e", "new.txt"), "n", 100)
+	del(t, b, filepath.Join("d", "x.txt"))
+	put(t, a, "report.doc", "a", 300)
+	put(t, b, "report.doc", "bb", 200)
+
+	p, err := NewTwoWayPlan(a, b, base, &Options{Conflict: CONFLICT_KEEP_BOTH})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := actions(p.AtoB), []string{"mkdir e", "copy e/new.txt", "keep both report.doc"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("a to b %q", got)
+	}
+	if got, want := actions(p.BtoA), []string{"delete d/x.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("b to a %q", got)
+	}
+	if len(p.Conflicts) != 1 {
+		t.Fatalf("conflicts %v", p.Conflicts)
+	}
+	if c := p.Conflicts[0]; c.Path != "report.doc" || c.Winner != SIDE_A || c.KeptAs != "report (conflict 2).doc" {
+		t.Errorf("conflict %+v", c)
+	}
+}
+
+func TestTwoWayFolders(t *testing.T) {
+	a, b, base := synced(t, func(tree Tree) {
+		put(t, tree, filepath.Join("d", "x.txt"), "x", 100)
+	})
+	// a deletes the folder while b adds a file to it
+	del(t, a, filepath.Join("d", "x.txt"))
+	del(t, a, "d")
+	put(t, b, filepath.Join("d", "y.txt"), "y", 100)
+
+	p, err := NewTwoWayPlan(a, b, base, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := actions(p.AtoB), []string{"delete d/x.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("a to b %q", got)
+	}
+	if got, want := actions(p.BtoA), []string{"mkdir d", "copy d/y.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("b to a %q", got)
+	}
+	if err = ExecuteTwoWay(p, nil); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"d": "/", filepath.Join("d", "y.txt"): "y"}
+	for _, tree := range []Tree{a, b} {
+		if got := contents(t, tree); !reflect.DeepEqual(got, want) {
+			t.Errorf("%v", got)
+		}
+	}
+}
+
+func TestTwoWayTypeChange(t *testing.T) {
+	a, b, base := synced(t, func(tree Tree) {
+		put(t, tree, "f", "o", 100)
+	})
+	del(t, a, "f")
+	a.Mkdir("f")
+	put(t, b, "f", "bb", 300)
+
+	for _, policy := range policies {
+		p, err := NewTwoWayPlan(a, b, base, &Options{Conflict: policy})
+		if len(p.Conflicts) != 1 || p.Conflicts[0].Winner != SIDE_NONE {
+			t.Errorf("%v: conflicts %v", policy, p.Conflicts)
+		}
+		if (err != nil) != (policy == CONFLICT_ABORT) {
+			t.Errorf("%v: err = %v", policy, err)
+		}
+		if len(p.AtoB.Actions) != 0 || len(p.BtoA.Actions) != 0 {
+			t.Errorf("%v: %q %q", policy, actions(p.AtoB), actions(p.BtoA))
+		}
+	}
+}
+
+func TestTwoWayErrors(t *testing.T) {
+	errFull := errors.New("device full")
+	mb := gowpd.NewMemoryBackend()
+	d := gowpd.NewDevice(mb)
+	d.CreateFolder(gowpd.WPD_DEVICE_OBJECT_ID, "Storage")
+	b, _ := NewDeviceTree(d, "Storage")
+	a := NewMemoryTree()
+	put(t, a, "f.txt", "o", 100)
+	put(t, b, "f.txt", "o", 100)
+	p, _ := NewTwoWayPlan(a, b, nil, nil)
+	if err := ExecuteTwoWay(p, nil); err != nil {
+		t.Fatal(err)
+	}
+	base := p.Base
+
+	put(t, a, "f.txt", "a", 200)
+	put(t, a, "g.txt", "g", 200)
+	mb.Fault = func(op string, ids []string) error {
+		if op == "CreateObjectWithPropertiesAndData" {
+			return errFull
+		}
+		return nil
+	}
+	p, _ = NewTwoWayPlan(a, b, base, nil)
+	if err := ExecuteTwoWay(p, nil); err == nil {
+		t.Fatal("expected error")
+	}
+	// the failed copy stays a change of a
+	if o := p.Base.A["f.txt"]; o == nil || o.ModTime != 100 {
+		t.Errorf("baseline %v", o)
+	}
+	mb.Fault = nil
+	p, _ = NewTwoWayPlan(a, b, p.Base, nil)
+	if got, want := actions(p.AtoB), []string{"overwrite f.txt", "copy g.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("retry %q %q", got, actions(p.BtoA))
+	}
+}
+
+// listCounter counts the listings of a tree.
+type listCounter struct {
+	Tree
+	lists int
+}
+
+func (t *listCounter) ListFiles(clean bool) (map[string]*gowpd.Object, error) {
+	t.lists++
+	return t.Tree.ListFiles(clean)
+}
+
+func TestTwoWayChangedDuringSync(t *testing.T) {
+	ma, mb, base := synced(t, func(tree Tree) {
+		put(t, tree, "f.txt", "o", 100)
+		put(t, tree, "g.txt", "o", 100)
+	})
+	a, b := &listCounter{Tree: ma}, &listCounter{Tree: mb}
+	put(t, a, "f.txt", "a", 200)
+	p, err := NewTwoWayPlan(a, b, base, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// g.txt changes on b after the plan is made
+	put(t, b, "g.txt", "b", 300)
+	a.lists, b.lists = 0, 0
+	if err = ExecuteTwoWay(p, nil); err != nil {
+		t.Fatal(err)
+	}
+	// only b is written to
+	if a.lists != 0 || b.lists != 1 {
+		t.Errorf("lists %v %v", a.lists, b.lists)
+	}
+	p, err = NewTwoWayPlan(a, b, p.Base, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := actions(p.BtoA); !reflect.DeepEqual(got, []string{"overwrite g.txt"}) {
+		t.Errorf("BtoA %q, AtoB %q", got, actions(p.AtoB))
+	}
+	if got := actions(p.AtoB); len(got) != 0 {
+		t.Errorf("AtoB %q", got)
+	}
+}
+
+func TestBaseline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gowpd-sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "base")
+
+	b, err := LoadBaseline(path)
+	if err != nil || len(b.A) != 0 || len(b.B) != 0 {
+		t.Fatalf("missing baseline = %v %v", b, err)
+	}
+	b.A["a.txt"] = &gowpd.Object{ObjectInfo: gowpd.ObjectInfo{ModTime: 100, Size: 3}, ChildCount: -1}
+	b.A["d"] = &gowpd.Object{ObjectInfo: gowpd.ObjectInfo{ModTime: 50, IsDir: true}, ChildCount: 1}
+	b.B["a.txt"] = &gowpd.Object{ObjectInfo: gowpd.ObjectInfo{ModTime: 200, Size: 3}, ChildCount: -1}
+	if err = b.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	got, err := LoadBaseline(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, b) {
+		t.Errorf("loaded %v %v", got.A, got.B)
+	}
+}
+
+func TestTwoWayTimePolicy(t *testing.T) {
+	a, b, base := synced(t, func(tree Tree) {
+		put(t, tree, "f.txt", "f", 1000)
+		put(t, tree, "g.txt", "g", 1000)
+	})
+	// the device reports its times an hour off after a daylight saving time
+	// change, and a file changed on a
+	put(t, b, "f.txt", "f", 1000+3600)
+	put(t, a, "g.txt", "g2", 1001)
+	put(t, b, "g.txt", "g", 1000+3600)
+
+	p, err := NewTwoWayPlan(a, b, base, &Options{Time: TimePolicy{HourOffsets: 1}})
+	if err != nil || len(p.Conflicts) != 0 {
+		t.Fatalf("conflicts %v %v", p.Conflicts, err)
+	}
+	if got := actions(p.AtoB); !reflect.DeepEqual(got, []string{"overwrite g.txt"}) || len(p.BtoA.Actions) != 0 {
+		t.Errorf("%q %q", got, actions(p.BtoA))
+	}
+
+	p, _ = NewTwoWayPlan(a, b, base, nil)
+	if len(p.Conflicts) != 1 || len(p.BtoA.Actions) != 1 {
+		t.Errorf("exact %v %q", p.Conflicts, actions(p.BtoA))
+	}
+}
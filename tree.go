@@ -0,0 +1,197 @@
+package gowpd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// TransferResult is the outcome of one file or folder of a tree transfer.
+// Path is relative to the root of the tree.
+type TransferResult struct {
+	Path  string
+	Id    string
+	IsDir bool
+	Size  int64
+	Err   error
+}
+
+// UploadTree copies the contents of localDir into the folder parentId.
+// Existing folders are reused, existing files are left untouched and
+// reported as failed. Files excluded by WithRules are left out.
+func (d *Device) UploadTree(localDir string, parentId string, opts ...CopyOption) ([]TransferResult, error) {
+	var results []TransferResult
+	o := newCopyOptions(opts)
+	o.objectName = ""
+	if o.progress != nil && o.tracker == nil {
+		var total int64
+		files := 0
+		filepath.Walk(localDir, func(path string, info os.FileInfo, err error) error {
+			if err != nil || path == localDir {
+				return nil
+			}
+			rel, _ := filepath.Rel(localDir, path)
+			if o.rules.Match(rel, ObjectFromFileInfo(path, info)) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !info.IsDir() {
+				total += info.Size()
+				files++
+			}
+			return nil
+		})
+		o.startTracking(total, files)
+	}
+	d.uploadTree(localDir, parentId, "", o, &results)
+	return results, treeError(results)
+}
+
+func (d *Device) uploadTree(dir string, parentId string, curPath string, opts *copyOptions, results *[]TransferResult) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		*results = append(*results, TransferResult{Path: curPath, IsDir: true, Err: err})
+		return
+	}
+	children, err := d.GetChildObjects(parentId)
+	if err != nil {
+		*results = append(*results, TransferResult{Path: curPath, Id: parentId, IsDir: true, Err: err})
+		return
+	}
+	existing := make(map[string]*Object)
+	for _, o := range children {
+		if o != nil {
+			existing[o.Name] = o
+		}
+	}
+	for _, info := range infos {
+		path := filepath.Join(dir, info.Name())
+		rs := TransferResult{Path: filepath.Join(curPath, info.Name()), IsDir: info.IsDir()}
+		if opts.rules.Match(rs.Path, ObjectFromFileInfo(path, info)) {
+			continue
+		}
+		name := opts.fileNameOf(info.Name())
+		o := existing[name]
+		if info.IsDir() {
+			if o != nil && o.IsDir {
+				rs.Id = o.Id
+			} else if o != nil {
+				rs.Err = fmt.Errorf("Not a folder : %v", rs.Path)
+			} else {
+				rs.Id, rs.Err = d.CreateFolder(parentId, name)
+			}
+			*results = append(*results, rs)
+			if rs.Err == nil {
+				d.uploadTree(path, rs.Id, rs.Path, opts, results)
+			}
+			continue
+		}
+		if o != nil {
+			rs.Id = o.Id
+			rs.Err = fmt.Errorf("Object exists : %v", rs.Path)
+		} else {
+			rs.Id, rs.Size, rs.Err = d.uploadFile(parentId, path, info, opts)
+		}
+		*results = append(*results, rs)
+	}
+}
+
+// DownloadTree copies the contents of the folder id into localDir, which is
+// created if needed. Modification times are preserved. Objects excluded by
+// WithRules are left out.
+func (d *Device) DownloadTree(id string, localDir string, opts ...CopyOption) ([]TransferResult, error) {
+	var results []TransferResult
+	err := os.MkdirAll(localDir, os.ModePerm)
+	if err != nil {
+		results = append(results, TransferResult{Id: id, IsDir: true, Err: err})
+		return results, treeError(results)
+	}
+	o := newCopyOptions(opts)
+	var entries []treeEntry
+	d.listTree(id, "", o.rules, &entries, &results)
+
+	if o.progress != nil && o.tracker == nil {
+		var total int64
+		files := 0
+		for _, e := range entries {
+			if !e.obj.IsDir {
+				total += e.obj.Size
+				files++
+			}
+		}
+		o.startTracking(total, files)
+	}
+	for _, e := range entries {
+		path := filepath.Join(localDir, e.path)
+		rs := TransferResult{Path: e.path, Id: e.obj.Id, IsDir: e.obj.IsDir}
+		if e.obj.IsDir {
+			rs.Err = os.MkdirAll(path, os.ModePerm)
+		} else {
+			rs.Size, rs.Err = d.copyObjectFromDevice(path, e.obj, o)
+		}
+		results = append(results, rs)
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if e.obj.IsDir && e.obj.ModTime != 0 {
+			SetFileTime(filepath.Join(localDir, e.path), e.obj.ModTime)
+		}
+	}
+	return results, treeError(results)
+}
+
+type treeEntry struct {
+	path string
+	obj  *Object
+}
+
+// listTree appends the objects below id which rules do not exclude to
+// entries, folders before their contents.
+func (d *Device) listTree(id string, curPath string, rules *Rules, entries *[]treeEntry, results *[]TransferResult) {
+	objs, err := d.GetChildObjects(id)
+	if err != nil {
+		*results = append(*results, TransferResult{Path: curPath, Id: id, IsDir: true, Err: err})
+		return
+	}
+	for _, o := range objs {
+		if o == nil {
+			continue
+		}
+		path := filepath.Join(curPath, o.Name)
+		if !isLocalName(o.Name) {
+			*results = append(*results, TransferResult{Path: path, Id: o.Id, IsDir: o.IsDir, Err: fmt.Errorf("Invalid name : %q", o.Name)})
+			continue
+		}
+		if rules.Match(path, o) {
+			continue
+		}
+		*entries = append(*entries, treeEntry{path, o})
+		if o.IsDir {
+			d.listTree(o.Id, path, rules, entries, results)
+		}
+	}
+}
+
+// isLocalName reports whether the object name is a file name within a local
+// folder. Names like "..", "a/b" or "C:" would write outside of it.
+func isLocalName(name string) bool {
+	return name != "" && name != "." && name != ".." &&
+		!strings.ContainsAny(name, `/\`) && !filepath.IsAbs(name) && filepath.VolumeName(name) == ""
+}
+
+func treeError(results []TransferResult) error {
+	n := 0
+	for _, rs := range results {
+		if rs.Err != nil {
+			n++
+		}
+	}
+	if n == 0 {
+		return nil
+	}
+	return fmt.Errorf("Failed to copy %v of %v objects", n, len(results))
+}
@@ -0,0 +1,185 @@
+package gowpd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, path string, data string, mtime time.Time) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUploadDownloadTree(t *testing.T) {
+	src, err := ioutil.TempDir("", "gowpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	mtime := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	files := map[string]string{
+		"a.txt":                          "aaa",
+		"archive.tar.gz":                 "gz",
+		filepath.Join("d", "b"):          "bb",
+		filepath.Join("d", "e", "c.jpg"): "ccc",
+	}
+	for name, data := range files {
+		writeFile(t, filepath.Join(src, name), data, mtime)
+	}
+	os.Mkdir(filepath.Join(src, "empty"), os.ModePerm)
+
+	d := NewMemoryDevice()
+	root := putFolder(t, d, WPD_DEVICE_OBJECT_ID, "Storage")
+	results, err := d.UploadTree(src, root)
+	if err != nil {
+		t.Fatal(err, results)
+	}
+	if len(results) != 7 {
+		t.Errorf("results = %v", results)
+	}
+	for _, rs := range results {
+		if rs.Id == "" {
+			t.Errorf("%v has no id", rs.Path)
+		}
+		if !rs.IsDir && rs.Size != int64(len(files[rs.Path])) {
+			t.Errorf("%v size = %v", rs.Path, rs.Size)
+		}
+	}
+	o := d.FindObject(filepath.Join("Storage", "d", "e", "c.jpg"))
+	if o == nil || o.Size != 3 || o.ModTime != mtime.Unix() {
+		t.Fatalf("c.jpg = %v", o)
+	}
+
+	dst, err := ioutil.TempDir("", "gowpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+	results, err = d.DownloadTree(root, filepath.Join(dst, "copy"))
+	if err != nil {
+		t.Fatal(err, results)
+	}
+	if len(results) != 7 {
+		t.Errorf("results = %v", results)
+	}
+	for name, data := range files {
+		path := filepath.Join(dst, "copy", name)
+		b, err := ioutil.ReadFile(path)
+		if err != nil || string(b) != data {
+			t.Errorf("%v = %q, %v", name, b, err)
+		}
+		info, _ := os.Stat(path)
+		if info == nil || !info.ModTime().Equal(mtime) {
+			t.Errorf("%v mtime = %v", name, info)
+		}
+	}
+	if info, err := os.Stat(filepath.Join(dst, "copy", "empty")); err != nil || !info.IsDir() {
+		t.Errorf("empty folder not copied: %v", err)
+	}
+}
+
+func TestUploadTreeExisting(t *testing.T) {
+	src, err := ioutil.TempDir("", "gowpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	writeFile(t, filepath.Join(src, "d", "a.txt"), "new", time.Now())
+	writeFile(t, filepath.Join(src, "d", "b.txt"), "b", time.Now())
+
+	d := NewMemoryDevice()
+	root := putFolder(t, d, WPD_DEVICE_OBJECT_ID, "Storage")
+	dir := putFolder(t, d, root, "d")
+	putFile(t, d, dir, "a.txt", "old")
+
+	results, err := d.UploadTree(src, root)
+	if err == nil {
+		t.Errorf("expected error")
+	}
+	for _, rs := range results {
+		switch rs.Path {
+		case "d":
+			if rs.Id != dir || rs.Err != nil {
+				t.Errorf("folder not reused: %v", rs)
+			}
+		case filepath.Join("d", "a.txt"):
+			if rs.Err == nil {
+				t.Errorf("existing file overwritten")
+			}
+		case filepath.Join("d", "b.txt"):
+			if rs.Err != nil {
+				t.Errorf("%v", rs.Err)
+			}
+		}
+	}
+	if ids, _ := d.GetChildIds(dir); len(ids) != 2 {
+		t.Errorf("children = %v", ids)
+	}
+}
+
+func TestUploadTreeObjectName(t *testing.T) {
+	src, err := ioutil.TempDir("", "gowpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	writeFile(t, filepath.Join(src, "a.txt"), "a", time.Now())
+	writeFile(t, filepath.Join(src, "b.txt"), "b", time.Now())
+
+	b := NewMemoryBackend()
+	d := NewDevice(b)
+	root := putFolder(t, d, WPD_DEVICE_OBJECT_ID, "Storage")
+	if _, err := d.UploadTree(src, root, WithObjectName("same")); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.txt", "b.txt"} {
+		v, err := b.GetValues(childId(t, d, root, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := v.String(WPD_OBJECT_NAME); got != name[:1] {
+			t.Errorf("%v: name = %q", name, got)
+		}
+	}
+}
+
+func TestDownloadTreeInvalidName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gowpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d := NewMemoryDevice()
+	root := putFolder(t, d, WPD_DEVICE_OBJECT_ID, "Storage")
+	up := putFolder(t, d, root, "..")
+	putFile(t, d, up, "evil.txt", "evil")
+	putFile(t, d, root, "a.txt", "a")
+
+	dst := filepath.Join(dir, "dst")
+	results, err := d.DownloadTree(root, dst)
+	if err == nil {
+		t.Errorf("no error")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "evil.txt")); !os.IsNotExist(err) {
+		t.Errorf("written outside : %v", err)
+	}
+	if len(results) != 2 || results[0].Err == nil || results[1].Path != "a.txt" || results[1].Err != nil {
+		t.Errorf("results %v", results)
+	}
+	for _, name := range []string{"..", ".", "", "a/b", `a\b`, "/a"} {
+		if isLocalName(name) {
+			t.Errorf("%q accepted", name)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package gowpd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	WPD_DEVICE_OBJECT_ID                  = "DEVICE"
+	PORTABLE_DEVICE_DELETE_NO_RECURSION   = 0
+	PORTABLE_DEVICE_DELETE_WITH_RECURSION = 1
+
+	S_OK                = 0
+	S_FALSE             = 1
+	E_NOTIMPL           = -2147467263 // 0x80004001
+	E_FAIL              = -2147467259 // 0x80004005
+	E_ACCESSDENIED      = -2147024891 // 0x80070005
+	E_INVALIDARG        = -2147024809 // 0x80070057
+	E_FILE_NOT_FOUND    = -2147024894 // HRESULT_FROM_WIN32(ERROR_FILE_NOT_FOUND)
+	E_DIR_NOT_EMPTY     = -2147024751 // HRESULT_FROM_WIN32(ERROR_DIR_NOT_EMPTY)
+	E_NOT_SUPPORTED     = -2147024846 // HRESULT_FROM_WIN32(ERROR_NOT_SUPPORTED)
+	E_PENDING           = -2147483638 // 0x8000000A
+	E_BUSY              = -2147024726 // HRESULT_FROM_WIN32(ERROR_BUSY)
+	E_NOT_READY         = -2147024875 // HRESULT_FROM_WIN32(ERROR_NOT_READY)
+	E_SEM_TIMEOUT       = -2147024775 // HRESULT_FROM_WIN32(ERROR_SEM_TIMEOUT)
+	E_TIMEOUT           = -2147023436 // HRESULT_FROM_WIN32(ERROR_TIMEOUT)
+	E_IO_DEVICE         = -2147023779 // HRESULT_FROM_WIN32(ERROR_IO_DEVICE)
+	E_INVALID_NAME      = -2147024773 // HRESULT_FROM_WIN32(ERROR_INVALID_NAME)
+	E_FILENAME_TOO_LONG = -2147024690 // HRESULT_FROM_WIN32(ERROR_FILENAME_EXCED_RANGE)
+)
+
+type GUID struct {
+	Data1 uint32
+	Data2 uint16
+	Data3 uint16
+	Data4 [8]byte
+}
+
+func GUIDFromString(s string) *GUID {
+	var id GUID
+	s = strings.Replace(s, "-", "", -1)
+	ui64, _ := strconv.ParseUint(s[:8], 16, 32)
+	id.Data1 = uint32(ui64)
+	ui64, _ = strconv.ParseUint(s[8:12], 16, 16)
+	id.Data2 = uint16(ui64)
+	ui64, _ = strconv.ParseUint(s[12:16], 16, 16)
+	id.Data3 = uint16(ui64)
+	ui64, _ = strconv.ParseUint(s[16:], 16, 64)
+	binary.BigEndian.PutUint64(id.Data4[:], ui64)
+	return &id
+}
+
+func (id GUID) String() string {
+	var s string
+	s = fmt.Sprintf("%08x-%04x-%04x-%02x%02x-%02x%02x%02x%02x%02x%02x",
+		id.Data1, id.Data2, id.Data3,
+		id.Data4[0], id.Data4[1], id.Data4[2], id.Data4[3],
+		id.Data4[4], id.Data4[5], id.Data4[6], id.Data4[7])
+	return s
+}
+
+type PROPERTYKEY struct {
+	Fmtid GUID
+	Pid   uint32
+}
+
+var (
+	WPD_OBJECT_ID                              = PROPERTYKEY{GUID{0xEF6B490D, 0x5CD8, 0x437A, [8]byte{0xAF, 0xFC, 0xDA, 0x8B, 0x60, 0xEE, 0x4A, 0x3C}}, 2}
+	WPD_OBJECT_PARENT_ID                       = PROPERTYKEY{GUID{0xEF6B490D, 0x5CD8, 0x437A, [8]byte{0xAF, 0xFC, 0xDA, 0x8B, 0x60, 0xEE, 0x4A, 0x3C}}, 3}
+	WPD_OBJECT_NAME                            = PROPERTYKEY{GUID{0xEF6B490D, 0x5CD8, 0x437A, [8]byte{0xAF, 0xFC, 0xDA, 0x8B, 0x60, 0xEE, 0x4A, 0x3C}}, 4}
+	WPD_OBJECT_CONTENT_TYPE                    = PROPERTYKEY{GUID{0xEF6B490D, 0x5CD8, 0x437A, [8]byte{0xAF, 0xFC, 0xDA, 0x8B, 0x60, 0xEE, 0x4A, 0x3C}}, 7}
+	WPD_OBJECT_SIZE                            = PROPERTYKEY{GUID{0xEF6B490D, 0x5CD8, 0x437A, [8]byte{0xAF, 0xFC, 0xDA, 0x8B, 0x60, 0xEE, 0x4A, 0x3C}}, 11}
+	WPD_OBJECT_ORIGINAL_FILE_NAME              = PROPERTYKEY{GUID{0xEF6B490D, 0x5CD8, 0x437A, [8]byte{0xAF, 0xFC, 0xDA, 0x8B, 0x60, 0xEE, 0x4A, 0x3C}}, 12}
+	WPD_OBJECT_DATE_CREATED                    = PROPERTYKEY{GUID{0xEF6B490D, 0x5CD8, 0x437A, [8]byte{0xAF, 0xFC, 0xDA, 0x8B, 0x60, 0xEE, 0x4A, 0x3C}}, 18}
+	WPD_OBJECT_DATE_MODIFIED                   = PROPERTYKEY{GUID{0xEF6B490D, 0x5CD8, 0x437A, [8]byte{0xAF, 0xFC, 0xDA, 0x8B, 0x60, 0xEE, 0x4A, 0x3C}}, 19}
+	WPD_PROPERTY_ATTRIBUTE_CAN_WRITE           = PROPERTYKEY{GUID{0xAB7943D8, 0x6332, 0x445F, [8]byte{0xA0, 0x0D, 0x8D, 0x5E, 0xF1, 0xE9, 0x6F, 0x37}}, 4}
+	WPD_RESOURCE_DEFAULT                       = PROPERTYKEY{GUID{0xE81E79BE, 0x34F0, 0x41BF, [8]byte{0xB5, 0x3F, 0xF1, 0xA0, 0x6A, 0xE8, 0x78, 0x42}}, 0}
+	WPD_COMMAND_OBJECT_MANAGEMENT_MOVE_OBJECTS = PROPERTYKEY{GUID{0xEF1E43DD, 0xA9ED, 0x4341, [8]byte{0x8B, 0xCC, 0x18, 0x61, 0x92, 0xAE, 0xA0, 0x89}}, 8}
+	WPD_COMMAND_OBJECT_MANAGEMENT_COPY_OBJECTS = PROPERTYKEY{GUID{0xEF1E43DD, 0xA9ED, 0x4341, [8]byte{0x8B, 0xCC, 0x18, 0x61, 0x92, 0xAE, 0xA0, 0x89}}, 9}
+	WPD_CONTENT_TYPE_FUNCTIONAL_OBJECT         = GUID{0x99ED0160, 0x17FF, 0x4C44, [8]byte{0x9D, 0x98, 0x1D, 0x7A, 0x6F, 0x94, 0x19, 0x21}}
+	WPD_CONTENT_TYPE_FOLDER                    = GUID{0x27E2E392, 0xA111, 0x48E0, [8]byte{0xAB, 0x0C, 0xE1, 0x77, 0x05, 0xA0, 0x5F, 0x85}}
+)
+
+// PropertyValues holds object properties by key. Values are string, uint32,
+// uint64, bool, GUID, PROPERTYKEY or time.Time.
+type PropertyValues map[PROPERTYKEY]interface{}
+
+func (v PropertyValues) String(key PROPERTYKEY) string {
+	s, _ := v[key].(string)
+	return s
+}
+
+func (v PropertyValues) Uint64(key PROPERTYKEY) uint64 {
+	switch n := v[key].(type) {
+	case uint64:
+		return n
+	case uint32:
+		return uint64(n)
+	}
+	return 0
+}
+
+func (v PropertyValues) Guid(key PROPERTYKEY) GUID {
+	g, _ := v[key].(GUID)
+	return g
+}
+
+func (v PropertyValues) Time(key PROPERTYKEY) time.Time {
+	t, _ := v[key].(time.Time)
+	return t
+}
+
+// HResult is a failed COM status code.
+type HResult int32
+
+func (hr HResult) Error() string {
+	return fmt.Sprintf("Error (%#08x)", uint32(hr))
+}
+
+func (hr HResult) Code() int32 {
+	return int32(hr)
+}
+
+// ErrorCode returns the HRESULT of err, if it has one.
+func ErrorCode(err error) (int32, bool) {
+	if e, ok := err.(interface{ Code() int32 }); ok {
+		return e.Code(), true
+	}
+	return 0, false
+}
+
+func hresultError(hr int32) error {
+	if hr >= 0 {
+		return nil
+	}
+	return HResult(hr)
+}
@@ -3,16 +3,10 @@
 package gowpd
 
 import (
-	"bufio"
-	"encoding/binary"
 	"fmt"
 	"io"
-	"os"
 	"reflect"
-	"strconv"
-	"strings"
 	"syscall"
-	"time"
 	"unsafe"
 )
 
@@ -26,40 +20,8 @@ const (
 	SECURITY_IMPERSONATION = 0x00020000
 	GENERIC_READ           = 0x80000000
 	STGC_DEFAULT           = 0
-
-	PathSeparator = string(os.PathSeparator)
 )
 
-type GUID syscall.GUID
-
-func GUIDFromString(s string) *GUID {
-	var id GUID
-	s = strings.Replace(s, "-", "", -1)
-	ui64, _ := strconv.ParseUint(s[:8], 16, 32)
-	id.Data1 = uint32(ui64)
-	ui64, _ = strconv.ParseUint(s[8:12], 16, 16)
-	id.Data2 = uint16(ui64)
-	ui64, _ = strconv.ParseUint(s[12:16], 16, 16)
-	id.Data3 = uint16(ui64)
-	ui64, _ = strconv.ParseUint(s[16:], 16, 64)
-	binary.BigEndian.PutUint64(id.Data4[:], ui64)
-	return &id
-}
-
-func (id GUID) String() string {
-	var s string
-	s = fmt.Sprintf("%08x-%04x-%04x-%02x%02x-%02x%02x%02x%02x%02x%02x",
-		id.Data1, id.Data2, id.Data3,
-		id.Data4[0], id.Data4[1], id.Data4[2], id.Data4[3],
-		id.Data4[4], id.Data4[5], id.Data4[6], id.Data4[7])
-	return s
-}
-
-type PROPERTYKEY struct {
-	Fmtid GUID
-	Pid   uint32
-}
-
 var (
 	ole                  = syscall.NewLazyDLL("ole32.dll")
 	procCoInitializeEx   = ole.NewProc("CoInitializeEx")
@@ -69,15 +31,29 @@ var (
 	procPropVariantClear = ole.NewProc("PropVariantClear")
 )
 
+// comError is a failed COM call. It keeps the HRESULT for ErrorCode.
+type comError struct {
+	hr  int32
+	msg string
+}
+
+func (e *comError) Error() string {
+	return e.msg
+}
+
+func (e *comError) Code() int32 {
+	return e.hr
+}
+
 func handleError(ret uintptr, err syscall.Errno) (int32, error) {
 	hr := int32(ret)
 	if hr >= 0 {
 		return hr, nil
 	}
 	if err == 0 {
-		return hr, fmt.Errorf("Error (%#08x)", ret)
+		return hr, &comError{hr, fmt.Sprintf("Error (%#08x)", ret)}
 	}
-	return hr, fmt.Errorf("%v (%#08x)", err, ret)
+	return hr, &comError{hr, fmt.Sprintf("%v (%#08x)", err, ret)}
 }
 
 func Syscall(trap, nargs, a1, a2, a3 uintptr) (int32, error) {
@@ -174,6 +150,11 @@ func (o *StreamReader) Read(buf []byte) (int, error) {
 	return int(n), err
 }
 
+func (o *StreamReader) Seek(offset int64, whence int) (int64, error) {
+	pos, _, err := o.stream.SeekTo(offset, whence)
+	return int64(pos), err
+}
+
 func (o *StreamReader) Close() error {
 	o.stream.Release()
 	return nil
@@ -200,50 +181,17 @@ func (o *StreamWriter) Commit() (string, int32, error) {
 	return o.stream.GetObjectID()
 }
 
-func (o *StreamWriter) Close() error {
+// Abort discards the data written and releases the stream.
+func (o *StreamWriter) Abort() error {
 	defer o.stream.Release()
-	_, err := o.stream.Commit(STGC_DEFAULT)
+	_, err := o.stream.Revert()
 	return err
 }
 
-type BufReadCloser struct {
-	reader *bufio.Reader
-	closer io.Closer
-}
-
-func NewBufReadCloser(s io.ReadCloser, size int) *BufReadCloser {
-	if size <= 0 {
-		return &BufReadCloser{bufio.NewReader(s), s}
-	}
-	return &BufReadCloser{bufio.NewReaderSize(s, size), s}
-}
-
-func (o *BufReadCloser) Read(buf []byte) (int, error) {
-	return o.reader.Read(buf)
-}
-
-func (o *BufReadCloser) Close() error {
-	return o.closer.Close()
-}
-
-type BufWriteCloser struct {
-	writer *bufio.Writer
-	closer io.Closer
-}
-
-func NewBufWriteCloser(s io.WriteCloser, size int) *BufWriteCloser {
-	if size <= 0 {
-		return &BufWriteCloser{bufio.NewWriter(s), s}
-	}
-	return &BufWriteCloser{bufio.NewWriterSize(s, size), s}
-}
-
-func (o *BufWriteCloser) Write(buf []byte) (int, error) {
-	return o.writer.Write(buf)
-}
-func (o *BufWriteCloser) Close() error {
-	o.writer.Flush()
-	return o.closer.Close()
+func (o *StreamWriter) Close() error {
+	defer o.stream.Release()
+	_, err := o.stream.Commit(STGC_DEFAULT)
+	return err
 }
 
 func getClientInformation() (cInfo *IPortableDeviceValues) {
@@ -266,44 +214,9 @@ func getPropertiesToRead() (keys *IPortableDeviceKeyCollection) {
 	}
 	keys.Add(WPD_OBJECT_PARENT_ID)
 	keys.Add(WPD_OBJECT_CONTENT_TYPE)
+	keys.Add(WPD_OBJECT_FORMAT)
 	keys.Add(WPD_OBJECT_SIZE)
 	keys.Add(WPD_OBJECT_ORIGINAL_FILE_NAME)
 	keys.Add(WPD_OBJECT_DATE_MODIFIED)
 	return
 }
-
-func getPropVariantCollection(id string) (*IPortableDevicePropVariantCollection, error) {
-	var list *IPortableDevicePropVariantCollection
-	hr, err := CoCreateInstance(CLSID_PortableDevicePropVariantCollection, IID_IPortableDevicePropVariantCollection, &list)
-	if hr < 0 {
-		return nil, err
-	}
-	var pv PROPVARIANT
-	pv.Vt = VT_LPWSTR
-	pt := syscall.StringToUTF16Ptr(id)
-	pv.Val1 = uintptr(unsafe.Pointer(pt))
-	list.Add(&pv)
-	return list, nil
-}
-
-func ObjectFromFileInfo(path string, info os.FileInfo) *Object {
-	var o Object
-	o.Name = info.Name()
-	o.Size = info.Size()
-	o.ModTime = info.ModTime().Unix()
-	o.IsDir = info.IsDir()
-	o.Id = path
-	return &o
-}
-
-func SetFileTime(path string, t int64) error {
-	tm := time.Unix(t, 0)
-	return os.Chtimes(path, tm, tm)
-}
-
-func CleanPath(path string) string {
-	if "/" != PathSeparator {
-		path = strings.ReplaceAll(path, "/", PathSeparator)
-	}
-	return strings.TrimRight(path, PathSeparator)
-}
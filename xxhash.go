@@ -0,0 +1,127 @@
+package gowpd
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+var (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+// xxh64 is the 64 bit xxHash with seed 0. Sum appends the hash big endian.
+type xxh64 struct {
+	v1, v2, v3, v4 uint64
+	total          uint64
+	mem            [32]byte
+	n              int
+}
+
+func newXXH64() hash.Hash64 {
+	h := &xxh64{}
+	h.Reset()
+	return h
+}
+
+func (h *xxh64) Reset() {
+	h.v1 = xxPrime1 + xxPrime2
+	h.v2 = xxPrime2
+	h.v3 = 0
+	h.v4 = -xxPrime1
+	h.total = 0
+	h.n = 0
+}
+
+func (h *xxh64) Size() int {
+	return 8
+}
+
+func (h *xxh64) BlockSize() int {
+	return 32
+}
+
+func (h *xxh64) Write(buf []byte) (int, error) {
+	n := len(buf)
+	h.total += uint64(n)
+	if h.n+len(buf) < 32 {
+		h.n += copy(h.mem[h.n:], buf)
+		return n, nil
+	}
+	if h.n > 0 {
+		c := copy(h.mem[h.n:], buf)
+		h.block(h.mem[:])
+		buf = buf[c:]
+		h.n = 0
+	}
+	for ; len(buf) >= 32; buf = buf[32:] {
+		h.block(buf)
+	}
+	h.n = copy(h.mem[:], buf)
+	return n, nil
+}
+
+func (h *xxh64) block(b []byte) {
+	h.v1 = xxRound(h.v1, binary.LittleEndian.Uint64(b[0:8]))
+	h.v2 = xxRound(h.v2, binary.LittleEndian.Uint64(b[8:16]))
+	h.v3 = xxRound(h.v3, binary.LittleEndian.Uint64(b[16:24]))
+	h.v4 = xxRound(h.v4, binary.LittleEndian.Uint64(b[24:32]))
+}
+
+func (h *xxh64) Sum64() uint64 {
+	var s uint64
+	if h.total >= 32 {
+		s = bits.RotateLeft64(h.v1, 1) + bits.RotateLeft64(h.v2, 7) +
+			bits.RotateLeft64(h.v3, 12) + bits.RotateLeft64(h.v4, 18)
+		s = xxMerge(s, h.v1)
+		s = xxMerge(s, h.v2)
+		s = xxMerge(s, h.v3)
+		s = xxMerge(s, h.v4)
+	} else {
+		s = h.v3 + xxPrime5
+	}
+	s += h.total
+
+	b := h.mem[:h.n]
+	for ; len(b) >= 8; b = b[8:] {
+		s ^= xxRound(0, binary.LittleEndian.Uint64(b))
+		s = bits.RotateLeft64(s, 27)*xxPrime1 + xxPrime4
+	}
+	if len(b) >= 4 {
+		s ^= uint64(binary.LittleEndian.Uint32(b)) * xxPrime1
+		s = bits.RotateLeft64(s, 23)*xxPrime2 + xxPrime3
+		b = b[4:]
+	}
+	for _, c := range b {
+		s ^= uint64(c) * xxPrime5
+		s = bits.RotateLeft64(s, 11) * xxPrime1
+	}
+
+	s ^= s >> 33
+	s *= xxPrime2
+	s ^= s >> 29
+	s *= xxPrime3
+	s ^= s >> 32
+	return s
+}
+
+func (h *xxh64) Sum(b []byte) []byte {
+	var sum [8]byte
+	binary.BigEndian.PutUint64(sum[:], h.Sum64())
+	return append(b, sum[:]...)
+}
+
+func xxRound(acc, input uint64) uint64 {
+	acc += input * xxPrime2
+	acc = bits.RotateLeft64(acc, 31)
+	return acc * xxPrime1
+}
+
+func xxMerge(acc, val uint64) uint64 {
+	acc ^= xxRound(0, val)
+	return acc*xxPrime1 + xxPrime4
+}